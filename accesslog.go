@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// accessLog -access-log打开的文件，为nil表示不记录访问日志
+var accessLog *accessLogger
+
+// accessLogger 按Combined Log Format逐行写入访问日志
+type accessLogger struct {
+	w *rotatingFile
+}
+
+// setupAccessLog 打开访问日志文件，与-log-file使用相同的轮转设置，为空表示不记录
+func setupAccessLog(path string) error {
+	if path == "" {
+		return nil
+	}
+	w, err := openLogFile(path)
+	if err != nil {
+		return err
+	}
+	accessLog = &accessLogger{w: w}
+	return nil
+}
+
+// accessRecord 一个已完成的请求或隧道
+type accessRecord struct {
+	status   int
+	size     int64 // CLF的大小字段：HTTP请求为响应体字节数，隧道为双向合计
+	up, down int64
+	decision *routeDecision // 实际走的路径，写入路由种类、第二级代理、命中的规则和标记
+	egress   string         // 直接连接目标时实际使用的出口地址，未分配出口地址时为空
+	aborted  bool           // 客户端在响应传输中断开，size为断开时已发送的字节数
+	start    time.Time
+}
+
+// write 以Combined Log Format写入一行，末尾追加 路由 上行字节 下行字节 耗时(秒) 出口地址 中断标记
+// 第二级代理 命中的规则 fallback/retried标记，CONNECT和SOCKS5请求的请求行为目标host:port
+func (l *accessLogger) write(r *http.Request, rec accessRecord) {
+	uri := r.RequestURI
+	if r.Method == http.MethodConnect {
+		uri = r.Host
+	}
+	abort := "-"
+	if rec.aborted {
+		abort = "aborted"
+	}
+	d := rec.decision
+	line := fmt.Sprintf("%s - %s [%s] \"%s %s %s\" %d %d \"%s\" \"%s\" %s %d %d %.3f %s %s %s %s %s\n",
+		clientKey(r), clfField(authUser(r)), rec.start.Format("02/Jan/2006:15:04:05 -0700"),
+		r.Method, clfEscape(uri), r.Proto, rec.status, rec.size,
+		clfEscape(clfField(r.Referer())), clfEscape(clfField(r.UserAgent())),
+		clfField(d.kind()), rec.up, rec.down, time.Since(rec.start).Seconds(), clfField(rec.egress), abort,
+		clfField(d.upstreamID()), clfField(d.rule), clfField(d.flags()))
+	l.w.Write([]byte(line))
+}
+
+// clfField 空值按CLF的习惯写为 -
+func clfField(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// clfEscape 转义引号内字段中的反斜杠、双引号和换行
+func clfEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+// logTunnelAccess 隧道两个方向都结束后写入访问日志
+func logTunnelAccess(r *http.Request, info *connInfo) {
+	if accessLog == nil {
+		return
+	}
+	up, down := info.up.Load(), info.down.Load()
+	accessLog.write(r, accessRecord{
+		status:   http.StatusOK,
+		size:     up + down,
+		up:       up,
+		down:     down,
+		decision: info.decision,
+		egress:   egressUsed(r),
+		start:    info.start,
+	})
+}
+
+// accessWriter 记录响应的状态码和字节数，请求结束时写入访问日志；
+// 被劫持的连接由隧道结束时写入
+type accessWriter struct {
+	http.ResponseWriter
+	status   int
+	size     int64
+	hijacked bool
+	aborted  bool
+	body     *countingBody // 为nil表示请求没有请求体
+	start    time.Time
+}
+
+// withAccessLog 配置了-access-log时包装w并统计请求体，返回的函数在处理结束时以最终的请求和路由调用
+func withAccessLog(w http.ResponseWriter, r *http.Request) (http.ResponseWriter, func(r *http.Request, route string)) {
+	if accessLog == nil {
+		return w, func(*http.Request, string) {}
+	}
+	aw := &accessWriter{ResponseWriter: w, start: time.Now()}
+	if r.Body != nil && r.Body != http.NoBody {
+		aw.body = &countingBody{ReadCloser: r.Body, total: new(atomic.Int64)}
+		r.Body = aw.body
+	}
+	return aw, aw.finish
+}
+
+// finish 写入访问日志，劫持的连接跳过，请求没有routeDecision时按route记录
+func (w *accessWriter) finish(r *http.Request, route string) {
+	if w.hijacked {
+		return
+	}
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	var up int64
+	if w.body != nil {
+		up = w.body.total.Load()
+	}
+	accessLog.write(r, accessRecord{status: w.status, size: w.size, up: up, down: w.size, decision: decisionFor(r, route), egress: egressUsed(r), aborted: w.aborted, start: w.start})
+}
+
+// markAborted 标记客户端在响应传输中断开
+func (w *accessWriter) markAborted() {
+	w.aborted = true
+}
+
+// WriteHeader 记录状态码
+func (w *accessWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// Write 记录响应体字节数
+func (w *accessWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.size += int64(n)
+	return n, err
+}
+
+// Flush 透传Flush
+func (w *accessWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack 透传Hijack，劫持后的访问日志由隧道写入
+func (w *accessWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("hijacking not supported")
+	}
+	w.hijacked = true
+	return hijacker.Hijack()
+}
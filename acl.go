@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// cidrMatcher 一组网段，匹配时IPv4映射的IPv6地址按IPv4处理
+type cidrMatcher []*net.IPNet
+
+// parseCIDRs 解析逗号分隔的网段列表，元素可以是CIDR或单个地址，name用于错误信息
+func parseCIDRs(name, value string) (cidrMatcher, error) {
+	var m cidrMatcher
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if !strings.Contains(item, "/") {
+			ip := net.ParseIP(item)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid %s entry %q", name, item)
+			}
+			bits := 128
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 32
+			}
+			m = append(m, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		ip, n, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s entry %q", name, item)
+		}
+		// ::ffff:10.0.0.0/104 这类写法转换为IPv4网段，否则无法匹配IPv4客户端
+		if ones, _ := n.Mask.Size(); ip.To4() != nil && len(n.IP) == net.IPv6len && ones >= 96 {
+			n = &net.IPNet{IP: ip.To4().Mask(net.CIDRMask(ones-96, 32)), Mask: net.CIDRMask(ones-96, 32)}
+		}
+		m = append(m, n)
+	}
+	return m, nil
+}
+
+// contains 判断地址是否属于其中任一网段
+func (m cidrMatcher) contains(ip net.IP) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	for _, n := range m {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	allowCIDRs stringList  // -allow-cidr参数
+	denyCIDRs  stringList  // -deny-cidr参数
+	allowNets  cidrMatcher // 允许使用代理的客户端网段，为空表示允许所有
+	denyNets   cidrMatcher // 禁止使用代理的客户端网段，优先于allowNets
+)
+
+// setupClientACL 解析-allow-cidr和-deny-cidr
+func setupClientACL() error {
+	var err error
+	if allowNets, err = parseCIDRs("-allow-cidr", allowCIDRs.String()); err != nil {
+		return err
+	}
+	denyNets, err = parseCIDRs("-deny-cidr", denyCIDRs.String())
+	return err
+}
+
+// clientAllowed 判断客户端地址是否允许使用代理，deny优先，allow为空时允许所有
+func clientAllowed(ip net.IP) bool {
+	if denyNets.contains(ip) {
+		return false
+	}
+	return len(allowNets) == 0 || allowNets.contains(ip)
+}
+
+// rejectClient 客户端地址被-allow-cidr/-deny-cidr拒绝时返回403并返回true
+func rejectClient(w http.ResponseWriter, r *http.Request, title string) bool {
+	if len(allowNets) == 0 && len(denyNets) == 0 {
+		return false
+	}
+	key := clientKey(r)
+	if ip := net.ParseIP(key); ip != nil && clientAllowed(ip) {
+		return false
+	}
+	logfCtx(r.Context(), levelInfo, "[%s] 拒绝客户端 %s 访问 %s", title, key, r.Host)
+	writeProxyError(w, http.StatusForbidden, reasonACLDenied, "", "Client address is not allowed to use this proxy")
+	return true
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseCIDRs(t *testing.T) {
+	tests := []struct {
+		value string
+		in    []string
+		out   []string
+		ok    bool
+	}{
+		{"10.0.0.0/8, 192.168.1.5", []string{"10.1.2.3", "192.168.1.5", "::ffff:10.9.9.9"}, []string{"11.0.0.1", "192.168.1.6"}, true},
+		{"2001:db8::/32,::1", []string{"2001:db8:1::5", "::1"}, []string{"2001:db9::1", "127.0.0.1"}, true},
+		{"::ffff:10.0.0.0/104", []string{"10.255.0.1", "::ffff:10.0.0.1"}, []string{"11.0.0.1"}, true},
+		{"::ffff:192.0.2.7", []string{"192.0.2.7"}, []string{"192.0.2.8"}, true},
+		{"", nil, []string{"10.0.0.1"}, true},
+		{"10.0.0.0/33", nil, nil, false},
+		{"10.0.0", nil, nil, false},
+		{"10.0.0.0/8,garbage", nil, nil, false},
+	}
+	for _, tt := range tests {
+		m, err := parseCIDRs("-allow-cidr", tt.value)
+		if (err == nil) != tt.ok {
+			t.Errorf("parseCIDRs(%q) error = %v, want ok %v", tt.value, err, tt.ok)
+			continue
+		}
+		for _, addr := range tt.in {
+			if !m.contains(net.ParseIP(addr)) {
+				t.Errorf("parseCIDRs(%q) does not contain %s", tt.value, addr)
+			}
+		}
+		for _, addr := range tt.out {
+			if m.contains(net.ParseIP(addr)) {
+				t.Errorf("parseCIDRs(%q) contains %s", tt.value, addr)
+			}
+		}
+	}
+}
+
+// TestRejectClient deny优先于allow，只配置deny时其他客户端都允许，被拒绝时返回403
+func TestRejectClient(t *testing.T) {
+	savedAllow, savedDeny := allowNets, denyNets
+	t.Cleanup(func() { allowNets, denyNets = savedAllow, savedDeny })
+
+	tests := []struct {
+		name        string
+		allow, deny string
+		remote      string
+		allowed     bool
+	}{
+		{"no lists", "", "", "203.0.113.1:1000", true},
+		{"allowed", "10.0.0.0/8", "", "10.1.1.1:1000", true},
+		{"not in allow", "10.0.0.0/8", "", "203.0.113.1:1000", false},
+		{"deny wins", "10.0.0.0/8", "10.1.0.0/16", "10.1.1.1:1000", false},
+		{"deny only", "", "10.1.0.0/16", "203.0.113.1:1000", true},
+		{"ipv6", "2001:db8::/32", "", "[2001:db8::1]:1000", true},
+		{"mapped client", "192.0.2.0/24", "", "[::ffff:192.0.2.9]:1000", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var err error
+			if allowNets, err = parseCIDRs("-allow-cidr", tt.allow); err != nil {
+				t.Fatal(err)
+			}
+			if denyNets, err = parseCIDRs("-deny-cidr", tt.deny); err != nil {
+				t.Fatal(err)
+			}
+			r := httptest.NewRequest(http.MethodConnect, "http://example.com:443", nil)
+			r.RemoteAddr = tt.remote
+			w := httptest.NewRecorder()
+			if rejected := rejectClient(w, withClientKey(r), "test"); rejected == tt.allowed {
+				t.Fatalf("rejected = %v, want %v", rejected, !tt.allowed)
+			}
+			if !tt.allowed && w.Code != http.StatusForbidden {
+				t.Errorf("status %d, want 403", w.Code)
+			}
+		})
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// adminMux 管理接口的路由，PAC文件等非代理请求都挂在这里，不会进入代理的处理函数
+var adminMux = http.NewServeMux()
+
+// newAdminServer 创建管理接口的监听服务，未配置-admin-port时返回nil
+func newAdminServer() *proxyServer {
+	if adminPort == 0 {
+		return nil
+	}
+	return &proxyServer{title: "管理接口", server: &http.Server{
+		Addr:    fmt.Sprintf(":%d", adminPort),
+		Handler: withRecovery("管理接口", adminMux.ServeHTTP),
+	}}
+}
+
+// setupAdminUpstream 注册 /upstream：GET返回当前的第二级代理(密码已隐藏)，PUT以请求体中的URL替换第二级代理
+func setupAdminUpstream() {
+	adminMux.HandleFunc("/upstream", serveAdminUpstream)
+}
+
+// serveAdminUpstream 查看或替换第二级代理，请求体为一个或逗号分隔的多个代理URL
+func serveAdminUpstream(w http.ResponseWriter, r *http.Request) {
+	if rejectAdmin(w, r) {
+		return
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+	case http.MethodPut:
+		body, err := io.ReadAll(io.LimitReader(r.Body, 64*1024))
+		if err != nil {
+			http.Error(w, "Failed to read request body", http.StatusBadRequest)
+			return
+		}
+		list, err := parseUpstreams([]string{strings.TrimSpace(string(body))})
+		if err == nil {
+			err = validateUpstreamChange(list)
+		}
+		if err != nil {
+			auditAdmin(r, "rejected: "+err.Error())
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		replaceUpstreams(list, "管理接口")
+		names := make([]string, 0, len(list))
+		for _, u := range list {
+			names = append(names, u.redacted())
+		}
+		auditAdmin(r, "replaced upstreams with "+strings.Join(names, ","))
+	default:
+		w.Header().Set("Allow", "GET, HEAD, PUT")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	for _, u := range upstreamList() {
+		fmt.Fprintln(w, u.redacted())
+	}
+}
+
+// rejectRemoteAdmin 管理类接口默认只接受本机的请求，未开启-admin-allow-remote时对其他地址返回403并返回true，
+// 本机请求只是不受来源限制，配置了管理接口认证时仍需要认证
+func rejectRemoteAdmin(w http.ResponseWriter, r *http.Request) bool {
+	if adminAllowRemote {
+		return false
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if ip := net.ParseIP(host); err == nil && ip != nil && ip.IsLoopback() {
+		return false
+	}
+	http.Error(w, "Admin endpoint is only available from localhost", http.StatusForbidden)
+	return true
+}
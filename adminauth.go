@@ -0,0 +1,168 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// adminRealm 管理接口要求认证时使用的realm
+const adminRealm = "web-proxy-admin"
+
+// adminAccess 管理接口的访问权限
+type adminAccess int
+
+const (
+	adminNone  adminAccess = iota // 未通过认证
+	adminRead                     // 只读，只能使用GET/HEAD
+	adminWrite                    // 可读写
+)
+
+// adminIdentity 通过认证的管理接口使用者
+type adminIdentity struct {
+	name   string // 审计日志中的操作者，令牌为 token#序号，账户为 user:账户名
+	access adminAccess
+}
+
+var (
+	adminAuthOn bool                   // 是否配置了管理接口的令牌或账户
+	adminRoles  map[string]adminAccess // 可使用管理接口的账户及其权限
+	adminAudit  *rotatingFile          // -admin-audit-log打开的文件，为nil表示只写入普通日志
+)
+
+// setupAdminAuth 校验管理接口的令牌和账户配置，并打开审计日志；
+// 账户的密码取自-auth/-auth-file，因此配置-admin-user时必须同时配置客户端账户
+func setupAdminAuth() error {
+	for _, token := range append(append([]string{}, adminTokens...), adminReadTokens...) {
+		if strings.TrimSpace(token) == "" {
+			return errors.New("-admin-token and -admin-read-token must not be empty")
+		}
+	}
+	roles := make(map[string]adminAccess)
+	for _, list := range []struct {
+		values stringList
+		access adminAccess
+	}{{adminReadUsers, adminRead}, {adminUsers, adminWrite}} {
+		for _, user := range strings.Split(list.values.String(), ",") {
+			if user = strings.TrimSpace(user); user != "" {
+				roles[user] = list.access
+			}
+		}
+	}
+	if len(roles) > 0 {
+		store := authStore.Load()
+		if store == nil {
+			return errors.New("-admin-user and -admin-read-user require -auth or -auth-file")
+		}
+		for user := range roles {
+			if _, ok := store.users[user]; !ok {
+				logf(levelWarn, "[管理接口] 账户 %s 不在-auth/-auth-file中，暂时无法登录", user)
+			}
+		}
+	}
+	adminRoles = roles
+	adminAuthOn = len(adminTokens) > 0 || len(adminReadTokens) > 0 || len(roles) > 0
+	if adminAllowRemote && !adminAuthOn {
+		logf(levelWarn, "[管理接口] 开启了-admin-allow-remote但未配置-admin-token或-admin-user，任何能访问管理端口的地址都可以修改配置")
+	}
+
+	if adminAuditFile != "" {
+		w, err := openLogFile(adminAuditFile)
+		if err != nil {
+			return err
+		}
+		adminAudit = w
+	}
+	return nil
+}
+
+// authenticateAdmin 校验Authorization头部中的Bearer令牌或Basic账户，未配置管理接口认证时视为可读写
+func authenticateAdmin(r *http.Request) adminIdentity {
+	if !adminAuthOn {
+		return adminIdentity{name: "anonymous", access: adminWrite}
+	}
+	scheme, value, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+	value = strings.TrimSpace(value)
+	switch {
+	case strings.EqualFold(scheme, "Bearer") && value != "":
+		// 逐个比较所有令牌，耗时与命中哪个令牌无关
+		id := adminIdentity{}
+		for i, token := range adminTokens {
+			if subtle.ConstantTimeCompare([]byte(value), []byte(token)) == 1 && id.access == adminNone {
+				id = adminIdentity{name: fmt.Sprintf("token#%d", i+1), access: adminWrite}
+			}
+		}
+		for i, token := range adminReadTokens {
+			if subtle.ConstantTimeCompare([]byte(value), []byte(token)) == 1 && id.access == adminNone {
+				id = adminIdentity{name: fmt.Sprintf("read-token#%d", i+1), access: adminRead}
+			}
+		}
+		return id
+	case strings.EqualFold(scheme, "Basic") && len(adminRoles) > 0:
+		decoded, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return adminIdentity{}
+		}
+		user, pass, _ := strings.Cut(string(decoded), ":")
+		access, ok := adminRoles[user]
+		store := authStore.Load()
+		if !ok || store == nil || !store.check(user, pass) {
+			return adminIdentity{}
+		}
+		return adminIdentity{name: "user:" + user, access: access}
+	}
+	return adminIdentity{}
+}
+
+// requiredAdminAccess 返回请求需要的权限，GET和HEAD为只读，其余方法都按修改操作处理
+func requiredAdminAccess(r *http.Request) adminAccess {
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		return adminRead
+	}
+	return adminWrite
+}
+
+// rejectAdmin 管理类接口的访问检查：先按-admin-allow-remote限制来源地址，
+// 配置了令牌或账户时再要求认证，未认证返回401，只读身份请求修改操作返回403，已拒绝时返回true
+func rejectAdmin(w http.ResponseWriter, r *http.Request) bool {
+	return rejectRemoteAdmin(w, r) || rejectAdminAuth(w, r)
+}
+
+// rejectAdminAuth 校验管理接口的认证和权限，调试接口不限制来源地址，只调用这一部分
+func rejectAdminAuth(w http.ResponseWriter, r *http.Request) bool {
+	id := authenticateAdmin(r)
+	if id.access == adminNone {
+		challenge := fmt.Sprintf("Bearer realm=%q", adminRealm)
+		if len(adminRoles) > 0 {
+			challenge += fmt.Sprintf(", Basic realm=%q", adminRealm)
+		}
+		w.Header().Set("WWW-Authenticate", challenge)
+		http.Error(w, "Admin authentication required", http.StatusUnauthorized)
+		if r.Header.Get("Authorization") != "" {
+			logf(levelWarn, "[管理接口] 客户端 %s 认证失败: %s %s", clientKey(r), r.Method, r.URL.Path)
+		}
+		return true
+	}
+	if id.access < requiredAdminAccess(r) {
+		auditAdmin(r, "denied: read-only credentials")
+		http.Error(w, "Read-only credentials cannot modify state", http.StatusForbidden)
+		return true
+	}
+	return false
+}
+
+// auditAdmin 记录一次管理接口的修改操作和操作者，写入普通日志，配置了-admin-audit-log时同时写入审计日志
+func auditAdmin(r *http.Request, result string) {
+	id := authenticateAdmin(r)
+	logf(levelInfo, "[审计] %s(%s) %s %s: %s", id.name, clientKey(r), r.Method, r.URL.RequestURI(), result)
+	if adminAudit == nil {
+		return
+	}
+	line := fmt.Sprintf("%s identity=%s client=%s method=%s uri=%q result=%q\n",
+		time.Now().Format(time.RFC3339), id.name, clientKey(r), r.Method, r.URL.RequestURI(), result)
+	adminAudit.Write([]byte(line))
+}
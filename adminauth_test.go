@@ -0,0 +1,175 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// withAdminAuth 在测试期间配置管理接口的令牌和账户，结束后恢复原值
+func withAdminAuth(t *testing.T) {
+	t.Helper()
+	savedTokens, savedReadTokens := adminTokens, adminReadTokens
+	savedUsers, savedReadUsers := adminUsers, adminReadUsers
+	savedStore, savedRemote := authStore.Load(), adminAllowRemote
+	t.Cleanup(func() {
+		adminTokens, adminReadTokens = savedTokens, savedReadTokens
+		adminUsers, adminReadUsers = savedUsers, savedReadUsers
+		authStore.Store(savedStore)
+		adminAllowRemote = savedRemote
+		adminAuthOn, adminRoles = false, nil
+	})
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("ops-pass"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authStore.Store(&credentialStore{users: map[string]credential{
+		"ops":     {secret: string(hash)},
+		"monitor": {secret: "watch"},
+		"client":  {secret: "proxy-only"},
+	}})
+	adminTokens, adminReadTokens = stringList{"rw-secret"}, stringList{"ro-secret"}
+	adminUsers, adminReadUsers = stringList{"ops"}, stringList{"monitor"}
+	adminAllowRemote = false
+	if err := setupAdminAuth(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// adminRequest 构造一个来自本机的管理接口请求
+func adminRequest(method, target, authorization string) *http.Request {
+	r := httptest.NewRequest(method, target, nil)
+	r.RemoteAddr = "127.0.0.1:40000"
+	if authorization != "" {
+		r.Header.Set("Authorization", authorization)
+	}
+	return r
+}
+
+func basic(user, pass string) string {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.SetBasicAuth(user, pass)
+	return r.Header.Get("Authorization")
+}
+
+func TestAuthenticateAdmin(t *testing.T) {
+	withAdminAuth(t)
+	tests := []struct {
+		name          string
+		authorization string
+		want          adminIdentity
+	}{
+		{"no header", "", adminIdentity{}},
+		{"read-write token", "Bearer rw-secret", adminIdentity{"token#1", adminWrite}},
+		{"read-only token", "bearer ro-secret", adminIdentity{"read-token#1", adminRead}},
+		{"wrong token", "Bearer nope", adminIdentity{}},
+		{"empty bearer", "Bearer ", adminIdentity{}},
+		{"bcrypt admin user", basic("ops", "ops-pass"), adminIdentity{"user:ops", adminWrite}},
+		{"read-only user", basic("monitor", "watch"), adminIdentity{"user:monitor", adminRead}},
+		{"wrong password", basic("ops", "wrong"), adminIdentity{}},
+		{"proxy user without admin role", basic("client", "proxy-only"), adminIdentity{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := authenticateAdmin(adminRequest(http.MethodGet, "/connections", tt.authorization))
+			if got != tt.want {
+				t.Errorf("authenticateAdmin = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestAdminDeleteRequiresWriteAccess 只读令牌和账户不能调用DELETE接口，未认证的请求返回401
+func TestAdminDeleteRequiresWriteAccess(t *testing.T) {
+	withAdminAuth(t)
+	tests := []struct {
+		name          string
+		authorization string
+		want          int
+	}{
+		{"unauthenticated", "", http.StatusUnauthorized},
+		{"read-only token", "Bearer ro-secret", http.StatusForbidden},
+		{"read-only user", basic("monitor", "watch"), http.StatusForbidden},
+		{"read-write token", "Bearer rw-secret", http.StatusNotFound},
+		{"admin user", basic("ops", "ops-pass"), http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			serveConnection(w, adminRequest(http.MethodDelete, "/connections/424242", tt.authorization))
+			if w.Code != tt.want {
+				t.Errorf("DELETE /connections/{id}: status %d, want %d", w.Code, tt.want)
+			}
+			w = httptest.NewRecorder()
+			serveConnections(w, adminRequest(http.MethodDelete, "/connections?host=example.invalid", tt.authorization))
+			want := tt.want
+			if want == http.StatusNotFound {
+				want = http.StatusOK
+			}
+			if w.Code != want {
+				t.Errorf("DELETE /connections?host=: status %d, want %d", w.Code, want)
+			}
+		})
+	}
+}
+
+func TestAdminReadOnlyCanRead(t *testing.T) {
+	withAdminAuth(t)
+	for _, authorization := range []string{"Bearer ro-secret", basic("monitor", "watch"), "Bearer rw-secret"} {
+		w := httptest.NewRecorder()
+		serveConnections(w, adminRequest(http.MethodGet, "/connections", authorization))
+		if w.Code != http.StatusOK {
+			t.Errorf("GET /connections with %q: status %d, want 200", authorization, w.Code)
+		}
+	}
+}
+
+func TestAdminChallenge(t *testing.T) {
+	withAdminAuth(t)
+	w := httptest.NewRecorder()
+	serveTunnelStats(w, adminRequest(http.MethodGet, "/tunnels", ""))
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("status %d, want 401", w.Code)
+	}
+	challenge := w.Header().Get("WWW-Authenticate")
+	if !strings.Contains(challenge, "Bearer") || !strings.Contains(challenge, "Basic") {
+		t.Errorf("WWW-Authenticate = %q, want Bearer and Basic challenges", challenge)
+	}
+}
+
+// TestAdminRemoteStillRestricted 令牌不能绕过-admin-allow-remote的来源限制
+func TestAdminRemoteStillRestricted(t *testing.T) {
+	withAdminAuth(t)
+	r := adminRequest(http.MethodGet, "/tunnels", "Bearer rw-secret")
+	r.RemoteAddr = "192.0.2.10:40000"
+	w := httptest.NewRecorder()
+	serveTunnelStats(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("remote request: status %d, want 403", w.Code)
+	}
+}
+
+func TestAdminAuthDisabled(t *testing.T) {
+	id := authenticateAdmin(adminRequest(http.MethodDelete, "/connections/1", ""))
+	if id.access != adminWrite {
+		t.Errorf("without admin credentials configured, access = %v, want read-write", id.access)
+	}
+}
+
+func TestSetupAdminAuthRequiresStore(t *testing.T) {
+	savedUsers, savedStore := adminUsers, authStore.Load()
+	t.Cleanup(func() {
+		adminUsers = savedUsers
+		authStore.Store(savedStore)
+		adminAuthOn, adminRoles = false, nil
+	})
+	adminUsers = stringList{"ops"}
+	authStore.Store(nil)
+	if err := setupAdminAuth(); err == nil {
+		t.Error("setupAdminAuth accepted -admin-user without -auth or -auth-file")
+	}
+}
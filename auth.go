@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const authRealm = "web-proxy" // 要求客户端认证时使用的realm
+
+// credential 单个账户的密码，支持明文、bcrypt和htpasswd的{SHA}格式，以及账户的附加属性
+type credential struct {
+	secret string
+	outIP  net.IP // out-ip= 指定的出口地址，为nil表示按-out-ip-pool分配
+}
+
+// parseCredential 解析 账户: 之后的部分，密码之后可以用空白分隔追加属性，目前支持 out-ip=地址，
+// 例如 $2y$10$...  out-ip=203.0.113.15；只识别末尾的已知属性，明文密码中的其他内容保持原样
+func parseCredential(value string) (credential, error) {
+	var c credential
+	for {
+		i := strings.LastIndexAny(value, " \t")
+		if i < 0 {
+			break
+		}
+		key, val, ok := strings.Cut(value[i+1:], "=")
+		if !ok || key != "out-ip" {
+			break
+		}
+		ip := net.ParseIP(val)
+		if ip == nil {
+			return c, fmt.Errorf("invalid out-ip %q", val)
+		}
+		c.outIP = ip
+		value = strings.TrimRight(value[:i], " \t")
+	}
+	c.secret = value
+	return c, nil
+}
+
+// verify 校验密码，明文和{SHA}以常量时间比较
+func (c credential) verify(pass string) bool {
+	switch {
+	case strings.HasPrefix(c.secret, "$2a$"), strings.HasPrefix(c.secret, "$2b$"), strings.HasPrefix(c.secret, "$2y$"):
+		return bcrypt.CompareHashAndPassword([]byte(c.secret), []byte(pass)) == nil
+	case strings.HasPrefix(c.secret, "{SHA}"):
+		sum := sha1.Sum([]byte(pass))
+		return subtle.ConstantTimeCompare([]byte(base64.StdEncoding.EncodeToString(sum[:])), []byte(c.secret[len("{SHA}"):])) == 1
+	}
+	return subtle.ConstantTimeCompare([]byte(pass), []byte(c.secret)) == 1
+}
+
+// hashed 判断密码是否以哈希形式保存
+func (c credential) hashed() bool {
+	return strings.HasPrefix(c.secret, "$2") || strings.HasPrefix(c.secret, "{SHA}")
+}
+
+// credentialStore 两个监听共用的账户表，重新加载时整体替换
+type credentialStore struct {
+	users map[string]credential
+
+	// verified 缓存校验通过的密码摘要，避免每个请求都计算bcrypt
+	verified sync.Map
+}
+
+// dummyCredential 账户不存在时用来比较的固定bcrypt哈希(cost 10，与htpasswd -B的默认值相同)，
+// 使不存在的账户与密码错误的账户付出同样的bcrypt耗时
+var dummyCredential = credential{secret: "$2a$10$cr1f6paxN0of6qyxgcb80.ez1Yq7J8TfMtdwimgEnqBotP.Hs9yoK"}
+
+// check 校验账户和密码，账户不存在时与dummyCredential比较一次，避免通过耗时判断账户是否存在；
+// 代理认证、SOCKS5的RFC 1929认证和管理接口都经过这里
+func (s *credentialStore) check(user, pass string) bool {
+	c, exists := s.users[user]
+	if !exists {
+		c = dummyCredential
+	}
+	sum := sha256.Sum256([]byte(user + "\x00" + pass))
+	if exists {
+		if _, ok := s.verified.Load(sum); ok {
+			return true
+		}
+	}
+	if !c.verify(pass) || !exists {
+		return false
+	}
+	s.verified.Store(sum, struct{}{})
+	return true
+}
+
+var (
+	authMu    sync.Mutex                      // 保护authUsers，账户文件轮询和重新加载配置都会替换账户表
+	authUsers map[string]credential           // -auth指定的账户
+	authStore atomic.Pointer[credentialStore] // 当前生效的账户表，为nil表示不要求认证
+)
+
+// parseAuthUsers 解析-auth参数列表，每项为 账户:密码
+func parseAuthUsers(values []string) (map[string]credential, error) {
+	users := make(map[string]credential, len(values))
+	for _, value := range values {
+		user, pass, ok := strings.Cut(value, ":")
+		if !ok || user == "" {
+			return nil, fmt.Errorf("invalid -auth %q, want user:pass", value)
+		}
+		c, err := parseCredential(pass)
+		if err != nil {
+			return nil, fmt.Errorf("invalid -auth for %q: %v", user, err)
+		}
+		users[user] = c
+	}
+	return users, nil
+}
+
+// loadAuthFile 读取htpasswd格式的账户文件，每行 账户:哈希 [out-ip=地址]，忽略空行和#开头的注释
+func loadAuthFile(path string) (map[string]credential, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	users := make(map[string]credential)
+	plain := 0
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		user, secret, ok := strings.Cut(text, ":")
+		if !ok || user == "" || secret == "" {
+			return nil, fmt.Errorf("%s:%d: want user:hash", path, line)
+		}
+		c, err := parseCredential(secret)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+		if c.secret == "" {
+			return nil, fmt.Errorf("%s:%d: want user:hash", path, line)
+		}
+		if !c.hashed() {
+			plain++
+		}
+		users[user] = c
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if plain > 0 {
+		log.Printf("[认证] %s 中有 %d 个账户使用明文密码，建议改用bcrypt(htpasswd -B)", path, plain)
+	}
+	return users, nil
+}
+
+// setupAuth 合并-auth和-auth-file的账户并生效，-auth-file修改后由watchFiles重新加载
+func setupAuth(path string) error {
+	if path == "" {
+		authMu.Lock()
+		defer authMu.Unlock()
+		return storeAuth(authUsers, "")
+	}
+	return reloadAuthFile(path)
+}
+
+// reloadAuthFile 重新读取账户文件并替换当前账户表
+func reloadAuthFile(path string) error {
+	authMu.Lock()
+	defer authMu.Unlock()
+	return storeAuth(authUsers, path)
+}
+
+// replaceAuthUsers 替换-auth指定的账户并重新读取账户文件，失败时保留原有账户
+func replaceAuthUsers(users map[string]credential, path string) error {
+	authMu.Lock()
+	defer authMu.Unlock()
+	if err := storeAuth(users, path); err != nil {
+		return err
+	}
+	authUsers = users
+	return nil
+}
+
+// storeAuth 合并users和账户文件后替换当前账户表，两者都未配置时不再要求认证，调用方需持有authMu
+func storeAuth(users map[string]credential, path string) error {
+	if path == "" {
+		if len(users) == 0 {
+			authStore.Store(nil)
+		} else {
+			authStore.Store(&credentialStore{users: users})
+		}
+		return nil
+	}
+	merged, err := loadAuthFile(path)
+	if err != nil {
+		return err
+	}
+	for user, c := range users {
+		merged[user] = c
+	}
+	authStore.Store(&credentialStore{users: merged})
+	log.Printf("[认证] 已加载 %d 个账户", len(merged))
+	return nil
+}
+
+// authUserCtx 请求上下文中保存认证结果的key
+type authUserCtx struct{}
+
+// authResult 客户端的认证结果
+type authResult struct {
+	user string
+	ok   bool
+}
+
+// proxyCredentials 从Proxy-Authorization头部解析Basic认证的账户和密码
+func proxyCredentials(r *http.Request) (user, pass string, ok bool) {
+	scheme, encoded, found := strings.Cut(r.Header.Get("Proxy-Authorization"), " ")
+	if !found || !strings.EqualFold(scheme, "Basic") {
+		return "", "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return "", "", false
+	}
+	return strings.Cut(string(decoded), ":")
+}
+
+// withAuth 要求认证时校验客户端的Proxy-Authorization，并将结果存入请求上下文，
+// 校验通过后删除该头部，避免继续向后转发
+func withAuth(r *http.Request) *http.Request {
+	store := authStore.Load()
+	if store == nil {
+		return r
+	}
+	var res authResult
+	if user, pass, ok := proxyCredentials(r); ok {
+		res = authResult{user: user, ok: store.check(user, pass)}
+	}
+	if res.ok {
+		r.Header.Del("Proxy-Authorization")
+	}
+	return r.WithContext(context.WithValue(r.Context(), authUserCtx{}, res))
+}
+
+// userOutIP 返回账户通过out-ip=指定的出口地址，账户不存在或未指定时返回nil
+func userOutIP(user string) net.IP {
+	store := authStore.Load()
+	if user == "" || store == nil {
+		return nil
+	}
+	return store.users[user].outIP
+}
+
+// authUser 返回认证通过的账户，未认证时为空
+func authUser(r *http.Request) string {
+	if res, _ := r.Context().Value(authUserCtx{}).(authResult); res.ok {
+		return res.user
+	}
+	return ""
+}
+
+// rejectUnauthorized 要求认证而客户端未通过时返回407并返回true，已提供受信任客户端证书的连接视为已认证
+func rejectUnauthorized(w http.ResponseWriter, r *http.Request, title string) bool {
+	if authStore.Load() == nil || clientCertName(r) != "" {
+		return false
+	}
+	res, _ := r.Context().Value(authUserCtx{}).(authResult)
+	if res.ok {
+		return false
+	}
+	if res.user != "" {
+		logfCtx(r.Context(), levelWarn, "[%s] 客户端 %s 认证失败: 账户 %q", title, clientKey(r), res.user)
+	}
+	w.Header().Set("Proxy-Authenticate", fmt.Sprintf("Basic realm=%q", authRealm))
+	writeProxyError(w, http.StatusProxyAuthRequired, reasonAuthRequired, "", "Proxy authentication required")
+	return true
+}
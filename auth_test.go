@@ -0,0 +1,215 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestCredentialVerify(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("s3cret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha1.Sum([]byte("s3cret"))
+	sha := "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+	// htpasswd -B 生成$2y$前缀，与$2a$格式相同
+	hash2y := "$2y$" + string(hash[len("$2a$"):])
+
+	tests := []struct {
+		name   string
+		secret string
+		hashed bool
+	}{
+		{"plain", "s3cret", false},
+		{"bcrypt", string(hash), true},
+		{"bcrypt $2y$", hash2y, true},
+		{"sha", sha, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := credential{secret: tt.secret}
+			if !c.verify("s3cret") {
+				t.Error("correct password rejected")
+			}
+			for _, wrong := range []string{"", "s3cre", "s3cret ", "S3CRET"} {
+				if c.verify(wrong) {
+					t.Errorf("wrong password %q accepted", wrong)
+				}
+			}
+			if c.hashed() != tt.hashed {
+				t.Errorf("hashed() = %v, want %v", c.hashed(), tt.hashed)
+			}
+		})
+	}
+	// 密码本身与哈希字符串相同时不能通过
+	if c := (credential{secret: sha}); c.verify(sha) {
+		t.Error("{SHA} hash accepted as its own password")
+	}
+}
+
+// TestCredentialStoreCheck 账户不存在时即使密码与某个账户的密码相同也不能通过，缓存只记录校验通过的密码
+func TestCredentialStoreCheck(t *testing.T) {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("pw"), bcrypt.MinCost)
+	s := &credentialStore{users: map[string]credential{"alice": {secret: string(hash)}, "bob": {secret: "pw"}}}
+	tests := []struct {
+		user, pass string
+		want       bool
+	}{
+		{"alice", "pw", true},
+		{"alice", "pw", true}, // 命中缓存
+		{"alice", "other", false},
+		{"bob", "pw", true},
+		{"carol", "pw", false},
+		{"", "", false},
+	}
+	for _, tt := range tests {
+		if got := s.check(tt.user, tt.pass); got != tt.want {
+			t.Errorf("check(%q, %q) = %v, want %v", tt.user, tt.pass, got, tt.want)
+		}
+	}
+}
+
+func TestProxyCredentials(t *testing.T) {
+	basic := func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) }
+	tests := []struct {
+		header     string
+		user, pass string
+		ok         bool
+	}{
+		{"Basic " + basic("alice:pw"), "alice", "pw", true},
+		{"basic  " + basic("alice:p:w"), "alice", "p:w", true},
+		{"Basic " + basic("alice"), "alice", "", false},
+		{"Bearer token", "", "", false},
+		{"Basic !!!", "", "", false},
+		{"", "", "", false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		r.Header.Set("Proxy-Authorization", tt.header)
+		user, pass, ok := proxyCredentials(r)
+		if user != tt.user || pass != tt.pass || ok != tt.ok {
+			t.Errorf("proxyCredentials(%q) = %q, %q, %v, want %q, %q, %v", tt.header, user, pass, ok, tt.user, tt.pass, tt.ok)
+		}
+	}
+}
+
+// TestRejectUnauthorized 要求认证时缺少或错误的凭据返回407和Proxy-Authenticate，通过后删除Proxy-Authorization
+func TestRejectUnauthorized(t *testing.T) {
+	saved := authStore.Load()
+	t.Cleanup(func() { authStore.Store(saved) })
+	authStore.Store(&credentialStore{users: map[string]credential{"alice": {secret: "pw"}}})
+	basic := func(s string) string { return "Basic " + base64.StdEncoding.EncodeToString([]byte(s)) }
+
+	tests := []struct {
+		name   string
+		header string
+		ok     bool
+	}{
+		{"missing", "", false},
+		{"wrong password", basic("alice:nope"), false},
+		{"unknown user", basic("mallory:pw"), false},
+		{"valid", basic("alice:pw"), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodConnect, "http://example.com:443", nil)
+			if tt.header != "" {
+				r.Header.Set("Proxy-Authorization", tt.header)
+			}
+			r = withAuth(withClientKey(r))
+			w := httptest.NewRecorder()
+			if rejected := rejectUnauthorized(w, r, "test"); rejected == tt.ok {
+				t.Fatalf("rejected = %v, want %v", rejected, !tt.ok)
+			}
+			if tt.ok {
+				if authUser(r) != "alice" {
+					t.Errorf("authUser = %q, want alice", authUser(r))
+				}
+				if r.Header.Get("Proxy-Authorization") != "" {
+					t.Error("Proxy-Authorization kept after successful authentication")
+				}
+				return
+			}
+			if w.Code != http.StatusProxyAuthRequired {
+				t.Errorf("status %d, want 407", w.Code)
+			}
+			if got := w.Header().Get("Proxy-Authenticate"); got != `Basic realm="web-proxy"` {
+				t.Errorf("Proxy-Authenticate %q", got)
+			}
+		})
+	}
+
+	authStore.Store(nil)
+	r := withAuth(withClientKey(httptest.NewRequest(http.MethodGet, "http://example.com/", nil)))
+	if rejectUnauthorized(httptest.NewRecorder(), r, "test") {
+		t.Error("request rejected with authentication disabled")
+	}
+}
+
+// TestUnknownUserCost 不存在的账户与密码错误的bcrypt账户耗时相当，代理认证和SOCKS5的RFC 1929认证都是如此
+func TestUnknownUserCost(t *testing.T) {
+	captureLog(t)
+	if !dummyCredential.hashed() || bcryptCost(t, dummyCredential.secret) != bcrypt.DefaultCost {
+		t.Fatalf("dummy credential %q is not a cost %d bcrypt hash", dummyCredential.secret, bcrypt.DefaultCost)
+	}
+	hash, _ := bcrypt.GenerateFromPassword([]byte("pw"), bcrypt.DefaultCost)
+	saved := authStore.Load()
+	t.Cleanup(func() { authStore.Store(saved) })
+	authStore.Store(&credentialStore{users: map[string]credential{"alice": {secret: string(hash)}}})
+
+	proxyAuth := func(user, pass string) bool {
+		r := httptest.NewRequest(http.MethodConnect, "http://example.com:443", nil)
+		r.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(user+":"+pass)))
+		return authUser(withAuth(r)) != ""
+	}
+	socksAuth := func(user, pass string) bool {
+		client, server := net.Pipe()
+		defer client.Close()
+		go func() {
+			client.Write([]byte{socksVersion, 1, socksAuthPassword})
+			client.Read(make([]byte, 2))
+			msg := append([]byte{0x01, byte(len(user))}, user...)
+			client.Write(append(append(msg, byte(len(pass))), pass...))
+			client.Read(make([]byte, 2))
+		}()
+		defer server.Close()
+		_, _, ok := socksServerAuth(server)
+		return ok
+	}
+	// 取3次中最短的耗时，减少调度带来的波动
+	cost := func(check func(user, pass string) bool, user string) time.Duration {
+		best := time.Duration(math.MaxInt64)
+		for i := 0; i < 3; i++ {
+			start := time.Now()
+			if check(user, "wrong") {
+				t.Fatalf("%s accepted with a wrong password", user)
+			}
+			best = min(best, time.Since(start))
+		}
+		return best
+	}
+	for name, check := range map[string]func(user, pass string) bool{"proxy": proxyAuth, "socks": socksAuth} {
+		wrong, unknown := cost(check, "alice"), cost(check, "mallory")
+		if unknown < wrong/3 {
+			t.Errorf("%s: unknown user took %s, wrong password %s; unknown users must cost a bcrypt comparison", name, unknown, wrong)
+		}
+	}
+}
+
+// bcryptCost 返回bcrypt哈希的cost
+func bcryptCost(t *testing.T, hash string) int {
+	t.Helper()
+	cost, err := bcrypt.Cost([]byte(hash))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cost
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+// blockedHosts 当前生效的目标域名黑名单，为nil表示不过滤，重新加载配置时整体替换
+var blockedHosts atomic.Pointer[domainRules]
+
+// loadBlocklist 读取黑名单文件，每行一个域名，忽略空行和#开头的注释
+func loadBlocklist(path string) (*domainRules, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	b := newDomainRules()
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		rule := strings.TrimSpace(scanner.Text())
+		if rule == "" || strings.HasPrefix(rule, "#") {
+			continue
+		}
+		if err := b.add(rule, ""); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	log.Printf("[黑名单] 已加载 %d 条规则", b.len())
+	return b, nil
+}
+
+// rejectBlockedHost 目标主机命中黑名单时返回403并返回true，CONNECT在拨号前即被拒绝
+func rejectBlockedHost(w http.ResponseWriter, r *http.Request, title string) bool {
+	b := blockedHosts.Load()
+	if b == nil {
+		return false
+	}
+	rule, _, ok := b.match(targetHost(r))
+	if !ok {
+		return false
+	}
+	target := requestTarget(r)
+	logfCtx(r.Context(), levelInfo, "[%s] 目标 %s 命中黑名单规则 %s", title, target, rule)
+	writeProxyError(w, http.StatusForbidden, reasonACLDenied, target, "Blocked by rule "+rule)
+	return true
+}
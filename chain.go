@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// proxyChain -proxy-chain配置的后续代理，二次代理经由选中的第二级代理依次穿过这些代理到达目标
+var proxyChain []*upstreamProxy
+
+// lastHop 返回经由upstream时的最后一跳代理
+func lastHop(upstream *upstreamProxy) *upstreamProxy {
+	if len(proxyChain) > 0 {
+		return proxyChain[len(proxyChain)-1]
+	}
+	return upstream
+}
+
+// dialChain 连接upstream并依次经由proxyChain中的每一跳建立隧道，每一跳使用自己的认证信息。
+// target不为空时再经由最后一跳连接target，返回的连接即为到target的隧道；
+// target为空时返回到最后一跳的连接(https时已完成TLS握手)，供普通HTTP转发以绝对URI发送请求
+func dialChain(ctx context.Context, upstream *upstreamProxy, target string) (net.Conn, error) {
+	hops := append([]*upstreamProxy{upstream}, proxyChain...)
+
+	setPhase(ctx, phaseUpstreamDial)
+	conn, err := dialProxyServer(ctx, upstream.scheme, upstream.server)
+	if err != nil {
+		errorLog.PrintfCtx(ctx, "upstream_dial", upstream.server, "[二次代理] 连接第二级代理 %s 失败(%s): %v", upstream.server, classifyError(err), err)
+		pe := newProxyError(true, "Failed to connect to the second proxy", err)
+		if pe.kind == kindDialTimeout {
+			pe.msg = fmt.Sprintf("Timed out connecting to the second proxy after %s", dialTimeout)
+		}
+		return nil, pe
+	}
+	for i, hop := range hops {
+		if i > 0 && hop.scheme == "https" {
+			if conn, err = proxyTLS(ctx, conn, hop.server); err != nil {
+				return nil, chainHopError(i, hop, "TLS handshake failed", err)
+			}
+		}
+		next := target
+		if i+1 < len(hops) {
+			next = hops[i+1].server
+		} else if target == "" {
+			break
+		}
+		if conn, err = hopConnect(ctx, conn, i, hop, next); err != nil {
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// hopConnect 在已连接到第i跳代理的conn上请求连接target，失败时关闭conn并返回注明是哪一跳的502错误
+func hopConnect(ctx context.Context, conn net.Conn, i int, hop *upstreamProxy, target string) (net.Conn, error) {
+	setPhase(ctx, phaseUpstreamHandshake)
+	stopWatch := watchConn(ctx, conn)
+	tunnel, err := hopHandshake(conn, i, hop, target)
+	if !stopWatch() && err == nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tunnel, nil
+}
+
+// hopHandshake 按代理的协议完成一次CONNECT或SOCKS5握手
+func hopHandshake(conn net.Conn, i int, hop *upstreamProxy, target string) (net.Conn, error) {
+	if hop.scheme == "socks5" {
+		if err := socks5Handshake(conn, target, hop.user); err != nil {
+			return nil, chainHopError(i, hop, "SOCKS5 handshake failed", err)
+		}
+		return conn, nil
+	}
+
+	authorizationHeader := ""
+	if hop.authorization != "" {
+		authorizationHeader = "Proxy-Authorization: " + hop.authorization + "\r\n"
+	}
+	connectRequest := fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\n%s\r\n", target, target, authorizationHeader)
+	if _, err := conn.Write([]byte(connectRequest)); err != nil {
+		return nil, chainHopError(i, hop, "CONNECT failed", err)
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		return nil, chainHopError(i, hop, "CONNECT failed", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, chainHopError(i, hop, "returned "+resp.Status, nil)
+	}
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// chainHopError 生成代理链第i跳(从0开始)失败的错误，返回给客户端的信息中注明是哪一跳
+func chainHopError(i int, hop *upstreamProxy, what string, err error) *proxyError {
+	msg := fmt.Sprintf("Proxy chain hop %d (%s) %s", i+1, hop.server, what)
+	if err != nil {
+		errorLog.Printf("upstream_chain", hop.server, "[二次代理] 代理链第 %d 跳 %s 失败(%s): %v", i+1, hop.server, what, err)
+	} else {
+		errorLog.Printf("upstream_chain", hop.server, "[二次代理] 代理链第 %d 跳 %s 失败: %s", i+1, hop.server, what)
+	}
+	return &proxyError{kind: kindUpstreamHandshake, upstream: true, status: http.StatusBadGateway, msg: msg, err: err}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// recordingHop 转发CONNECT的代理，记录每个CONNECT的目标和Proxy-Authorization
+func recordingHop(t *testing.T) (addr string, seen chan string) {
+	t.Helper()
+	seen = make(chan string, 16)
+	addr = tunnelProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		seen <- r.Host + " " + r.Header.Get("Proxy-Authorization")
+		handleDirectTunneling(w, r)
+	})
+	return addr, seen
+}
+
+// withChain 在测试期间使用给定的-proxy-chain
+func withChain(t *testing.T, chain ...*upstreamProxy) {
+	t.Helper()
+	saved := proxyChain
+	t.Cleanup(func() { proxyChain = saved })
+	proxyChain = chain
+}
+
+// TestDialChain 经由第二级代理依次穿过后续各跳到达目标，每一跳收到下一跳的地址和自己的认证信息
+func TestDialChain(t *testing.T) {
+	echo := newEchoServer(t)
+	first, firstSeen := recordingHop(t)
+	second, secondSeen := recordingHop(t)
+	third, thirdSeen := recordingHop(t)
+	withChain(t,
+		&upstreamProxy{scheme: "http", server: second, user: url.UserPassword("bob", "pw"), authorization: "Basic " + base64.StdEncoding.EncodeToString([]byte("bob:pw"))},
+		&upstreamProxy{scheme: "http", server: third},
+	)
+
+	conn, err := dialChain(connectRequest(echo).Context(), &upstreamProxy{scheme: "http", server: first}, echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, "ping")
+	got := make([]byte, 4)
+	if _, err := io.ReadFull(conn, got); err != nil || string(got) != "ping" {
+		t.Fatalf("tunnel through the chain echoed %q, %v", got, err)
+	}
+
+	for _, hop := range []struct {
+		name string
+		seen chan string
+		want string
+	}{
+		{"first", firstSeen, second + " "},
+		{"second", secondSeen, third + " Basic " + base64.StdEncoding.EncodeToString([]byte("bob:pw"))},
+		{"third", thirdSeen, echo + " "},
+	} {
+		if got := <-hop.seen; got != hop.want {
+			t.Errorf("%s hop saw CONNECT %q, want %q", hop.name, got, hop.want)
+		}
+	}
+}
+
+// TestDialChainToLastHop target为空时返回到最后一跳本身的连接，供普通HTTP转发使用
+func TestDialChainToLastHop(t *testing.T) {
+	last := newEchoServer(t)
+	first, firstSeen := recordingHop(t)
+	withChain(t, &upstreamProxy{scheme: "http", server: last})
+
+	conn, err := dialChain(connectRequest("example.com:80").Context(), &upstreamProxy{scheme: "http", server: first}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if got := <-firstSeen; got != last+" " {
+		t.Errorf("first hop saw CONNECT %q, want the last hop", got)
+	}
+	io.WriteString(conn, "GET http://example.com/ HTTP/1.1\r\n\r\n")
+	got := make([]byte, 4)
+	if _, err := io.ReadFull(conn, got); err != nil || string(got) != "GET " {
+		t.Errorf("connection did not reach the last hop: %q, %v", got, err)
+	}
+}
+
+// TestDialChainHopFailure 某一跳拒绝时返回502，信息中注明是第几跳
+func TestDialChainHopFailure(t *testing.T) {
+	first, _ := recordingHop(t)
+	refusing := newConnectProxy(t, func(*http.Request) string { return "HTTP/1.1 403 Forbidden\r\nContent-Length: 0\r\n\r\n" })
+	withChain(t, &upstreamProxy{scheme: "http", server: refusing.addr})
+
+	_, err := dialChain(connectRequest("example.com:443").Context(), &upstreamProxy{scheme: "http", server: first}, "example.com:443")
+	pe, ok := err.(*proxyError)
+	if !ok {
+		t.Fatalf("error %v, want a *proxyError", err)
+	}
+	if pe.statusCode() != http.StatusBadGateway || !strings.Contains(pe.msg, "hop 2 ("+refusing.addr+") returned 403") {
+		t.Errorf("got %d %q, want 502 naming hop 2", pe.statusCode(), pe.msg)
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+)
+
+// clientKeyCtx 请求上下文中保存客户端标识的key
+type clientKeyCtx struct{}
+
+// clientKey 返回用于会话分配、出口地址选择、日志等的客户端标识，目前为客户端IP，
+// 对端为受信任的下游代理时取转发头部中的实际客户端
+func clientKey(r *http.Request) string {
+	if key := clientKeyFrom(r.Context()); key != "" {
+		return key
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	peer := net.ParseIP(host)
+	if peer == nil {
+		return host
+	}
+	return forwardedClient(r, peer).String()
+}
+
+// withClientKey 将客户端标识存入请求上下文，供拨号和Transport回调等拿不到请求的地方使用
+func withClientKey(r *http.Request) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), clientKeyCtx{}, clientKey(r)))
+}
+
+// clientKeyFrom 取出请求上下文中的客户端标识
+func clientKeyFrom(ctx context.Context) string {
+	key, _ := ctx.Value(clientKeyCtx{}).(string)
+	return key
+}
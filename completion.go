@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// statusWriter 记录转发HTTP请求时写回客户端的状态码和响应字节数
+type statusWriter struct {
+	http.ResponseWriter
+	status  int
+	size    int64
+	aborted bool
+}
+
+// abortMarker 由记录响应的ResponseWriter实现，转发中客户端断开时由forwardHTTP标记，日志据此区分中断的传输
+type abortMarker interface {
+	markAborted()
+}
+
+// markAborted 标记客户端在响应传输中断开，并传给下层同样记录响应的ResponseWriter(访问日志)
+func (w *statusWriter) markAborted() {
+	w.aborted = true
+	if m, ok := w.ResponseWriter.(abortMarker); ok {
+		m.markAborted()
+	}
+}
+
+// WriteHeader 记录状态码
+func (w *statusWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// Write 记录响应字节数
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.size += int64(n)
+	return n, err
+}
+
+// Flush 透传Flush，流式响应依赖它
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// logForwardDone 普通HTTP请求结束时输出状态码、字节数和耗时，5xx为warn；debug级别时附带连接是否复用和新建连接的耗时
+func logForwardDone(r *http.Request, w *statusWriter, info *connInfo, trace *connTrace, start time.Time) {
+	level := levelInfo
+	if w.status >= http.StatusInternalServerError {
+		level = levelWarn
+	}
+	if !logEnabled(level) {
+		return
+	}
+	elapsed := time.Since(start)
+	e := requestEntry(r, "request_done", "")
+	e.Level, e.Status = level, w.status
+	e.BytesUp, e.BytesDown, e.DurationMS = info.up.Load(), w.size, elapsed.Milliseconds()
+	if logEnabled(levelDebug) {
+		e.Conn = trace.timing()
+		if c := e.Conn; c != nil && jsonLog == nil {
+			logfCtx(r.Context(), levelDebug, "[HTTP转发] 连接: reused=%t was_idle=%t idle=%.3fms dns=%.3fms connect=%.3fms tls=%.3fms",
+				c.Reused, c.WasIdle, c.IdleMS, c.DNSMS, c.ConnectMS, c.TLSMS)
+		}
+	}
+	if w.aborted {
+		e.Error = "client closed the connection"
+		logEvent(e, fmt.Sprintf("[HTTP转发] 客户端中断: %s %s 状态 %d 已发送 %d 字节 耗时 %s",
+			r.Method, r.URL, w.status, w.size, elapsed.Round(time.Millisecond)))
+		return
+	}
+	logEvent(e, fmt.Sprintf("[HTTP转发] 完成: %s %s 状态 %d 响应 %d 字节 耗时 %s",
+		r.Method, r.URL, w.status, w.size, elapsed.Round(time.Millisecond)))
+}
+
+// logTunnelResult CONNECT请求建立隧道成功或失败时输出结果和耗时，经由第二级代理时带上代理返回的状态码
+func logTunnelResult(r *http.Request, route string, start time.Time, err error) {
+	level := levelInfo
+	if err != nil {
+		level = levelWarn
+	}
+	if !logEnabled(level) {
+		return
+	}
+	elapsed := time.Since(start)
+	e := requestEntry(r, "tunnel_open", "")
+	e.Level, e.Route, e.Status = level, decisionFor(r, route).kind(), upstreamStatus(r)
+	e.DurationMS, e.Error = elapsed.Milliseconds(), errorString(err)
+
+	line := fmt.Sprintf("[隧道] 已建立: %s 路由 %s", r.Host, e.Route)
+	if err != nil {
+		line = fmt.Sprintf("[隧道] 建立失败: %s 路由 %s 原因 %v", r.Host, e.Route, err)
+	}
+	if e.Status != 0 {
+		line += fmt.Sprintf(" 第二级代理返回 %d", e.Status)
+	}
+	logEvent(e, line+" 耗时 "+elapsed.Round(time.Millisecond).String())
+}
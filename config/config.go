@@ -0,0 +1,137 @@
+// Package config 读取YAML或JSON配置文件并应用到命令行参数上。键名与参数名相同，
+// 嵌套的键以-连接，例如 tls: {cert: a.pem} 等同于 -tls-cert a.pem，列表对应可重复指定的参数；
+// 命令行中显式指定的参数优先于配置文件
+package config
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// fileFlag 指定配置文件本身的参数，不能出现在配置文件中
+const fileFlag = "config"
+
+// Option 配置文件中的一项，Name与命令行参数名相同
+type Option struct {
+	Name   string
+	Values []string
+	Line   int
+}
+
+// Repeatable 可重复指定的参数实现此接口，配置文件中的列表逐项Set，
+// 其他参数的列表按逗号连接后Set一次
+type Repeatable interface {
+	IsRepeatable() bool
+}
+
+// Load 读取path并把其中的配置项应用到fs上，fs中已显式指定的参数保持不变
+func Load(fs *flag.FlagSet, path string) error {
+	options, err := Read(fs, path)
+	if err != nil {
+		return err
+	}
+	explicit := Explicit(fs)
+	for _, o := range options {
+		if explicit[o.Name] {
+			continue
+		}
+		f := fs.Lookup(o.Name)
+		for _, v := range o.FlagValues(f) {
+			if err := f.Value.Set(v); err != nil {
+				return fmt.Errorf("%s:%d: option %q: invalid value %q: %v", path, o.Line, o.Name, v, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Explicit 返回fs中显式指定的参数
+func Explicit(fs *flag.FlagSet) map[string]bool {
+	explicit := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+	return explicit
+}
+
+// FlagValues 返回设置到参数f上的值，不可重复的参数把列表按逗号连接，例如 -trusted-proxies
+func (o Option) FlagValues(f *flag.Flag) []string {
+	if r, ok := f.Value.(Repeatable); (!ok || !r.IsRepeatable()) && len(o.Values) > 1 {
+		return []string{strings.Join(o.Values, ",")}
+	}
+	return o.Values
+}
+
+// Read 解析配置文件，返回展开后的配置项，fs中不存在的配置项报告文件行号
+func Read(fs *flag.FlagSet, path string) ([]Option, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(fs, path, data)
+}
+
+// Parse 解析配置文件的内容，path只用于错误信息
+func Parse(fs *flag.FlagSet, path string, data []byte) ([]Option, error) {
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if len(root.Content) == 0 {
+		return nil, nil
+	}
+	var options []Option
+	if err := collect(fs, path, root.Content[0], "", &options); err != nil {
+		return nil, err
+	}
+	return options, nil
+}
+
+// collect 展开一层映射中的配置项，错误信息注明文件行号和配置项
+func collect(fs *flag.FlagSet, path string, node *yaml.Node, prefix string, options *[]Option) error {
+	if node.Kind != yaml.MappingNode {
+		return fmt.Errorf("%s:%d: expected a mapping of options", path, node.Line)
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, value := node.Content[i], node.Content[i+1]
+		name := key.Value
+		if prefix != "" {
+			name = prefix + "-" + name
+		}
+		if value.Kind == yaml.MappingNode {
+			if err := collect(fs, path, value, name, options); err != nil {
+				return err
+			}
+			continue
+		}
+		if fs.Lookup(name) == nil || name == fileFlag {
+			return fmt.Errorf("%s:%d: unknown option %q", path, key.Line, name)
+		}
+		values, err := nodeValues(value)
+		if err != nil {
+			return fmt.Errorf("%s:%d: option %q: %v", path, value.Line, name, err)
+		}
+		*options = append(*options, Option{Name: name, Values: values, Line: value.Line})
+	}
+	return nil
+}
+
+// nodeValues 取出配置项的值，列表返回每个元素
+func nodeValues(node *yaml.Node) ([]string, error) {
+	switch node.Kind {
+	case yaml.ScalarNode:
+		return []string{node.Value}, nil
+	case yaml.SequenceNode:
+		values := make([]string, 0, len(node.Content))
+		for _, item := range node.Content {
+			if item.Kind != yaml.ScalarNode {
+				return nil, fmt.Errorf("line %d: list items must be plain values", item.Line)
+			}
+			values = append(values, item.Value)
+		}
+		return values, nil
+	}
+	return nil, fmt.Errorf("unsupported value")
+}
@@ -0,0 +1,148 @@
+package config
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// list 可重复指定的参数
+type list []string
+
+func (l *list) String() string     { return strings.Join(*l, ",") }
+func (l *list) Set(v string) error { *l = append(*l, v); return nil }
+func (l *list) IsRepeatable() bool { return true }
+
+// testFlags 与程序中的参数形式相同的一组参数
+type testFlags struct {
+	fs       *flag.FlagSet
+	port     int
+	proxyURL list
+	trusted  string
+	tlsCert  string
+	timeout  time.Duration
+	verbose  bool
+}
+
+func newTestFlags() *testFlags {
+	f := &testFlags{fs: flag.NewFlagSet("test", flag.ContinueOnError)}
+	f.fs.IntVar(&f.port, "proxy-port", 9522, "")
+	f.fs.Var(&f.proxyURL, "proxy-url", "")
+	f.fs.StringVar(&f.trusted, "trusted-proxies", "", "")
+	f.fs.StringVar(&f.tlsCert, "tls-cert", "", "")
+	f.fs.DurationVar(&f.timeout, "dial-timeout", 10*time.Second, "")
+	f.fs.BoolVar(&f.verbose, "verbose", false, "")
+	f.fs.String("config", "", "")
+	return f
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want []Option
+		err  string
+	}{
+		{"empty", "", nil, ""},
+		{"scalars", "proxy-port: 8000\nverbose: true\n", []Option{
+			{Name: "proxy-port", Values: []string{"8000"}, Line: 1},
+			{Name: "verbose", Values: []string{"true"}, Line: 2},
+		}, ""},
+		{"nested keys", "tls:\n  cert: a.pem\n", []Option{{Name: "tls-cert", Values: []string{"a.pem"}, Line: 2}}, ""},
+		{"list", "proxy-url:\n  - a:1\n  - b:2\n", []Option{{Name: "proxy-url", Values: []string{"a:1", "b:2"}, Line: 2}}, ""},
+		{"json", `{"proxy-port": 8001, "tls": {"cert": "b.pem"}}`, []Option{
+			{Name: "proxy-port", Values: []string{"8001"}, Line: 1},
+			{Name: "tls-cert", Values: []string{"b.pem"}, Line: 1},
+		}, ""},
+		{"unknown option", "proxy-port: 1\nbogus: 2\n", nil, `test.yaml:2: unknown option "bogus"`},
+		{"unknown nested option", "tls:\n  key: k.pem\n", nil, `test.yaml:2: unknown option "tls-key"`},
+		{"config is not an option", "config: other.yaml\n", nil, `unknown option "config"`},
+		{"nested list item", "proxy-url:\n  - [a]\n", nil, "list items must be plain values"},
+		{"not a mapping", "- a\n- b\n", nil, "test.yaml:1: expected a mapping of options"},
+		{"syntax error", "proxy-port: [\n", nil, "test.yaml:"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Parse(newTestFlags().fs, "test.yaml", []byte(tt.data))
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("Parse error = %v, want it to contain %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Parse = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func writeConfig(t *testing.T, data string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "web-proxy.yaml")
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// TestLoad 配置文件的值应用到参数上，列表逐项追加或按逗号连接，命令行显式指定的参数优先
+func TestLoad(t *testing.T) {
+	path := writeConfig(t, `
+proxy-port: 8000
+proxy-url: [a:1, b:2]
+trusted-proxies: [10.0.0.0/8, 192.168.0.0/16]
+dial-timeout: 3s
+tls:
+  cert: cert.pem
+`)
+	f := newTestFlags()
+	if err := f.fs.Parse([]string{"-proxy-port", "7000"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := Load(f.fs, path); err != nil {
+		t.Fatal(err)
+	}
+	if f.port != 7000 {
+		t.Errorf("proxy-port = %d, want the command-line value 7000", f.port)
+	}
+	if !reflect.DeepEqual([]string(f.proxyURL), []string{"a:1", "b:2"}) {
+		t.Errorf("proxy-url = %v", f.proxyURL)
+	}
+	if f.trusted != "10.0.0.0/8,192.168.0.0/16" {
+		t.Errorf("trusted-proxies = %q, want the list joined with commas", f.trusted)
+	}
+	if f.timeout != 3*time.Second || f.tlsCert != "cert.pem" {
+		t.Errorf("dial-timeout = %v, tls-cert = %q", f.timeout, f.tlsCert)
+	}
+}
+
+func TestLoadInvalidValue(t *testing.T) {
+	path := writeConfig(t, "proxy-port: 8000\ndial-timeout: soon\n")
+	err := Load(newTestFlags().fs, path)
+	if err == nil || !strings.Contains(err.Error(), ":2: option \"dial-timeout\": invalid value \"soon\"") {
+		t.Errorf("Load error = %v, want the line and option of the invalid value", err)
+	}
+}
+
+func TestLoadMissingFile(t *testing.T) {
+	if err := Load(newTestFlags().fs, filepath.Join(t.TempDir(), "missing.yaml")); !os.IsNotExist(err) {
+		t.Errorf("Load of a missing file = %v, want a not-exist error", err)
+	}
+}
+
+func TestExplicit(t *testing.T) {
+	f := newTestFlags()
+	f.fs.Parse([]string{"-verbose", "-proxy-url", "x:1"})
+	want := map[string]bool{"verbose": true, "proxy-url": true}
+	if got := Explicit(f.fs); !reflect.DeepEqual(got, want) {
+		t.Errorf("Explicit = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// connLimitRetry 超出-max-conns、-max-conns-per-client或-max-conns-per-user时Retry-After的秒数
+const connLimitRetry = 1
+
+var (
+	maxConns          int           // 所有监听同时处理的请求和隧道上限，0表示不限制
+	maxConnsPerClient int           // 每个客户端同时进行的隧道和HTTP请求上限，0表示不限制
+	maxConnsPerUser   int           // 每个账户同时进行的隧道和HTTP请求上限，未启用认证时按客户端IP，0表示不限制
+	clientIPv6Prefix  int           // 统计IPv6客户端时使用的前缀长度，128表示按单个地址
+	connSem           chan struct{} // -max-conns的信号量，为nil表示不限制
+)
+
+// connSlot 一个请求占用的名额：普通HTTP请求在处理函数返回时释放，
+// 建立了隧道时由隧道接手，在隧道结束时释放
+type connSlot struct {
+	client     string      // 计数用的客户端标识
+	clientHeld bool        // 已通过rejectClientLimit占用客户端名额
+	user       string      // 计数用的账户标识，见userLimitKey
+	userHeld   bool        // 已通过rejectUserLimit占用账户名额
+	globalHeld bool        // 已通过rejectOverCapacity占用全局名额
+	tunnel     atomic.Bool // 已由隧道接手
+	once       sync.Once
+}
+
+// connSlotCtx 请求上下文中保存connSlot的key
+type connSlotCtx struct{}
+
+// held 是否占用了任一名额
+func (s *connSlot) held() bool {
+	return s.clientHeld || s.userHeld || s.globalHeld
+}
+
+// release 释放占用的名额，多次调用只释放一次
+func (s *connSlot) release() {
+	s.once.Do(func() {
+		if s.clientHeld {
+			activeConns.releaseClient(s.client)
+		}
+		if s.userHeld {
+			activeConns.releaseUser(s.user)
+		}
+		if s.globalHeld {
+			<-connSem
+			metricConnsInUse.with().Add(-1)
+		}
+	})
+}
+
+// withConnSlot 配置了-max-conns、-max-conns-per-client或-max-conns-per-user时为请求准备名额，
+// 返回的函数在处理函数返回时调用(包括panic时)，请求未被隧道接手时释放名额；需在withAuth之后调用
+func withConnSlot(r *http.Request) (*http.Request, func()) {
+	if connSem == nil && maxConnsPerClient <= 0 && maxConnsPerUser <= 0 {
+		return r, func() {}
+	}
+	s := &connSlot{client: clientLimitKey(clientKey(r)), user: userLimitKey(r)}
+	return r.WithContext(context.WithValue(r.Context(), connSlotCtx{}, s)), func() {
+		if !s.tunnel.Load() {
+			s.release()
+		}
+	}
+}
+
+// takeConnSlot 隧道接手请求的名额，没有名额时返回nil
+func takeConnSlot(ctx context.Context) *connSlot {
+	s, _ := ctx.Value(connSlotCtx{}).(*connSlot)
+	if s == nil || !s.held() {
+		return nil
+	}
+	s.tunnel.Store(true)
+	return s
+}
+
+// rejectOverCapacity 同时处理的请求和隧道已达到-max-conns时立即返回503并返回true，在其他检查之前调用
+func rejectOverCapacity(w http.ResponseWriter, r *http.Request, title string) bool {
+	s, _ := r.Context().Value(connSlotCtx{}).(*connSlot)
+	if s == nil || connSem == nil {
+		return false
+	}
+	select {
+	case connSem <- struct{}{}:
+		s.globalHeld = true
+		metricConnsInUse.with().Add(1)
+		return false
+	default:
+	}
+	logfCtx(r.Context(), levelWarn, "[%s] 同时处理的连接数已达上限 %d，拒绝客户端 %s 的请求 %s", title, maxConns, clientKey(r), r.Host)
+	w.Header().Set("Retry-After", strconv.Itoa(connLimitRetry))
+	writeProxyError(w, http.StatusServiceUnavailable, reasonOverloaded, r.Host, "Proxy is at its connection limit, retry later")
+	return true
+}
+
+// rejectClientLimit 客户端正在进行的隧道和HTTP请求已达到-max-conns-per-client时返回429并返回true，
+// 需在拨号之前调用
+func rejectClientLimit(w http.ResponseWriter, r *http.Request, title string) bool {
+	s, _ := r.Context().Value(connSlotCtx{}).(*connSlot)
+	if s == nil || maxConnsPerClient <= 0 {
+		return false
+	}
+	if !activeConns.acquireClient(s.client, maxConnsPerClient) {
+		logfCtx(r.Context(), levelWarn, "[%s] 客户端 %s 的连接数已达上限 %d，拒绝请求 %s", title, s.client, maxConnsPerClient, r.Host)
+		w.Header().Set("Retry-After", strconv.Itoa(connLimitRetry))
+		writeProxyError(w, http.StatusTooManyRequests, reasonQuotaExceeded, r.Host, "Too many concurrent connections from this client, retry later")
+		return true
+	}
+	s.clientHeld = true
+	return false
+}
+
+// rejectUserLimit 账户正在进行的隧道和HTTP请求已达到-max-conns-per-user时返回429并返回true，
+// 名额由所有监听共用，需在拨号之前调用
+func rejectUserLimit(w http.ResponseWriter, r *http.Request, title string) bool {
+	s, _ := r.Context().Value(connSlotCtx{}).(*connSlot)
+	if s == nil || maxConnsPerUser <= 0 {
+		return false
+	}
+	if !activeConns.acquireUser(s.user, maxConnsPerUser) {
+		logfCtx(r.Context(), levelWarn, "[%s] 账户 %s 的连接数已达上限 %d，拒绝请求 %s", title, s.user, maxConnsPerUser, r.Host)
+		w.Header().Set("Retry-After", strconv.Itoa(connLimitRetry))
+		writeProxyError(w, http.StatusTooManyRequests, reasonQuotaExceeded, r.Host, "Too many concurrent connections for this user, retry later")
+		return true
+	}
+	s.userHeld = true
+	return false
+}
+
+// userLimitKey 按账户计数使用的标识：通过认证的账户名，使用客户端证书时为证书名，
+// 未启用认证时为按clientLimitKey归并的客户端IP
+func userLimitKey(r *http.Request) string {
+	if user := authUser(r); user != "" {
+		return user
+	}
+	if cert := clientCertName(r); cert != "" {
+		return cert
+	}
+	return clientLimitKey(clientKey(r))
+}
+
+// setupConnLimit 校验-max-conns、-max-conns-per-client、-max-conns-per-user和-max-conns-ipv6-prefix，配置了-max-conns时创建信号量
+func setupConnLimit() error {
+	if maxConns < 0 {
+		return fmt.Errorf("invalid -max-conns %d, want 0 or more", maxConns)
+	}
+	if maxConnsPerClient < 0 {
+		return fmt.Errorf("invalid -max-conns-per-client %d, want 0 or more", maxConnsPerClient)
+	}
+	if maxConnsPerUser < 0 {
+		return fmt.Errorf("invalid -max-conns-per-user %d, want 0 or more", maxConnsPerUser)
+	}
+	if clientIPv6Prefix < 0 || clientIPv6Prefix > 128 {
+		return fmt.Errorf("invalid -max-conns-ipv6-prefix %d, want 0-128", clientIPv6Prefix)
+	}
+	if maxConns > 0 {
+		connSem = make(chan struct{}, maxConns)
+		metricConnsLimit.with().Store(int64(maxConns))
+	}
+	return nil
+}
+
+// connsInUse 返回-max-conns已占用的名额，未限制时为0
+func connsInUse() int {
+	return len(connSem)
+}
+
+// clientLimitKey 计数使用的客户端标识，IPv6地址按-max-conns-ipv6-prefix归并到同一网段
+func clientLimitKey(client string) string {
+	ip := net.ParseIP(client)
+	if ip == nil || ip.To4() != nil || clientIPv6Prefix >= 128 {
+		return client
+	}
+	return (&net.IPNet{IP: ip.Mask(net.CIDRMask(clientIPv6Prefix, 128)), Mask: net.CIDRMask(clientIPv6Prefix, 128)}).String()
+}
+
+// setupUsage 注册 /usage
+func setupUsage() {
+	adminMux.HandleFunc("/usage", serveUsage)
+}
+
+// serveUsage 以JSON返回每个账户(未启用认证时为客户端IP)当前占用的-max-conns-per-user名额，
+// max_conns_per_user为0表示不限制，此时users为空
+func serveUsage(w http.ResponseWriter, r *http.Request) {
+	if rejectAdmin(w, r) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		MaxConnsPerUser int            `json:"max_conns_per_user"`
+		Users           map[string]int `json:"users"`
+	}{maxConnsPerUser, activeConns.userCounts()})
+}
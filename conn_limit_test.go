@@ -0,0 +1,296 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// withConnLimits 在测试期间使用给定的-max-conns、-max-conns-per-client和-max-conns-ipv6-prefix
+func withConnLimits(t *testing.T, global, perClient, prefix int) {
+	t.Helper()
+	savedMax, savedPer, savedPrefix, savedSem := maxConns, maxConnsPerClient, clientIPv6Prefix, connSem
+	t.Cleanup(func() {
+		maxConns, maxConnsPerClient, clientIPv6Prefix, connSem = savedMax, savedPer, savedPrefix, savedSem
+	})
+	maxConns, maxConnsPerClient, clientIPv6Prefix, connSem = global, perClient, prefix, nil
+	if err := setupConnLimit(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// limitedRequest 构造来自remote的请求并准备名额
+func limitedRequest(remote string) (*http.Request, func()) {
+	r := httptest.NewRequest(http.MethodConnect, "http://example.com:443", nil)
+	r.RemoteAddr = remote
+	return withConnSlot(withClientKey(r))
+}
+
+func TestClientLimitKey(t *testing.T) {
+	withConnLimits(t, 0, 1, 64)
+	tests := []struct{ client, want string }{
+		{"192.0.2.1", "192.0.2.1"},
+		{"2001:db8:1:2:aaaa::1", "2001:db8:1:2::/64"},
+		{"2001:db8:1:2:bbbb::2", "2001:db8:1:2::/64"},
+		{"not-an-ip", "not-an-ip"},
+	}
+	for _, tt := range tests {
+		if got := clientLimitKey(tt.client); got != tt.want {
+			t.Errorf("clientLimitKey(%q) = %q, want %q", tt.client, got, tt.want)
+		}
+	}
+	clientIPv6Prefix = 128
+	if got := clientLimitKey("2001:db8::1"); got != "2001:db8::1" {
+		t.Errorf("clientLimitKey with /128 = %q", got)
+	}
+}
+
+// TestClientConnLimit 同一客户端(IPv6按网段)超出-max-conns-per-client时返回429，名额释放后恢复，其他客户端不受影响
+func TestClientConnLimit(t *testing.T) {
+	withConnLimits(t, 0, 2, 64)
+	var releases []func()
+	for i := 0; i < 2; i++ {
+		r, release := limitedRequest("[2001:db8:1:2::" + string(rune('a'+i)) + "]:1000")
+		releases = append(releases, release)
+		if rejectClientLimit(httptest.NewRecorder(), r, "test") {
+			t.Fatalf("request %d within the limit rejected", i)
+		}
+	}
+
+	r, release := limitedRequest("[2001:db8:1:2::ff]:1000")
+	w := httptest.NewRecorder()
+	if !rejectClientLimit(w, r, "test") || w.Code != http.StatusTooManyRequests {
+		t.Fatalf("third request from the same /64: status %d, want 429", w.Code)
+	}
+	if w.Header().Get("Retry-After") != "1" {
+		t.Errorf("Retry-After %q", w.Header().Get("Retry-After"))
+	}
+	release()
+
+	other, releaseOther := limitedRequest("192.0.2.1:1000")
+	defer releaseOther()
+	if rejectClientLimit(httptest.NewRecorder(), other, "test") {
+		t.Error("another client was rejected")
+	}
+
+	releases[0]()
+	releases[0]() // 多次释放只计一次
+	r, release = limitedRequest("[2001:db8:1:2::1]:1000")
+	defer release()
+	if rejectClientLimit(httptest.NewRecorder(), r, "test") {
+		t.Error("request rejected after a slot was released")
+	}
+	r, release2 := limitedRequest("[2001:db8:1:2::2]:1000")
+	defer release2()
+	if !rejectClientLimit(httptest.NewRecorder(), r, "test") {
+		t.Error("double release freed two slots")
+	}
+	releases[1]()
+}
+
+func TestSetupConnLimit(t *testing.T) {
+	tests := []struct {
+		global, perClient, prefix int
+		ok                        bool
+	}{
+		{0, 0, 128, true},
+		{10, 2, 64, true},
+		{-1, 0, 128, false},
+		{0, -1, 128, false},
+		{0, 0, 129, false},
+		{0, 0, -1, false},
+	}
+	for _, tt := range tests {
+		savedMax, savedPer, savedPrefix, savedSem := maxConns, maxConnsPerClient, clientIPv6Prefix, connSem
+		maxConns, maxConnsPerClient, clientIPv6Prefix, connSem = tt.global, tt.perClient, tt.prefix, nil
+		err := setupConnLimit()
+		if (err == nil) != tt.ok {
+			t.Errorf("setupConnLimit(%d, %d, /%d) error = %v, want ok %v", tt.global, tt.perClient, tt.prefix, err, tt.ok)
+		}
+		if tt.ok && (connSem != nil) != (tt.global > 0) {
+			t.Errorf("-max-conns %d: semaphore created = %v", tt.global, connSem != nil)
+		}
+		maxConns, maxConnsPerClient, clientIPv6Prefix, connSem = savedMax, savedPer, savedPrefix, savedSem
+	}
+}
+
+// TestGlobalConnLimit 超出-max-conns时返回503和Retry-After；普通请求在处理函数返回时释放名额，
+// 被隧道接手的名额在隧道结束时才释放
+func TestGlobalConnLimit(t *testing.T) {
+	withConnLimits(t, 2, 0, 128)
+	first, releaseFirst := limitedRequest("192.0.2.1:1000")
+	if rejectOverCapacity(httptest.NewRecorder(), first, "test") {
+		t.Fatal("first request rejected")
+	}
+	tunnel, releaseTunnel := limitedRequest("192.0.2.2:1000")
+	if rejectOverCapacity(httptest.NewRecorder(), tunnel, "test") {
+		t.Fatal("second request rejected")
+	}
+	slot := takeConnSlot(tunnel.Context())
+	if slot == nil {
+		t.Fatal("tunnel did not take over the slot")
+	}
+	if connsInUse() != 2 {
+		t.Fatalf("connsInUse = %d, want 2", connsInUse())
+	}
+
+	over, releaseOver := limitedRequest("192.0.2.3:1000")
+	w := httptest.NewRecorder()
+	if !rejectOverCapacity(w, over, "test") || w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("request over -max-conns: status %d, want 503", w.Code)
+	}
+	if w.Header().Get("Retry-After") != "1" {
+		t.Errorf("Retry-After %q", w.Header().Get("Retry-After"))
+	}
+	releaseOver()
+	if connsInUse() != 2 {
+		t.Errorf("rejected request changed connsInUse to %d", connsInUse())
+	}
+
+	releaseFirst()
+	releaseTunnel()
+	if connsInUse() != 1 {
+		t.Errorf("connsInUse = %d after the handlers returned, want 1 held by the tunnel", connsInUse())
+	}
+	slot.release()
+	if connsInUse() != 0 {
+		t.Errorf("connsInUse = %d after the tunnel ended, want 0", connsInUse())
+	}
+}
+
+// withUserLimit 在测试期间使用给定的-max-conns-per-user
+func withUserLimit(t *testing.T, limit int) {
+	t.Helper()
+	saved := maxConnsPerUser
+	t.Cleanup(func() { maxConnsPerUser = saved })
+	maxConnsPerUser = limit
+	if err := setupConnLimit(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// userTunnel 以user的身份经由proxy建立到target的隧道，返回连接和响应状态码
+func userTunnel(t *testing.T, proxy, target, user string) (net.Conn, int) {
+	t.Helper()
+	auth := base64.StdEncoding.EncodeToString([]byte(user + ":pw"))
+	conn, br := rawRequest(t, proxy, "CONNECT "+target+" HTTP/1.1\r\nHost: "+target+"\r\nProxy-Authorization: Basic "+auth+"\r\n\r\n")
+	resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn, resp.StatusCode
+}
+
+// usageCounts 返回 /usage 中每个账户占用的名额
+func usageCounts(t *testing.T) map[string]int {
+	t.Helper()
+	w := httptest.NewRecorder()
+	serveUsage(w, adminRequest(http.MethodGet, "/usage", ""))
+	var usage struct {
+		Users map[string]int `json:"users"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&usage); err != nil {
+		t.Fatal(err)
+	}
+	return usage.Users
+}
+
+// TestUserConnLimit 同一账户在两个监听上保持-max-conns-per-user个隧道时，下一个隧道返回429，其他账户不受影响；
+// 隧道关闭后名额释放
+func TestUserConnLimit(t *testing.T) {
+	withConnLimits(t, 0, 0, 128)
+	withUserLimit(t, 2)
+	saved := authStore.Load()
+	t.Cleanup(func() { authStore.Store(saved) })
+	authStore.Store(&credentialStore{users: map[string]credential{"alice": {secret: "pw"}, "bob": {secret: "pw"}}})
+	echo := newEchoServer(t)
+	first := httptest.NewServer(directHandler("正向代理"))
+	t.Cleanup(first.Close)
+	second := httptest.NewServer(directHandler("规则代理"))
+	t.Cleanup(second.Close)
+
+	var held []net.Conn
+	for _, proxy := range []string{first.Listener.Addr().String(), second.Listener.Addr().String()} {
+		conn, status := userTunnel(t, proxy, echo, "alice")
+		if status != http.StatusOK {
+			t.Fatalf("alice tunnel within the limit: status %d, want 200", status)
+		}
+		held = append(held, conn)
+	}
+	conn, status := userTunnel(t, second.Listener.Addr().String(), echo, "alice")
+	conn.Close()
+	if status != http.StatusTooManyRequests {
+		t.Errorf("third alice tunnel: status %d, want 429", status)
+	}
+	bob, status := userTunnel(t, first.Listener.Addr().String(), echo, "bob")
+	if status != http.StatusOK {
+		t.Errorf("bob tunnel: status %d, want 200", status)
+	}
+	if usage := usageCounts(t); usage["alice"] != 2 || usage["bob"] != 1 {
+		t.Errorf("/usage users = %v, want alice 2 and bob 1", usage)
+	}
+
+	held[0].Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for usageCounts(t)["alice"] != 1 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	conn, status = userTunnel(t, second.Listener.Addr().String(), echo, "alice")
+	if status != http.StatusOK {
+		t.Errorf("alice tunnel after one closed: status %d, want 200", status)
+	}
+	for _, c := range []net.Conn{conn, held[1], bob} {
+		c.Close()
+	}
+	for len(usageCounts(t)) != 0 && time.Now().Before(deadline.Add(2*time.Second)) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if usage := usageCounts(t); len(usage) != 0 {
+		t.Errorf("/usage users = %v after every tunnel closed, want none", usage)
+	}
+}
+
+// TestUserConnLimitPanic 处理函数panic时账户名额照样释放；未启用认证时按客户端IP计数
+func TestUserConnLimitPanic(t *testing.T) {
+	withConnLimits(t, 0, 0, 128)
+	withUserLimit(t, 1)
+	saved := authStore.Load()
+	t.Cleanup(func() { authStore.Store(saved) })
+	authStore.Store(nil)
+
+	h := withRecovery("test", func(w http.ResponseWriter, r *http.Request) {
+		r, release := withConnSlot(withClientKey(r))
+		defer release()
+		if !rejectUserLimit(w, r, "test") {
+			panic("boom")
+		}
+	})
+	captureLog(t)
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		r.RemoteAddr = "192.0.2.1:1000"
+		h.ServeHTTP(w, r)
+		if w.Code != http.StatusBadGateway {
+			t.Fatalf("request %d: status %d, want the 502 from the recovered panic", i, w.Code)
+		}
+	}
+	if usage := usageCounts(t); len(usage) != 0 {
+		t.Errorf("/usage users = %v after the panics, want none", usage)
+	}
+
+	r, release := limitedRequest("192.0.2.1:1000")
+	defer release()
+	if rejectUserLimit(httptest.NewRecorder(), r, "test") {
+		t.Fatal("first request from the IP rejected")
+	}
+	other, releaseOther := limitedRequest("192.0.2.1:2000")
+	defer releaseOther()
+	if w := httptest.NewRecorder(); !rejectUserLimit(w, other, "test") || w.Code != http.StatusTooManyRequests {
+		t.Errorf("second request from the same IP without auth: status %d, want 429", w.Code)
+	}
+}
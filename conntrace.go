@@ -0,0 +1,112 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptrace"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// connTrace 通过httptrace记录转发普通HTTP请求时取得的连接：是否复用了连接池中的空闲连接，
+// 以及新建连接时解析、连接和TLS握手的耗时；回调可能来自Transport的拨号goroutine，由mu保护
+type connTrace struct {
+	route string
+
+	mu       sync.Mutex
+	got      bool // 已取得连接
+	reused   bool
+	wasIdle  bool
+	idleTime time.Duration
+
+	dnsStart, connectStart, tlsStart time.Time
+	dns, connect, tlsHandshake       time.Duration
+}
+
+// connTiming debug级别时request_done事件的conn字段
+type connTiming struct {
+	Reused    bool    `json:"reused"`
+	WasIdle   bool    `json:"was_idle"`
+	IdleMS    float64 `json:"idle_ms,omitempty"`
+	DNSMS     float64 `json:"dns_ms,omitempty"`
+	ConnectMS float64 `json:"connect_ms,omitempty"`
+	TLSMS     float64 `json:"tls_ms,omitempty"`
+}
+
+// attach 在出站请求上附加httptrace，取得连接和新建连接的各阶段结束时同时记录指标
+func (c *connTrace) attach(r *http.Request, route string) *http.Request {
+	c.route = route
+	return r.WithContext(httptrace.WithClientTrace(r.Context(), &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) { c.start(&c.dnsStart) },
+		DNSDone: func(info httptrace.DNSDoneInfo) {
+			if info.Err == nil {
+				c.done(&c.dnsStart, &c.dns, "dns")
+			}
+		},
+		ConnectStart: func(string, string) { c.start(&c.connectStart) },
+		ConnectDone: func(_, _ string, err error) {
+			if err == nil {
+				c.done(&c.connectStart, &c.connect, "connect")
+			}
+		},
+		TLSHandshakeStart: func() { c.start(&c.tlsStart) },
+		TLSHandshakeDone: func(_ tls.ConnectionState, err error) {
+			if err == nil {
+				c.done(&c.tlsStart, &c.tlsHandshake, "tls")
+			}
+		},
+		GotConn: c.gotConn,
+	}))
+}
+
+// start 记录一个阶段开始的时间，并行拨号多个地址时以第一次开始为准
+func (c *connTrace) start(at *time.Time) {
+	c.mu.Lock()
+	if at.IsZero() {
+		*at = time.Now()
+	}
+	c.mu.Unlock()
+}
+
+// done 记录一个阶段的耗时并计入拨号耗时直方图，每个阶段只记录第一次成功
+func (c *connTrace) done(at *time.Time, d *time.Duration, phase string) {
+	c.mu.Lock()
+	if at.IsZero() || *d != 0 {
+		c.mu.Unlock()
+		return
+	}
+	*d = time.Since(*at)
+	elapsed := *d
+	c.mu.Unlock()
+	metricHTTPDial.observe(elapsed, c.route, phase)
+}
+
+// gotConn 记录取得的连接是否复用，按复用与否计数，复用的空闲连接记录其空闲时长
+func (c *connTrace) gotConn(info httptrace.GotConnInfo) {
+	c.mu.Lock()
+	c.got, c.reused, c.wasIdle, c.idleTime = true, info.Reused, info.WasIdle, info.IdleTime
+	c.mu.Unlock()
+	metricHTTPConns.with(c.route, strconv.FormatBool(info.Reused)).Add(1)
+	if info.WasIdle {
+		metricHTTPConnIdle.observe(info.IdleTime, c.route)
+	}
+}
+
+// timing 返回记录的连接信息，未取得连接时返回nil
+func (c *connTrace) timing() *connTiming {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.got {
+		return nil
+	}
+	ms := func(d time.Duration) float64 { return float64(d.Microseconds()) / 1000 }
+	return &connTiming{
+		Reused:    c.reused,
+		WasIdle:   c.wasIdle,
+		IdleMS:    ms(c.idleTime),
+		DNSMS:     ms(c.dns),
+		ConnectMS: ms(c.connect),
+		TLSMS:     ms(c.tlsHandshake),
+	}
+}
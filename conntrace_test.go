@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// withJSONLog 在测试期间以JSON格式输出指定级别及以上的日志，返回写入的缓冲
+func withJSONLog(t *testing.T, level string) *syncBuffer {
+	t.Helper()
+	savedLog, savedLevel := jsonLog, minLogLevel
+	t.Cleanup(func() { jsonLog, minLogLevel = savedLog, savedLevel })
+	buf := &syncBuffer{}
+	jsonLog = &jsonLogWriter{out: buf}
+	if err := setupLogging(logFormatText, level); err != nil {
+		t.Fatal(err)
+	}
+	return buf
+}
+
+// TestConnTraceReused 对同一源站的第二个请求复用第一个请求的连接，request_done的conn字段和指标都如实记录
+func TestConnTraceReused(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello")
+	}))
+	t.Cleanup(origin.Close)
+	logs := withJSONLog(t, levelDebug)
+	srv := httptest.NewServer(directHandler("正向代理"))
+	t.Cleanup(srv.Close)
+
+	reused, fresh := metricHTTPConns.with(routeDirect, "true"), metricHTTPConns.with(routeDirect, "false")
+	beforeReused, beforeFresh := reused.Load(), fresh.Load()
+	beforeConnect := metricHTTPDial.count(routeDirect, "connect")
+	client := proxyClient(srv.URL)
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get(origin.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+
+	// request_done在处理函数返回时输出，可能晚于客户端读完响应
+	deadline := time.Now().Add(2 * time.Second)
+	for strings.Count(logs.String(), `"event":"request_done"`) < 2 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	var conns []*connTiming
+	for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+		var e logEntry
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatalf("bad log line %q: %v", line, err)
+		}
+		if e.Event == "request_done" {
+			conns = append(conns, e.Conn)
+		}
+	}
+	if len(conns) != 2 || conns[0] == nil || conns[1] == nil {
+		t.Fatalf("request_done conn fields = %v, want two", conns)
+	}
+	if conns[0].Reused || !conns[1].Reused || !conns[1].WasIdle {
+		t.Errorf("conn fields = %+v, %+v, want a new connection then reused=true", conns[0], conns[1])
+	}
+	if dn, rn := fresh.Load()-beforeFresh, reused.Load()-beforeReused; dn != 1 || rn != 1 {
+		t.Errorf("webproxy_http_conns_total grew by reused=false %d, reused=true %d, want 1 and 1", dn, rn)
+	}
+	if n := metricHTTPDial.count(routeDirect, "connect") - beforeConnect; n != 1 {
+		t.Errorf("connect phase observed %d times, want 1", n)
+	}
+
+	w := httptest.NewRecorder()
+	serveMetrics(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	for _, want := range []string{
+		`webproxy_http_dial_duration_seconds_bucket{route="direct",phase="connect",le="+Inf"} `,
+		`webproxy_http_dial_duration_seconds_count{route="direct",phase="connect"} `,
+		`webproxy_http_conn_idle_seconds_bucket{route="direct",le="0.01"} `,
+	} {
+		if !strings.Contains(w.Body.String(), want) {
+			t.Errorf("/metrics is missing %s", want)
+		}
+	}
+}
+
+// TestConnTraceInfoLevel info级别时request_done不带conn字段
+func TestConnTraceInfoLevel(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	t.Cleanup(origin.Close)
+	logs := withJSONLog(t, levelInfo)
+	srv := httptest.NewServer(directHandler("正向代理"))
+	t.Cleanup(srv.Close)
+	resp, err := proxyClient(srv.URL).Get(origin.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if strings.Contains(logs.String(), `"conn"`) {
+		t.Errorf("conn field logged at info level:\n%s", logs)
+	}
+}
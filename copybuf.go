@@ -0,0 +1,34 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync"
+)
+
+// copyBufferSize transfer每个方向使用的缓冲区大小
+var copyBufferSize int
+
+// copyBuffers transfer复用的缓冲区，大小固定为copyBufferSize
+var copyBuffers = sync.Pool{
+	New: func() any {
+		buf := make([]byte, copyBufferSize)
+		return &buf
+	},
+}
+
+// validateCopyBufferSize 校验-copy-buffer-size
+func validateCopyBufferSize() error {
+	if copyBufferSize < 1024 {
+		return fmt.Errorf("invalid -copy-buffer-size %d, want at least 1024", copyBufferSize)
+	}
+	return nil
+}
+
+// copyPooled 使用池中的缓冲区将src复制到dst，返回前将缓冲区放回池中；
+// dst包装为只有Write的类型，避免io.CopyBuffer改用dst的ReadFrom而另外分配缓冲区
+func copyPooled(dst io.Writer, src io.Reader) (int64, error) {
+	buf := copyBuffers.Get().(*[]byte)
+	defer copyBuffers.Put(buf)
+	return io.CopyBuffer(struct{ io.Writer }{dst}, src, *buf)
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"testing"
+)
+
+// BenchmarkCopy 比较copyPooled与io.Copy的吞吐和每次复制的分配；
+// src和dst都包装为只有Read和Write的类型，两者都经过缓冲区复制，io.Copy每次分配32KB
+func BenchmarkCopy(b *testing.B) {
+	copies := []struct {
+		name string
+		copy func(io.Writer, io.Reader) (int64, error)
+	}{
+		{"io.Copy", io.Copy},
+		{"copyPooled", copyPooled},
+	}
+	for _, size := range []int{4 << 10, 64 << 10, 1 << 20} {
+		data := bytes.Repeat([]byte("x"), size)
+		for _, c := range copies {
+			b.Run(fmt.Sprintf("%s/%dKB", c.name, size>>10), func(b *testing.B) {
+				b.ReportAllocs()
+				b.SetBytes(int64(size))
+				r := bytes.NewReader(data)
+				for i := 0; i < b.N; i++ {
+					r.Reset(data)
+					if _, err := c.copy(struct{ io.Writer }{io.Discard}, struct{ io.Reader }{r}); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 请求处理的各个阶段，超出预算时在504响应中注明
+const (
+	phaseResolve           = "resolve"
+	phaseDial              = "dial"
+	phaseUpstreamDial      = "upstream_dial"
+	phaseUpstreamHandshake = "upstream_handshake"
+	phaseTLS               = "tls"
+	phaseResponse          = "response"
+)
+
+// budgetKey 请求上下文中保存requestBudget的key
+type budgetKey struct{}
+
+// requestBudget 一个代理请求的整体时间预算，记录当前所处的阶段
+type requestBudget struct {
+	limit   time.Duration
+	timer   *time.Timer
+	expired atomic.Bool
+
+	mu    sync.Mutex
+	phase string
+}
+
+// withBudget 为请求附加时间预算，CONNECT使用建立隧道的预算，普通HTTP请求使用请求预算；
+// 预算耗尽或客户端断开时请求上下文都会被取消。limit为0时不限制
+func withBudget(r *http.Request) (*http.Request, context.CancelFunc) {
+	limit := requestTimeout
+	if r.Method == http.MethodConnect {
+		limit = connectTimeout
+	}
+	if limit <= 0 {
+		return r, func() {}
+	}
+
+	ctx, cancel := context.WithCancel(r.Context())
+	b := &requestBudget{limit: limit}
+	b.timer = time.AfterFunc(limit, func() {
+		b.expired.Store(true)
+		cancel()
+	})
+	ctx = context.WithValue(ctx, budgetKey{}, b)
+	return r.WithContext(ctx), func() {
+		b.timer.Stop()
+		cancel()
+	}
+}
+
+// budgetFrom 取出请求上下文中的时间预算
+func budgetFrom(ctx context.Context) *requestBudget {
+	b, _ := ctx.Value(budgetKey{}).(*requestBudget)
+	return b
+}
+
+// setPhase 记录请求当前所处的阶段
+func setPhase(ctx context.Context, phase string) {
+	if b := budgetFrom(ctx); b != nil {
+		b.mu.Lock()
+		b.phase = phase
+		b.mu.Unlock()
+	}
+}
+
+// stopBudget 连接建立或响应头到达后停止计时，之后的数据传输不受预算限制
+func stopBudget(ctx context.Context) {
+	if b := budgetFrom(ctx); b != nil {
+		b.timer.Stop()
+	}
+}
+
+// writeBudgetError 如果请求因预算耗尽而失败，返回504并注明超时阶段，已写入响应时返回true
+func writeBudgetError(w http.ResponseWriter, r *http.Request) bool {
+	b := budgetFrom(r.Context())
+	if b == nil || !b.expired.Load() {
+		return false
+	}
+	b.mu.Lock()
+	phase := b.phase
+	b.mu.Unlock()
+
+	reason := reasonRequestTimeout
+	if phase == phaseDial || phase == phaseUpstreamDial {
+		reason = reasonDialTimeout
+	}
+	writeProxyError(w, http.StatusGatewayTimeout, reason, requestTarget(r), fmt.Sprintf("Request exceeded its %s budget during %s", b.limit, phase))
+	return true
+}
+
+// watchConn 在ctx取消时中断conn上阻塞的读写，返回的函数用于解除监视
+func watchConn(ctx context.Context, conn net.Conn) func() bool {
+	return context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Unix(1, 0))
+	})
+}
+
+// withPhaseTrace 通过httptrace记录Transport内部的解析、拨号、TLS握手和等待响应阶段
+func withPhaseTrace(r *http.Request) *http.Request {
+	if budgetFrom(r.Context()) == nil {
+		return r
+	}
+	ctx := r.Context()
+	trace := &httptrace.ClientTrace{
+		DNSStart:          func(httptrace.DNSStartInfo) { setPhase(ctx, phaseResolve) },
+		ConnectStart:      func(string, string) { setPhase(ctx, phaseDial) },
+		TLSHandshakeStart: func() { setPhase(ctx, phaseTLS) },
+		TLSHandshakeDone:  func(tls.ConnectionState, error) { setPhase(ctx, phaseResponse) },
+		WroteRequest:      func(httptrace.WroteRequestInfo) { setPhase(ctx, phaseResponse) },
+	}
+	return r.WithContext(httptrace.WithClientTrace(ctx, trace))
+}
+
+// forwardErrorHandler 返回转发普通HTTP请求失败时的错误处理函数，将转发错误包装为proxyError后写入错误响应，
+// upstream表示请求是否经由第二级代理
+func forwardErrorHandler(upstream bool) func(http.ResponseWriter, *http.Request, error) {
+	return func(w http.ResponseWriter, r *http.Request, err error) {
+		pe := newProxyError(upstream, "Failed to forward the request", err)
+		if pe.kind != kindDialTimeout && pe.kind != kindPolicyDenied && pe.kind != kindBadTarget {
+			pe.status = http.StatusBadGateway
+		}
+		errorLog.PrintfCtx(r.Context(), "forward", r.Host, "[HTTP转发] 请求 %s 失败(%s): %v", r.Host, pe.kind, err)
+		writeFailure(w, r, pe)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestRequestBudget 响应头在-request-timeout内未到达时返回504并注明阶段，响应头到达后的传输不受预算限制
+func TestRequestBudget(t *testing.T) {
+	saved := requestTimeout
+	t.Cleanup(func() { requestTimeout = saved })
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/slow-headers":
+			time.Sleep(300 * time.Millisecond)
+		case "/slow-body":
+			w.WriteHeader(http.StatusOK)
+			w.(http.Flusher).Flush()
+			time.Sleep(300 * time.Millisecond)
+		}
+		io.WriteString(w, "done")
+	}))
+	defer origin.Close()
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r, cancel := withBudget(withClientKey(r))
+		defer cancel()
+		handleDirectHTTP(w, r)
+	}))
+	defer proxy.Close()
+
+	tests := []struct {
+		path    string
+		timeout time.Duration
+		status  int
+		reason  string
+		body    string
+	}{
+		{"/slow-headers", 100 * time.Millisecond, http.StatusGatewayTimeout, string(reasonRequestTimeout), "budget during response"},
+		{"/slow-headers", 0, http.StatusOK, "", "done"},
+		{"/slow-body", 100 * time.Millisecond, http.StatusOK, "", "done"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path+"/"+tt.timeout.String(), func(t *testing.T) {
+			requestTimeout = tt.timeout
+			resp, err := proxyClient(proxy.URL).Get(origin.URL + tt.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != tt.status {
+				t.Errorf("status %d, want %d", resp.StatusCode, tt.status)
+			}
+			if got := resp.Header.Get("X-WebProxy-Error"); got != tt.reason {
+				t.Errorf("X-WebProxy-Error %q, want %q", got, tt.reason)
+			}
+			if !strings.Contains(string(body), tt.body) {
+				t.Errorf("body %q, want %q", body, tt.body)
+			}
+		})
+	}
+}
+
+// TestBudgetPhaseReason 拨号阶段耗尽预算时原因为dial_timeout，其他阶段为request_timeout
+func TestBudgetPhaseReason(t *testing.T) {
+	saved := requestTimeout
+	t.Cleanup(func() { requestTimeout = saved })
+	requestTimeout = time.Millisecond
+	tests := []struct {
+		phase  string
+		reason errorReason
+	}{
+		{phaseDial, reasonDialTimeout},
+		{phaseUpstreamDial, reasonDialTimeout},
+		{phaseResolve, reasonRequestTimeout},
+		{phaseTLS, reasonRequestTimeout},
+		{phaseResponse, reasonRequestTimeout},
+	}
+	for _, tt := range tests {
+		r, cancel := withBudget(httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+		setPhase(r.Context(), tt.phase)
+		<-r.Context().Done()
+		w := httptest.NewRecorder()
+		if !writeBudgetError(w, r) {
+			t.Fatalf("%s: expired budget not reported", tt.phase)
+		}
+		if got := w.Header().Get("X-WebProxy-Error"); got != string(tt.reason) {
+			t.Errorf("%s: reason %q, want %q", tt.phase, got, tt.reason)
+		}
+		cancel()
+	}
+}
+
+// proxyClient 经由proxyURL发送请求的客户端，不复用连接
+func proxyClient(proxyURL string) *http.Client {
+	u, _ := url.Parse(proxyURL)
+	return &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(u), DisableKeepAlives: true}}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+)
+
+// newDebugServer 创建提供pprof的调试监听服务，与代理和管理接口完全分开，配置了管理接口认证时同样要求认证，
+// 未配置-debug-addr时返回nil
+func newDebugServer() (*proxyServer, error) {
+	if debugAddr == "" {
+		return nil, nil
+	}
+	if err := validateDebugAddr(debugAddr, debugAllowRemote); err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.HandleFunc("/debug/goroutines", serveGoroutineCount)
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		if rejectAdminAuth(w, r) {
+			return
+		}
+		mux.ServeHTTP(w, r)
+	}
+	return &proxyServer{title: "调试", server: &http.Server{
+		Addr:    debugAddr,
+		Handler: withRecovery("调试", handler),
+	}}, nil
+}
+
+// validateDebugAddr 校验-debug-addr，未开启-debug-allow-remote时只允许本机回环地址
+func validateDebugAddr(addr string, allowRemote bool) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("invalid -debug-addr %q, want host:port", addr)
+	}
+	if allowRemote {
+		return nil
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return fmt.Errorf("-debug-addr %q is not a loopback address, use 127.0.0.1:port or add -debug-allow-remote", addr)
+	}
+	return nil
+}
+
+// serveGoroutineCount 返回当前的goroutine数量和隧道数量，便于对照判断转发goroutine是否泄漏
+func serveGoroutineCount(w http.ResponseWriter, r *http.Request) {
+	total, _ := activeConns.counts()
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintf(w, "goroutines %d\ntunnels %d\n", runtime.NumGoroutine(), total)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+// routeFallback 指标和日志中的路由种类：选择了经由第二级代理，但因第二级代理不可用改为直接连接目标
+const routeFallback = "fallback"
+
+// routeDecision 请求实际走的路径，由withDecision在选定转发方式时创建，转发过程中补充实际经由的第二级代理，
+// 以及是否改为直接转发、是否换代理重试；访问日志、指标和连接列表都以此为准
+type routeDecision struct {
+	route    string                        // 选定的转发方式：direct或proxy
+	rule     string                        // 命中的路由规则，未经过规则路由或未命中规则时为空
+	upstream atomic.Pointer[upstreamProxy] // 实际经由的第二级代理，尚未连接或改为直接转发时为nil
+	fallback atomic.Bool                   // 第二级代理不可用，改为直接连接目标
+	retried  atomic.Bool                   // 连接第二级代理失败后换了下一个代理
+}
+
+// decisionCtx 请求上下文中保存routeDecision的key
+type decisionCtx struct{}
+
+// withDecision 为请求创建routeDecision，route为选定的转发方式，rule为命中的路由规则
+func withDecision(r *http.Request, route, rule string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), decisionCtx{}, &routeDecision{route: route, rule: rule}))
+}
+
+// decisionFrom 返回请求上下文中的routeDecision，没有时为nil
+func decisionFrom(ctx context.Context) *routeDecision {
+	d, _ := ctx.Value(decisionCtx{}).(*routeDecision)
+	return d
+}
+
+// decisionFor 返回请求的routeDecision，未经过withDecision时按route新建一个，之后的记录不会保存
+func decisionFor(r *http.Request, route string) *routeDecision {
+	if d := decisionFrom(r.Context()); d != nil {
+		return d
+	}
+	return &routeDecision{route: route}
+}
+
+// kind 指标和日志中的路由种类：direct、proxy，改为直接转发时为fallback
+func (d *routeDecision) kind() string {
+	if d.fallback.Load() {
+		return routeFallback
+	}
+	return d.route
+}
+
+// upstreamID 实际经由的第二级代理地址，没有经由第二级代理时为空
+func (d *routeDecision) upstreamID() string {
+	if u := d.upstream.Load(); u != nil {
+		return u.server
+	}
+	return ""
+}
+
+// flags 访问日志中的标记：fallback、retried，都没有时为空
+func (d *routeDecision) flags() string {
+	var flags []string
+	if d.fallback.Load() {
+		flags = append(flags, "fallback")
+	}
+	if d.retried.Load() {
+		flags = append(flags, "retried")
+	}
+	return strings.Join(flags, ",")
+}
+
+// recordUpstream 记录实际经由的第二级代理
+func recordUpstream(ctx context.Context, u *upstreamProxy) {
+	if d := decisionFrom(ctx); d != nil {
+		d.upstream.Store(u)
+	}
+}
+
+// recordRetry 记录连接第二级代理失败后换了下一个代理
+func recordRetry(ctx context.Context) {
+	if d := decisionFrom(ctx); d != nil {
+		d.retried.Store(true)
+	}
+}
+
+// recordFallback 记录第二级代理不可用而改为直接连接目标
+func recordFallback(ctx context.Context) {
+	if d := decisionFrom(ctx); d != nil {
+		d.fallback.Store(true)
+		d.upstream.Store(nil)
+	}
+}
+
+// countRouted 转发结束时按路由种类和第二级代理计数，标签只有这两个，取值受配置限制
+func countRouted(d *routeDecision, up, down int64) {
+	kind, upstream := d.kind(), d.upstreamID()
+	metricRouted.with(kind, upstream).Add(1)
+	metricRoutedBytes.with(kind, upstream, directionUpload).Add(up)
+	metricRoutedBytes.with(kind, upstream, directionDownload).Add(down)
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// withFallback 在测试期间设置-fallback-direct，并清除第二级代理不可用的冷却期
+func withFallback(t *testing.T, enabled bool) {
+	t.Helper()
+	saved := fallbackDirect
+	t.Cleanup(func() {
+		fallbackDirect = saved
+		upstreamDownUntil.Store(0)
+	})
+	fallbackDirect = enabled
+	upstreamDownUntil.Store(0)
+}
+
+// TestRouteDecisionLabels 直接转发、经由第二级代理和改为直接转发的隧道，在指标标签、访问日志和连接列表中
+// 都报告实际走的路径
+func TestRouteDecisionLabels(t *testing.T) {
+	echo := newEchoServer(t)
+	good := newConnectProxy(t, func(*http.Request) string { return "HTTP/1.1 200 Connection Established\r\n\r\n" })
+	closed, _ := net.Listen("tcp", "127.0.0.1:0")
+	refused := closed.Addr().String()
+	closed.Close()
+
+	logPath := filepath.Join(t.TempDir(), "access.log")
+	f, err := openRotatingFile(logPath, 0, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := accessLog
+	accessLog = &accessLogger{w: f}
+	t.Cleanup(func() { accessLog = saved; f.f.Close() })
+
+	srv := httptest.NewServer(routedHandler("规则代理"))
+	t.Cleanup(srv.Close)
+
+	tests := []struct {
+		name     string
+		rules    string
+		upstream string
+		fallback bool
+		// 期望的标签和访问日志字段
+		route, upstreamID, rule, flags string
+	}{
+		{"direct hit", "127.0.0.1 direct\n", good.addr, false, routeDirect, "", "127.0.0.1", "-"},
+		{"upstream hit", "* proxy\n", good.addr, false, routeProxy, good.addr, "*", "-"},
+		{"fallback", "* proxy\n", refused, true, routeFallback, "", "*", "fallback"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withRules(t, tt.rules, routeDirect)
+			withUpstreams(t, []*upstreamProxy{{scheme: "http", server: tt.upstream}})
+			withFallback(t, tt.fallback)
+			routed := metricRouted.with(tt.route, tt.upstreamID)
+			before := routed.Load()
+
+			conn, br, resp := connectThrough(t, srv.Listener.Addr().String(), echo, "ping")
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("CONNECT status = %d, want 200", resp.StatusCode)
+			}
+			got := make([]byte, 4)
+			if _, err := io.ReadFull(br, got); err != nil || string(got) != "ping" {
+				t.Fatalf("tunnel echoed %q, %v", got, err)
+			}
+
+			w := httptest.NewRecorder()
+			serveConnections(w, adminRequest(http.MethodGet, "/connections", ""))
+			var list []connStatus
+			if err := json.NewDecoder(w.Body).Decode(&list); err != nil || len(list) != 1 {
+				t.Fatalf("connections = %s, %v, want one tunnel", w.Body, err)
+			}
+			if c := list[0]; c.Route != tt.route || c.Upstream != tt.upstreamID || c.Rule != tt.rule {
+				t.Errorf("connection route/upstream/rule = %q/%q/%q, want %q/%q/%q",
+					c.Route, c.Upstream, c.Rule, tt.route, tt.upstreamID, tt.rule)
+			}
+
+			conn.Close()
+			deadline := time.Now().Add(2 * time.Second)
+			for routed.Load() == before && time.Now().Before(deadline) {
+				time.Sleep(5 * time.Millisecond)
+			}
+			if n := routed.Load() - before; n != 1 {
+				t.Errorf("webproxy_routed_total{route=%q,upstream=%q} grew by %d, want 1", tt.route, tt.upstreamID, n)
+			}
+
+			data, _ := os.ReadFile(logPath)
+			lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+			fields := strings.Fields(lines[len(lines)-1])
+			want := []string{tt.route, strings.Join([]string{clfField(tt.upstreamID), tt.rule, tt.flags}, " ")}
+			if got := []string{fields[len(fields)-9], strings.Join(fields[len(fields)-3:], " ")}; got[0] != want[0] || got[1] != want[1] {
+				t.Errorf("access log route and decision fields = %q, want %q in %s", got, want, lines[len(lines)-1])
+			}
+		})
+	}
+}
+
+// TestUpstreamRetryRecorded 连接选中的第二级代理失败、换下一个代理成功时，记录重试和实际经由的代理
+func TestUpstreamRetryRecorded(t *testing.T) {
+	closed, _ := net.Listen("tcp", "127.0.0.1:0")
+	refused := &upstreamProxy{scheme: "http", server: closed.Addr().String()}
+	closed.Close()
+	good := newConnectProxy(t, func(*http.Request) string { return "HTTP/1.1 200 Connection Established\r\n\r\n" })
+	working := &upstreamProxy{scheme: "http", server: good.addr}
+	withUpstreams(t, []*upstreamProxy{refused, working})
+	upstreamNext.Store(0)
+
+	r := withUpstream(withDecision(connectRequest("example.com:443"), routeProxy, ""))
+	conn, err := connectViaProxy(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	d := decisionFrom(r.Context())
+	if d.kind() != routeProxy || d.upstreamID() != good.addr || d.flags() != "retried" {
+		t.Errorf("decision = %s %s %q, want proxy %s \"retried\"", d.kind(), d.upstreamID(), d.flags(), good.addr)
+	}
+}
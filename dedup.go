@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// dedupMaxEntries 去重日志最多同时跟踪的错误种类数量
+const dedupMaxEntries = 1024
+
+// dedupEntry 一类错误在当前窗口内的记录
+type dedupEntry struct {
+	first      time.Time // 窗口开始时间
+	msg        string    // 第一次出现时的日志内容
+	suppressed int       // 窗口内被折叠的次数
+}
+
+// dedupLogger 对窗口内相同类别+目标的错误日志去重：第一次出现立即输出，
+// 窗口内的重复只计数，窗口结束时输出一行带重复次数的汇总
+type dedupLogger struct {
+	mu      sync.Mutex
+	window  time.Duration
+	entries map[string]*dedupEntry
+}
+
+// errorLog 全局的错误日志去重器，在main中按-log-dedup-window初始化
+var errorLog = &dedupLogger{entries: make(map[string]*dedupEntry)}
+
+// newDedupLogger 创建去重日志，window为0时不去重
+func newDedupLogger(window time.Duration) *dedupLogger {
+	d := &dedupLogger{window: window, entries: make(map[string]*dedupEntry)}
+	if window > 0 {
+		go d.flushLoop()
+	}
+	return d
+}
+
+// Printf 输出一条以class和target为去重键的warn级别错误日志，级别未启用时不格式化
+func (d *dedupLogger) Printf(class, target, format string, args ...any) {
+	d.PrintfCtx(context.Background(), class, target, format, args...)
+}
+
+// PrintfCtx 与Printf相同，并带上ctx中的请求ID，被折叠的重复日志只保留第一条的ID
+func (d *dedupLogger) PrintfCtx(ctx context.Context, class, target, format string, args ...any) {
+	if !logEnabled(levelWarn) {
+		return
+	}
+	id := requestIDFrom(ctx)
+	msg := fmt.Sprintf(format, args...)
+	if d.window <= 0 {
+		recentErrors.add(msg)
+		logMessage(levelWarn, id, msg)
+		return
+	}
+
+	key := class + "|" + target
+	now := time.Now()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if e, ok := d.entries[key]; ok {
+		if now.Sub(e.first) < d.window {
+			e.suppressed++
+			return
+		}
+		d.flushEntry(key, e)
+	}
+	if len(d.entries) >= dedupMaxEntries {
+		d.flushExpired(now)
+	}
+	if len(d.entries) < dedupMaxEntries {
+		d.entries[key] = &dedupEntry{first: now, msg: msg}
+	}
+	recentErrors.add(msg)
+	logMessage(levelWarn, id, msg)
+}
+
+// flushLoop 定期输出已结束窗口的汇总
+func (d *dedupLogger) flushLoop() {
+	ticker := time.NewTicker(d.window)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		d.mu.Lock()
+		d.flushExpired(now)
+		d.mu.Unlock()
+	}
+}
+
+// flushExpired 输出并移除所有窗口已结束的记录，调用方需持有锁
+func (d *dedupLogger) flushExpired(now time.Time) {
+	for key, e := range d.entries {
+		if now.Sub(e.first) >= d.window {
+			d.flushEntry(key, e)
+		}
+	}
+}
+
+// flushEntry 输出记录的汇总并移除，调用方需持有锁
+func (d *dedupLogger) flushEntry(key string, e *dedupEntry) {
+	if e.suppressed > 0 {
+		logMessage(levelWarn, "", fmt.Sprintf("%s (%s内重复%d次)", e.msg, d.window, e.suppressed))
+	}
+	delete(d.entries, key)
+}
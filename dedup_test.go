@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// captureLog 在测试期间将log包的输出写入缓冲，结束后恢复到stderr
+func captureLog(t *testing.T) *syncBuffer {
+	t.Helper()
+	buf := &syncBuffer{}
+	flags := log.Flags()
+	log.SetOutput(buf)
+	log.SetFlags(0)
+	t.Cleanup(func() {
+		log.SetOutput(os.Stderr)
+		log.SetFlags(flags)
+	})
+	return buf
+}
+
+// TestDedupLogger 窗口内相同类别和目标的错误只输出第一条，窗口结束后输出带重复次数的汇总
+func TestDedupLogger(t *testing.T) {
+	logs := captureLog(t)
+	d := &dedupLogger{window: 50 * time.Millisecond, entries: make(map[string]*dedupEntry)}
+
+	for i := 0; i < 3; i++ {
+		d.Printf("dial", "a.example:443", "connect a.example failed #%d", i)
+	}
+	d.Printf("dial", "b.example:443", "connect b.example failed")
+	d.Printf("tls", "a.example:443", "handshake with a.example failed")
+	if got, want := logs.String(), "connect a.example failed #0\nconnect b.example failed\nhandshake with a.example failed\n"; got != want {
+		t.Fatalf("within the window logged:\n%s\nwant:\n%s", got, want)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	logs.Reset()
+	d.Printf("dial", "a.example:443", "connect a.example failed #3")
+	want := "connect a.example failed #0 (50ms内重复2次)\nconnect a.example failed #3\n"
+	if got := logs.String(); got != want {
+		t.Errorf("after the window logged:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestDedupLoggerDisabled(t *testing.T) {
+	logs := captureLog(t)
+	d := newDedupLogger(0)
+	for i := 0; i < 3; i++ {
+		d.Printf("dial", "a.example:443", "failed")
+	}
+	if n := strings.Count(logs.String(), "failed\n"); n != 3 {
+		t.Errorf("window 0 logged %d lines, want every one of 3", n)
+	}
+}
+
+// TestDedupLoggerBounded 不同错误种类超过dedupMaxEntries时不再跟踪新的种类，但照常输出
+func TestDedupLoggerBounded(t *testing.T) {
+	logs := captureLog(t)
+	d := &dedupLogger{window: time.Hour, entries: make(map[string]*dedupEntry)}
+	for i := 0; i < dedupMaxEntries+10; i++ {
+		d.Printf("dial", fmt.Sprintf("host%d:443", i), "failed %d", i)
+	}
+	if len(d.entries) > dedupMaxEntries {
+		t.Errorf("tracking %d entries, want at most %d", len(d.entries), dedupMaxEntries)
+	}
+	if n := strings.Count(logs.String(), "\n"); n != dedupMaxEntries+10 {
+		t.Errorf("logged %d lines, want %d", n, dedupMaxEntries+10)
+	}
+}
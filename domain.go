@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// domainRules 按域名匹配的规则表，example.com 只匹配该主机，.example.com 或 *.example.com 匹配该域名及其所有子域名，
+// * 匹配所有主机；查找时逐级去掉最左边的标签查表，耗时只与域名层级有关，与规则数量无关
+type domainRules struct {
+	exact  map[string]string
+	suffix map[string]string
+}
+
+// newDomainRules 创建空的规则表
+func newDomainRules() *domainRules {
+	return &domainRules{exact: make(map[string]string), suffix: make(map[string]string)}
+}
+
+// normalizeRule 返回规则的规范写法，与match返回的rule相同：小写、去掉末尾的点，*.example.com 写作 .example.com
+func normalizeRule(rule string) string {
+	rule = strings.TrimSuffix(strings.ToLower(rule), ".")
+	if strings.HasPrefix(rule, "*.") {
+		rule = rule[1:]
+	}
+	return rule
+}
+
+// add 添加一条规则，value为规则命中时返回的值
+func (d *domainRules) add(rule, value string) error {
+	rule = normalizeRule(rule)
+	switch {
+	case rule == "*":
+		// 空的后缀在逐级查找的最后命中，优先级最低
+		d.suffix[""] = value
+	case strings.HasPrefix(rule, "."):
+		if len(rule) == 1 {
+			return errors.New("empty suffix rule")
+		}
+		d.suffix[rule[1:]] = value
+	default:
+		d.exact[rule] = value
+	}
+	return nil
+}
+
+// len 返回规则数量
+func (d *domainRules) len() int {
+	return len(d.exact) + len(d.suffix)
+}
+
+// each 按normalizeRule的写法依次返回每条规则及其值，顺序不固定
+func (d *domainRules) each(fn func(rule, value string)) {
+	for rule, value := range d.exact {
+		fn(rule, value)
+	}
+	for suffix, value := range d.suffix {
+		if suffix == "" {
+			fn("*", value)
+		} else {
+			fn("."+suffix, value)
+		}
+	}
+}
+
+// match 返回命中的规则及其值，精确规则优先，其次为最具体的后缀规则
+func (d *domainRules) match(host string) (rule, value string, ok bool) {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if value, ok := d.exact[host]; ok {
+		return host, value, true
+	}
+	for name := host; name != ""; {
+		if value, ok := d.suffix[name]; ok {
+			return "." + name, value, true
+		}
+		i := strings.IndexByte(name, '.')
+		if i < 0 {
+			break
+		}
+		name = name[i+1:]
+	}
+	if value, ok := d.suffix[""]; ok {
+		return "*", value, true
+	}
+	return "", "", false
+}
+
+// targetHost 返回请求目标去掉端口后的主机
+func targetHost(r *http.Request) string {
+	target := requestTarget(r)
+	if host, _, err := net.SplitHostPort(target); err == nil {
+		return host
+	}
+	return target
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// upstreamDownUntil 第二级代理被判定不可用的截止时间(UnixNano)，冷却期内直接转发而不再尝试连接第二级代理
+var upstreamDownUntil atomic.Int64
+
+// upstreamCoolingDown 判断第二级代理是否处于不可用的冷却期内
+func upstreamCoolingDown() bool {
+	return time.Now().UnixNano() < upstreamDownUntil.Load()
+}
+
+// markUpstreamDown 记录第二级代理不可用，在-fallback-cooldown内的请求直接转发
+func markUpstreamDown() {
+	upstreamDownUntil.Store(time.Now().Add(fallbackCooldown).UnixNano())
+}
+
+// upstreamUnreachable 判断失败是否因为第二级代理本身不可用(连接、TLS或握手中断)，
+// 第二级代理明确返回的拒绝(如403、407)或SOCKS5应答不算作不可用
+func upstreamUnreachable(ctx context.Context, err error) bool {
+	if canRetryUpstream(ctx, err) {
+		return true
+	}
+	var (
+		pe       *proxyError
+		replyErr *socksReplyError
+	)
+	if ctx.Err() != nil || !errors.As(err, &pe) || !pe.upstream || errors.As(err, &replyErr) {
+		return false
+	}
+	return pe.kind == kindTLS || (pe.kind == kindUpstreamHandshake && pe.err != nil)
+}
+
+// connectWithFallback 经由第二级代理建立隧道，开启-fallback-direct且第二级代理不可用时改为直接连接目标
+func connectWithFallback(r *http.Request) (net.Conn, error) {
+	if !fallbackDirect {
+		return connectViaProxy(r)
+	}
+	if !upstreamCoolingDown() {
+		conn, err := connectViaProxy(r)
+		if err == nil || !upstreamUnreachable(r.Context(), err) {
+			return conn, err
+		}
+		markUpstreamDown()
+		logfCtx(r.Context(), levelWarn, "[二次代理] 第二级代理不可用(%s)，%s 改为直接转发，%s 内不再尝试第二级代理", classifyError(err), r.Host, fallbackCooldown)
+	}
+	recordFallback(r.Context())
+	logfCtx(r.Context(), levelInfo, "[二次代理] 直接连接 %s", r.Host)
+	conn, err := dialDirect(r.Context(), "tcp", r.Host)
+	if err != nil {
+		return nil, directDialError(err)
+	}
+	return conn, nil
+}
+
+// fallbackRoundTripper 经由第二级代理转发普通HTTP请求，第二级代理不可用且请求没有请求体时改为直接转发
+type fallbackRoundTripper struct {
+	upstream http.RoundTripper
+}
+
+func (t fallbackRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !upstreamCoolingDown() {
+		resp, err := t.upstream.RoundTrip(req)
+		if err == nil || req.Body != nil || !upstreamUnreachable(req.Context(), err) {
+			return resp, err
+		}
+		markUpstreamDown()
+		logfCtx(req.Context(), levelWarn, "[二次代理] 第二级代理不可用(%s)，%s 改为直接转发，%s 内不再尝试第二级代理", classifyError(err), req.Host, fallbackCooldown)
+	}
+	recordFallback(req.Context())
+	logfCtx(req.Context(), levelInfo, "[二次代理] 直接转发 %s", req.Host)
+	return directTransport.RoundTrip(req)
+}
@@ -0,0 +1,11 @@
+package main
+
+// fdLimit Windows下没有RLIMIT_NOFILE
+func fdLimit() (uint64, bool) {
+	return 0, false
+}
+
+// openFDCount Windows下不统计句柄数量
+func openFDCount() (int, bool) {
+	return 0, false
+}
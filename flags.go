@@ -0,0 +1,19 @@
+package main
+
+import "strings"
+
+// stringList 可重复指定的字符串参数，每次出现追加一个值
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+// Set 追加一个值
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// IsRepeatable 配置文件中的列表逐项追加
+func (l *stringList) IsRepeatable() bool { return true }
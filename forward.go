@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// hopHeaders 只对单跳连接有效、转发时必须去掉的头部
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Connection",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// forwardHTTP 以正向代理的方式转发普通HTTP请求：按客户端发来的绝对URI构造出站请求，
+// 通过transport发送后将状态码、头部和响应体原样写回，upstream表示transport是否经由第二级代理
+func forwardHTTP(w http.ResponseWriter, r *http.Request, transport http.RoundTripper, upstream bool) {
+	if !r.URL.IsAbs() || r.URL.Host == "" {
+		writeProxyError(w, http.StatusBadRequest, reasonBadRequest, "", "Proxy requests must use an absolute URI")
+		return
+	}
+
+	route := routeDirect
+	if upstream {
+		route = routeProxy
+	}
+	info, ctx, done, ok := trackHTTP(r, route)
+	if !ok {
+		w.Header().Set("Connection", "close")
+		writeProxyError(w, http.StatusServiceUnavailable, reasonOverloaded, r.URL.Host, "Proxy is shutting down, retry later")
+		return
+	}
+	defer done()
+	sw := &statusWriter{ResponseWriter: w}
+	w = sw
+	trace := &connTrace{}
+	defer logForwardDone(r, sw, info, trace, time.Now())
+
+	// Clone会替换掉r的上下文，阶段记录的httptrace要在替换之后附加
+	outReq := trace.attach(withPhaseTrace(r.Clone(ctx)), route)
+	outReq.RequestURI = ""
+	// 目标只取自绝对URI，HTTP/1.0客户端可以不带Host；客户端的Connection: close是逐跳语义，不传给源站
+	outReq.Host = ""
+	outReq.Close = false
+	removeHopHeaders(outReq.Header)
+	if r.ContentLength == 0 {
+		outReq.Body = nil
+	}
+	if outReq.Body != nil {
+		outReq.Body = &countingBody{ReadCloser: outReq.Body, total: &info.up}
+	}
+	if choice := egressFrom(ctx); choice != nil && !upstream {
+		// 复用的连接不会再次拨号，从实际取得的连接记录出口地址
+		outReq = outReq.WithContext(httptrace.WithClientTrace(outReq.Context(), &httptrace.ClientTrace{
+			GotConn: func(ci httptrace.GotConnInfo) { choice.record(ci.Conn.LocalAddr()) },
+		}))
+	}
+
+	resp, err := transport.RoundTrip(outReq)
+	if err != nil {
+		forwardErrorHandler(upstream)(w, r, err)
+		return
+	}
+	defer resp.Body.Close()
+	stopBudget(r.Context())
+
+	// 第二级代理要求的认证只能由本代理提供，不能把407转交给客户端
+	if upstream && resp.StatusCode == http.StatusProxyAuthRequired {
+		errorLog.PrintfCtx(r.Context(), "upstream_status", r.Host, "[二次代理] 第二级代理拒绝转发 %s: %s", r.Host, resp.Status)
+		writeFailure(w, r, &proxyError{kind: kindUpstreamAuth, upstream: true, msg: "The second proxy rejected our credentials"})
+		return
+	}
+
+	removeHopHeaders(resp.Header)
+	hasBody := bodyAllowed(r.Method, resp.StatusCode)
+	if !hasBody {
+		checkNoBodyFraming(r, resp)
+	}
+	header := w.Header()
+	for k, v := range resp.Header {
+		header[k] = v
+	}
+	w.WriteHeader(resp.StatusCode)
+	if !hasBody {
+		return
+	}
+	resp.Body = &countingBody{ReadCloser: limitBody(resp.Body, settingsFrom(r.Context()).rate), total: &info.down}
+	if copyResponseBody(r.Context(), w, resp) {
+		sw.markAborted()
+	}
+}
+
+// bodyAllowed 判断响应是否带响应体：HEAD请求的响应以及204、304响应没有响应体，
+// 不论源站实际发送了什么都不向客户端复制
+func bodyAllowed(method string, status int) bool {
+	return method != http.MethodHead && status != http.StatusNoContent && status != http.StatusNotModified
+}
+
+// checkNoBodyFraming 204、304响应声明了响应体时记录警告；204响应不能带Content-Length，
+// 304响应的Content-Length描述的是对应200响应的长度，原样保留
+func checkNoBodyFraming(r *http.Request, resp *http.Response) {
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusNotModified {
+		return
+	}
+	violated := len(resp.TransferEncoding) > 0
+	if resp.StatusCode == http.StatusNoContent {
+		if cl := resp.Header.Get("Content-Length"); cl != "" && cl != "0" {
+			violated = true
+		}
+		resp.Header.Del("Content-Length")
+	}
+	if violated {
+		logfCtx(r.Context(), levelWarn, "[HTTP转发] 源站 %s 为 %s 响应声明了响应体，已丢弃", r.URL.Host, resp.Status)
+	}
+}
+
+// copyResponseBody 将响应体写回客户端，长度未知的响应(如流式输出)每次读到数据后立即刷新。
+// 客户端写入失败或断开时立即关闭源站的响应体，使Transport关闭到源站的连接而不是读完剩余的响应体，返回true
+func copyResponseBody(ctx context.Context, w http.ResponseWriter, resp *http.Response) (aborted bool) {
+	flusher, streaming := w.(http.Flusher)
+	streaming = streaming && resp.ContentLength == -1
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := resp.Body.Read(buf)
+		if n > 0 {
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				resp.Body.Close()
+				return true
+			}
+			if streaming {
+				flusher.Flush()
+			}
+		}
+		if err != nil {
+			// 客户端断开时请求的ctx被取消，出站请求随之中止，读取返回的错误不是源站的问题
+			return ctx.Err() != nil
+		}
+	}
+}
+
+// countingBody 读取请求体或响应体时累计字节数，供连接列表显示
+type countingBody struct {
+	io.ReadCloser
+	total *atomic.Int64
+}
+
+// Read 读取并计数
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.total.Add(int64(n))
+	return n, err
+}
+
+// removeHopHeaders 删除逐跳头部，包括Connection头部中列出的头部
+func removeHopHeaders(h http.Header) {
+	for _, value := range h.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
@@ -0,0 +1,488 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// directTestHandler 只包含直接转发处理函数的handler，用于测试转发路径本身
+var directTestHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	r = withClientKey(r)
+	if r.Method == http.MethodConnect {
+		handleDirectTunneling(w, r)
+	} else {
+		handleDirectHTTP(w, r)
+	}
+})
+
+// directProxy 以directTestHandler监听的代理
+func directProxy(t *testing.T) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(directTestHandler)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// rawRequest 通过原始TCP连接发送手写的请求，返回连接和读取响应的reader
+func rawRequest(t *testing.T, addr, request string) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.WriteString(conn, request); err != nil {
+		t.Fatal(err)
+	}
+	return conn, bufio.NewReader(conn)
+}
+
+// TestForwardHTTP 普通HTTP请求的方法、请求体、头部原样到达源站，状态码、响应头部和响应体原样返回
+func TestForwardHTTP(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("X-Method", r.Method)
+		w.Header().Set("X-Echo", r.Header.Get("X-Custom"))
+		w.Header().Set("X-Path", r.URL.RequestURI())
+		status, _ := strconv.Atoi(r.URL.Query().Get("status"))
+		if status == 0 {
+			status = http.StatusOK
+		}
+		w.WriteHeader(status)
+		w.Write(body)
+	}))
+	defer origin.Close()
+	client := proxyClient(directProxy(t).URL)
+
+	tests := []struct {
+		method string
+		path   string
+		body   string
+		status int
+	}{
+		{http.MethodGet, "/a?x=1", "", http.StatusOK},
+		{http.MethodPost, "/submit", "form=data", http.StatusOK},
+		{http.MethodPut, "/put?status=201", strings.Repeat("p", 100000), http.StatusCreated},
+		{http.MethodDelete, "/gone?status=404", "", http.StatusNotFound},
+		{http.MethodPatch, "/err?status=502", "patch", http.StatusBadGateway},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+			var reqBody io.Reader
+			if tt.body != "" {
+				reqBody = strings.NewReader(tt.body)
+			}
+			req, _ := http.NewRequest(tt.method, origin.URL+tt.path, reqBody)
+			req.Header.Set("X-Custom", "kept")
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != tt.status {
+				t.Errorf("status %d, want %d", resp.StatusCode, tt.status)
+			}
+			if string(got) != tt.body {
+				t.Errorf("echoed body %d bytes, want %d", len(got), len(tt.body))
+			}
+			if m := resp.Header.Get("X-Method"); m != tt.method {
+				t.Errorf("origin saw method %q", m)
+			}
+			if p := resp.Header.Get("X-Path"); p != tt.path {
+				t.Errorf("origin saw request URI %q, want %q", p, tt.path)
+			}
+			if e := resp.Header.Get("X-Echo"); e != "kept" {
+				t.Errorf("request header arrived as %q", e)
+			}
+		})
+	}
+
+	// 非绝对URI的请求不是代理请求
+	_, br := rawRequest(t, strings.TrimPrefix(directProxy(t).URL, "http://"), "GET /relative HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("relative request URI: status %d, want 400", resp.StatusCode)
+	}
+}
+
+// TestHTTP10Get HTTP/1.0客户端不带Host头部时按绝对URI转发，响应不使用chunked，以关闭连接结束响应体
+func TestHTTP10Get(t *testing.T) {
+	body := strings.Repeat("streamed ", 1000)
+	originClose := make(chan bool, 4)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/stream" {
+			http.NotFound(w, r)
+			return
+		}
+		originClose <- r.Close
+		// 长度未知的响应，HTTP/1.1客户端会收到chunked
+		io.WriteString(w, body[:10])
+		w.(http.Flusher).Flush()
+		io.WriteString(w, body[10:])
+	}))
+	defer origin.Close()
+	proxy := directProxy(t)
+
+	tests := []struct {
+		name    string
+		request string
+	}{
+		{"no Host header", "GET %s/stream HTTP/1.0\r\n\r\n"},
+		{"keep-alive requested", "GET %s/stream HTTP/1.0\r\nConnection: keep-alive\r\n\r\n"},
+		{"Host differs from the URI", "GET %s/stream HTTP/1.0\r\nHost: wrong.invalid\r\n\r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, br := rawRequest(t, proxy.Listener.Addr().String(), fmt.Sprintf(tt.request, origin.URL))
+			status, err := br.ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasPrefix(status, "HTTP/1.0 200") {
+				t.Fatalf("status line %q, want HTTP/1.0 200", status)
+			}
+			resp, err := http.ReadResponse(bufio.NewReader(io.MultiReader(strings.NewReader(status), br)), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(resp.TransferEncoding) > 0 {
+				t.Errorf("HTTP/1.0 client got Transfer-Encoding %v", resp.TransferEncoding)
+			}
+			got, err := io.ReadAll(resp.Body)
+			if err != nil || string(got) != body {
+				t.Errorf("body = %d bytes, %v, want %d bytes", len(got), err, len(body))
+			}
+			if !resp.Close {
+				t.Error("response to an HTTP/1.0 client without a length did not close the connection")
+			}
+			if <-originClose {
+				t.Error("the client's Connection: close was forwarded to the origin")
+			}
+		})
+	}
+}
+
+// TestHTTP10Connect HTTP/1.0客户端的CONNECT同样建立隧道
+func TestHTTP10Connect(t *testing.T) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		conn, err := echo.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+	proxy := directProxy(t)
+
+	conn, br := rawRequest(t, proxy.Listener.Addr().String(), "CONNECT "+echo.Addr().String()+" HTTP/1.0\r\n\r\n")
+	resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT status %d, want 200", resp.StatusCode)
+	}
+	io.WriteString(conn, "ping")
+	got := make([]byte, 4)
+	if _, err := io.ReadFull(br, got); err != nil || string(got) != "ping" {
+		t.Errorf("tunnel echoed %q, %v", got, err)
+	}
+}
+
+// misbehavingOrigin 每个连接只应答一个请求，按请求路径返回predefined中原样的响应，用于模拟违反分帧规则的源站
+func misbehavingOrigin(t *testing.T, predefined map[string]string) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				req, err := http.ReadRequest(bufio.NewReader(conn))
+				if err != nil {
+					return
+				}
+				io.WriteString(conn, predefined[req.URL.Path])
+			}()
+		}
+	}()
+	return "http://" + ln.Addr().String()
+}
+
+// syncBuffer 可并发写入的日志缓冲，处理函数在响应写完后仍可能写日志
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf strings.Builder
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func (b *syncBuffer) Reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.buf.Reset()
+}
+
+// TestNoBodyFraming HEAD、204、304响应即使源站发送了响应体，客户端收到的响应也没有响应体，
+// 同一连接上的下一个响应不会被残留的字节破坏
+func TestNoBodyFraming(t *testing.T) {
+	origin := misbehavingOrigin(t, map[string]string{
+		"/not-modified": "HTTP/1.1 304 Not Modified\r\nETag: \"v1\"\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nstale\r\n0\r\n\r\n",
+		"/no-content":   "HTTP/1.1 204 No Content\r\nContent-Length: 5\r\n\r\nextra",
+		"/head":         "HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nextra",
+		"/options":      "HTTP/1.1 200 OK\r\nAllow: GET, OPTIONS\r\nContent-Length: 0\r\n\r\n",
+		"/ok":           "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok",
+	})
+	proxy := directProxy(t)
+	logs := &syncBuffer{}
+	log.SetOutput(logs)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	tests := []struct {
+		method, path  string
+		status        int
+		contentLength string // 客户端应收到的Content-Length头部
+		warn          bool
+	}{
+		{http.MethodGet, "/not-modified", http.StatusNotModified, "", true},
+		{http.MethodGet, "/no-content", http.StatusNoContent, "", true},
+		{http.MethodHead, "/head", http.StatusOK, "5", false},
+		{http.MethodOptions, "/options", http.StatusOK, "0", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			logs.Reset()
+			// 同一连接上紧接着发送第二个请求，验证第一个响应的分帧正确
+			conn, br := rawRequest(t, proxy.Listener.Addr().String(), fmt.Sprintf(
+				"%s %s%s HTTP/1.1\r\nHost: x\r\n\r\nGET %s/ok HTTP/1.1\r\nHost: x\r\n\r\n", tt.method, origin, tt.path, origin))
+			defer conn.Close()
+			resp, err := http.ReadResponse(br, &http.Request{Method: tt.method})
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.status {
+				t.Errorf("status %d, want %d", resp.StatusCode, tt.status)
+			}
+			if len(resp.TransferEncoding) > 0 {
+				t.Errorf("Transfer-Encoding %v on a response without a body", resp.TransferEncoding)
+			}
+			if got := resp.Header.Get("Content-Length"); got != tt.contentLength {
+				t.Errorf("Content-Length %q, want %q", got, tt.contentLength)
+			}
+			if tt.path == "/options" && resp.Header.Get("Allow") != "GET, OPTIONS" {
+				t.Errorf("OPTIONS response headers modified: %v", resp.Header)
+			}
+
+			next, err := http.ReadResponse(br, nil)
+			if err != nil {
+				t.Fatalf("next response on the connection: %v", err)
+			}
+			body, _ := io.ReadAll(next.Body)
+			if next.StatusCode != http.StatusOK || string(body) != "ok" {
+				t.Errorf("next response = %d %q, want 200 \"ok\"", next.StatusCode, body)
+			}
+			if warned := strings.Contains(logs.String(), "声明了响应体"); warned != tt.warn {
+				t.Errorf("framing warning logged = %v, want %v: %s", warned, tt.warn, logs.String())
+			}
+		})
+	}
+}
+
+// TestClientAbortClosesOrigin 客户端在大响应传输中断开时，源站很快看到连接关闭而不是被读完整个响应体，
+// 访问日志按中断记录断开时已发送的字节数
+func TestClientAbortClosesOrigin(t *testing.T) {
+	const total = 256 << 20
+	path := filepath.Join(t.TempDir(), "access.log")
+	f, err := openRotatingFile(path, 0, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := accessLog
+	accessLog = &accessLogger{w: f}
+	t.Cleanup(func() { accessLog = saved; f.f.Close() })
+
+	sent := make(chan int64, 1)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Has("length") {
+			w.Header().Set("Content-Length", fmt.Sprint(total))
+		}
+		chunk := make([]byte, 32<<10)
+		var n int64
+		for n < total {
+			m, err := w.Write(chunk)
+			n += int64(m)
+			if err != nil {
+				break
+			}
+		}
+		sent <- n
+	}))
+	defer origin.Close()
+	handled := make(chan struct{}, 1)
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() { handled <- struct{}{} }()
+		w, logAccess := withAccessLog(w, r)
+		defer logAccess(r, routeDirect)
+		handleDirectHTTP(w, withClientKey(r))
+	}))
+	defer proxy.Close()
+
+	for _, query := range []string{"?length", "?stream"} {
+		t.Run(query[1:], func(t *testing.T) {
+			conn, br := rawRequest(t, proxy.Listener.Addr().String(), "GET "+origin.URL+"/"+query+" HTTP/1.1\r\nHost: x\r\n\r\n")
+			resp, err := http.ReadResponse(br, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := io.CopyN(io.Discard, resp.Body, 1<<20); err != nil {
+				t.Fatal(err)
+			}
+			conn.Close()
+
+			select {
+			case n := <-sent:
+				if n >= total/4 {
+					t.Errorf("origin sent %d of %d bytes after the client went away", n, total)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("origin did not see the connection close")
+			}
+			<-handled
+			data, _ := os.ReadFile(path)
+			lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+			fields := strings.Fields(lines[len(lines)-1])
+			if fields[len(fields)-4] != "aborted" {
+				t.Errorf("access log line not marked aborted: %s", lines[len(lines)-1])
+			}
+			if size, _ := strconv.ParseInt(fields[9], 10, 64); size < 1<<20 || size >= total {
+				t.Errorf("access log size %d, want the bytes sent before the abort", size)
+			}
+		})
+	}
+}
+
+func TestRemoveHopHeaders(t *testing.T) {
+	tests := []struct {
+		name    string
+		header  http.Header
+		removed []string
+		kept    []string
+	}{
+		{
+			"standard hop headers",
+			http.Header{"Keep-Alive": {"timeout=5"}, "Proxy-Authorization": {"Basic x"}, "Proxy-Connection": {"keep-alive"},
+				"Te": {"trailers"}, "Trailer": {"X-T"}, "Upgrade": {"h2c"}, "Transfer-Encoding": {"chunked"}, "Accept": {"*/*"}},
+			[]string{"Keep-Alive", "Proxy-Authorization", "Proxy-Connection", "Te", "Trailer", "Upgrade", "Transfer-Encoding"},
+			[]string{"Accept"},
+		},
+		{
+			"listed in Connection",
+			http.Header{"Connection": {"X-Hop, x-other ,", "close"}, "X-Hop": {"1"}, "X-Other": {"2"}, "X-End": {"3"}},
+			[]string{"Connection", "X-Hop", "X-Other"},
+			[]string{"X-End"},
+		},
+		{
+			"response headers",
+			http.Header{"Proxy-Authenticate": {"Basic"}, "Connection": {"keep-alive"}, "Set-Cookie": {"a=b"}},
+			[]string{"Proxy-Authenticate", "Connection"},
+			[]string{"Set-Cookie"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			removeHopHeaders(tt.header)
+			for _, name := range tt.removed {
+				if v, ok := tt.header[name]; ok {
+					t.Errorf("%s = %q was not removed", name, v)
+				}
+			}
+			for _, name := range tt.kept {
+				if tt.header.Get(name) == "" {
+					t.Errorf("end-to-end header %s was removed", name)
+				}
+			}
+		})
+	}
+}
+
+// TestForwardStripsHopHeaders 逐跳头部在请求和响应两个方向上都不被转发
+func TestForwardStripsHopHeaders(t *testing.T) {
+	seen := make(chan http.Header, 1)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen <- r.Header.Clone()
+		w.Header().Set("Connection", "X-Origin-Hop")
+		w.Header().Set("X-Origin-Hop", "1")
+		w.Header().Set("Keep-Alive", "timeout=5")
+		w.Header().Set("X-Origin-End", "1")
+	}))
+	defer origin.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, origin.URL, nil)
+	req.Header.Set("Connection", "X-Client-Hop")
+	req.Header.Set("X-Client-Hop", "1")
+	req.Header.Set("Proxy-Authorization", "Basic dTpw")
+	req.Header.Set("X-Client-End", "1")
+	resp, err := proxyClient(directProxy(t).URL).Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	got := <-seen
+	for _, name := range []string{"X-Client-Hop", "Proxy-Authorization"} {
+		if got.Get(name) != "" {
+			t.Errorf("origin received hop header %s", name)
+		}
+	}
+	if got.Get("X-Client-End") == "" {
+		t.Error("origin did not receive X-Client-End")
+	}
+	for _, name := range []string{"X-Origin-Hop", "Keep-Alive"} {
+		if resp.Header.Get(name) != "" {
+			t.Errorf("client received hop header %s", name)
+		}
+	}
+	if resp.Header.Get("X-Origin-End") == "" {
+		t.Error("client did not receive X-Origin-End")
+	}
+}
@@ -1,4 +1,4 @@
-module main
+module web-proxy
 
 go 1.21.3
 
@@ -7,6 +7,9 @@ toolchain go1.21.8
 require (
 	github.com/gin-gonic/gin v1.9.1
 	github.com/gospider007/requests v0.0.0-20240316035331-c1438ce9a24d
+	golang.org/x/crypto v0.21.0
+	golang.org/x/net v0.22.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -58,15 +61,12 @@ require (
 	go.uber.org/multierr v1.11.0 // indirect
 	go.uber.org/zap v1.27.0 // indirect
 	golang.org/x/arch v0.3.0 // indirect
-	golang.org/x/crypto v0.21.0 // indirect
 	golang.org/x/exp v0.0.0-20240314144324-c7f7c6466f7f // indirect
 	golang.org/x/image v0.15.0 // indirect
 	golang.org/x/mod v0.16.0 // indirect
-	golang.org/x/net v0.22.0 // indirect
 	golang.org/x/sys v0.18.0 // indirect
 	golang.org/x/text v0.14.0 // indirect
 	golang.org/x/tools v0.19.0 // indirect
 	google.golang.org/protobuf v1.30.0 // indirect
-	gopkg.in/yaml.v3 v3.0.1 // indirect
 	nhooyr.io/websocket v1.8.10 // indirect
 )
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// newH2CServer 创建以明文HTTP/2提供服务的代理监听，客户端可以在一个连接上并发发送多个代理请求，
+// 与-h2c-mode对应的HTTP监听共用路由、认证和日志，同一端口上的HTTP/1.1请求照常处理；未配置-h2c-port时返回nil
+func newH2CServer() *proxyServer {
+	if h2cPort == 0 {
+		return nil
+	}
+	handler := directHandler("h2c")
+	if h2cMode == routeProxy {
+		handler = proxyHandler("h2c")
+	}
+	srv := &http.Server{Addr: fmt.Sprintf(":%d", h2cPort)}
+	h2s := &http2.Server{}
+	// 注册退出时的处理，Shutdown会向HTTP/2连接发送GOAWAY，不再接受新的流
+	http2.ConfigureServer(srv, h2s)
+	srv.Handler = h2c.NewHandler(h2ProxyRequest(handler), h2s)
+	return &proxyServer{title: "h2c", server: srv}
+}
+
+// h2ProxyRequest 将HTTP/2代理请求还原为HTTP/1.1监听收到的形式：请求只有:authority和:path，
+// 按:authority补全绝对URI，明文监听上的目标总是http://；HTTP/2流不能劫持为隧道，CONNECT返回405，
+// 同一端口上HTTP/1.1的请求原样交给h
+func h2ProxyRequest(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if r.Method == http.MethodConnect {
+			w.Header().Set("Allow", "GET, HEAD, POST, PUT, PATCH, DELETE, OPTIONS")
+			writeProxyError(w, http.StatusMethodNotAllowed, reasonBadRequest, r.Host, "CONNECT is not supported over h2c, use HTTP/1.1")
+			return
+		}
+		if r.URL.Host == "" {
+			u := *r.URL
+			u.Scheme, u.Host = "http", r.Host
+			r.URL = &u
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// validateH2CMode 校验-h2c-mode参数
+func validateH2CMode(mode string) error {
+	if err := validateRoute("-h2c-mode", mode); err != nil {
+		return err
+	}
+	if mode == routeProxy && len(upstreamList()) == 0 && h2cPort != 0 {
+		return errors.New("-h2c-mode proxy requires -proxy-url")
+	}
+	return nil
+}
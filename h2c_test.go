@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"golang.org/x/net/http2"
+)
+
+// startH2CServer 在随机端口上启动-h2c-port监听，返回监听地址
+func startH2CServer(t *testing.T) string {
+	t.Helper()
+	saved := h2cPort
+	h2cPort = 1
+	s := newH2CServer()
+	h2cPort = saved
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.server.Serve(ln)
+	t.Cleanup(func() { s.server.Close() })
+	return ln.Addr().String()
+}
+
+// h2cClient 以prior knowledge方式连接addr的HTTP/2客户端，dials记录建立的连接数
+func h2cClient(addr string, dials *atomic.Int32) *http2.Transport {
+	return &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, _ string, _ *tls.Config) (net.Conn, error) {
+			dials.Add(1)
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+	}
+}
+
+// TestH2CMultiplexedProxyRequests 多个并发的代理请求在一个明文HTTP/2连接上转发到各自的目标
+func TestH2CMultiplexedProxyRequests(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s %s", r.Method, r.URL.Path)
+	}))
+	defer origin.Close()
+	addr := startH2CServer(t)
+
+	var dials atomic.Int32
+	transport := h2cClient(addr, &dials)
+	defer transport.CloseIdleConnections()
+
+	// 先发一个请求建立连接，之后的并发请求都复用它
+	if resp, err := transport.RoundTrip(httptestRequest(t, http.MethodGet, origin.URL+"/warmup")); err != nil {
+		t.Fatal(err)
+	} else {
+		resp.Body.Close()
+	}
+
+	const n = 20
+	var wg sync.WaitGroup
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			path := fmt.Sprintf("/item/%d", i)
+			resp, err := transport.RoundTrip(httptestRequest(t, http.MethodGet, origin.URL+path))
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+			if resp.ProtoMajor != 2 || resp.StatusCode != http.StatusOK || string(body) != "GET "+path {
+				errs <- fmt.Errorf("%s: %s %d %q", path, resp.Proto, resp.StatusCode, body)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	if got := dials.Load(); got != 1 {
+		t.Errorf("%d connections to the h2c listener, want 1", got)
+	}
+}
+
+func TestH2CConnectRejected(t *testing.T) {
+	addr := startH2CServer(t)
+	var dials atomic.Int32
+	transport := h2cClient(addr, &dials)
+	defer transport.CloseIdleConnections()
+
+	req := httptestRequest(t, http.MethodConnect, "http://example.com:443")
+	req.URL.Path = ""
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("CONNECT over h2c: status %d, want 405", resp.StatusCode)
+	}
+}
+
+// httptestRequest 构造客户端请求，URL无法解析时结束测试
+func httptestRequest(t *testing.T, method, url string) *http.Request {
+	t.Helper()
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return req
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// h2ReadChunk 读取泵从响应体读到的一段数据
+type h2ReadChunk struct {
+	data []byte
+	err  error
+}
+
+// h2StreamConn 将一个HTTP/2 CONNECT流包装为net.Conn，读取响应体、写入请求体。
+// 流被重置时读写返回错误，transfer随之只关闭这一条隧道。
+// 响应体由读取泵读入，读超时只让本次Read返回，流保持可用，与idleReader的空闲检测配合；
+// 请求体是无法中断的管道，写超时到期时如仍有Write阻塞则关闭整个流
+type h2StreamConn struct {
+	body   io.ReadCloser
+	pw     *io.PipeWriter
+	cancel context.CancelFunc
+	remote net.Addr
+	once   sync.Once
+	closed chan struct{}
+
+	chunks  chan h2ReadChunk
+	pending []byte // 上次Read未取完的数据，只在Read中使用
+	readErr error  // 读取泵结束的原因，只在Read中使用
+
+	readDeadline  streamDeadline
+	writeDeadline streamDeadline
+	writeTimedOut atomic.Bool
+}
+
+// newH2StreamConn 包装CONNECT流并启动读取泵
+func newH2StreamConn(body io.ReadCloser, pw *io.PipeWriter, cancel context.CancelFunc, remote net.Addr) *h2StreamConn {
+	c := &h2StreamConn{
+		body:          body,
+		pw:            pw,
+		cancel:        cancel,
+		remote:        remote,
+		closed:        make(chan struct{}),
+		chunks:        make(chan h2ReadChunk),
+		readDeadline:  makeStreamDeadline(),
+		writeDeadline: makeStreamDeadline(),
+	}
+	go c.pump()
+	return c
+}
+
+// pump 持续读取响应体交给Read，出错或连接关闭后退出
+func (c *h2StreamConn) pump() {
+	for {
+		buf := make([]byte, 32<<10)
+		n, err := c.body.Read(buf)
+		select {
+		case c.chunks <- h2ReadChunk{data: buf[:n], err: err}:
+		case <-c.closed:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Read 读取响应体，读超时返回os.ErrDeadlineExceeded，之后仍可继续读取
+func (c *h2StreamConn) Read(p []byte) (int, error) {
+	for len(c.pending) == 0 {
+		if c.readErr != nil {
+			return 0, c.readErr
+		}
+		select {
+		case chunk := <-c.chunks:
+			c.pending, c.readErr = chunk.data, chunk.err
+		case <-c.readDeadline.wait():
+			return 0, os.ErrDeadlineExceeded
+		case <-c.closed:
+			return 0, net.ErrClosed
+		}
+	}
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// Write 写入请求体，写超时到期时关闭流并返回os.ErrDeadlineExceeded
+func (c *h2StreamConn) Write(p []byte) (int, error) {
+	expired, armed := c.writeDeadline.armed()
+	if !armed {
+		return c.pw.Write(p)
+	}
+	select {
+	case <-expired:
+		return 0, os.ErrDeadlineExceeded
+	default:
+	}
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-expired:
+			c.writeTimedOut.Store(true)
+			c.Close()
+		case <-done:
+		}
+	}()
+	n, err := c.pw.Write(p)
+	close(done)
+	if err != nil && c.writeTimedOut.Load() {
+		err = os.ErrDeadlineExceeded
+	}
+	return n, err
+}
+
+// CloseWrite 结束请求体，第二级代理收到END_STREAM，响应方向继续读取
+func (c *h2StreamConn) CloseWrite() error {
+	return c.pw.Close()
+}
+
+// Close 结束请求体并取消流，可重复调用
+func (c *h2StreamConn) Close() error {
+	c.once.Do(func() {
+		close(c.closed)
+		c.pw.Close()
+		c.body.Close()
+		c.cancel()
+	})
+	return nil
+}
+
+func (c *h2StreamConn) LocalAddr() net.Addr  { return h2Addr("") }
+func (c *h2StreamConn) RemoteAddr() net.Addr { return c.remote }
+
+// SetDeadline 同时设置读写超时
+func (c *h2StreamConn) SetDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	c.writeDeadline.set(t)
+	return nil
+}
+
+func (c *h2StreamConn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	return nil
+}
+
+func (c *h2StreamConn) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline.set(t)
+	return nil
+}
+
+// streamDeadline 可重复设置的超时，到期时关闭cancel，用法与net.Pipe的实现相同
+type streamDeadline struct {
+	mu     sync.Mutex
+	timer  *time.Timer
+	cancel chan struct{} // 到期时关闭
+}
+
+func makeStreamDeadline() streamDeadline {
+	return streamDeadline{cancel: make(chan struct{})}
+}
+
+// set 设置超时时间，零值表示不超时，已过去的时间立即到期
+func (d *streamDeadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.timer != nil && !d.timer.Stop() {
+		<-d.cancel // 等待定时器关闭cancel
+	}
+	d.timer = nil
+
+	closed := isClosedChan(d.cancel)
+	if t.IsZero() {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		return
+	}
+	if dur := time.Until(t); dur > 0 {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		cancel := d.cancel
+		d.timer = time.AfterFunc(dur, func() { close(cancel) })
+		return
+	}
+	if !closed {
+		close(d.cancel)
+	}
+}
+
+// wait 返回到期时关闭的channel
+func (d *streamDeadline) wait() chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.cancel
+}
+
+// armed 返回到期时关闭的channel，以及是否设置了超时
+func (d *streamDeadline) armed() (chan struct{}, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.cancel, d.timer != nil || isClosedChan(d.cancel)
+}
+
+func isClosedChan(c <-chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// h2StreamPair 返回一个h2StreamConn，以及模拟第二级代理一端的响应体写入端和请求体读取端
+func h2StreamPair(t *testing.T) (*h2StreamConn, *io.PipeWriter, *io.PipeReader, chan struct{}) {
+	t.Helper()
+	bodyR, bodyW := io.Pipe()
+	pr, pw := io.Pipe()
+	cancelled := make(chan struct{})
+	c := newH2StreamConn(bodyR, pw, func() { close(cancelled) }, h2Addr("proxy:443"))
+	t.Cleanup(func() {
+		c.Close()
+		bodyW.Close()
+		pr.Close()
+	})
+	return c, bodyW, pr, cancelled
+}
+
+// TestH2StreamReadDeadline 读超时只让本次Read返回超时错误，流保持可用
+func TestH2StreamReadDeadline(t *testing.T) {
+	c, bodyW, _, _ := h2StreamPair(t)
+	c.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	buf := make([]byte, 16)
+	if _, err := c.Read(buf); !errors.Is(err, os.ErrDeadlineExceeded) || !isTimeout(err) {
+		t.Fatalf("Read after the deadline = %v, want a timeout", err)
+	}
+
+	c.SetReadDeadline(time.Time{})
+	go io.WriteString(bodyW, "hello")
+	n, err := c.Read(buf)
+	if err != nil || string(buf[:n]) != "hello" {
+		t.Fatalf("Read after clearing the deadline = %q, %v", buf[:n], err)
+	}
+
+	// 比缓冲区大的数据分多次读完，之后返回EOF
+	go func() {
+		io.WriteString(bodyW, "0123456789abcdefXYZ")
+		bodyW.Close()
+	}()
+	got, err := io.ReadAll(c)
+	if err != nil || string(got) != "0123456789abcdefXYZ" {
+		t.Errorf("ReadAll = %q, %v", got, err)
+	}
+}
+
+func TestH2StreamWriteDeadline(t *testing.T) {
+	c, _, pr, cancelled := h2StreamPair(t)
+
+	// 已经过去的超时不阻塞也不关闭流
+	c.SetWriteDeadline(time.Now().Add(-time.Second))
+	if _, err := c.Write([]byte("x")); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("Write past the deadline = %v, want os.ErrDeadlineExceeded", err)
+	}
+	c.SetWriteDeadline(time.Time{})
+	go io.ReadFull(pr, make([]byte, 2))
+	if _, err := c.Write([]byte("ok")); err != nil {
+		t.Fatalf("Write after clearing the deadline: %v", err)
+	}
+
+	// 没有人读取请求体时阻塞的Write在到期后返回，并关闭整个流
+	c.SetWriteDeadline(time.Now().Add(20 * time.Millisecond))
+	if _, err := c.Write([]byte("blocked")); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("blocked Write = %v, want os.ErrDeadlineExceeded", err)
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Fatal("stream was not cancelled after the write deadline")
+	}
+	if _, err := c.Read(make([]byte, 1)); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Read after the write deadline closed the stream = %v", err)
+	}
+}
+
+// TestH2StreamCloseWrite CloseWrite结束请求体，响应方向仍可读取
+func TestH2StreamCloseWrite(t *testing.T) {
+	c, bodyW, pr, cancelled := h2StreamPair(t)
+	if !closeWrite(c) {
+		t.Fatal("closeWrite did not use CloseWrite")
+	}
+	if n, err := pr.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+		t.Errorf("request body after CloseWrite: %d, %v, want EOF", n, err)
+	}
+	go io.WriteString(bodyW, "still open")
+	buf := make([]byte, 32)
+	if n, err := c.Read(buf); err != nil || string(buf[:n]) != "still open" {
+		t.Errorf("Read after CloseWrite = %q, %v", buf[:n], err)
+	}
+	select {
+	case <-cancelled:
+		t.Error("CloseWrite cancelled the stream")
+	default:
+	}
+}
+
+func TestH2StreamCloseUnblocksRead(t *testing.T) {
+	c, _, _, cancelled := h2StreamPair(t)
+	done := make(chan error, 1)
+	go func() {
+		_, err := c.Read(make([]byte, 1))
+		done <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	c.Close()
+	c.Close()
+	select {
+	case err := <-done:
+		if !errors.Is(err, net.ErrClosed) && !errors.Is(err, io.ErrClosedPipe) {
+			t.Errorf("Read after Close = %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Close did not unblock Read")
+	}
+	<-cancelled
+}
+
+// TestH2StreamIdleReader 空闲检测可以用在HTTP/2流上，两个方向都空闲时返回errTunnelIdle
+func TestH2StreamIdleReader(t *testing.T) {
+	saved := tunnelIdleTimeout
+	t.Cleanup(func() { tunnelIdleTimeout = saved })
+	tunnelIdleTimeout = 30 * time.Millisecond
+
+	c, _, _, _ := h2StreamPair(t)
+	r := newTunnelIdle(tunnelIdleTimeout).watch(c)
+	if _, ok := r.(*idleReader); !ok {
+		t.Fatalf("watch returned %T, want *idleReader", r)
+	}
+	if _, err := r.Read(make([]byte, 1)); !errors.Is(err, errTunnelIdle) {
+		t.Errorf("idle Read = %v, want errTunnelIdle", err)
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// upstreamHealth 一个第二级代理的健康检查状态
+type upstreamHealth struct {
+	healthy atomic.Bool
+
+	mu        sync.Mutex
+	successes int           // 连续成功次数
+	failures  int           // 连续失败次数
+	latency   time.Duration // 最近一次成功探测的耗时
+	lastErr   string        // 最近一次失败的原因
+	lastCheck time.Time     // 最近一次探测的时间
+}
+
+// upstreamHealthStatus 管理接口返回的健康状态
+type upstreamHealthStatus struct {
+	Server    string    `json:"server"`
+	Healthy   bool      `json:"healthy"`
+	LatencyMS int64     `json:"latency_ms"`
+	LastError string    `json:"last_error,omitempty"`
+	LastCheck time.Time `json:"last_check"`
+}
+
+// healthSet 一组第二级代理的健康状态，创建后只读，重新加载配置时整体替换并停止旧的探测
+type healthSet struct {
+	states map[*upstreamProxy]*upstreamHealth
+	done   chan struct{}
+}
+
+// healthStates 当前的健康状态，未启用健康检查时为nil
+var healthStates atomic.Pointer[healthSet]
+
+// upstreamHealthy 判断第二级代理是否可用，未启用健康检查时总是可用
+func upstreamHealthy(u *upstreamProxy) bool {
+	set := healthStates.Load()
+	if set == nil {
+		return true
+	}
+	h, ok := set.states[u]
+	return !ok || h.healthy.Load()
+}
+
+// errUpstreamsDown 所有第二级代理都未通过健康检查
+var errUpstreamsDown = &proxyError{kind: kindDialRefused, upstream: true, msg: "The second proxy is unavailable (health check failing)"}
+
+var registerHealthHandler sync.Once
+
+// startHealthChecks 按-health-interval在后台定期探测list中的每个第二级代理，并停止之前的探测；
+// 连续-health-fall次失败判定为不可用，之后连续-health-rise次成功恢复
+func startHealthChecks(list []*upstreamProxy) {
+	if healthInterval <= 0 || len(list) == 0 {
+		return
+	}
+	set := &healthSet{states: make(map[*upstreamProxy]*upstreamHealth, len(list)), done: make(chan struct{})}
+	for _, u := range list {
+		h := &upstreamHealth{}
+		h.healthy.Store(true)
+		set.states[u] = h
+	}
+	if old := healthStates.Swap(set); old != nil {
+		close(old.done)
+	}
+	registerHealthHandler.Do(func() {
+		adminMux.HandleFunc("/upstreams", serveUpstreamHealth)
+	})
+	for _, u := range list {
+		go runHealthCheck(u, set.states[u], set.done)
+	}
+}
+
+// runHealthCheck 定期探测一个第二级代理，直到done被关闭
+func runHealthCheck(u *upstreamProxy, h *upstreamHealth, done <-chan struct{}) {
+	ticker := time.NewTicker(healthInterval)
+	defer ticker.Stop()
+	for {
+		start := time.Now()
+		err := probeUpstream(u)
+		countUpstreamProbe(u, probeHealth, err)
+		h.record(u, time.Since(start), err)
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// probeUpstream 连接第二级代理，配置了-health-target时再经由它建立到该地址的隧道
+func probeUpstream(u *upstreamProxy) error {
+	ctx, cancel := context.WithTimeout(withHealthProbe(context.Background()), dialTimeout)
+	defer cancel()
+
+	var (
+		conn net.Conn
+		err  error
+	)
+	if healthTarget == "" {
+		if u.scheme == "socks5" {
+			conn, err = dialUpstream(ctx, "tcp", u.server)
+		} else {
+			conn, err = dialProxyServer(ctx, u.scheme, u.server)
+		}
+	} else {
+		r, _ := http.NewRequestWithContext(ctx, http.MethodConnect, "//"+healthTarget, nil)
+		r.Host = healthTarget
+		conn, err = connectUpstream(r, u)
+	}
+	if err != nil {
+		return err
+	}
+	conn.Close()
+	return nil
+}
+
+// record 记录一次探测结果，状态变化时输出日志
+func (h *upstreamHealth) record(u *upstreamProxy, latency time.Duration, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lastCheck = time.Now()
+	if err != nil {
+		h.successes = 0
+		h.failures++
+		h.lastErr = err.Error()
+		if h.healthy.Load() && h.failures >= healthFall {
+			h.healthy.Store(false)
+			logf(levelWarn, "[健康检查] 第二级代理 %s 连续 %d 次探测失败，标记为不可用: %v", u.server, h.failures, err)
+		}
+		return
+	}
+	h.failures = 0
+	h.successes++
+	h.latency = latency
+	if !h.healthy.Load() && h.successes >= healthRise {
+		h.healthy.Store(true)
+		h.lastErr = ""
+		log.Printf("[健康检查] 第二级代理 %s 连续 %d 次探测成功，恢复可用(延迟 %s)", u.server, h.successes, latency)
+	}
+}
+
+// status 返回当前的健康状态
+func (h *upstreamHealth) status(u *upstreamProxy) upstreamHealthStatus {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return upstreamHealthStatus{
+		Server:    u.server,
+		Healthy:   h.healthy.Load(),
+		LatencyMS: h.latency.Milliseconds(),
+		LastError: h.lastErr,
+		LastCheck: h.lastCheck,
+	}
+}
+
+// healthProbeCtx 标记健康检查和空闲探测发出的请求，其结果不计入转发流量的指标
+type healthProbeCtx struct{}
+
+// withHealthProbe 返回标记为探测请求的ctx
+func withHealthProbe(ctx context.Context) context.Context {
+	return context.WithValue(ctx, healthProbeCtx{}, true)
+}
+
+// isHealthProbe 判断ctx是否属于探测请求
+func isHealthProbe(ctx context.Context) bool {
+	probe, _ := ctx.Value(healthProbeCtx{}).(bool)
+	return probe
+}
+
+// serveUpstreamHealth 管理接口 /upstreams，以JSON返回各第二级代理的健康状态
+func serveUpstreamHealth(w http.ResponseWriter, r *http.Request) {
+	if rejectAdmin(w, r) {
+		return
+	}
+	upstreams := upstreamList()
+	set := healthStates.Load()
+	list := make([]upstreamHealthStatus, 0, len(upstreams))
+	for _, u := range upstreams {
+		if h, ok := set.states[u]; ok {
+			list = append(list, h.status(u))
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
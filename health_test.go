@@ -0,0 +1,84 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestUpstreamHealthRecord(t *testing.T) {
+	savedRise, savedFall := healthRise, healthFall
+	t.Cleanup(func() { healthRise, healthFall = savedRise, savedFall })
+	healthRise, healthFall = 2, 2
+
+	u := &upstreamProxy{server: "192.0.2.1:8080"}
+	h := &upstreamHealth{}
+	h.healthy.Store(true)
+	fail := errors.New("refused")
+	steps := []struct {
+		err  error
+		want bool
+	}{
+		{fail, true}, // 一次失败不足-health-fall
+		{nil, true},
+		{fail, true},
+		{fail, false}, // 连续两次失败
+		{nil, false},  // 一次成功不足-health-rise
+		{fail, false},
+		{nil, false},
+		{nil, true},
+	}
+	for i, step := range steps {
+		h.record(u, 0, step.err)
+		if got := h.healthy.Load(); got != step.want {
+			t.Fatalf("step %d: healthy = %v, want %v", i, got, step.want)
+		}
+	}
+}
+
+// TestHealthProbeNotCountedAsFailure 健康检查被第二级代理拒绝时不计入转发的失败指标，只计入探测指标
+func TestHealthProbeNotCountedAsFailure(t *testing.T) {
+	withProbeTimeouts(t, 0)
+	healthTarget = "example.com:443"
+	u := newFakeUpstream(t, false).proxy("http")
+
+	refused := metricUpstreamFailures.with("400").Load()
+	probes := metricUpstreamProbes.with(u.server, probeHealth, "failure").Load()
+	err := probeUpstream(u)
+	if err == nil {
+		t.Fatal("probe through a proxy refusing CONNECT succeeded")
+	}
+	countUpstreamProbe(u, probeHealth, err)
+	if got := metricUpstreamFailures.with("400").Load(); got != refused {
+		t.Errorf("health probe added %d to webproxy_upstream_connect_failures_total", got-refused)
+	}
+	if got := metricUpstreamProbes.with(u.server, probeHealth, "failure").Load(); got != probes+1 {
+		t.Errorf("webproxy_upstream_probes_total = %d, want %d", got, probes+1)
+	}
+}
+
+func TestServeUpstreamHealthRequiresAdmin(t *testing.T) {
+	healthStates.Store(&healthSet{states: map[*upstreamProxy]*upstreamHealth{}})
+	t.Cleanup(func() { healthStates.Store(nil) })
+
+	r := adminRequest(http.MethodGet, "/upstreams", "")
+	r.RemoteAddr = "192.0.2.10:40000"
+	w := httptest.NewRecorder()
+	serveUpstreamHealth(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("remote request: status %d, want 403", w.Code)
+	}
+
+	withAdminAuth(t)
+	w = httptest.NewRecorder()
+	serveUpstreamHealth(w, adminRequest(http.MethodGet, "/upstreams", ""))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("unauthenticated request: status %d, want 401", w.Code)
+	}
+	w = httptest.NewRecorder()
+	serveUpstreamHealth(w, adminRequest(http.MethodGet, "/upstreams", "Bearer ro-secret"))
+	if w.Code != http.StatusOK {
+		t.Errorf("read-only token: status %d, want 200", w.Code)
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+)
+
+var (
+	directHintClients string      // -direct-hint-clients参数
+	directHintNets    cidrMatcher // 可以得知direct规则的客户端网段，为空表示不告知任何客户端
+	advertiseDirect   int         // -advertise-direct，0表示只加提示头部，305或307表示重定向到源站
+)
+
+// directHintHeader 告知客户端目标命中了direct规则的响应头部
+const directHintHeader = "X-WebProxy-Route"
+
+// setupDirectHint 解析-direct-hint-clients并校验-advertise-direct
+func setupDirectHint() error {
+	if advertiseDirect != 0 && advertiseDirect != http.StatusUseProxy && advertiseDirect != http.StatusTemporaryRedirect {
+		return fmt.Errorf("invalid -advertise-direct %d, want 0, 305 or 307", advertiseDirect)
+	}
+	var err error
+	directHintNets, err = parseCIDRs("-direct-hint-clients", directHintClients)
+	return err
+}
+
+// adviseDirect 受信任的客户端经规则代理发送的普通HTTP请求命中direct规则时告知客户端可以直接连接：
+// 默认照常转发并加上 X-WebProxy-Route: direct，配置了-advertise-direct时不转发，以305或307重定向到源站，
+// 已经响应时返回true；CONNECT、未命中规则和按PAC直接连接的请求不处理
+func adviseDirect(w http.ResponseWriter, r *http.Request) bool {
+	if len(directHintNets) == 0 || r.Method == http.MethodConnect {
+		return false
+	}
+	d := decisionFrom(r.Context())
+	if d == nil || d.route != routeDirect || d.rule == "" || d.rule == "pac" {
+		return false
+	}
+	if ip := net.ParseIP(clientKey(r)); ip == nil || !directHintNets.contains(ip) {
+		return false
+	}
+	w.Header().Set(directHintHeader, routeDirect)
+	if advertiseDirect == 0 {
+		return false
+	}
+	// 307要求客户端以相同的方法和请求体访问Location，请求体不会被代理读取
+	logfCtx(r.Context(), levelDebug, "[规则代理] %s 命中 %s，以 %d 告知客户端 %s 直接连接", targetHost(r), d.rule, advertiseDirect, clientKey(r))
+	w.Header().Set("Location", r.URL.String())
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Connection", "close")
+	w.WriteHeader(advertiseDirect)
+	return true
+}
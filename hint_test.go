@@ -0,0 +1,139 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// withDirectHint 在测试期间设置-direct-hint-clients和-advertise-direct
+func withDirectHint(t *testing.T, clients string, code int) {
+	t.Helper()
+	savedClients, savedNets, savedCode := directHintClients, directHintNets, advertiseDirect
+	t.Cleanup(func() { directHintClients, directHintNets, advertiseDirect = savedClients, savedNets, savedCode })
+	directHintClients, advertiseDirect = clients, code
+	if err := setupDirectHint(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestDirectHintHeader 只有受信任的客户端访问命中direct规则的目标时响应才带提示头部，CONNECT不带
+func TestDirectHintHeader(t *testing.T) {
+	withRates(t, 0, 0)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello")
+	}))
+	t.Cleanup(origin.Close)
+	withRules(t, "127.0.0.1 direct\n", routeDirect)
+	srv := httptest.NewServer(routedHandler("规则代理"))
+	t.Cleanup(srv.Close)
+
+	matched := origin.URL + "/"
+	// localhost不命中127.0.0.1的规则，按未命中时的direct直接连接
+	unmatched := strings.Replace(origin.URL, "127.0.0.1", "localhost", 1) + "/"
+	tests := []struct {
+		name, clients, target string
+		want                  string
+	}{
+		{"trusted client, direct rule", "127.0.0.0/8", matched, routeDirect},
+		{"trusted client, no rule", "127.0.0.0/8", unmatched, ""},
+		{"untrusted client", "10.0.0.0/8", matched, ""},
+		{"disabled", "", matched, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withDirectHint(t, tt.clients, 0)
+			resp, err := proxyClient(srv.URL).Get(tt.target)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK || string(body) != "hello" {
+				t.Errorf("GET %s = %d %q, want the origin's response passed through", tt.target, resp.StatusCode, body)
+			}
+			if got := resp.Header.Get(directHintHeader); got != tt.want {
+				t.Errorf("%s = %q, want %q", directHintHeader, got, tt.want)
+			}
+		})
+	}
+
+	withDirectHint(t, "127.0.0.0/8", http.StatusTemporaryRedirect)
+	echo := newEchoServer(t)
+	withRules(t, "127.0.0.1 direct\n", routeDirect)
+	conn, _, resp := connectThrough(t, srv.Listener.Addr().String(), echo, "")
+	conn.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get(directHintHeader) != "" {
+		t.Errorf("CONNECT = %d with %s %q, want a plain tunnel", resp.StatusCode, directHintHeader, resp.Header.Get(directHintHeader))
+	}
+}
+
+// TestAdvertiseDirectRedirect -advertise-direct=307时代理不访问源站，重定向到原URL，
+// 客户端以相同的方法和请求体直接访问Location即可得到源站的响应
+func TestAdvertiseDirectRedirect(t *testing.T) {
+	withRates(t, 0, 0)
+	received := make(chan string, 4)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received <- r.Method + " " + r.URL.RequestURI() + " " + string(body)
+		io.WriteString(w, "direct")
+	}))
+	t.Cleanup(origin.Close)
+	withRules(t, "127.0.0.1 direct\n", routeProxy)
+	withDirectHint(t, "127.0.0.1", http.StatusTemporaryRedirect)
+	srv := httptest.NewServer(routedHandler("规则代理"))
+	t.Cleanup(srv.Close)
+
+	client := proxyClient(srv.URL)
+	client.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+	target := origin.URL + "/upload?id=1"
+	resp, err := client.Post(target, "text/plain", strings.NewReader("payload"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusTemporaryRedirect || resp.Header.Get("Location") != target || resp.Header.Get(directHintHeader) != routeDirect {
+		t.Fatalf("POST via proxy = %d Location %q %s %q, want 307 to %s", resp.StatusCode, resp.Header.Get("Location"), directHintHeader, resp.Header.Get(directHintHeader), target)
+	}
+	select {
+	case got := <-received:
+		t.Fatalf("proxy forwarded the request to the origin: %s", got)
+	default:
+	}
+
+	// 按307的语义，客户端以原方法和请求体直接访问Location
+	direct, err := http.Post(resp.Header.Get("Location"), "text/plain", strings.NewReader("payload"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	direct.Body.Close()
+	if got := <-received; got != "POST /upload?id=1 payload" {
+		t.Errorf("origin received %q, want the original method, URL and body", got)
+	}
+
+	// 重定向同样只对受信任的客户端
+	withDirectHint(t, "10.0.0.0/8", http.StatusTemporaryRedirect)
+	resp, err = client.Post(target, "text/plain", strings.NewReader("payload"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get(directHintHeader) != "" {
+		t.Errorf("untrusted client: status %d %s %q, want the request forwarded", resp.StatusCode, directHintHeader, resp.Header.Get(directHintHeader))
+	}
+	if got := <-received; got != "POST /upload?id=1 payload" {
+		t.Errorf("origin received %q for the untrusted client", got)
+	}
+}
+
+func TestSetupDirectHint(t *testing.T) {
+	withDirectHint(t, "127.0.0.1", http.StatusUseProxy)
+	for _, code := range []int{301, 302, 200} {
+		directHintClients, advertiseDirect = "", code
+		if err := setupDirectHint(); err == nil {
+			t.Errorf("-advertise-direct %d accepted", code)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// errInvalidTarget 目标地址不符合主机名/IP语法
+var errInvalidTarget = errors.New("invalid target host")
+
+// validateTarget 严格校验host:port形式的目标地址，返回由校验后的主机和端口重新拼接的地址，
+// 拒绝空主机、空白和控制字符、userinfo、非法端口以及不符合主机名/IP语法的输入
+func validateTarget(target string) (string, error) {
+	for i := 0; i < len(target); i++ {
+		if c := target[i]; c <= ' ' || c == 0x7f || c == '@' {
+			return "", errInvalidTarget
+		}
+	}
+	host, port, err := net.SplitHostPort(target)
+	if err != nil || !validPort(port) {
+		return "", errInvalidTarget
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return net.JoinHostPort(ip.String(), port), nil
+	}
+	if !validHostname(host) {
+		return "", errInvalidTarget
+	}
+	return net.JoinHostPort(strings.ToLower(host), port), nil
+}
+
+// validPort 判断端口是否为1-65535之间的纯数字
+func validPort(port string) bool {
+	if port == "" || len(port) > 5 {
+		return false
+	}
+	for i := 0; i < len(port); i++ {
+		if port[i] < '0' || port[i] > '9' {
+			return false
+		}
+	}
+	n, _ := strconv.Atoi(port)
+	return n >= 1 && n <= 65535
+}
+
+// validHostname 按RFC 1123检查主机名，额外允许下划线和末尾的点
+func validHostname(host string) bool {
+	host = strings.TrimSuffix(host, ".")
+	if host == "" || len(host) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(host, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for i := 0; i < len(label); i++ {
+			c := label[i]
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// rejectInvalidTarget 校验请求的目标地址，非法时返回400并返回true；
+// CONNECT请求校验通过后r.Host被替换为规范化的地址，之后的握手和拨号只使用校验过的值
+func rejectInvalidTarget(w http.ResponseWriter, r *http.Request, title string) bool {
+	target := r.Host
+	if r.Method != http.MethodConnect {
+		target = requestTarget(r)
+	}
+	clean, err := validateTarget(target)
+	if err == nil && r.URL.User != nil {
+		// net/http解析请求行时已去掉了userinfo，这里仍按非法目标拒绝
+		err = errInvalidTarget
+	}
+	if err != nil {
+		logfCtx(r.Context(), levelInfo, "[%s] 拒绝非法的目标地址 %q", title, target)
+		writeProxyError(w, http.StatusBadRequest, reasonBadRequest, "", "Invalid target host")
+		return true
+	}
+	if r.Method == http.MethodConnect {
+		r.Host = clean
+	}
+	return false
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestValidateTarget(t *testing.T) {
+	tests := []struct {
+		target string
+		want   string // 为空表示应被拒绝
+	}{
+		{"example.com:443", "example.com:443"},
+		{"Example.COM:443", "example.com:443"},
+		{"example.com.:443", "example.com.:443"},
+		{"_srv.example.com:443", "_srv.example.com:443"},
+		{"192.0.2.1:80", "192.0.2.1:80"},
+		{"[2001:DB8::1]:443", "[2001:db8::1]:443"},
+		{"[::ffff:192.0.2.1]:443", "192.0.2.1:443"},
+		{"example.com", ""},
+		{"example.com:", ""},
+		{"example.com:0", ""},
+		{"example.com:65536", ""},
+		{"example.com:+443", ""},
+		{":443", ""},
+		{"user@example.com:443", ""},
+		{"example.com:443\r\nX-Injected: 1", ""},
+		{"exa mple.com:443", ""},
+		{"-example.com:443", ""},
+		{"example..com:443", ""},
+		{"exam/ple.com:443", ""},
+		{strings.Repeat("a", 64) + ".com:443", ""},
+		{"2001:db8::1:443", ""},
+	}
+	for _, tt := range tests {
+		got, err := validateTarget(tt.target)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("validateTarget(%q) = %q, want rejected", tt.target, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("validateTarget(%q) = %q, %v, want %q", tt.target, got, err, tt.want)
+		}
+	}
+}
+
+// FuzzValidateTarget 任意输入都不会panic；接受的目标可以被net.SplitHostPort拆分，
+// 主机不为空、端口合法，且再次校验得到相同的结果
+func FuzzValidateTarget(f *testing.F) {
+	for _, seed := range []string{
+		"example.com:443", "Example.COM:443", "example.com.:443", "_srv.example.com:443",
+		"192.0.2.1:80", "[2001:DB8::1]:443", "[::ffff:192.0.2.1]:443", "[fe80::1%eth0]:443",
+		"example.com", ":443", "user@example.com:443", "example.com:443\r\nX-Injected: 1",
+		"[::1]", "[[::1]]:80", "2001:db8::1:443", "example.com:00080", "\x00:1",
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, target string) {
+		got, err := validateTarget(target)
+		if err != nil {
+			return
+		}
+		host, port, err := net.SplitHostPort(got)
+		if err != nil {
+			t.Fatalf("validateTarget(%q) = %q, which SplitHostPort rejects: %v", target, got, err)
+		}
+		if host == "" || !validPort(port) {
+			t.Fatalf("validateTarget(%q) = %q with host %q port %q", target, got, host, port)
+		}
+		if again, err := validateTarget(got); err != nil || again != got {
+			t.Fatalf("validateTarget(%q) = %q, but validating it again gives %q, %v", target, got, again, err)
+		}
+	})
+}
+
+// TestRejectInvalidTarget 非法目标返回400，CONNECT通过校验后r.Host替换为规范化的地址
+func TestRejectInvalidTarget(t *testing.T) {
+	r := connectRequest("Example.COM:443")
+	w := httptest.NewRecorder()
+	if rejectInvalidTarget(w, r, "test") {
+		t.Fatalf("valid CONNECT rejected: %d", w.Code)
+	}
+	if r.Host != "example.com:443" {
+		t.Errorf("r.Host = %q, want the normalized target", r.Host)
+	}
+
+	r = connectRequest("bad_host!:443")
+	w = httptest.NewRecorder()
+	if !rejectInvalidTarget(w, r, "test") || w.Code != http.StatusBadRequest {
+		t.Errorf("invalid CONNECT target: status %d, want 400", w.Code)
+	}
+	if got := w.Header().Get("X-WebProxy-Error"); got != string(reasonBadRequest) {
+		t.Errorf("X-WebProxy-Error %q", got)
+	}
+
+	r = withClientKey(httptest.NewRequest(http.MethodGet, "http://example.com/path", nil))
+	if w := httptest.NewRecorder(); rejectInvalidTarget(w, r, "test") {
+		t.Errorf("plain GET without a port rejected: %d", w.Code)
+	}
+}
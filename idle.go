@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// tunnelIdleTimeout 隧道两个方向都没有数据多久后关闭，0表示不关闭
+var tunnelIdleTimeout time.Duration
+
+// errTunnelIdle 隧道超过-tunnel-idle-timeout没有数据，作为关闭原因输出
+var errTunnelIdle = errors.New("idle")
+
+// tunnelIdle 隧道两个方向共用的最后活动时间
+type tunnelIdle struct {
+	timeout time.Duration
+	last    atomic.Int64 // UnixNano
+}
+
+// newTunnelIdle timeout大于0时返回从现在开始计时的tunnelIdle，否则返回nil
+func newTunnelIdle(timeout time.Duration) *tunnelIdle {
+	if timeout <= 0 {
+		return nil
+	}
+	idle := &tunnelIdle{timeout: timeout}
+	idle.last.Store(time.Now().UnixNano())
+	return idle
+}
+
+// deadline 最后活动时间加上超时
+func (t *tunnelIdle) deadline() time.Time {
+	return time.Unix(0, t.last.Load()).Add(t.timeout)
+}
+
+// watch 为conn的读取加上空闲超时，不支持读超时的连接原样返回
+func (t *tunnelIdle) watch(conn net.Conn) io.ReadCloser {
+	if t == nil || conn.SetReadDeadline(t.deadline()) != nil {
+		return conn
+	}
+	return &idleReader{Conn: conn, idle: t}
+}
+
+// idleReader 以读超时实现空闲检测：每次读取前将读超时设为最后活动时间加超时，
+// 超时时另一个方向在期间有过数据则按新的最后活动时间继续等待
+type idleReader struct {
+	net.Conn
+	idle *tunnelIdle
+}
+
+// Read 读取并更新最后活动时间，两个方向都空闲超时后返回errTunnelIdle
+func (r *idleReader) Read(p []byte) (int, error) {
+	for {
+		r.Conn.SetReadDeadline(r.idle.deadline())
+		n, err := r.Conn.Read(p)
+		if n > 0 {
+			r.idle.last.Store(time.Now().UnixNano())
+		}
+		if err == nil || !isTimeout(err) {
+			return n, err
+		}
+		if n > 0 {
+			return n, nil
+		}
+		if time.Now().After(r.idle.deadline()) {
+			return 0, errTunnelIdle
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"reflect"
+	"runtime"
+	"runtime/pprof"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	leakCheckInterval time.Duration // 核对隧道goroutine数量与连接表的间隔，0表示不核对
+	leakStacks        bool          // 是否为转发goroutine打上隧道ID标签，/leaks 附带其调用栈
+)
+
+// leakThreshold 转发隧道的goroutine超出连接表中隧道所需的数量多少个时输出警告
+const leakThreshold = 64
+
+// tunnelGoroutinesPerTunnel 每个隧道最多的goroutine数量：两个方向的转发和等待两者结束的goroutine
+const tunnelGoroutinesPerTunnel = 3
+
+// tunnelFuncPrefix startTunnel中启动的goroutine在调用栈中的函数名前缀，可执行文件中为main.startTunnel.func，
+// 测试中为包路径加.startTunnel.func
+var tunnelFuncPrefix = runtime.FuncForPC(reflect.ValueOf(startTunnel).Pointer()).Name() + ".func"
+
+// labelTunnel 开启-leak-stacks时为当前goroutine打上隧道ID和转发方向的标签，goroutine profile中可以按隧道区分
+func labelTunnel(info *connInfo, direction string) {
+	if leakStacks {
+		pprof.SetGoroutineLabels(pprof.WithLabels(context.Background(),
+			pprof.Labels("tunnel", strconv.FormatUint(info.id, 10), "direction", direction)))
+	}
+}
+
+// goroutineGroup goroutine profile中调用栈和标签都相同的一组goroutine
+type goroutineGroup struct {
+	count  int
+	labels string // 形如 {"direction":"upload", "tunnel":"12"}，没有标签时为空
+	stack  string
+}
+
+// goroutineGroups 按debug=1的goroutine profile返回所有goroutine的分组
+func goroutineGroups() []goroutineGroup {
+	var buf bytes.Buffer
+	pprof.Lookup("goroutine").WriteTo(&buf, 1)
+	var groups []goroutineGroup
+	// 第一行是总数，之后每组以空行分隔，组的第一行为 数量 @ 地址...
+	for _, block := range strings.Split(buf.String(), "\n\n")[1:] {
+		head, rest, _ := strings.Cut(block, "\n")
+		fields := strings.Fields(head)
+		if len(fields) == 0 {
+			continue
+		}
+		n, err := strconv.Atoi(fields[0])
+		if err != nil {
+			continue
+		}
+		g := goroutineGroup{count: n, stack: rest}
+		if labels, ok := strings.CutPrefix(rest, "# labels: "); ok {
+			g.labels, g.stack, _ = strings.Cut(labels, "\n")
+		}
+		groups = append(groups, g)
+	}
+	return groups
+}
+
+// countTunnelGoroutines 返回调用栈中包含startTunnel所启动函数的goroutine数量
+func countTunnelGoroutines(groups []goroutineGroup) int {
+	n := 0
+	for _, g := range groups {
+		if strings.Contains(g.stack, tunnelFuncPrefix) {
+			n += g.count
+		}
+	}
+	return n
+}
+
+// reconcileTunnels 比较连接表中的隧道数量和实际属于隧道的goroutine数量，后者超出隧道所需的数量达到leakThreshold时输出警告，
+// 说明有转发goroutine在注销后仍未退出；返回两者供测试使用
+func reconcileTunnels() (tunnels, goroutines int) {
+	tunnels, _ = activeConns.counts()
+	goroutines = countTunnelGoroutines(goroutineGroups())
+	if excess := goroutines - tunnels*tunnelGoroutinesPerTunnel; excess >= leakThreshold {
+		log.Printf("[隧道] 可能存在泄漏: 连接表中 %d 个隧道，最多应有 %d 个转发goroutine，实际 %d 个，进程共 %d 个goroutine",
+			tunnels, tunnels*tunnelGoroutinesPerTunnel, goroutines, runtime.NumGoroutine())
+	}
+	return tunnels, goroutines
+}
+
+// setupLeakCheck 注册 /leaks，配置了-leak-check-interval时定期核对隧道goroutine数量
+func setupLeakCheck(interval time.Duration) {
+	adminMux.HandleFunc("/leaks", serveLeaks)
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		for range time.Tick(interval) {
+			reconcileTunnels()
+		}
+	}()
+}
+
+// leakStatus /leaks 返回的单个隧道：一个方向已经结束超过min_age，另一个方向仍在转发
+type leakStatus struct {
+	ID         uint64   `json:"id"`
+	Client     string   `json:"client"`
+	Target     string   `json:"target"`
+	Route      string   `json:"route"`
+	Closed     string   `json:"closed_direction"` // 已经结束的方向：upload表示客户端已关闭，download表示目标已关闭
+	ClosedFor  float64  `json:"closed_seconds"`
+	BytesUp    int64    `json:"bytes_up"`
+	BytesDown  int64    `json:"bytes_down"`
+	Age        float64  `json:"age_seconds"`
+	Goroutines int      `json:"goroutines,omitempty"` // 开启-leak-stacks时仍属于该隧道的goroutine数量
+	Stacks     []string `json:"stacks,omitempty"`     // 开启-leak-stacks时这些goroutine的调用栈
+}
+
+// halfClosed 返回已经结束的方向和结束的时间，两个方向都在转发或都已结束时ok为false
+func (info *connInfo) halfClosed() (direction string, at time.Time, ok bool) {
+	up, down := info.upDone.Load(), info.downDone.Load()
+	switch {
+	case up != 0 && down == 0:
+		return directionUpload, time.Unix(0, up), true
+	case down != 0 && up == 0:
+		return directionDownload, time.Unix(0, down), true
+	}
+	return "", time.Time{}, false
+}
+
+// serveLeaks 以JSON返回一个方向结束超过 ?min_age=(默认10m) 而另一个方向仍在转发的隧道，最早结束的在前，
+// 同时返回连接表中的隧道数量和属于隧道的goroutine数量
+func serveLeaks(w http.ResponseWriter, r *http.Request) {
+	if rejectAdmin(w, r) {
+		return
+	}
+	minAge := 10 * time.Minute
+	if value := r.URL.Query().Get("min_age"); value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil || d < 0 {
+			http.Error(w, "min_age must be a duration such as 10m", http.StatusBadRequest)
+			return
+		}
+		minAge = d
+	}
+
+	now := time.Now()
+	groups := goroutineGroups()
+	list := make([]leakStatus, 0)
+	for _, info := range activeConns.list("") {
+		if info.kind != connTunnel {
+			continue
+		}
+		direction, at, ok := info.halfClosed()
+		if !ok || now.Sub(at) < minAge {
+			continue
+		}
+		s := leakStatus{
+			ID:        info.id,
+			Client:    info.client,
+			Target:    info.target,
+			Route:     info.decision.kind(),
+			Closed:    direction,
+			ClosedFor: now.Sub(at).Seconds(),
+			BytesUp:   info.up.Load(),
+			BytesDown: info.down.Load(),
+			Age:       now.Sub(info.start).Seconds(),
+		}
+		if leakStacks {
+			label := `"tunnel":"` + strconv.FormatUint(info.id, 10) + `"`
+			for _, g := range groups {
+				if strings.Contains(g.labels, label) {
+					s.Goroutines += g.count
+					s.Stacks = append(s.Stacks, g.stack)
+				}
+			}
+		}
+		list = append(list, s)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ClosedFor > list[j].ClosedFor })
+
+	tunnels, _ := activeConns.counts()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Tunnels          int          `json:"tunnels"`
+		TunnelGoroutines int          `json:"tunnel_goroutines"`
+		Goroutines       int          `json:"goroutines"`
+		HalfClosed       []leakStatus `json:"half_closed"`
+	}{tunnels, countTunnelGoroutines(groups), runtime.NumGoroutine(), list})
+}
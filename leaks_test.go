@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// waitGoroutines 等待goroutine数量回落到baseline以内，超时时输出所有goroutine的调用栈
+func waitGoroutines(t *testing.T, baseline int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > baseline {
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<20)
+			t.Fatalf("%d goroutines still running, want at most %d:\n%s",
+				runtime.NumGoroutine(), baseline, buf[:runtime.Stack(buf, true)])
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestClientAbortDuringUpstreamHandshake 客户端在第二级代理响应CONNECT之前断开时，到第二级代理的连接被关闭，
+// 处理请求的goroutine全部退出
+func TestClientAbortDuringUpstreamHandshake(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	received, closed := make(chan struct{}, 8), make(chan struct{}, 8)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				// 读到CONNECT后不响应，直到代理关闭连接
+				if _, err := http.ReadRequest(bufio.NewReader(conn)); err != nil {
+					return
+				}
+				received <- struct{}{}
+				io.Copy(io.Discard, conn)
+				closed <- struct{}{}
+			}()
+		}
+	}()
+	withUpstreams(t, []*upstreamProxy{{scheme: "http", server: ln.Addr().String()}})
+	srv := httptest.NewServer(proxyHandler("二次代理"))
+	t.Cleanup(srv.Close)
+	baseline := runtime.NumGoroutine()
+
+	for i := 0; i < 3; i++ {
+		conn, _ := rawRequest(t, srv.Listener.Addr().String(), "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n")
+		select {
+		case <-received:
+		case <-time.After(3 * time.Second):
+			t.Fatal("the second proxy did not receive the CONNECT")
+		}
+		conn.Close()
+		select {
+		case <-closed:
+		case <-time.After(3 * time.Second):
+			t.Fatal("the connection to the second proxy stayed open after the client went away")
+		}
+	}
+	srv.CloseClientConnections()
+	waitGoroutines(t, baseline)
+	if tunnels, goroutines := reconcileTunnels(); tunnels != 0 || goroutines != 0 {
+		t.Errorf("reconcileTunnels = %d tunnels, %d goroutines, want 0, 0", tunnels, goroutines)
+	}
+}
+
+// TestOriginHalfCloseLeak 目标半关闭而客户端继续保持连接时，/leaks 列出该隧道和仍在运行的转发goroutine，
+// 客户端关闭后goroutine全部退出
+func TestOriginHalfCloseLeak(t *testing.T) {
+	savedStacks := leakStacks
+	t.Cleanup(func() { leakStacks = savedStacks })
+	leakStacks = true
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.WriteString(conn, "bye")
+		conn.(*net.TCPConn).CloseWrite()
+		io.Copy(io.Discard, conn)
+	}()
+	srv := httptest.NewServer(directHandler("正向代理"))
+	t.Cleanup(srv.Close)
+	baseline := runtime.NumGoroutine()
+
+	conn, br, resp := connectThrough(t, srv.Listener.Addr().String(), ln.Addr().String(), "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT status = %d, want 200", resp.StatusCode)
+	}
+	if data, err := io.ReadAll(br); err != nil || string(data) != "bye" {
+		t.Fatalf("read %q, %v before the half-close, want \"bye\"", data, err)
+	}
+
+	var leaks struct {
+		Tunnels          int          `json:"tunnels"`
+		TunnelGoroutines int          `json:"tunnel_goroutines"`
+		HalfClosed       []leakStatus `json:"half_closed"`
+	}
+	w := httptest.NewRecorder()
+	serveLeaks(w, adminRequest(http.MethodGet, "/leaks?min_age=0s", ""))
+	if err := json.NewDecoder(w.Body).Decode(&leaks); err != nil {
+		t.Fatal(err)
+	}
+	if len(leaks.HalfClosed) != 1 {
+		t.Fatalf("half_closed = %+v, want the one tunnel", leaks.HalfClosed)
+	}
+	leak := leaks.HalfClosed[0]
+	if leak.Closed != directionDownload || leak.Target != ln.Addr().String() || leak.BytesDown != 3 {
+		t.Errorf("leak = %+v, want the download direction closed after 3 bytes", leak)
+	}
+	if leak.Goroutines != 1 || len(leak.Stacks) != 1 || !strings.Contains(leak.Stacks[0], ".transfer") {
+		t.Errorf("leak goroutines = %d, stacks = %q, want the upload transfer", leak.Goroutines, leak.Stacks)
+	}
+	if leaks.Tunnels != 1 || leaks.TunnelGoroutines < 1 || leaks.TunnelGoroutines > tunnelGoroutinesPerTunnel {
+		t.Errorf("tunnels = %d, tunnel goroutines = %d", leaks.Tunnels, leaks.TunnelGoroutines)
+	}
+
+	w = httptest.NewRecorder()
+	serveLeaks(w, adminRequest(http.MethodGet, "/leaks?min_age=1h", ""))
+	if strings.Contains(w.Body.String(), `"id"`) {
+		t.Errorf("tunnel half-closed just now listed with min_age=1h: %s", w.Body)
+	}
+
+	conn.Close()
+	srv.CloseClientConnections()
+	waitGoroutines(t, baseline)
+	if tunnels, goroutines := reconcileTunnels(); tunnels != 0 || goroutines != 0 {
+		t.Errorf("reconcileTunnels = %d tunnels, %d goroutines, want 0, 0", tunnels, goroutines)
+	}
+}
+
+// TestGoroutineGroups 能从goroutine profile中解析出数量、标签和调用栈
+func TestGoroutineGroups(t *testing.T) {
+	total := 0
+	for _, g := range goroutineGroups() {
+		if g.count <= 0 || g.stack == "" {
+			t.Errorf("bad group %+v", g)
+		}
+		total += g.count
+	}
+	if n := runtime.NumGoroutine(); total < n/2 || total > n*2 {
+		t.Errorf("groups add up to %d goroutines, runtime reports %d", total, n)
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	acceptMinBackoff = 5 * time.Millisecond   // 文件描述符耗尽时的初始退避时间
+	acceptMaxBackoff = 1 * time.Second        // 退避时间上限
+	fdWarnInterval   = 30 * time.Second       // 文件描述符耗尽告警的最小间隔
+	shedAcceptWait   = 100 * time.Millisecond // 释放预留fd后等待排队连接的时间
+	fdPerConn        = 2                      // 每个隧道占用的fd数量(客户端和目标各一个)
+	fdHeadroom       = 64                     // 监听、日志文件、DNS等额外占用的fd
+	overloadMessage  = "Proxy is out of file descriptors, retry later"
+)
+
+// fdGuardListener 包装net.Listener，在文件描述符耗尽(EMFILE/ENFILE)时退避重试，
+// 并借助预留的fd接受排队中的连接返回503，避免客户端一直挂起
+type fdGuardListener struct {
+	net.Listener
+	title string
+
+	mu       sync.Mutex
+	reserve  *os.File  // 预留的应急fd
+	closed   bool      // 监听已关闭，不再重新预留fd
+	lastWarn time.Time // 上一次告警时间
+}
+
+// newFDGuardListener 创建fdGuardListener并预留一个应急fd
+func newFDGuardListener(ln net.Listener, title string) *fdGuardListener {
+	l := &fdGuardListener{Listener: ln, title: title}
+	l.reserve, _ = os.Open(os.DevNull)
+	return l
+}
+
+// Accept 接受连接，fd耗尽时按指数退避等待而不是空转
+func (l *fdGuardListener) Accept() (net.Conn, error) {
+	var delay time.Duration
+	for {
+		conn, err := l.Listener.Accept()
+		if err == nil {
+			return conn, nil
+		}
+		if !isFDExhausted(err) {
+			return nil, err
+		}
+		metricFDExhausted.with(l.title).Add(1)
+		l.shed(err)
+
+		if delay == 0 {
+			delay = acceptMinBackoff
+		} else {
+			delay *= 2
+		}
+		if delay > acceptMaxBackoff {
+			delay = acceptMaxBackoff
+		}
+		time.Sleep(delay)
+	}
+}
+
+// Close 关闭监听并释放预留的fd
+func (l *fdGuardListener) Close() error {
+	l.mu.Lock()
+	l.closed = true
+	if l.reserve != nil {
+		l.reserve.Close()
+		l.reserve = nil
+	}
+	l.mu.Unlock()
+	return l.Listener.Close()
+}
+
+// shed 释放预留fd，接受一个排队的连接并直接返回503，然后重新预留；
+// 接受连接时不持有锁，否则Close会等待阻塞中的Accept，退出时无法关闭监听
+func (l *fdGuardListener) shed(cause error) {
+	l.mu.Lock()
+	if l.reserve != nil {
+		l.reserve.Close()
+		l.reserve = nil
+	}
+	l.warn(cause)
+	closed := l.closed
+	l.mu.Unlock()
+	if closed {
+		return
+	}
+
+	// 排队的连接可能已被其他Accept取走，支持截止时间的监听只等待一小段时间
+	dl, canDeadline := l.Listener.(interface{ SetDeadline(time.Time) error })
+	if canDeadline {
+		dl.SetDeadline(time.Now().Add(shedAcceptWait))
+	}
+	if conn, err := l.Listener.Accept(); err == nil {
+		conn.SetWriteDeadline(time.Now().Add(time.Second))
+		writeRawError(conn, http.StatusServiceUnavailable, reasonOverloaded, "", overloadMessage)
+		conn.Close()
+		metricFDShed.with(l.title).Add(1)
+	}
+	if canDeadline {
+		dl.SetDeadline(time.Time{})
+	}
+
+	l.mu.Lock()
+	if !l.closed && l.reserve == nil {
+		l.reserve, _ = os.Open(os.DevNull)
+	}
+	l.mu.Unlock()
+}
+
+// warn 输出限频的fd耗尽告警，附带当前的限制和使用量，调用方需持有锁
+func (l *fdGuardListener) warn(err error) {
+	if time.Since(l.lastWarn) < fdWarnInterval {
+		return
+	}
+	l.lastWarn = time.Now()
+
+	limit, usage := "未知", "未知"
+	if n, ok := fdLimit(); ok {
+		limit = strconv.FormatUint(n, 10)
+	}
+	if n, ok := openFDCount(); ok {
+		usage = strconv.Itoa(n)
+	}
+	logf(levelError, "[%s] 文件描述符耗尽: %v (限制: %s, 已使用: %s)，暂停接受新连接", l.title, err, limit, usage)
+}
+
+// checkFDLimit 启动时检查RLIMIT_NOFILE是否足够支撑-max-conns，每个隧道需要两个fd，再加上监听和日志等的余量，
+// 不足时只输出告警，不影响启动
+func checkFDLimit() {
+	limit, ok := fdLimit()
+	if !ok || maxConns <= 0 {
+		return
+	}
+	if need := uint64(maxConns)*fdPerConn + fdHeadroom; limit < need {
+		logf(levelWarn, "[启动] 文件描述符限制 %d 低于-max-conns %d 需要的约 %d 个，连接数达到上限前可能先耗尽fd，建议调高ulimit -n", limit, maxConns, need)
+	}
+}
+
+// fdUsage 返回当前打开的fd数量，供指标使用
+func fdUsage() (int64, bool) {
+	n, ok := openFDCount()
+	return int64(n), ok
+}
+
+// fdLimitValue 返回fd软限制，供指标使用
+func fdLimitValue() (int64, bool) {
+	n, ok := fdLimit()
+	return int64(n), ok
+}
+
+// isFDExhausted 判断错误是否为文件描述符耗尽
+func isFDExhausted(err error) bool {
+	return errors.Is(err, syscall.EMFILE) || errors.Is(err, syscall.ENFILE)
+}
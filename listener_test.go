@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// fakeListener 按顺序返回预设的Accept结果，用完后阻塞直到关闭，用于模拟文件描述符耗尽
+type fakeListener struct {
+	mu      sync.Mutex
+	results []acceptResult
+	closed  chan struct{}
+	once    sync.Once
+}
+
+type acceptResult struct {
+	conn net.Conn
+	err  error
+}
+
+func newFakeListener(results ...acceptResult) *fakeListener {
+	return &fakeListener{results: results, closed: make(chan struct{})}
+}
+
+func (l *fakeListener) Accept() (net.Conn, error) {
+	l.mu.Lock()
+	if len(l.results) > 0 {
+		res := l.results[0]
+		l.results = l.results[1:]
+		l.mu.Unlock()
+		return res.conn, res.err
+	}
+	l.mu.Unlock()
+	<-l.closed
+	return nil, net.ErrClosed
+}
+
+func (l *fakeListener) Close() error {
+	l.once.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *fakeListener) Addr() net.Addr { return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)} }
+
+func emfile() error {
+	return &net.OpError{Op: "accept", Net: "tcp", Err: os.NewSyscallError("accept", syscall.EMFILE)}
+}
+
+func TestIsFDExhausted(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{emfile(), true},
+		{&net.OpError{Op: "accept", Err: os.NewSyscallError("accept", syscall.ENFILE)}, true},
+		{syscall.ECONNABORTED, false},
+		{net.ErrClosed, false},
+		{errors.New("other"), false},
+	}
+	for _, tt := range tests {
+		if got := isFDExhausted(tt.err); got != tt.want {
+			t.Errorf("isFDExhausted(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+// TestFDGuardShedsQueuedConn fd耗尽时用预留的fd接受排队的连接并返回503，之后恢复正常接受
+func TestFDGuardShedsQueuedConn(t *testing.T) {
+	shedServer, shedClient := net.Pipe()
+	okServer, okClient := net.Pipe()
+	defer shedClient.Close()
+	defer okClient.Close()
+	ln := newFDGuardListener(newFakeListener(
+		acceptResult{err: emfile()},
+		acceptResult{conn: shedServer},
+		acceptResult{conn: okServer},
+	), "test")
+	defer ln.Close()
+
+	status := make(chan int, 1)
+	go func() {
+		resp, err := http.ReadResponse(bufio.NewReader(shedClient), nil)
+		if err != nil {
+			status <- 0
+			return
+		}
+		status <- resp.StatusCode
+	}()
+
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("Accept: %v", err)
+	}
+	if conn != okServer {
+		t.Error("Accept did not return the connection after the shed one")
+	}
+	if got := <-status; got != http.StatusServiceUnavailable {
+		t.Errorf("shed connection got status %d, want 503", got)
+	}
+
+	ln.mu.Lock()
+	reserved := ln.reserve != nil
+	ln.mu.Unlock()
+	if !reserved {
+		t.Error("emergency fd was not reserved again after shedding")
+	}
+}
+
+// TestFDGuardCloseDuringShed shed阻塞在Accept时Close不能被锁住，退出时必须能关闭监听
+func TestFDGuardCloseDuringShed(t *testing.T) {
+	ln := newFDGuardListener(newFakeListener(acceptResult{err: emfile()}), "test")
+
+	accepted := make(chan error, 1)
+	go func() {
+		_, err := ln.Accept()
+		accepted <- err
+	}()
+	time.Sleep(50 * time.Millisecond) // 等待进入shed中阻塞的Accept
+
+	closed := make(chan struct{})
+	go func() {
+		ln.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Close blocked while shed was waiting in Accept")
+	}
+	select {
+	case err := <-accepted:
+		if !errors.Is(err, net.ErrClosed) {
+			t.Errorf("Accept after Close returned %v, want net.ErrClosed", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Accept did not return after Close")
+	}
+
+	ln.mu.Lock()
+	defer ln.mu.Unlock()
+	if ln.reserve != nil {
+		t.Error("emergency fd reserved again after Close")
+	}
+}
+
+func TestFDGaugesExported(t *testing.T) {
+	if _, ok := fdLimit(); !ok {
+		t.Skip("platform does not expose RLIMIT_NOFILE")
+	}
+	for _, m := range []*metricVec{metricOpenFDs, metricFDLimit} {
+		if v, ok := m.collect(); !ok || v <= 0 {
+			t.Errorf("%s collect = %d, %v", m.name, v, ok)
+		}
+	}
+}
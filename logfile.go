@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// logFileErrorInterval 写日志文件失败时向标准错误报告的最短间隔
+const logFileErrorInterval = time.Minute
+
+// rotatingFile 按大小和时间自动轮转的日志文件，path.1为最近一次轮转的文件，最多保留maxFiles个；
+// 写入失败时只向标准错误报告，不会把错误返回给调用方，避免影响请求处理
+type rotatingFile struct {
+	mu       sync.Mutex
+	path     string
+	maxSize  int64         // 超过该大小时轮转，0表示不按大小轮转
+	maxAge   time.Duration // 文件打开超过该时间时轮转，0表示不按时间轮转
+	maxFiles int           // 保留的旧文件数量
+
+	f        *os.File
+	size     int64
+	opened   time.Time
+	lastWarn time.Time
+}
+
+// openRotatingFile 以追加方式打开日志文件
+func openRotatingFile(path string, maxSize int64, maxAge time.Duration, maxFiles int) (*rotatingFile, error) {
+	w := &rotatingFile{path: path, maxSize: maxSize, maxAge: maxAge, maxFiles: maxFiles}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// open 打开path，调用方需持有锁或在初始化时调用
+func (w *rotatingFile) open() error {
+	f, err := os.OpenFile(w.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	w.f, w.size, w.opened = f, info.Size(), time.Now()
+	return nil
+}
+
+// Write 写入一条日志，需要时先轮转，总是返回成功
+func (w *rotatingFile) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.f == nil || (w.maxSize > 0 && w.size+int64(len(p)) > w.maxSize && w.size > 0) ||
+		(w.maxAge > 0 && time.Since(w.opened) >= w.maxAge) {
+		if err := w.rotate(); err != nil {
+			w.warn("轮转", err)
+		}
+	}
+	if w.f == nil {
+		return len(p), nil
+	}
+	n, err := w.f.Write(p)
+	w.size += int64(n)
+	if err != nil {
+		w.warn("写入", err)
+	}
+	return len(p), nil
+}
+
+// rotate 关闭当前文件，将path.N依次改名为path.N+1，超出maxFiles的删除，再打开新文件
+func (w *rotatingFile) rotate() error {
+	if w.f != nil {
+		w.f.Close()
+		w.f = nil
+	}
+	if w.maxFiles <= 0 {
+		os.Remove(w.path)
+	} else {
+		os.Remove(fmt.Sprintf("%s.%d", w.path, w.maxFiles))
+		for i := w.maxFiles - 1; i >= 1; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", w.path, i), fmt.Sprintf("%s.%d", w.path, i+1))
+		}
+		os.Rename(w.path, w.path+".1")
+	}
+	return w.open()
+}
+
+// reopen 重新打开日志文件，供外部工具改名或删除文件后使用
+func (w *rotatingFile) reopen() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.f != nil {
+		w.f.Close()
+		w.f = nil
+	}
+	if err := w.open(); err != nil {
+		w.warn("重新打开", err)
+	}
+}
+
+// warn 向标准错误报告日志文件的错误，logFileErrorInterval内只报告一次，调用方需持有锁
+func (w *rotatingFile) warn(op string, err error) {
+	if time.Since(w.lastWarn) < logFileErrorInterval {
+		return
+	}
+	w.lastWarn = time.Now()
+	fmt.Fprintf(os.Stderr, "%s %s日志文件 %s 失败: %v\n", time.Now().Format("2006/01/02 15:04:05"), op, w.path, err)
+}
+
+// logFiles 已打开的日志文件，收到SIGUSR1时全部重新打开
+var logFiles []*rotatingFile
+
+// setupLogFile 配置了-log-file时将日志写入该文件，之后的log调用和JSON日志都使用它
+func setupLogFile(path string) error {
+	if path == "" {
+		return nil
+	}
+	w, err := openLogFile(path)
+	if err != nil {
+		return err
+	}
+	log.SetOutput(w)
+	return nil
+}
+
+// openLogFile 按-log-max-size、-log-max-age和-log-max-files打开日志文件
+func openLogFile(path string) (*rotatingFile, error) {
+	w, err := openRotatingFile(path, int64(logMaxSizeMB)<<20, logMaxAge, logMaxFiles)
+	if err != nil {
+		return nil, err
+	}
+	logFiles = append(logFiles, w)
+	return w, nil
+}
+
+// reopenLogFiles 重新打开所有日志文件
+func reopenLogFiles() {
+	for _, w := range logFiles {
+		w.reopen()
+	}
+}
@@ -0,0 +1,20 @@
+//go:build !windows
+
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// watchLogReopen 收到SIGUSR1时重新打开日志文件，配合logrotate等外部工具使用
+func watchLogReopen() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGUSR1)
+	for range ch {
+		reopenLogFiles()
+		log.Println("收到SIGUSR1，已重新打开日志文件")
+	}
+}
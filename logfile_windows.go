@@ -0,0 +1,4 @@
+package main
+
+// watchLogReopen Windows下没有SIGUSR1，只依靠按大小和时间的自动轮转
+func watchLogReopen() {}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// -log-format的取值
+const (
+	logFormatText = "text" // 原有的文本格式
+	logFormatJSON = "json" // 每行一个JSON对象
+)
+
+// 日志级别，从低到高
+const (
+	levelDebug = "debug"
+	levelInfo  = "info"
+	levelWarn  = "warn"
+	levelError = "error"
+)
+
+// logLevels 按从低到高排列的日志级别
+var logLevels = []string{levelDebug, levelInfo, levelWarn, levelError}
+
+// minLogLevel -log-level在logLevels中的位置，低于它的日志不输出
+var minLogLevel = 1
+
+// listenerNames 各监听在JSON日志和指标中使用的名称
+var listenerNames = map[string]string{
+	"二次代理":   "proxy",
+	"正向代理":   "direct",
+	"规则代理":   "rules",
+	"SOCKS5": "socks5",
+	"h2c":    "h2c",
+	"管理接口":   "admin",
+	"调试":     "debug",
+	"指标":     "metrics",
+	"WPAD":   "wpad",
+	"隧道":     "tunnel",
+}
+
+// logEntry JSON格式的一行日志，所有行使用相同的key，没有的值留空
+type logEntry struct {
+	TS         time.Time `json:"ts"`
+	Level      string    `json:"level"`
+	Event      string    `json:"event"`
+	RequestID  string    `json:"request_id"`
+	Listener   string    `json:"listener"`
+	Client     string    `json:"client"`
+	User       string    `json:"user"`
+	Host       string    `json:"host"`
+	Method     string    `json:"method"`
+	Route      string    `json:"route"`
+	Upstream   string    `json:"upstream"`
+	Status     int       `json:"status"`
+	BytesUp    int64     `json:"bytes_up"`
+	BytesDown  int64     `json:"bytes_down"`
+	DurationMS int64     `json:"duration_ms"`
+	Error      string    `json:"error"`
+	Msg        string    `json:"msg"`
+
+	Rule        string `json:"rule,omitempty"`         // 命中的路由规则
+	Fallback    bool   `json:"fallback,omitempty"`     // 第二级代理不可用而改为直接转发
+	Retried     bool   `json:"retried,omitempty"`      // 连接第二级代理失败后换了下一个代理
+	IdleTimeout string `json:"idle_timeout,omitempty"` // 隧道实际使用的空闲超时，只在tunnel_closed中出现
+	Rate        string `json:"rate,omitempty"`         // 隧道实际使用的单连接限速，只在tunnel_closed中出现
+
+	Milestones *tunnelMilestones `json:"milestones,omitempty"` // 隧道建立过程中的时间点，只在tunnel_closed中出现
+
+	Conn *connTiming `json:"conn,omitempty"` // 转发HTTP请求取得的连接是否复用及新建连接的耗时，只在debug级别的request_done中出现
+}
+
+// jsonLogWriter JSON格式下log包的输出，将其他地方的文本日志包装为msg字段，使每一行都是JSON
+type jsonLogWriter struct {
+	mu  sync.Mutex
+	out io.Writer
+}
+
+// jsonLog 为nil表示使用文本格式
+var jsonLog *jsonLogWriter
+
+// setupLogging 校验-log-level和-log-format，json时接管log包的输出
+func setupLogging(format, level string) error {
+	minLogLevel = slices.Index(logLevels, level)
+	if minLogLevel < 0 {
+		minLogLevel = 1
+		return fmt.Errorf("invalid -log-level %q, want debug, info, warn or error", level)
+	}
+	switch format {
+	case logFormatText:
+		return nil
+	case logFormatJSON:
+		jsonLog = &jsonLogWriter{out: log.Writer()}
+		log.SetFlags(0)
+		log.SetOutput(jsonLog)
+		return nil
+	}
+	return fmt.Errorf("invalid -log-format %q, want text or json", format)
+}
+
+// Write 将log包输出的一行文本日志写为JSON
+func (w *jsonLogWriter) Write(p []byte) (int, error) {
+	w.write(logEntry{Level: levelInfo, Event: "log", Msg: strings.TrimSuffix(string(p), "\n")})
+	return len(p), nil
+}
+
+// write 输出一行JSON日志，未设置时间时使用当前时间
+func (w *jsonLogWriter) write(e logEntry) {
+	if e.TS.IsZero() {
+		e.TS = time.Now()
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	w.mu.Lock()
+	w.out.Write(append(line, '\n'))
+	w.mu.Unlock()
+	if syslogOut != nil {
+		syslogOut.send(e.Level, string(line))
+	}
+}
+
+// logEnabled 判断指定级别的日志是否输出
+func logEnabled(level string) bool {
+	return slices.Index(logLevels, level) >= minLogLevel
+}
+
+// logf 输出一行指定级别的日志，级别未启用时不格式化
+func logf(level, format string, args ...any) {
+	if logEnabled(level) {
+		logMessage(level, "", fmt.Sprintf(format, args...))
+	}
+}
+
+// logfCtx 与logf相同，并带上ctx中的请求ID
+func logfCtx(ctx context.Context, level, format string, args ...any) {
+	if logEnabled(level) {
+		logMessage(level, requestIDFrom(ctx), fmt.Sprintf(format, args...))
+	}
+}
+
+// logMessage 输出一行指定级别的文本日志，id为请求ID，文本格式下作为前缀，JSON格式下写入request_id字段
+func logMessage(level, id, msg string) {
+	if !logEnabled(level) {
+		return
+	}
+	if jsonLog == nil {
+		if id != "" {
+			msg = "[" + id + "] " + msg
+		}
+		if l := levelLoggers[level]; l != nil {
+			l.Print(msg)
+		} else {
+			log.Print(msg)
+		}
+		return
+	}
+	jsonLog.write(logEntry{Level: level, Event: "log", RequestID: id, Msg: msg})
+}
+
+// logEvent 输出一个结构化事件：JSON格式下写出e，文本格式下输出text，text为空表示文本格式不输出；
+// e.Level为空时有错误为warn，否则为info
+func logEvent(e logEntry, text string) {
+	if e.Level == "" {
+		e.Level = levelInfo
+		if e.Error != "" {
+			e.Level = levelWarn
+		}
+	}
+	if !logEnabled(e.Level) {
+		return
+	}
+	if jsonLog != nil {
+		jsonLog.write(e)
+		return
+	}
+	if text != "" {
+		logMessage(e.Level, e.RequestID, text)
+	}
+}
+
+// requestEntry 以请求的客户端、账户、目标和路由填充事件
+func requestEntry(r *http.Request, event, title string) logEntry {
+	e := logEntry{
+		Event:     event,
+		RequestID: requestIDFrom(r.Context()),
+		Listener:  listenerNames[title],
+		Client:    clientKey(r),
+		User:      authUser(r),
+		Host:      r.Host,
+		Method:    r.Method,
+		Route:     routeFrom(r),
+		Upstream:  usedUpstream(r),
+	}
+	// 已经连接第二级代理或改为直接转发后，以实际走的路径为准
+	if d := decisionFrom(r.Context()); d != nil {
+		e.Route, e.Rule, e.Fallback, e.Retried = d.kind(), d.rule, d.fallback.Load(), d.retried.Load()
+		if upstream := d.upstreamID(); upstream != "" || d.fallback.Load() {
+			e.Upstream = upstream
+		}
+	}
+	return e
+}
+
+// errorString 返回错误信息，err为nil时为空
+func errorString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 隧道数据的转发方向
+const (
+	directionUpload   = "upload"   // 客户端到目标
+	directionDownload = "download" // 目标到客户端
+)
+
+// metricVec 一组同名、按标签区分的指标，输出为Prometheus文本格式；
+// 指标都是整数，counter只增加，gauge可增可减
+type metricVec struct {
+	name   string
+	help   string
+	kind   string // counter或gauge
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]*metricValue // 以标签值拼接为key
+
+	collect func() (int64, bool) // 输出前读取当前值的gauge，例如打开的fd数量，返回false时不输出
+}
+
+// metricValue 一组标签值对应的指标值
+type metricValue struct {
+	labels []string
+	atomic.Int64
+}
+
+// metricRegistry 所有指标，按注册顺序输出
+var metricRegistry []*metricVec
+
+// newMetricVec 创建并注册指标
+func newMetricVec(kind, name, help string, labels ...string) *metricVec {
+	m := &metricVec{name: name, help: help, kind: kind, labels: labels, values: make(map[string]*metricValue)}
+	metricRegistry = append(metricRegistry, m)
+	return m
+}
+
+// newGaugeFunc 创建并注册一个无标签、在输出时才读取当前值的gauge
+func newGaugeFunc(name, help string, collect func() (int64, bool)) *metricVec {
+	m := newMetricVec("gauge", name, help)
+	m.collect = collect
+	return m
+}
+
+// with 返回标签值对应的指标值，不存在时创建
+func (m *metricVec) with(values ...string) *metricValue {
+	key := strings.Join(values, "\xff")
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	v, ok := m.values[key]
+	if !ok {
+		v = &metricValue{labels: values}
+		m.values[key] = v
+	}
+	return v
+}
+
+// total 返回所有标签值的合计
+func (m *metricVec) total() int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var n int64
+	for _, v := range m.values {
+		n += v.Load()
+	}
+	return n
+}
+
+// write 以Prometheus文本格式输出，各组标签按字典序排列
+func (m *metricVec) write(w io.Writer) {
+	if m.collect != nil {
+		v, ok := m.collect()
+		if !ok {
+			return
+		}
+		m.with().Store(v)
+	}
+	m.mu.Lock()
+	keys := make([]string, 0, len(m.values))
+	for key := range m.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	values := make([]*metricValue, 0, len(keys))
+	for _, key := range keys {
+		values = append(values, m.values[key])
+	}
+	m.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+	for _, v := range values {
+		pairs := make([]string, len(m.labels))
+		for i, label := range m.labels {
+			pairs[i] = label + `="` + labelEscaper.Replace(v.labels[i]) + `"`
+		}
+		if len(pairs) == 0 {
+			fmt.Fprintf(w, "%s %d\n", m.name, v.Load())
+			continue
+		}
+		fmt.Fprintf(w, "%s{%s} %d\n", m.name, strings.Join(pairs, ","), v.Load())
+	}
+}
+
+// labelEscaper 转义标签值中的反斜杠、双引号和换行
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// histogramVec 一组同名、按标签区分的直方图，记录耗时，以秒为单位输出；不写入-state-file
+type histogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64 // 各桶的上界(秒)，从小到大
+
+	mu     sync.Mutex
+	values map[string]*histogramValue
+}
+
+// histogramValue 一组标签值对应的直方图，counts[i]为落入第i个桶(不累计)的次数
+type histogramValue struct {
+	labels []string
+	counts []int64
+	count  int64
+	sum    float64
+}
+
+// histogramRegistry 所有直方图，在metricRegistry之后按注册顺序输出
+var histogramRegistry []*histogramVec
+
+// latencyBuckets 拨号、握手等耗时直方图默认使用的桶
+var latencyBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// newHistogramVec 创建并注册直方图
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	h := &histogramVec{name: name, help: help, labels: labels, buckets: buckets, values: make(map[string]*histogramValue)}
+	histogramRegistry = append(histogramRegistry, h)
+	return h
+}
+
+// observe 记录一次耗时
+func (h *histogramVec) observe(d time.Duration, values ...string) {
+	h.observeValue(d.Seconds(), values...)
+}
+
+// observeValue 记录一个数值，用于字节数等不是耗时的直方图
+func (h *histogramVec) observeValue(value float64, values ...string) {
+	key := strings.Join(values, "\xff")
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	v, ok := h.values[key]
+	if !ok {
+		v = &histogramValue{labels: values, counts: make([]int64, len(h.buckets))}
+		h.values[key] = v
+	}
+	if i := sort.SearchFloat64s(h.buckets, value); i < len(h.buckets) {
+		v.counts[i]++
+	}
+	v.count++
+	v.sum += value
+}
+
+// count 返回标签值对应的记录次数
+func (h *histogramVec) count(values ...string) int64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if v, ok := h.values[strings.Join(values, "\xff")]; ok {
+		return v.count
+	}
+	return 0
+}
+
+// write 以Prometheus文本格式输出，桶的计数为累计值，各组标签按字典序排列
+func (h *histogramVec) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	keys := make([]string, 0, len(h.values))
+	for key := range h.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		v := h.values[key]
+		pairs := make([]string, 0, len(h.labels)+1)
+		for i, label := range h.labels {
+			pairs = append(pairs, label+`="`+labelEscaper.Replace(v.labels[i])+`"`)
+		}
+		var cumulative int64
+		for i, le := range h.buckets {
+			cumulative += v.counts[i]
+			fmt.Fprintf(w, "%s_bucket{%s} %d\n", h.name, strings.Join(append(pairs, `le="`+strconv.FormatFloat(le, 'g', -1, 64)+`"`), ","), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket{%s} %d\n", h.name, strings.Join(append(pairs, `le="+Inf"`), ","), v.count)
+		suffix := ""
+		if len(pairs) > 0 {
+			suffix = "{" + strings.Join(pairs, ",") + "}"
+		}
+		fmt.Fprintf(w, "%s_sum%s %g\n%s_count%s %d\n", h.name, suffix, v.sum, h.name, suffix, v.count)
+	}
+}
+
+var (
+	metricRequests = newMetricVec("counter", "webproxy_requests_total",
+		"Requests received, by listener and method (CONNECT or HTTP).", "listener", "method")
+	metricUpstreamFailures = newMetricVec("counter", "webproxy_upstream_connect_failures_total",
+		"CONNECT requests refused by the second proxy, by response status. Health probes are not included.", "status")
+	metricUpstreamProbes = newMetricVec("counter", "webproxy_upstream_probes_total",
+		"Health and idle probes sent to second proxies, by upstream, kind (health or idle) and result.", "upstream", "kind", "result")
+	metricTunnelBytes = newMetricVec("counter", "webproxy_tunnel_bytes_total",
+		"Bytes forwarded through tunnels, by direction.", "direction")
+	metricRouted = newMetricVec("counter", "webproxy_routed_total",
+		"Requests and tunnels that finished forwarding, by route kind (direct, proxy or fallback) and the second proxy used.", "route", "upstream")
+	metricRoutedBytes = newMetricVec("counter", "webproxy_routed_bytes_total",
+		"Bytes forwarded by finished requests and tunnels, by route kind, second proxy and direction.", "route", "upstream", "direction")
+	metricTunnels = newMetricVec("gauge", "webproxy_open_tunnels",
+		"Tunnels currently open, by route.", "route")
+	metricConnsInUse = newMetricVec("gauge", "webproxy_conns_in_use",
+		"Requests and tunnels holding a -max-conns slot.")
+	metricConnsLimit = newMetricVec("gauge", "webproxy_conns_limit",
+		"The -max-conns limit, 0 when unlimited.")
+	metricStartTime = newGaugeFunc("webproxy_process_start_time_seconds",
+		"Unix time the process started. Counters restored from -state-file do not reset on restart, so compute rates with this in mind.",
+		func() (int64, bool) { return startTime.Unix(), true })
+	metricOpenFDs = newGaugeFunc("webproxy_open_fds",
+		"File descriptors currently open by the process.", fdUsage)
+	metricFDLimit = newGaugeFunc("webproxy_fd_limit",
+		"The RLIMIT_NOFILE soft limit.", fdLimitValue)
+	metricFDExhausted = newMetricVec("counter", "webproxy_accept_fd_exhausted_total",
+		"Accept calls that failed with EMFILE/ENFILE, by listener.", "listener")
+	metricFDShed = newMetricVec("counter", "webproxy_accept_fd_shed_total",
+		"Queued connections answered with 503 using the reserved fd, by listener.", "listener")
+	metricPanics = newMetricVec("counter", "webproxy_panics_total",
+		"Panics recovered, by listener, or tunnel for forwarding goroutines.", "where")
+	metricOriginQueued = newMetricVec("gauge", "webproxy_origin_queued",
+		"HTTP requests waiting for a -max-inflight-per-origin slot.")
+	metricOriginShed = newMetricVec("counter", "webproxy_origin_shed_total",
+		"HTTP requests refused by the -max-inflight-per-origin limiter, by reason (queue_full or timeout).", "reason")
+	metricHTTPConns = newMetricVec("counter", "webproxy_http_conns_total",
+		"Connections obtained by forwarded HTTP requests, by route and whether a pooled connection was reused (true or false).", "route", "reused")
+
+	metricHTTPDial = newHistogramVec("webproxy_http_dial_duration_seconds",
+		"Time forwarded HTTP requests spent opening new connections, by route and phase (dns, connect or tls).", latencyBuckets, "route", "phase")
+	metricHTTPConnIdle = newHistogramVec("webproxy_http_conn_idle_seconds",
+		"How long reused connections had been idle in the pool, by route.", []float64{.01, .1, .5, 1, 5, 10, 30, 60, 90}, "route")
+	metricTunnelMilestones = newHistogramVec("webproxy_tunnel_milestone_seconds",
+		"Time from receiving CONNECT to each tunnel milestone, by route and milestone (connect, first_client_byte or first_origin_byte).", latencyBuckets, "route", "milestone")
+	metricTunnelFirstBurst = newHistogramVec("webproxy_tunnel_first_client_burst_bytes",
+		"Size of the first read from the client after the tunnel was established, usually the TLS ClientHello, by route.", []float64{64, 256, 512, 1024, 2048, 4096, 8192, 16384, 65536}, "route")
+)
+
+// newMetricsServer 创建只提供 /metrics 的监听服务，与代理和管理接口完全分开，未配置-metrics-port时返回nil
+func newMetricsServer() *proxyServer {
+	if metricsPort == 0 {
+		return nil
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", serveMetrics)
+	return &proxyServer{title: "指标", server: &http.Server{
+		Addr:    fmt.Sprintf(":%d", metricsPort),
+		Handler: withRecovery("指标", mux.ServeHTTP),
+	}}
+}
+
+// serveMetrics 输出所有指标
+func serveMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	for _, m := range metricRegistry {
+		m.write(w)
+	}
+	for _, h := range histogramRegistry {
+		h.write(w)
+	}
+}
+
+// countRequest 按监听和请求方法计数
+func countRequest(r *http.Request, listener string) {
+	method := "HTTP"
+	if r.Method == http.MethodConnect {
+		method = http.MethodConnect
+	}
+	metricRequests.with(listener, method).Add(1)
+}
+
+// countUpstreamFailure 按状态码记录第二级代理拒绝的CONNECT，健康检查的探测另由countUpstreamProbe记录
+func countUpstreamFailure(ctx context.Context, status int) {
+	if isHealthProbe(ctx) {
+		return
+	}
+	metricUpstreamFailures.with(strconv.Itoa(status)).Add(1)
+}
+
+// 探测第二级代理的种类
+const (
+	probeHealth = "health" // -health-interval的定期健康检查
+	probeIdle   = "idle"   // -upstream-probe-idle的空闲隧道探测
+)
+
+// countUpstreamProbe 按第二级代理、探测种类和结果记录一次探测
+func countUpstreamProbe(u *upstreamProxy, kind string, err error) {
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	metricUpstreamProbes.with(u.server, kind, result).Add(1)
+}
+
+// byteCounter 转发过程中累计字节数的钩子，atomic.Int64和指标值都满足该接口，
+// 连接列表、指标和之后的配额等都通过它实时获得转发量
+type byteCounter interface {
+	Add(delta int64) int64
+}
+
+// countingReader 读取时将字节数累加到每个counter
+type countingReader struct {
+	io.Reader
+	counters []byteCounter
+}
+
+// Read 读取并计数
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if n > 0 {
+		for _, c := range r.counters {
+			c.Add(int64(n))
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// firstRead 作为byteCounter放进隧道一个方向的转发循环，第一次读到数据时记录从since起的耗时和读到的字节数，
+// 之后每次读取只多一次原子读，每个方向只有一个转发循环，不会并发调用；
+// 劫持时已缓存并先行转发的客户端数据不经过转发循环，不计入
+type firstRead struct {
+	since time.Time
+	at    *atomic.Int64 // 纳秒数，至少为1，0表示尚未读到数据
+	size  *atomic.Int64 // 可为nil
+}
+
+// Add 实现byteCounter，返回值没有意义
+func (f firstRead) Add(n int64) int64 {
+	if f.at.Load() != 0 {
+		return 0
+	}
+	// 先记下大小再记时间，读到时间不为0时大小已经可用
+	if f.size != nil {
+		f.size.Store(n)
+	}
+	f.at.Store(max(int64(time.Since(f.since)), 1))
+	return 0
+}
+
+// firstPending 判断counters中是否有尚未读到数据的firstRead
+func firstPending(counters []byteCounter) bool {
+	for _, c := range counters {
+		if f, ok := c.(firstRead); ok && f.at.Load() == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// tunnelMilestones 隧道的时间点，均为从收到CONNECT起算的毫秒数，尚未发生的为nil
+type tunnelMilestones struct {
+	ConnectMS        *float64 `json:"connect_ms,omitempty"`           // 到目标或第二级代理的连接建立
+	FirstClientMS    *float64 `json:"first_client_byte_ms,omitempty"` // 客户端在隧道中第一次发来数据
+	FirstOriginMS    *float64 `json:"first_origin_byte_ms,omitempty"` // 目标第一次发来数据
+	FirstClientBytes int64    `json:"first_client_bytes,omitempty"`   // 客户端第一次发来的数据的大小，通常是TLS ClientHello
+}
+
+// milestones 返回隧道当前的时间点，HTTP请求返回nil
+func (info *connInfo) milestones() *tunnelMilestones {
+	if info.kind != connTunnel {
+		return nil
+	}
+	ms := func(d time.Duration) *float64 {
+		v := float64(d.Microseconds()) / 1000
+		return &v
+	}
+	m := &tunnelMilestones{ConnectMS: ms(info.start.Sub(info.received))}
+	if d := info.firstUp.Load(); d > 0 {
+		m.FirstClientMS, m.FirstClientBytes = ms(time.Duration(d)), info.firstUpSize.Load()
+	}
+	if d := info.firstDown.Load(); d > 0 {
+		m.FirstOriginMS = ms(time.Duration(d))
+	}
+	return m
+}
+
+// String 用于隧道关闭的文本日志，例如 建立 1.2ms 首个上行 3.4ms(517 字节) 首个下行 20.1ms
+func (m *tunnelMilestones) String() string {
+	if m == nil {
+		return ""
+	}
+	format := func(v *float64) string {
+		if v == nil {
+			return "-"
+		}
+		return fmt.Sprintf("%.1fms", *v)
+	}
+	parts := []string{"建立 " + format(m.ConnectMS)}
+	up := "首个上行 " + format(m.FirstClientMS)
+	if m.FirstClientMS != nil {
+		up += fmt.Sprintf("(%d 字节)", m.FirstClientBytes)
+	}
+	parts = append(parts, up, "首个下行 "+format(m.FirstOriginMS))
+	return strings.Join(parts, " ")
+}
+
+// observeMilestones 隧道结束时将已发生的时间点和客户端第一次发来的数据大小计入直方图
+func observeMilestones(info *connInfo) {
+	route := info.decision.kind()
+	metricTunnelMilestones.observe(info.start.Sub(info.received), route, "connect")
+	if d := info.firstUp.Load(); d > 0 {
+		metricTunnelMilestones.observe(time.Duration(d), route, "first_client_byte")
+		metricTunnelFirstBurst.observeValue(float64(info.firstUpSize.Load()), route)
+	}
+	if d := info.firstDown.Load(); d > 0 {
+		metricTunnelMilestones.observe(time.Duration(d), route, "first_origin_byte")
+	}
+}
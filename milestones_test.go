@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestTunnelMilestones 按脚本进行的隧道：客户端在200之后等待再发送，目标收到后等待再回复，
+// /connections、tunnel_closed日志和直方图中的时间点都已记录且先后顺序正确
+func TestTunnelMilestones(t *testing.T) {
+	const hello = "client-hello-bytes"
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		buf := make([]byte, len(hello))
+		io.ReadFull(conn, buf)
+		time.Sleep(30 * time.Millisecond)
+		io.WriteString(conn, "server-hello")
+		io.Copy(io.Discard, conn)
+	}()
+	logs := withJSONLog(t, levelInfo)
+	withRates(t, 0, 0)
+	srv := httptest.NewServer(directHandler("正向代理"))
+	t.Cleanup(srv.Close)
+	target := ln.Addr().String()
+	beforeConnect := metricTunnelMilestones.count(routeDirect, "connect")
+	beforeOrigin := metricTunnelMilestones.count(routeDirect, "first_origin_byte")
+	beforeBurst := metricTunnelFirstBurst.count(routeDirect)
+
+	conn, br, resp := connectThrough(t, srv.Listener.Addr().String(), target, "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT status = %d, want 200", resp.StatusCode)
+	}
+	time.Sleep(50 * time.Millisecond)
+	io.WriteString(conn, hello)
+	reply := make([]byte, len("server-hello"))
+	if _, err := io.ReadFull(br, reply); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(where string, m *tunnelMilestones) {
+		t.Helper()
+		if m == nil || m.ConnectMS == nil || m.FirstClientMS == nil || m.FirstOriginMS == nil {
+			t.Fatalf("%s: milestones %+v, want all populated", where, m)
+		}
+		if !(*m.ConnectMS <= *m.FirstClientMS && *m.FirstClientMS+25 <= *m.FirstOriginMS) {
+			t.Errorf("%s: connect %.1fms first client byte %.1fms first origin byte %.1fms, want them in order",
+				where, *m.ConnectMS, *m.FirstClientMS, *m.FirstOriginMS)
+		}
+		if *m.FirstClientMS < 45 {
+			t.Errorf("%s: first client byte at %.1fms, but the client waited 50ms after 200", where, *m.FirstClientMS)
+		}
+		if m.FirstClientBytes != int64(len(hello)) {
+			t.Errorf("%s: first client burst %d bytes, want %d", where, m.FirstClientBytes, len(hello))
+		}
+	}
+
+	w := httptest.NewRecorder()
+	serveConnections(w, adminRequest(http.MethodGet, "/connections?host="+target, ""))
+	var list []connStatus
+	if err := json.NewDecoder(w.Body).Decode(&list); err != nil || len(list) != 1 {
+		t.Fatalf("connections = %s, %v, want one tunnel", w.Body, err)
+	}
+	check("/connections", list[0].Milestones)
+
+	conn.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for !strings.Contains(logs.String(), `"event":"tunnel_closed"`) && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	var closed *logEntry
+	for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+		var e logEntry
+		if json.Unmarshal([]byte(line), &e) == nil && e.Event == "tunnel_closed" {
+			closed = &e
+		}
+	}
+	if closed == nil {
+		t.Fatalf("no tunnel_closed line:\n%s", logs)
+	}
+	check("tunnel_closed", closed.Milestones)
+
+	if metricTunnelMilestones.count(routeDirect, "connect") != beforeConnect+1 ||
+		metricTunnelMilestones.count(routeDirect, "first_origin_byte") != beforeOrigin+1 ||
+		metricTunnelFirstBurst.count(routeDirect) != beforeBurst+1 {
+		t.Error("tunnel milestones were not observed in the histograms")
+	}
+}
+
+func TestTunnelMilestonesString(t *testing.T) {
+	v := func(f float64) *float64 { return &f }
+	tests := []struct {
+		m    *tunnelMilestones
+		want string
+	}{
+		{&tunnelMilestones{ConnectMS: v(1.23)}, "建立 1.2ms 首个上行 - 首个下行 -"},
+		{&tunnelMilestones{ConnectMS: v(1), FirstClientMS: v(3.4), FirstOriginMS: v(20.06), FirstClientBytes: 517}, "建立 1.0ms 首个上行 3.4ms(517 字节) 首个下行 20.1ms"},
+		{nil, ""},
+	}
+	for _, tt := range tests {
+		if got := tt.m.String(); got != tt.want {
+			t.Errorf("String() = %q, want %q", got, tt.want)
+		}
+	}
+}
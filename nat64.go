@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"time"
+)
+
+// nat64Net NAT64前缀，为nil表示未启用
+var nat64Net *net.IPNet
+
+// nat64PrefixLens RFC 6052允许的NAT64前缀长度
+var nat64PrefixLens = []int{96, 64, 56, 48, 40, 32}
+
+// ipv4OnlyArpa RFC 7050中ipv4only.arpa固定解析到的IPv4地址
+var ipv4OnlyArpa = []net.IP{net.IPv4(192, 0, 0, 170), net.IPv4(192, 0, 0, 171)}
+
+// setupNAT64 根据-nat64-prefix配置NAT64前缀，auto表示通过ipv4only.arpa探测
+func setupNAT64(value string) error {
+	if value == "" {
+		return nil
+	}
+	if value == "auto" {
+		prefix, err := detectNAT64Prefix()
+		if err != nil {
+			log.Println("[NAT64] 自动探测前缀失败，不启用NAT64:", err)
+			return nil
+		}
+		nat64Net = prefix
+		log.Println("[NAT64] 探测到前缀:", prefix)
+		return nil
+	}
+
+	_, prefix, err := net.ParseCIDR(value)
+	if err != nil || prefix.IP.To4() != nil {
+		return fmt.Errorf("invalid -nat64-prefix %q: must be an IPv6 prefix such as 64:ff9b::/96", value)
+	}
+	ones, _ := prefix.Mask.Size()
+	if !validNAT64Len(ones) {
+		return fmt.Errorf("invalid -nat64-prefix %q: prefix length must be one of 32, 40, 48, 56, 64, 96", value)
+	}
+	nat64Net = prefix
+	return nil
+}
+
+// validNAT64Len 判断前缀长度是否为RFC 6052允许的长度
+func validNAT64Len(ones int) bool {
+	for _, l := range nat64PrefixLens {
+		if l == ones {
+			return true
+		}
+	}
+	return false
+}
+
+// detectNAT64Prefix 解析ipv4only.arpa的AAAA记录，从中找出内嵌了知名IPv4地址的前缀(RFC 7050)
+func detectNAT64Prefix() (*net.IPNet, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	ips, err := net.DefaultResolver.LookupIP(ctx, "ip6", "ipv4only.arpa")
+	if err != nil {
+		return nil, err
+	}
+	for _, ip := range ips {
+		for _, ones := range nat64PrefixLens {
+			prefix := &net.IPNet{IP: ip.Mask(net.CIDRMask(ones, 128)), Mask: net.CIDRMask(ones, 128)}
+			v4, ok := nat64Extract(prefix, ip)
+			if !ok {
+				continue
+			}
+			for _, known := range ipv4OnlyArpa {
+				if v4.Equal(known) {
+					return prefix, nil
+				}
+			}
+		}
+	}
+	return nil, errors.New("no AAAA record of ipv4only.arpa embeds a well-known IPv4 address")
+}
+
+// nat64Synthesize 按RFC 6052将IPv4地址嵌入NAT64前缀，跳过第64-71位的保留字节
+func nat64Synthesize(prefix *net.IPNet, v4 net.IP) net.IP {
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, prefix.IP.To16())
+	ones, _ := prefix.Mask.Size()
+	pos := ones / 8
+	for _, b := range v4.To4() {
+		if pos == 8 {
+			pos++
+		}
+		ip[pos] = b
+		pos++
+	}
+	return ip
+}
+
+// nat64Extract 从NAT64合成地址中取回内嵌的IPv4地址
+func nat64Extract(prefix *net.IPNet, ip net.IP) (net.IP, bool) {
+	ip16 := ip.To16()
+	if ip16 == nil || ip.To4() != nil || !prefix.Contains(ip16) {
+		return nil, false
+	}
+	ones, _ := prefix.Mask.Size()
+	if ones < 64 && ip16[8] != 0 {
+		return nil, false
+	}
+	v4 := make(net.IP, net.IPv4len)
+	pos := ones / 8
+	for i := range v4 {
+		if pos == 8 {
+			pos++
+		}
+		v4[i] = ip16[pos]
+		pos++
+	}
+	return net.IPv4(v4[0], v4[1], v4[2], v4[3]), true
+}
+
+// policyIP 返回用于访问策略判断的地址，NAT64合成地址映射回内嵌的IPv4地址
+func policyIP(ip net.IP) net.IP {
+	if nat64Net != nil {
+		if v4, ok := nat64Extract(nat64Net, ip); ok {
+			return v4
+		}
+	}
+	return ip
+}
+
+// nat64Addrs 目标只有IPv4地址时返回对应的NAT64合成地址列表，否则返回nil表示按原地址拨号
+func nat64Addrs(ctx context.Context, addr string) ([]string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IP{ip}
+	} else {
+		ipAddrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range ipAddrs {
+			ips = append(ips, a.IP)
+		}
+	}
+
+	var addrs []string
+	for _, ip := range ips {
+		if ip.To4() == nil {
+			// 存在IPv6地址，直接使用原地址拨号
+			return nil, nil
+		}
+		addrs = append(addrs, net.JoinHostPort(nat64Synthesize(nat64Net, ip).String(), port))
+	}
+	return addrs, nil
+}
+
+// dialNAT64 通过NAT64合成地址依次尝试拨号
+func dialNAT64(ctx context.Context, dialer *net.Dialer, network string, addrs []string) (net.Conn, error) {
+	var lastErr error
+	for _, a := range addrs {
+		conn, err := dialer.DialContext(ctx, network, a)
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
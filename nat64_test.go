@@ -0,0 +1,125 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+// withNAT64 在测试期间设置NAT64前缀
+func withNAT64(t *testing.T, prefix string) {
+	t.Helper()
+	saved := nat64Net
+	t.Cleanup(func() { nat64Net = saved })
+	nat64Net = nil
+	if err := setupNAT64(prefix); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestNAT64RoundTrip 按RFC 6052 2.4节的示例合成每种前缀长度的地址，/32到/56跳过第8个字节，再取回原IPv4地址
+func TestNAT64RoundTrip(t *testing.T) {
+	v4 := net.ParseIP("192.0.2.33")
+	tests := []struct {
+		prefix, want string
+	}{
+		{"2001:db8::/32", "2001:db8:c000:221::"},
+		{"2001:db8:100::/40", "2001:db8:1c0:2:21::"},
+		{"2001:db8:122::/48", "2001:db8:122:c000:2:2100::"},
+		{"2001:db8:122:300::/56", "2001:db8:122:3c0:0:221::"},
+		{"2001:db8:122:344::/64", "2001:db8:122:344:c0:2:2100:0"},
+		{"2001:db8:122:344::/96", "2001:db8:122:344::c000:221"},
+	}
+	for _, tt := range tests {
+		_, prefix, err := net.ParseCIDR(tt.prefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ip := nat64Synthesize(prefix, v4)
+		if !ip.Equal(net.ParseIP(tt.want)) {
+			t.Errorf("%s: synthesized %s, want %s", tt.prefix, ip, tt.want)
+		}
+		if ones, _ := prefix.Mask.Size(); ones < 64 && ip[8] != 0 {
+			t.Errorf("%s: u-octet is %#x, want 0", tt.prefix, ip[8])
+		}
+		got, ok := nat64Extract(prefix, ip)
+		if !ok || !got.Equal(v4) {
+			t.Errorf("%s: extracted %s, %v, want %s", tt.prefix, got, ok, v4)
+		}
+	}
+}
+
+// TestNAT64ExtractRejects 前缀之外的地址、IPv4地址和u-octet不为0的地址不是合成地址
+func TestNAT64ExtractRejects(t *testing.T) {
+	_, prefix32, _ := net.ParseCIDR("2001:db8::/32")
+	_, prefix96, _ := net.ParseCIDR("64:ff9b::/96")
+	tests := []struct {
+		name   string
+		prefix *net.IPNet
+		ip     string
+	}{
+		{"outside prefix", prefix96, "2001:db8::c000:221"},
+		{"ipv4", prefix96, "192.0.2.33"},
+		{"u-octet set", prefix32, "2001:db8:c000:221:ff00::"},
+	}
+	for _, tt := range tests {
+		if v4, ok := nat64Extract(tt.prefix, net.ParseIP(tt.ip)); ok {
+			t.Errorf("%s: extracted %s from %s", tt.name, v4, tt.ip)
+		}
+	}
+}
+
+// TestPolicyIPNAT64 启用NAT64时合成地址按内嵌的IPv4地址判断访问策略，其他地址不变
+func TestPolicyIPNAT64(t *testing.T) {
+	synthesized := net.ParseIP("64:ff9b::7f00:1")
+	withNAT64(t, "")
+	if got := policyIP(synthesized); !got.Equal(synthesized) {
+		t.Errorf("without NAT64 policyIP(%s) = %s", synthesized, got)
+	}
+	withNAT64(t, "64:ff9b::/96")
+	tests := []struct{ ip, want string }{
+		{"64:ff9b::7f00:1", "127.0.0.1"},
+		{"64:ff9b::a00:1", "10.0.0.1"},
+		{"2001:db8::1", "2001:db8::1"},
+		{"192.0.2.1", "192.0.2.1"},
+	}
+	for _, tt := range tests {
+		if got := policyIP(net.ParseIP(tt.ip)); !got.Equal(net.ParseIP(tt.want)) {
+			t.Errorf("policyIP(%s) = %s, want %s", tt.ip, got, tt.want)
+		}
+	}
+	if !isSelfIP(synthesized) {
+		t.Errorf("%s embeds 127.0.0.1 but is not treated as a self address", synthesized)
+	}
+}
+
+// TestSetupNAT64 只接受RFC 6052允许长度的IPv6前缀
+func TestSetupNAT64(t *testing.T) {
+	tests := []struct {
+		value string
+		err   string
+	}{
+		{"64:ff9b::/96", ""},
+		{"2001:db8::/32", ""},
+		{"2001:db8:100::/40", ""},
+		{"2001:db8:122::/48", ""},
+		{"2001:db8:122:300::/56", ""},
+		{"2001:db8:122:344::/64", ""},
+		{"64:ff9b::/80", "prefix length must be one of"},
+		{"64:ff9b::/24", "prefix length must be one of"},
+		{"192.0.2.0/24", "must be an IPv6 prefix"},
+		{"64:ff9b::", "must be an IPv6 prefix"},
+	}
+	for _, tt := range tests {
+		withNAT64(t, "")
+		err := setupNAT64(tt.value)
+		switch {
+		case tt.err == "" && err != nil:
+			t.Errorf("setupNAT64(%q): %v", tt.value, err)
+		case tt.err == "" && nat64Net.String() != tt.value:
+			t.Errorf("setupNAT64(%q) set prefix %s", tt.value, nat64Net)
+		case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+			t.Errorf("setupNAT64(%q) error = %v, want %q", tt.value, err, tt.err)
+		}
+	}
+}
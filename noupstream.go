@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// 未配置-proxy-url时二次代理端口的行为
+const (
+	noUpstreamReject    = "reject"     // 直接返回503
+	noUpstreamDirect    = "direct"     // 按正向代理直接转发
+	noUpstreamFailStart = "fail-start" // 不启动二次代理监听
+)
+
+// validateNoUpstreamMode 校验-no-upstream-mode参数
+func validateNoUpstreamMode(mode string) error {
+	switch mode {
+	case noUpstreamReject, noUpstreamDirect, noUpstreamFailStart:
+		return nil
+	}
+	return fmt.Errorf("invalid -no-upstream-mode %q, want reject, direct or fail-start", mode)
+}
+
+// logNoUpstreamMode 未配置第二级代理时在启动时输出二次代理端口采用的行为
+func logNoUpstreamMode() {
+	switch noUpstreamMode {
+	case noUpstreamReject:
+		log.Printf("[二次代理] 未配置 -proxy-url，端口 %d 上的请求将直接返回503", proxyPort)
+	case noUpstreamDirect:
+		log.Printf("[二次代理] 未配置 -proxy-url，端口 %d 上的请求将直接转发", proxyPort)
+	case noUpstreamFailStart:
+		log.Printf("[二次代理] 未配置 -proxy-url，不启动端口 %d 的监听", proxyPort)
+	}
+}
+
+// handleWithoutUpstream 未配置第二级代理时按-no-upstream-mode处理二次代理端口收到的请求
+func handleWithoutUpstream(w http.ResponseWriter, r *http.Request) {
+	if noUpstreamMode == noUpstreamDirect {
+		if r.Method == http.MethodConnect {
+			handleDirectTunneling(w, r)
+		} else {
+			withOriginLimit(w, r, handleDirectHTTP)
+		}
+		return
+	}
+	writeProxyError(w, http.StatusServiceUnavailable, reasonConfigError, requestTarget(r), "No upstream proxy configured")
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestValidateNoUpstreamMode(t *testing.T) {
+	for _, mode := range []string{noUpstreamReject, noUpstreamDirect, noUpstreamFailStart} {
+		if err := validateNoUpstreamMode(mode); err != nil {
+			t.Errorf("validateNoUpstreamMode(%q) = %v", mode, err)
+		}
+	}
+	for _, mode := range []string{"", "Direct", "passthrough"} {
+		if validateNoUpstreamMode(mode) == nil {
+			t.Errorf("validateNoUpstreamMode(%q) accepted", mode)
+		}
+	}
+}
+
+// TestHandleWithoutUpstream reject返回503，direct按正向代理转发到源站
+func TestHandleWithoutUpstream(t *testing.T) {
+	saved := noUpstreamMode
+	t.Cleanup(func() { noUpstreamMode = saved })
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "origin")
+	}))
+	defer origin.Close()
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handleWithoutUpstream(w, withClientKey(r))
+	}))
+	defer proxy.Close()
+	client := proxyClient(proxy.URL)
+
+	noUpstreamMode = noUpstreamReject
+	resp, err := client.Get(origin.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("reject: status %d, want 503", resp.StatusCode)
+	}
+	if got := resp.Header.Get("X-WebProxy-Error"); got != string(reasonConfigError) {
+		t.Errorf("reject: X-WebProxy-Error %q, want %q", got, reasonConfigError)
+	}
+
+	noUpstreamMode = noUpstreamDirect
+	resp, err = client.Get(origin.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "origin" {
+		t.Errorf("direct: status %d body %q, want the origin response", resp.StatusCode, body)
+	}
+}
+
+// TestStatusPageNoUpstreamMode 状态页显示-no-upstream-mode，没有第二级代理时标明正在生效
+func TestStatusPageNoUpstreamMode(t *testing.T) {
+	saved := noUpstreamMode
+	t.Cleanup(func() { noUpstreamMode = saved })
+	page := func() string {
+		t.Helper()
+		w := httptest.NewRecorder()
+		serveStatusPage(w, adminRequest(http.MethodGet, "/", ""))
+		if w.Code != http.StatusOK {
+			t.Fatalf("GET / = %d", w.Code)
+		}
+		return w.Body.String()
+	}
+
+	withUpstreams(t, nil)
+	for _, mode := range []string{noUpstreamReject, noUpstreamDirect, noUpstreamFailStart} {
+		noUpstreamMode = mode
+		if want := "<tr><th>No-upstream mode</th><td>" + mode + " (in effect)</td></tr>"; !strings.Contains(page(), want) {
+			t.Errorf("status page does not contain %q", want)
+		}
+	}
+	withUpstreams(t, []*upstreamProxy{{scheme: "http", server: "127.0.0.1:3128"}})
+	if want := "<tr><th>No-upstream mode</th><td>fail-start</td></tr>"; !strings.Contains(page(), want) {
+		t.Errorf("with an upstream the status page should show the mode without (in effect), want %q", want)
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	originQueueLen  = 32              // 每个目标主机在并发已满时最多排队的请求数
+	originQueueWait = 2 * time.Second // 排队请求的最长等待时间
+	originRetry     = 1               // 被拒绝请求的Retry-After秒数
+)
+
+// 请求被拒绝的原因，用作webproxy_origin_shed_total的标签
+const (
+	shedQueueFull    = "queue_full" // 排队的请求已达上限
+	shedQueueTimeout = "timeout"    // 排队超过originQueueWait
+)
+
+// originSlot 一个目标主机的并发控制
+type originSlot struct {
+	sem  chan struct{} // 正在处理的请求
+	refs int           // 正在处理和排队的请求总数
+}
+
+// originLimiter 按目标主机限制普通HTTP请求的并发数，超出后短暂排队，队列满或等待超时则拒绝，
+// 所有监听端口共用同一个limiter
+type originLimiter struct {
+	mu      sync.Mutex
+	origins map[string]*originSlot
+}
+
+var originLimits = &originLimiter{origins: make(map[string]*originSlot)}
+
+// acquire 获取目标主机的处理名额，成功时返回释放函数
+func (l *originLimiter) acquire(ctx context.Context, key string, limit int) (func(), bool) {
+	l.mu.Lock()
+	slot, ok := l.origins[key]
+	if !ok {
+		slot = &originSlot{sem: make(chan struct{}, limit)}
+		l.origins[key] = slot
+	}
+	if slot.refs >= limit+originQueueLen {
+		l.mu.Unlock()
+		metricOriginShed.with(shedQueueFull).Add(1)
+		return nil, false
+	}
+	slot.refs++
+	l.mu.Unlock()
+
+	select {
+	case slot.sem <- struct{}{}:
+		return func() { l.release(key, slot, true) }, true
+	default:
+	}
+
+	// 并发已满，排队等待
+	metricOriginQueued.with().Add(1)
+	defer metricOriginQueued.with().Add(-1)
+	timer := time.NewTimer(originQueueWait)
+	defer timer.Stop()
+	select {
+	case slot.sem <- struct{}{}:
+		return func() { l.release(key, slot, true) }, true
+	case <-timer.C:
+		metricOriginShed.with(shedQueueTimeout).Add(1)
+	case <-ctx.Done():
+	}
+	l.release(key, slot, false)
+	return nil, false
+}
+
+// release 释放名额，没有请求引用时删除该目标主机的记录
+func (l *originLimiter) release(key string, slot *originSlot, held bool) {
+	if held {
+		<-slot.sem
+	}
+	l.mu.Lock()
+	slot.refs--
+	if slot.refs == 0 {
+		delete(l.origins, key)
+	}
+	l.mu.Unlock()
+}
+
+// withOriginLimit 在-max-inflight-per-origin限制下执行普通HTTP请求的处理函数，超出限制时返回503
+func withOriginLimit(w http.ResponseWriter, r *http.Request, handler http.HandlerFunc) {
+	if maxInflightPerOrigin <= 0 {
+		handler(w, r)
+		return
+	}
+	target := requestTarget(r)
+	release, ok := originLimits.acquire(r.Context(), target, maxInflightPerOrigin)
+	if !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(originRetry))
+		writeProxyError(w, http.StatusServiceUnavailable, reasonOverloaded, target, "Too many concurrent requests to this host, retry later")
+		return
+	}
+	defer release()
+	handler(w, r)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// waitGauge 等待指标达到want，超时后返回当前值
+func waitGauge(m *metricValue, want int64) int64 {
+	deadline := time.Now().Add(2 * time.Second)
+	for m.Load() != want && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	return m.Load()
+}
+
+// TestOriginLimiterQueueFull 并发已满时请求排队并计入webproxy_origin_queued，队列满后拒绝并按原因计数
+func TestOriginLimiterQueueFull(t *testing.T) {
+	l := &originLimiter{origins: make(map[string]*originSlot)}
+	release, ok := l.acquire(context.Background(), "example.com:80", 1)
+	if !ok {
+		t.Fatal("first request was refused")
+	}
+
+	queued := metricOriginQueued.with()
+	base := queued.Load()
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	for i := 0; i < originQueueLen; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if release, ok := l.acquire(ctx, "example.com:80", 1); ok {
+				release()
+			}
+		}()
+	}
+	if got := waitGauge(queued, base+originQueueLen); got != base+originQueueLen {
+		t.Fatalf("webproxy_origin_queued = %d, want %d", got, base+originQueueLen)
+	}
+
+	shed := metricOriginShed.with(shedQueueFull).Load()
+	if _, ok := l.acquire(context.Background(), "example.com:80", 1); ok {
+		t.Error("request beyond the queue was accepted")
+	}
+	if got := metricOriginShed.with(shedQueueFull).Load(); got != shed+1 {
+		t.Errorf("webproxy_origin_shed_total{reason=\"queue_full\"} = %d, want %d", got, shed+1)
+	}
+	if other, ok := l.acquire(context.Background(), "other.example:80", 1); !ok {
+		t.Error("a different origin was limited")
+	} else {
+		other()
+	}
+
+	cancel()
+	wg.Wait()
+	release()
+	if got := waitGauge(queued, base); got != base {
+		t.Errorf("webproxy_origin_queued = %d after the queue drained, want %d", got, base)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if n := len(l.origins); n != 0 {
+		t.Errorf("%d origins still tracked after every request finished", n)
+	}
+}
+
+func TestOriginLimiterQueueTimeout(t *testing.T) {
+	if testing.Short() {
+		t.Skip("waits for originQueueWait")
+	}
+	l := &originLimiter{origins: make(map[string]*originSlot)}
+	release, _ := l.acquire(context.Background(), "example.com:80", 1)
+	defer release()
+	shed := metricOriginShed.with(shedQueueTimeout).Load()
+	if _, ok := l.acquire(context.Background(), "example.com:80", 1); ok {
+		t.Fatal("queued request was accepted while the slot was held")
+	}
+	if got := metricOriginShed.with(shedQueueTimeout).Load(); got != shed+1 {
+		t.Errorf("webproxy_origin_shed_total{reason=\"timeout\"} = %d, want %d", got, shed+1)
+	}
+}
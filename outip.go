@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// maxOutIPPool 出口地址池的最大容量
+const maxOutIPPool = 65536
+
+var (
+	outIPPool []net.IP // 直接转发时可用的出口地址池，为空表示由系统选择
+	outIPv4   []net.IP // 地址池中的IPv4地址
+	outIPv6   []net.IP // 地址池中的IPv6地址
+)
+
+// parseOutIPPool 解析出口地址池，支持逗号分隔的单个地址和 起始-结束 形式的范围
+func parseOutIPPool(value string) ([]net.IP, error) {
+	var pool []net.IP
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		start, end, isRange := strings.Cut(item, "-")
+		first := net.ParseIP(strings.TrimSpace(start))
+		if first == nil {
+			return nil, fmt.Errorf("invalid -out-ip-pool entry %q", item)
+		}
+		if !isRange {
+			pool = append(pool, first)
+			continue
+		}
+		last := net.ParseIP(strings.TrimSpace(end))
+		if last == nil || (first.To4() == nil) != (last.To4() == nil) {
+			return nil, fmt.Errorf("invalid -out-ip-pool range %q", item)
+		}
+		if bytes.Compare(first.To16(), last.To16()) > 0 {
+			return nil, fmt.Errorf("invalid -out-ip-pool range %q: start is after end", item)
+		}
+		for ip := first.To16(); ; ip = nextIP(ip) {
+			if len(pool) >= maxOutIPPool {
+				return nil, fmt.Errorf("-out-ip-pool has more than %d addresses", maxOutIPPool)
+			}
+			pool = append(pool, ip)
+			if ip.Equal(last) {
+				break
+			}
+		}
+	}
+	if len(pool) == 0 {
+		return nil, errors.New("-out-ip-pool is empty")
+	}
+	return pool, nil
+}
+
+// nextIP 返回下一个IP地址
+func nextIP(ip net.IP) net.IP {
+	next := make(net.IP, len(ip))
+	copy(next, ip)
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] != 0 {
+			break
+		}
+	}
+	return next
+}
+
+// setOutIPPool 按地址族拆分出口地址池并生效，连接目标时使用与目标地址同一地址族的出口地址
+func setOutIPPool(pool []net.IP) {
+	var v4, v6 []net.IP
+	for _, ip := range pool {
+		if ip.To4() != nil {
+			v4 = append(v4, ip.To4())
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+	outIPPool, outIPv4, outIPv6 = pool, v4, v6
+}
+
+// outIPFor 按标识的哈希稳定地从对应地址族的地址池中选择出口地址，该地址族没有可用地址时返回nil
+func outIPFor(key string, v6 bool) net.IP {
+	pool := outIPv4
+	if v6 {
+		pool = outIPv6
+	}
+	if len(pool) == 0 || key == "" {
+		return nil
+	}
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return pool[h.Sum32()%uint32(len(pool))]
+}
+
+// egressChoice 一个请求分配到的出口地址，每个地址族各一个，为nil的地址族由系统选择
+type egressChoice struct {
+	v4, v6 net.IP
+	used   atomic.Value // string 实际使用的出口地址，供访问日志使用
+}
+
+// egressCtx 请求上下文中保存出口地址分配结果的key
+type egressCtx struct{}
+
+// withEgress 为请求分配出口地址：认证通过的账户按账户名、否则按客户端IP在地址池中稳定选择，
+// 账户配置了out-ip=时对该地址族使用指定的地址；没有地址池也没有指定地址时不做处理
+func withEgress(r *http.Request) *http.Request {
+	user := authUser(r)
+	override := userOutIP(user)
+	if len(outIPPool) == 0 && override == nil {
+		return r
+	}
+	key := user
+	if key == "" {
+		key = clientKey(r)
+	}
+	choice := &egressChoice{v4: outIPFor(key, false), v6: outIPFor(key, true)}
+	if override != nil {
+		if override.To4() != nil {
+			choice.v4 = override.To4()
+		} else {
+			choice.v6 = override
+		}
+	}
+	return r.WithContext(context.WithValue(r.Context(), egressCtx{}, choice))
+}
+
+// egressFrom 取出请求上下文中的出口地址分配，未分配时返回nil
+func egressFrom(ctx context.Context) *egressChoice {
+	c, _ := ctx.Value(egressCtx{}).(*egressChoice)
+	return c
+}
+
+// local 返回连接ip时使用的出口地址，与ip同一地址族
+func (c *egressChoice) local(ip net.IP) net.IP {
+	if ip.To4() != nil {
+		return c.v4
+	}
+	return c.v6
+}
+
+// key 返回区分出口地址的key，分配相同的请求共用一个连接池
+func (c *egressChoice) key() string {
+	return c.v4.String() + "|" + c.v6.String()
+}
+
+// record 记录实际使用的出口地址
+func (c *egressChoice) record(addr net.Addr) {
+	if tcp, ok := addr.(*net.TCPAddr); ok {
+		c.used.Store(tcp.IP.String())
+	}
+}
+
+// egressUsed 返回请求实际使用的出口地址，未分配出口地址或尚未建立连接时为空
+func egressUsed(r *http.Request) string {
+	if c := egressFrom(r.Context()); c != nil {
+		used, _ := c.used.Load().(string)
+		return used
+	}
+	return ""
+}
+
+// dialEgress 解析目标并按目标地址的地址族绑定出口地址后依次尝试连接；
+// 只有一个地址族有出口地址时优先连接该地址族的目标地址，都失败后再不绑定出口地址连接其余地址
+func dialEgress(ctx context.Context, dialer *net.Dialer, network, addr string, choice *egressChoice) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IP{ip}
+	} else {
+		setPhase(ctx, phaseResolve)
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range addrs {
+			ips = append(ips, a.IP)
+		}
+	}
+
+	// 有出口地址的地址族排在前面，组内保持解析结果的顺序
+	var bound, unbound []net.IP
+	for _, ip := range ips {
+		if choice.local(ip) != nil {
+			bound = append(bound, ip)
+		} else {
+			unbound = append(unbound, ip)
+		}
+	}
+	setPhase(ctx, phaseDial)
+	var lastErr error
+	for _, ip := range append(bound, unbound...) {
+		d := *dialer
+		if local := choice.local(ip); local != nil {
+			d.LocalAddr = &net.TCPAddr{IP: local}
+		}
+		conn, err := d.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			choice.record(conn.LocalAddr())
+			return conn, nil
+		}
+		lastErr = err
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	if lastErr == nil {
+		lastErr = &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return nil, lastErr
+}
+
+// egressTransport 直接转发普通HTTP请求的RoundTripper，按出口地址分配选择各自的http.Transport，
+// 避免不同出口地址的请求复用同一个连接，使源地址与分配不一致
+type egressTransport struct {
+	base       *http.Transport
+	transports sync.Map // egressTransportKey -> *http.Transport
+}
+
+// egressTransportKey 出口地址分配和命中规则的TLS设置共同决定使用的Transport
+type egressTransportKey struct {
+	egress string
+	tls    string
+}
+
+// RoundTrip 使用与请求的出口地址分配对应的Transport发送请求，命中规则带TLS设置时从对应的副本复制
+func (t *egressTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	tls := tlsFrom(req.Context())
+	base := transportForTLS(t.base, tls)
+	choice := egressFrom(req.Context())
+	if choice == nil {
+		return base.RoundTrip(req)
+	}
+	key := egressTransportKey{choice.key(), tls.transportKey()}
+	transport, ok := t.transports.Load(key)
+	if !ok {
+		transport, _ = t.transports.LoadOrStore(key, base.Clone())
+	}
+	return transport.(*http.Transport).RoundTrip(req)
+}
+
+// logOutIP 记录直接转发请求分配到的出口地址
+func logOutIP(r *http.Request) {
+	if c := egressFrom(r.Context()); c != nil {
+		logfCtx(r.Context(), levelDebug, "[正向代理] 客户端 %s 访问 %s 分配的出口地址: IPv4 %s IPv6 %s", clientKey(r), r.Host, c.v4, c.v6)
+	}
+}
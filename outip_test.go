@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseOutIPPool(t *testing.T) {
+	tests := []struct {
+		value string
+		want  int
+		ok    bool
+	}{
+		{"203.0.113.10", 1, true},
+		{"203.0.113.10-203.0.113.20", 11, true},
+		{"203.0.113.10, 2001:db8::1-2001:db8::3", 4, true},
+		{"203.0.113.255-203.0.114.1", 3, true},
+		{"203.0.113.20-203.0.113.10", 0, false},
+		{"203.0.113.1-2001:db8::1", 0, false},
+		{"not-an-ip", 0, false},
+		{"", 0, false},
+	}
+	for _, tt := range tests {
+		pool, err := parseOutIPPool(tt.value)
+		if (err == nil) != tt.ok {
+			t.Errorf("parseOutIPPool(%q) error = %v, want ok %v", tt.value, err, tt.ok)
+			continue
+		}
+		if len(pool) != tt.want {
+			t.Errorf("parseOutIPPool(%q) = %d addresses, want %d", tt.value, len(pool), tt.want)
+		}
+	}
+}
+
+// withPool 在测试期间使用给定的出口地址池和账户表
+func withPool(t *testing.T, pool string, users map[string]credential) {
+	t.Helper()
+	savedPool, savedStore := outIPPool, authStore.Load()
+	t.Cleanup(func() {
+		setOutIPPool(savedPool)
+		authStore.Store(savedStore)
+	})
+	var ips []net.IP
+	if pool != "" {
+		var err error
+		if ips, err = parseOutIPPool(pool); err != nil {
+			t.Fatal(err)
+		}
+	}
+	setOutIPPool(ips)
+	if users != nil {
+		authStore.Store(&credentialStore{users: users})
+	} else {
+		authStore.Store(nil)
+	}
+}
+
+// TestOutIPForStable 同一标识总是分配到同一个出口地址，且只从与目标同一地址族的地址中选择
+func TestOutIPForStable(t *testing.T) {
+	withPool(t, "203.0.113.10-203.0.113.20,2001:db8::10-2001:db8::1f", nil)
+	for _, key := range []string{"alice", "192.0.2.7", "2001:db8:1::5"} {
+		v4, v6 := outIPFor(key, false), outIPFor(key, true)
+		if v4 == nil || v4.To4() == nil {
+			t.Fatalf("outIPFor(%q, v4) = %v, want an IPv4 address", key, v4)
+		}
+		if v6 == nil || v6.To4() != nil {
+			t.Fatalf("outIPFor(%q, v6) = %v, want an IPv6 address", key, v6)
+		}
+		for i := 0; i < 100; i++ {
+			if !outIPFor(key, false).Equal(v4) || !outIPFor(key, true).Equal(v6) {
+				t.Fatalf("outIPFor(%q) is not stable", key)
+			}
+		}
+	}
+	if outIPFor("", false) != nil {
+		t.Error("empty key was assigned an address")
+	}
+
+	withPool(t, "203.0.113.10", nil)
+	if ip := outIPFor("alice", true); ip != nil {
+		t.Errorf("IPv6 pick from an IPv4-only pool = %v, want nil", ip)
+	}
+}
+
+// egressRequest 构造一个已认证(user非空时)的请求并分配出口地址
+func egressRequest(user, remote string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	r.RemoteAddr = remote
+	if user != "" {
+		r = r.WithContext(context.WithValue(r.Context(), authUserCtx{}, authResult{user: user, ok: true}))
+	}
+	return withEgress(withClientKey(r))
+}
+
+// TestWithEgressOverride 账户的out-ip=优先于地址池的哈希分配，只替换对应地址族
+func TestWithEgressOverride(t *testing.T) {
+	withPool(t, "203.0.113.10-203.0.113.20,2001:db8::10-2001:db8::1f", map[string]credential{
+		"alice": {secret: "x", outIP: net.ParseIP("198.51.100.99")},
+		"bob":   {secret: "x"},
+	})
+
+	alice := egressFrom(egressRequest("alice", "192.0.2.1:1000").Context())
+	if alice == nil || !alice.v4.Equal(net.ParseIP("198.51.100.99")) {
+		t.Fatalf("alice v4 = %v, want the out-ip override", alice)
+	}
+	if !alice.v6.Equal(outIPFor("alice", true)) {
+		t.Errorf("alice v6 = %v, want the pool pick %v", alice.v6, outIPFor("alice", true))
+	}
+
+	// 认证用户按账户名分配，与客户端地址无关
+	bob1 := egressFrom(egressRequest("bob", "192.0.2.1:1000").Context())
+	bob2 := egressFrom(egressRequest("bob", "192.0.2.200:1000").Context())
+	if bob1.key() != bob2.key() || !bob1.v4.Equal(outIPFor("bob", false)) {
+		t.Errorf("bob assignments differ across client addresses: %s vs %s", bob1.key(), bob2.key())
+	}
+
+	// 未认证时按客户端IP分配
+	anon := egressFrom(egressRequest("", "192.0.2.1:1000").Context())
+	if !anon.v4.Equal(outIPFor("192.0.2.1", false)) {
+		t.Errorf("anonymous v4 = %v, want %v", anon.v4, outIPFor("192.0.2.1", false))
+	}
+}
+
+func TestWithEgressOverrideWithoutPool(t *testing.T) {
+	withPool(t, "", map[string]credential{"alice": {secret: "x", outIP: net.ParseIP("2001:db8::99")}})
+	if c := egressFrom(egressRequest("", "192.0.2.1:1000").Context()); c != nil {
+		t.Errorf("request without pool or override was assigned %s", c.key())
+	}
+	c := egressFrom(egressRequest("alice", "192.0.2.1:1000").Context())
+	if c == nil || c.v4 != nil || !c.v6.Equal(net.ParseIP("2001:db8::99")) {
+		t.Errorf("alice = %+v, want only the IPv6 override", c)
+	}
+}
+
+func TestParseCredential(t *testing.T) {
+	tests := []struct {
+		value  string
+		secret string
+		outIP  string
+		ok     bool
+	}{
+		{"secret", "secret", "", true},
+		{"$2y$10$abcdefghijklmnopqrstuv out-ip=203.0.113.15", "$2y$10$abcdefghijklmnopqrstuv", "203.0.113.15", true},
+		{"pass\tout-ip=2001:db8::1", "pass", "2001:db8::1", true},
+		{"two words", "two words", "", true},
+		{"pass key=value", "pass key=value", "", true},
+		{"pass out-ip=bogus", "", "", false},
+	}
+	for _, tt := range tests {
+		c, err := parseCredential(tt.value)
+		if (err == nil) != tt.ok {
+			t.Errorf("parseCredential(%q) error = %v, want ok %v", tt.value, err, tt.ok)
+			continue
+		}
+		if !tt.ok {
+			continue
+		}
+		if c.secret != tt.secret {
+			t.Errorf("parseCredential(%q) secret = %q, want %q", tt.value, c.secret, tt.secret)
+		}
+		if got := c.outIP.String(); tt.outIP != "" && got != net.ParseIP(tt.outIP).String() || tt.outIP == "" && c.outIP != nil {
+			t.Errorf("parseCredential(%q) out-ip = %v, want %q", tt.value, c.outIP, tt.outIP)
+		}
+	}
+}
+
+// TestEgressTransportNoCrossClientReuse 不同出口地址的请求不能复用彼此的连接，源地址始终与分配一致
+func TestEgressTransportNoCrossClientReuse(t *testing.T) {
+	if ln, err := net.Listen("tcp", "127.0.0.2:0"); err != nil {
+		t.Skip("127.0.0.2 is not usable as a source address here")
+	} else {
+		ln.Close()
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, _ := net.SplitHostPort(r.RemoteAddr)
+		io.WriteString(w, host)
+	}))
+	defer srv.Close()
+
+	transport := &egressTransport{base: directTransport.base.Clone()}
+	defer transport.base.CloseIdleConnections()
+	for i := 0; i < 3; i++ {
+		for _, source := range []string{"127.0.0.1", "127.0.0.2"} {
+			choice := &egressChoice{v4: net.ParseIP(source).To4()}
+			req := httptest.NewRequest(http.MethodGet, srv.URL, nil).WithContext(context.WithValue(context.Background(), egressCtx{}, choice))
+			req.RequestURI = ""
+			resp, err := transport.RoundTrip(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if string(body) != source {
+				t.Errorf("request assigned %s arrived from %s", source, body)
+			}
+			if used, _ := choice.used.Load().(string); used != "" && used != source {
+				t.Errorf("recorded egress %s, want %s", used, source)
+			}
+		}
+	}
+}
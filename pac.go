@@ -0,0 +1,124 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// defaultPACTemplate 默认的PAC脚本模板，.Bypass中的域名及其子域名直连，其余走代理
+const defaultPACTemplate = `function FindProxyForURL(url, host) {
+{{- range .Bypass}}
+    if (host == "{{.}}" || dnsDomainIs(host, ".{{.}}")) return "DIRECT";
+{{- end}}
+    return "PROXY {{.Proxy}}";
+}
+`
+
+// pacData 渲染PAC模板时可用的数据
+type pacData struct {
+	Proxy  string   // 浏览器应使用的代理地址 host:port
+	Bypass []string // 直连的域名
+}
+
+var (
+	pacTemplate *template.Template // 当前使用的PAC模板
+	pacBypass   []string           // 解析后的-pac-bypass
+)
+
+// setupPAC 解析PAC模板和直连域名，并在管理接口上注册/proxy.pac
+func setupPAC(templatePath string, bypass []string) error {
+	text := defaultPACTemplate
+	if templatePath != "" {
+		data, err := os.ReadFile(templatePath)
+		if err != nil {
+			return err
+		}
+		text = string(data)
+	}
+	t, err := template.New("pac").Parse(text)
+	if err != nil {
+		return err
+	}
+	pacTemplate = t
+
+	for _, value := range bypass {
+		for _, domain := range strings.Split(value, ",") {
+			if domain = strings.Trim(strings.TrimSpace(domain), "."); domain != "" {
+				pacBypass = append(pacBypass, strings.ToLower(domain))
+			}
+		}
+	}
+	adminMux.HandleFunc("/proxy.pac", servePAC)
+	return nil
+}
+
+// pacProxyPort 返回PAC中应使用的代理端口：启用规则路由时为规则端口，配置了第二级代理时为二次代理端口，否则为直接转发端口
+func pacProxyPort() int {
+	switch {
+	case routes.Load() != nil:
+		return rulesPort
+	case len(upstreamList()) > 0:
+		return proxyPort
+	}
+	return directPort
+}
+
+// servePAC 根据当前的监听地址生成PAC脚本，代理主机取-pac-host，未配置时取请求PAC时使用的主机名
+func servePAC(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	host := pacHost
+	if host == "" {
+		host = r.Host
+		if h, _, err := net.SplitHostPort(r.Host); err == nil {
+			host = h
+		}
+	}
+	data := pacData{Proxy: net.JoinHostPort(host, strconv.Itoa(pacProxyPort())), Bypass: pacBypass}
+
+	var sb strings.Builder
+	if err := pacTemplate.Execute(&sb, data); err != nil {
+		http.Error(w, "Failed to render PAC file: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write([]byte(sb.String()))
+}
+
+// newWPADServer 创建WPAD监听服务，只对Host为wpad或-wpad-name指定的名称、路径为/wpad.dat的请求返回PAC，
+// 其余请求(包括带绝对URI的代理请求)一律返回404
+func newWPADServer() *proxyServer {
+	if !wpadEnabled {
+		return nil
+	}
+	names := map[string]bool{"wpad": true}
+	for _, value := range wpadNames {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.ToLower(strings.TrimSpace(name)); name != "" {
+				names[strings.TrimSuffix(name, ".")] = true
+			}
+		}
+	}
+	return &proxyServer{title: "WPAD", server: &http.Server{
+		Addr: net.JoinHostPort("", strconv.Itoa(wpadPort)),
+		Handler: withRecovery("WPAD", func(w http.ResponseWriter, r *http.Request) {
+			host := r.Host
+			if h, _, err := net.SplitHostPort(host); err == nil {
+				host = h
+			}
+			host = strings.TrimSuffix(strings.ToLower(host), ".")
+			if r.URL.IsAbs() || r.URL.Path != "/wpad.dat" || !names[host] {
+				http.NotFound(w, r)
+				return
+			}
+			servePAC(w, r)
+		}),
+	}}
+}
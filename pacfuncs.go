@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net"
+	"strings"
+	"time"
+)
+
+// pacNow 当前时间，测试中替换以验证weekdayRange和timeRange
+var pacNow = time.Now
+
+// pacFunctions PAC脚本可以调用的标准辅助函数，dateRange未实现，调用时求值出错
+var pacFunctions = map[string]jsBuiltin{
+	"isPlainHostName": func(args []any) (any, error) {
+		return !strings.Contains(jsString(jsArg(args, 0)), "."), nil
+	},
+	"dnsDomainIs": func(args []any) (any, error) {
+		return strings.HasSuffix(strings.ToLower(jsString(jsArg(args, 0))), strings.ToLower(jsString(jsArg(args, 1)))), nil
+	},
+	"localHostOrDomainIs": func(args []any) (any, error) {
+		host, hostdom := strings.ToLower(jsString(jsArg(args, 0))), strings.ToLower(jsString(jsArg(args, 1)))
+		return host == hostdom || (!strings.Contains(host, ".") && strings.HasPrefix(hostdom, host+".")), nil
+	},
+	"isResolvable": func(args []any) (any, error) {
+		return pacResolve(jsString(jsArg(args, 0))) != nil, nil
+	},
+	"dnsResolve": func(args []any) (any, error) {
+		if ip := pacResolve(jsString(jsArg(args, 0))); ip != nil {
+			return ip.String(), nil
+		}
+		return nil, nil
+	},
+	"isInNet": func(args []any) (any, error) {
+		ip := pacResolve(jsString(jsArg(args, 0)))
+		pattern, mask := net.ParseIP(jsString(jsArg(args, 1))).To4(), net.ParseIP(jsString(jsArg(args, 2))).To4()
+		if ip == nil || pattern == nil || mask == nil {
+			return false, nil
+		}
+		m := net.IPMask(mask)
+		return ip.Mask(m).Equal(pattern.Mask(m)), nil
+	},
+	"myIpAddress": func([]any) (any, error) {
+		for _, ip := range localIPs() {
+			if ip4 := ip.To4(); ip4 != nil && !ip4.IsLoopback() {
+				return ip4.String(), nil
+			}
+		}
+		return "127.0.0.1", nil
+	},
+	"dnsDomainLevels": func(args []any) (any, error) {
+		return float64(strings.Count(jsString(jsArg(args, 0)), ".")), nil
+	},
+	"shExpMatch": func(args []any) (any, error) {
+		return shExpMatch(jsString(jsArg(args, 0)), jsString(jsArg(args, 1))), nil
+	},
+	"weekdayRange": func(args []any) (any, error) {
+		now, args := pacTime(args)
+		days := []string{"SUN", "MON", "TUE", "WED", "THU", "FRI", "SAT"}
+		index := func(v any) int {
+			for i, d := range days {
+				if strings.EqualFold(jsString(v), d) {
+					return i
+				}
+			}
+			return -1
+		}
+		start, end := index(jsArg(args, 0)), index(jsArg(args, 0))
+		if len(args) > 1 {
+			end = index(args[1])
+		}
+		if start < 0 || end < 0 {
+			return false, nil
+		}
+		return inCircularRange(int(now.Weekday()), start, end), nil
+	},
+	"timeRange": func(args []any) (any, error) {
+		now, args := pacTime(args)
+		n := make([]int, len(args))
+		for i, arg := range args {
+			f := jsNumber(arg)
+			if math.IsNaN(f) {
+				return false, nil
+			}
+			n[i] = int(f)
+		}
+		second := now.Hour()*3600 + now.Minute()*60 + now.Second()
+		var start, end int
+		switch len(n) {
+		case 1:
+			return now.Hour() == n[0], nil
+		case 2:
+			start, end = n[0]*3600, n[1]*3600
+		case 4:
+			start, end = n[0]*3600+n[1]*60, n[2]*3600+n[3]*60
+		case 6:
+			start, end = n[0]*3600+n[1]*60+n[2], n[3]*3600+n[4]*60+n[5]
+		default:
+			return false, nil
+		}
+		if start <= end {
+			return start <= second && second < end, nil
+		}
+		return second >= start || second < end, nil
+	},
+	"dateRange": func([]any) (any, error) {
+		return nil, errors.New("dateRange is not supported")
+	},
+	"alert": func(args []any) (any, error) {
+		logf(levelDebug, "[PAC] alert: %s", jsString(jsArg(args, 0)))
+		return undefined, nil
+	},
+}
+
+// pacTime 返回当前时间，最后一个参数为"GMT"时使用UTC并去掉该参数
+func pacTime(args []any) (time.Time, []any) {
+	now := pacNow()
+	if len(args) > 0 && strings.EqualFold(jsString(args[len(args)-1]), "GMT") {
+		return now.UTC(), args[:len(args)-1]
+	}
+	return now, args
+}
+
+// inCircularRange 判断v是否在start到end之间(含两端)，start大于end时跨过一周的末尾
+func inCircularRange(v, start, end int) bool {
+	if start <= end {
+		return v >= start && v <= end
+	}
+	return v >= start || v <= end
+}
+
+// pacResolve 解析PAC辅助函数的主机参数，IP字面量直接返回，域名解析后优先返回IPv4地址，失败时返回nil
+func pacResolve(host string) net.IP {
+	if ip := net.ParseIP(host); ip != nil {
+		return ip
+	}
+	if host == "" {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), pacDNSTimeout)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil || len(addrs) == 0 {
+		return nil
+	}
+	for _, addr := range addrs {
+		if ip4 := addr.IP.To4(); ip4 != nil {
+			return ip4
+		}
+	}
+	return addrs[0].IP
+}
+
+// shExpMatch 按shell通配符匹配：*匹配任意长度的字符，?匹配一个字符，其余字符按原样匹配
+func shExpMatch(s, pattern string) bool {
+	// 回溯时只需记住最近一个*的位置
+	si, pi, star, mark := 0, 0, -1, 0
+	for si < len(s) {
+		switch {
+		case pi < len(pattern) && (pattern[pi] == '?' || pattern[pi] == s[si]):
+			si++
+			pi++
+		case pi < len(pattern) && pattern[pi] == '*':
+			star, mark = pi, si
+			pi++
+		case star >= 0:
+			pi = star + 1
+			mark++
+			si = mark
+		default:
+			return false
+		}
+	}
+	for pi < len(pattern) && pattern[pi] == '*' {
+		pi++
+	}
+	return pi == len(pattern)
+}
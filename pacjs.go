@@ -0,0 +1,1522 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// PAC脚本使用的JavaScript子集的解释器。支持函数声明和函数表达式、var/let/const、if/else、for、while、
+// break/continue/return、常见的运算符，以及字符串和数组上的常用方法；不支持对象字面量、正则表达式、
+// switch和异常处理，遇到时返回解析错误，调用方按直接连接处理
+
+// jsMaxSteps 一次求值最多执行的语句和函数调用次数，避免脚本中的死循环拖住请求
+const jsMaxSteps = 1000000
+
+// jsMaxDepth 函数调用最大嵌套深度
+const jsMaxDepth = 200
+
+// jsUndefined JavaScript的undefined，null为Go的nil
+type jsUndefined struct{}
+
+var undefined = jsUndefined{}
+
+// jsBuiltin 由Go实现的函数，例如PAC辅助函数
+type jsBuiltin func(args []any) (any, error)
+
+// jsFunction 脚本中定义的函数
+type jsFunction struct {
+	name   string
+	params []string
+	body   []jsStmt
+	scope  *jsScope // 定义时所在的作用域
+}
+
+// jsScope 变量作用域，找不到的变量向外层查找
+type jsScope struct {
+	vars   map[string]any
+	parent *jsScope
+	run    *jsRun
+}
+
+// jsRun 一次求值的状态：执行步数和调用深度
+type jsRun struct {
+	steps, depth int
+}
+
+// lookup 查找变量所在的作用域
+func (s *jsScope) lookup(name string) (*jsScope, bool) {
+	for ; s != nil; s = s.parent {
+		if _, ok := s.vars[name]; ok {
+			return s, true
+		}
+	}
+	return nil, false
+}
+
+// global 返回最外层作用域
+func (s *jsScope) global() *jsScope {
+	for s.parent != nil {
+		s = s.parent
+	}
+	return s
+}
+
+// step 计入一步，超出jsMaxSteps时返回错误
+func (s *jsScope) step() error {
+	if s.run.steps++; s.run.steps > jsMaxSteps {
+		return errors.New("script exceeded its step limit")
+	}
+	return nil
+}
+
+// ---- 词法分析 ----
+
+type jsTokenKind int
+
+const (
+	tokEOF jsTokenKind = iota
+	tokIdent
+	tokNumber
+	tokString
+	tokPunct
+)
+
+type jsToken struct {
+	kind jsTokenKind
+	text string  // 标识符、标点或字符串的内容
+	num  float64 // 数字的值
+	line int
+}
+
+// jsPuncts 多字符的标点，较长的在前
+var jsPuncts = []string{"===", "!==", "==", "!=", "<=", ">=", "&&", "||", "++", "--", "+=", "-=", "*=", "/="}
+
+// jsLex 将脚本拆分为token
+func jsLex(src string) ([]jsToken, error) {
+	var tokens []jsToken
+	line := 1
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == '\n':
+			line++
+			i++
+		case c == ' ' || c == '\t' || c == '\r' || c == '\f' || c == '\v':
+			i++
+		case strings.HasPrefix(src[i:], "//"):
+			for i < len(src) && src[i] != '\n' {
+				i++
+			}
+		case strings.HasPrefix(src[i:], "/*"):
+			end := strings.Index(src[i+2:], "*/")
+			if end < 0 {
+				return nil, fmt.Errorf("line %d: unterminated comment", line)
+			}
+			line += strings.Count(src[i:i+2+end], "\n")
+			i += end + 4
+		case c == '_' || c == '$' || isASCIILetter(c):
+			j := i + 1
+			for j < len(src) && (src[j] == '_' || src[j] == '$' || isASCIILetter(src[j]) || isASCIIDigit(src[j])) {
+				j++
+			}
+			tokens = append(tokens, jsToken{kind: tokIdent, text: src[i:j], line: line})
+			i = j
+		case isASCIIDigit(c) || (c == '.' && i+1 < len(src) && isASCIIDigit(src[i+1])):
+			j := i
+			for j < len(src) && (isASCIIDigit(src[j]) || src[j] == '.' || src[j] == 'x' || src[j] == 'X' ||
+				(src[j] >= 'a' && src[j] <= 'f') || (src[j] >= 'A' && src[j] <= 'F')) {
+				j++
+			}
+			text := src[i:j]
+			var n float64
+			var err error
+			if strings.HasPrefix(text, "0x") || strings.HasPrefix(text, "0X") {
+				var u uint64
+				u, err = strconv.ParseUint(text[2:], 16, 64)
+				n = float64(u)
+			} else {
+				n, err = strconv.ParseFloat(text, 64)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid number %q", line, text)
+			}
+			tokens = append(tokens, jsToken{kind: tokNumber, num: n, line: line})
+			i = j
+		case c == '"' || c == '\'':
+			s, n, err := jsLexString(src[i:])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", line, err)
+			}
+			tokens = append(tokens, jsToken{kind: tokString, text: s, line: line})
+			i += n
+		default:
+			p := string(c)
+			for _, punct := range jsPuncts {
+				if strings.HasPrefix(src[i:], punct) {
+					p = punct
+					break
+				}
+			}
+			if !strings.Contains("(){}[];,.=+-*/%<>!?:&|", p[:1]) {
+				return nil, fmt.Errorf("line %d: unexpected character %q", line, c)
+			}
+			tokens = append(tokens, jsToken{kind: tokPunct, text: p, line: line})
+			i += len(p)
+		}
+	}
+	return append(tokens, jsToken{kind: tokEOF, line: line}), nil
+}
+
+// jsLexString 解析以引号开头的字符串字面量，返回内容和消耗的字节数
+func jsLexString(src string) (string, int, error) {
+	quote := src[0]
+	var b strings.Builder
+	for i := 1; i < len(src); i++ {
+		c := src[i]
+		switch {
+		case c == quote:
+			return b.String(), i + 1, nil
+		case c == '\n':
+			return "", 0, errors.New("unterminated string")
+		case c == '\\' && i+1 < len(src):
+			i++
+			switch e := src[i]; e {
+			case 'n':
+				b.WriteByte('\n')
+			case 't':
+				b.WriteByte('\t')
+			case 'r':
+				b.WriteByte('\r')
+			case '0':
+				b.WriteByte(0)
+			default:
+				b.WriteByte(e)
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", 0, errors.New("unterminated string")
+}
+
+func isASCIILetter(c byte) bool { return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') }
+func isASCIIDigit(c byte) bool  { return c >= '0' && c <= '9' }
+
+// ---- 语法分析 ----
+
+// jsParser 递归下降的语法分析器
+type jsParser struct {
+	tokens []jsToken
+	pos    int
+}
+
+// jsProgram 解析后的脚本，可以多次并发求值
+type jsProgram struct {
+	body []jsStmt
+}
+
+// jsParse 解析脚本
+func jsParse(src string) (*jsProgram, error) {
+	tokens, err := jsLex(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &jsParser{tokens: tokens}
+	var body []jsStmt
+	for p.peek().kind != tokEOF {
+		stmt, err := p.statement()
+		if err != nil {
+			return nil, err
+		}
+		body = append(body, stmt)
+	}
+	return &jsProgram{body: body}, nil
+}
+
+func (p *jsParser) peek() jsToken { return p.tokens[p.pos] }
+
+func (p *jsParser) next() jsToken {
+	t := p.tokens[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+// is 判断下一个token是否为指定的标点或关键字
+func (p *jsParser) is(text string) bool {
+	t := p.peek()
+	return (t.kind == tokPunct || t.kind == tokIdent) && t.text == text
+}
+
+// accept 下一个token为text时消耗它并返回true
+func (p *jsParser) accept(text string) bool {
+	if p.is(text) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+// expect 要求下一个token为text
+func (p *jsParser) expect(text string) error {
+	if !p.accept(text) {
+		return p.errorf("expected %q", text)
+	}
+	return nil
+}
+
+func (p *jsParser) errorf(format string, args ...any) error {
+	t := p.peek()
+	got := t.text
+	switch t.kind {
+	case tokEOF:
+		got = "end of script"
+	case tokNumber:
+		got = strconv.FormatFloat(t.num, 'g', -1, 64)
+	case tokString:
+		got = strconv.Quote(t.text)
+	}
+	return fmt.Errorf("line %d: %s, got %s", t.line, fmt.Sprintf(format, args...), got)
+}
+
+// ident 读取一个标识符
+func (p *jsParser) ident() (string, error) {
+	if t := p.peek(); t.kind == tokIdent && !jsKeywords[t.text] {
+		p.pos++
+		return t.text, nil
+	}
+	return "", p.errorf("expected an identifier")
+}
+
+// jsKeywords 不能用作变量名的关键字
+var jsKeywords = map[string]bool{
+	"function": true, "var": true, "let": true, "const": true, "if": true, "else": true, "return": true,
+	"for": true, "while": true, "break": true, "continue": true, "true": true, "false": true, "null": true,
+	"typeof": true, "new": true, "switch": true, "case": true, "try": true, "catch": true, "throw": true,
+}
+
+// endStatement 语句结尾的分号可以省略
+func (p *jsParser) endStatement() {
+	p.accept(";")
+}
+
+func (p *jsParser) statement() (jsStmt, error) {
+	t := p.peek()
+	if t.kind == tokPunct {
+		switch t.text {
+		case "{":
+			p.next()
+			body, err := p.block()
+			return &jsBlockStmt{body: body}, err
+		case ";":
+			p.next()
+			return &jsBlockStmt{}, nil
+		}
+	}
+	if t.kind == tokIdent {
+		switch t.text {
+		case "function":
+			p.next()
+			fn, err := p.function(true)
+			if err != nil {
+				return nil, err
+			}
+			return &jsFuncDecl{fn: fn}, nil
+		case "var", "let", "const":
+			p.next()
+			decl, err := p.varDecl()
+			p.endStatement()
+			return decl, err
+		case "if":
+			return p.ifStatement()
+		case "for":
+			return p.forStatement()
+		case "while":
+			p.next()
+			if err := p.expect("("); err != nil {
+				return nil, err
+			}
+			cond, err := p.expression()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect(")"); err != nil {
+				return nil, err
+			}
+			body, err := p.statement()
+			return &jsForStmt{cond: cond, body: body}, err
+		case "return":
+			p.next()
+			stmt := &jsReturnStmt{}
+			if !p.is(";") && !p.is("}") && p.peek().kind != tokEOF && p.peek().line == t.line {
+				value, err := p.expression()
+				if err != nil {
+					return nil, err
+				}
+				stmt.value = value
+			}
+			p.endStatement()
+			return stmt, nil
+		case "break", "continue":
+			p.next()
+			p.endStatement()
+			return &jsJumpStmt{kind: t.text}, nil
+		case "switch", "try", "throw", "new", "do":
+			return nil, p.errorf("unsupported statement")
+		}
+	}
+	expr, err := p.expression()
+	if err != nil {
+		return nil, err
+	}
+	p.endStatement()
+	return &jsExprStmt{expr: expr}, nil
+}
+
+// block 读取到 } 为止的语句
+func (p *jsParser) block() ([]jsStmt, error) {
+	var body []jsStmt
+	for !p.accept("}") {
+		if p.peek().kind == tokEOF {
+			return nil, p.errorf("expected \"}\"")
+		}
+		stmt, err := p.statement()
+		if err != nil {
+			return nil, err
+		}
+		body = append(body, stmt)
+	}
+	return body, nil
+}
+
+// function 读取function关键字之后的函数，named表示必须有函数名
+func (p *jsParser) function(named bool) (*jsFunction, error) {
+	fn := &jsFunction{}
+	if named || p.peek().kind == tokIdent {
+		name, err := p.ident()
+		if err != nil {
+			return nil, err
+		}
+		fn.name = name
+	}
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	for !p.accept(")") {
+		if len(fn.params) > 0 {
+			if err := p.expect(","); err != nil {
+				return nil, err
+			}
+		}
+		name, err := p.ident()
+		if err != nil {
+			return nil, err
+		}
+		fn.params = append(fn.params, name)
+	}
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+	body, err := p.block()
+	fn.body = body
+	return fn, err
+}
+
+func (p *jsParser) varDecl() (jsStmt, error) {
+	decl := &jsVarDecl{}
+	for {
+		name, err := p.ident()
+		if err != nil {
+			return nil, err
+		}
+		var init jsExpr
+		if p.accept("=") {
+			if init, err = p.assignment(); err != nil {
+				return nil, err
+			}
+		}
+		decl.names = append(decl.names, name)
+		decl.inits = append(decl.inits, init)
+		if !p.accept(",") {
+			return decl, nil
+		}
+	}
+}
+
+func (p *jsParser) ifStatement() (jsStmt, error) {
+	p.next()
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	cond, err := p.expression()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect(")"); err != nil {
+		return nil, err
+	}
+	then, err := p.statement()
+	if err != nil {
+		return nil, err
+	}
+	stmt := &jsIfStmt{cond: cond, then: then}
+	if p.accept("else") {
+		if stmt.els, err = p.statement(); err != nil {
+			return nil, err
+		}
+	}
+	return stmt, nil
+}
+
+func (p *jsParser) forStatement() (jsStmt, error) {
+	p.next()
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	stmt := &jsForStmt{}
+	var err error
+	switch {
+	case p.accept(";"):
+	case p.accept("var"), p.accept("let"), p.accept("const"):
+		if stmt.init, err = p.varDecl(); err != nil {
+			return nil, err
+		}
+		if p.is("in") || p.is("of") {
+			return nil, p.errorf("unsupported for loop")
+		}
+		if err := p.expect(";"); err != nil {
+			return nil, err
+		}
+	default:
+		expr, err := p.expression()
+		if err != nil {
+			return nil, err
+		}
+		stmt.init = &jsExprStmt{expr: expr}
+		if err := p.expect(";"); err != nil {
+			return nil, err
+		}
+	}
+	if !p.is(";") {
+		if stmt.cond, err = p.expression(); err != nil {
+			return nil, err
+		}
+	}
+	if err := p.expect(";"); err != nil {
+		return nil, err
+	}
+	if !p.is(")") {
+		if stmt.post, err = p.expression(); err != nil {
+			return nil, err
+		}
+	}
+	if err := p.expect(")"); err != nil {
+		return nil, err
+	}
+	stmt.body, err = p.statement()
+	return stmt, err
+}
+
+// expression 逗号分隔的表达式，值为最后一个
+func (p *jsParser) expression() (jsExpr, error) {
+	expr, err := p.assignment()
+	for err == nil && p.accept(",") {
+		var right jsExpr
+		if right, err = p.assignment(); err == nil {
+			expr = &jsBinary{op: ",", left: expr, right: right}
+		}
+	}
+	return expr, err
+}
+
+func (p *jsParser) assignment() (jsExpr, error) {
+	left, err := p.conditional()
+	if err != nil {
+		return nil, err
+	}
+	for _, op := range []string{"=", "+=", "-=", "*=", "/="} {
+		if p.accept(op) {
+			target, ok := left.(jsAssignable)
+			if !ok {
+				return nil, p.errorf("invalid assignment target")
+			}
+			value, err := p.assignment()
+			if err != nil {
+				return nil, err
+			}
+			return &jsAssign{target: target, op: strings.TrimSuffix(op, "="), value: value}, nil
+		}
+	}
+	return left, nil
+}
+
+func (p *jsParser) conditional() (jsExpr, error) {
+	cond, err := p.binary(0)
+	if err != nil || !p.accept("?") {
+		return cond, err
+	}
+	then, err := p.assignment()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect(":"); err != nil {
+		return nil, err
+	}
+	els, err := p.assignment()
+	if err != nil {
+		return nil, err
+	}
+	return &jsConditional{cond: cond, then: then, els: els}, nil
+}
+
+// jsBinaryLevels 二元运算符按优先级从低到高
+var jsBinaryLevels = [][]string{
+	{"||"},
+	{"&&"},
+	{"===", "!==", "==", "!="},
+	{"<=", ">=", "<", ">"},
+	{"+", "-"},
+	{"*", "/", "%"},
+}
+
+func (p *jsParser) binary(level int) (jsExpr, error) {
+	if level == len(jsBinaryLevels) {
+		return p.unary()
+	}
+	left, err := p.binary(level + 1)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		matched := ""
+		for _, op := range jsBinaryLevels[level] {
+			if t := p.peek(); t.kind == tokPunct && t.text == op {
+				matched = op
+				break
+			}
+		}
+		if matched == "" {
+			return left, nil
+		}
+		p.next()
+		right, err := p.binary(level + 1)
+		if err != nil {
+			return nil, err
+		}
+		left = &jsBinary{op: matched, left: left, right: right}
+	}
+}
+
+func (p *jsParser) unary() (jsExpr, error) {
+	for _, op := range []string{"!", "-", "+", "typeof"} {
+		if p.accept(op) {
+			operand, err := p.unary()
+			if err != nil {
+				return nil, err
+			}
+			return &jsUnary{op: op, operand: operand}, nil
+		}
+	}
+	for _, op := range []string{"++", "--"} {
+		if p.accept(op) {
+			operand, err := p.unary()
+			if err != nil {
+				return nil, err
+			}
+			target, ok := operand.(jsAssignable)
+			if !ok {
+				return nil, p.errorf("invalid %s operand", op)
+			}
+			return &jsIncrement{target: target, delta: incrementDelta(op), prefix: true}, nil
+		}
+	}
+	return p.postfix()
+}
+
+func incrementDelta(op string) float64 {
+	if op == "++" {
+		return 1
+	}
+	return -1
+}
+
+func (p *jsParser) postfix() (jsExpr, error) {
+	expr, err := p.primary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		switch {
+		case p.accept("("):
+			args, err := p.arguments()
+			if err != nil {
+				return nil, err
+			}
+			expr = &jsCall{callee: expr, args: args}
+		case p.accept("."):
+			name := p.next()
+			if name.kind != tokIdent {
+				return nil, p.errorf("expected a property name")
+			}
+			expr = &jsMember{object: expr, property: &jsLiteral{value: name.text}}
+		case p.accept("["):
+			index, err := p.expression()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect("]"); err != nil {
+				return nil, err
+			}
+			expr = &jsMember{object: expr, property: index}
+		case p.is("++") || p.is("--"):
+			target, ok := expr.(jsAssignable)
+			if !ok {
+				return expr, nil
+			}
+			expr = &jsIncrement{target: target, delta: incrementDelta(p.next().text)}
+		default:
+			return expr, nil
+		}
+	}
+}
+
+// arguments 读取 ( 之后到 ) 为止的参数
+func (p *jsParser) arguments() ([]jsExpr, error) {
+	var args []jsExpr
+	for !p.accept(")") {
+		if len(args) > 0 {
+			if err := p.expect(","); err != nil {
+				return nil, err
+			}
+		}
+		arg, err := p.assignment()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+	}
+	return args, nil
+}
+
+func (p *jsParser) primary() (jsExpr, error) {
+	t := p.next()
+	switch t.kind {
+	case tokNumber:
+		return &jsLiteral{value: t.num}, nil
+	case tokString:
+		return &jsLiteral{value: t.text}, nil
+	case tokIdent:
+		switch t.text {
+		case "true", "false":
+			return &jsLiteral{value: t.text == "true"}, nil
+		case "null":
+			return &jsLiteral{value: nil}, nil
+		case "undefined":
+			return &jsLiteral{value: undefined}, nil
+		case "function":
+			fn, err := p.function(false)
+			if err != nil {
+				return nil, err
+			}
+			return &jsFuncExpr{fn: fn}, nil
+		}
+		if jsKeywords[t.text] {
+			p.pos--
+			return nil, p.errorf("unsupported expression")
+		}
+		return &jsIdent{name: t.text}, nil
+	case tokPunct:
+		switch t.text {
+		case "(":
+			expr, err := p.expression()
+			if err != nil {
+				return nil, err
+			}
+			return expr, p.expect(")")
+		case "[":
+			arr := &jsArrayLit{}
+			for !p.accept("]") {
+				if len(arr.elems) > 0 {
+					if err := p.expect(","); err != nil {
+						return nil, err
+					}
+					if p.accept("]") {
+						break
+					}
+				}
+				elem, err := p.assignment()
+				if err != nil {
+					return nil, err
+				}
+				arr.elems = append(arr.elems, elem)
+			}
+			return arr, nil
+		}
+	}
+	p.pos--
+	return nil, p.errorf("unexpected token")
+}
+
+// ---- 语句 ----
+
+// jsFlow 语句执行后的控制流
+type jsFlow int
+
+const (
+	flowNormal jsFlow = iota
+	flowReturn
+	flowBreak
+	flowContinue
+)
+
+type jsStmt interface {
+	exec(s *jsScope) (jsFlow, any, error)
+}
+
+type (
+	jsBlockStmt  struct{ body []jsStmt }
+	jsFuncDecl   struct{ fn *jsFunction }
+	jsExprStmt   struct{ expr jsExpr }
+	jsReturnStmt struct{ value jsExpr }
+	jsJumpStmt   struct{ kind string }
+	jsVarDecl    struct {
+		names []string
+		inits []jsExpr
+	}
+	jsIfStmt struct {
+		cond      jsExpr
+		then, els jsStmt
+	}
+	jsForStmt struct {
+		init       jsStmt
+		cond, post jsExpr
+		body       jsStmt
+	}
+)
+
+// execBody 依次执行语句，先定义其中声明的函数，使函数可以在声明之前调用
+func execBody(s *jsScope, body []jsStmt) (jsFlow, any, error) {
+	for _, stmt := range body {
+		if decl, ok := stmt.(*jsFuncDecl); ok {
+			s.vars[decl.fn.name] = &jsFunction{name: decl.fn.name, params: decl.fn.params, body: decl.fn.body, scope: s}
+		}
+	}
+	for _, stmt := range body {
+		if err := s.step(); err != nil {
+			return flowNormal, nil, err
+		}
+		flow, value, err := stmt.exec(s)
+		if err != nil || flow != flowNormal {
+			return flow, value, err
+		}
+	}
+	return flowNormal, nil, nil
+}
+
+func (b *jsBlockStmt) exec(s *jsScope) (jsFlow, any, error) {
+	return execBody(&jsScope{vars: make(map[string]any), parent: s, run: s.run}, b.body)
+}
+
+// exec 函数声明已由execBody提前定义
+func (d *jsFuncDecl) exec(*jsScope) (jsFlow, any, error) {
+	return flowNormal, nil, nil
+}
+
+func (e *jsExprStmt) exec(s *jsScope) (jsFlow, any, error) {
+	_, err := e.expr.eval(s)
+	return flowNormal, nil, err
+}
+
+func (r *jsReturnStmt) exec(s *jsScope) (jsFlow, any, error) {
+	if r.value == nil {
+		return flowReturn, undefined, nil
+	}
+	v, err := r.value.eval(s)
+	return flowReturn, v, err
+}
+
+func (j *jsJumpStmt) exec(*jsScope) (jsFlow, any, error) {
+	if j.kind == "break" {
+		return flowBreak, nil, nil
+	}
+	return flowContinue, nil, nil
+}
+
+func (d *jsVarDecl) exec(s *jsScope) (jsFlow, any, error) {
+	for i, name := range d.names {
+		var v any = undefined
+		if d.inits[i] != nil {
+			var err error
+			if v, err = d.inits[i].eval(s); err != nil {
+				return flowNormal, nil, err
+			}
+		}
+		s.vars[name] = v
+	}
+	return flowNormal, nil, nil
+}
+
+func (i *jsIfStmt) exec(s *jsScope) (jsFlow, any, error) {
+	cond, err := i.cond.eval(s)
+	if err != nil {
+		return flowNormal, nil, err
+	}
+	if jsTruthy(cond) {
+		return i.then.exec(s)
+	}
+	if i.els != nil {
+		return i.els.exec(s)
+	}
+	return flowNormal, nil, nil
+}
+
+func (f *jsForStmt) exec(outer *jsScope) (jsFlow, any, error) {
+	s := &jsScope{vars: make(map[string]any), parent: outer, run: outer.run}
+	if f.init != nil {
+		if _, _, err := f.init.exec(s); err != nil {
+			return flowNormal, nil, err
+		}
+	}
+	for {
+		if err := s.step(); err != nil {
+			return flowNormal, nil, err
+		}
+		if f.cond != nil {
+			cond, err := f.cond.eval(s)
+			if err != nil {
+				return flowNormal, nil, err
+			}
+			if !jsTruthy(cond) {
+				return flowNormal, nil, nil
+			}
+		}
+		flow, value, err := f.body.exec(s)
+		switch {
+		case err != nil, flow == flowReturn:
+			return flow, value, err
+		case flow == flowBreak:
+			return flowNormal, nil, nil
+		}
+		if f.post != nil {
+			if _, err := f.post.eval(s); err != nil {
+				return flowNormal, nil, err
+			}
+		}
+	}
+}
+
+// ---- 表达式 ----
+
+type jsExpr interface {
+	eval(s *jsScope) (any, error)
+}
+
+// jsAssignable 可以赋值的表达式：变量和数组元素
+type jsAssignable interface {
+	jsExpr
+	assign(s *jsScope, v any) error
+}
+
+type (
+	jsLiteral  struct{ value any }
+	jsIdent    struct{ name string }
+	jsFuncExpr struct{ fn *jsFunction }
+	jsArrayLit struct{ elems []jsExpr }
+	jsUnary    struct {
+		op      string
+		operand jsExpr
+	}
+	jsBinary struct {
+		op          string
+		left, right jsExpr
+	}
+	jsConditional struct{ cond, then, els jsExpr }
+	jsAssign      struct {
+		target jsAssignable
+		op     string // 复合赋值的运算符，普通赋值为空
+		value  jsExpr
+	}
+	jsIncrement struct {
+		target jsAssignable
+		delta  float64
+		prefix bool
+	}
+	jsCall struct {
+		callee jsExpr
+		args   []jsExpr
+	}
+	jsMember struct{ object, property jsExpr }
+)
+
+func (l *jsLiteral) eval(*jsScope) (any, error) { return l.value, nil }
+
+func (i *jsIdent) eval(s *jsScope) (any, error) {
+	scope, ok := s.lookup(i.name)
+	if !ok {
+		return nil, fmt.Errorf("%s is not defined", i.name)
+	}
+	return scope.vars[i.name], nil
+}
+
+// assign 给已声明的变量赋值，未声明的变量定义在最外层作用域
+func (i *jsIdent) assign(s *jsScope, v any) error {
+	if scope, ok := s.lookup(i.name); ok {
+		scope.vars[i.name] = v
+		return nil
+	}
+	s.global().vars[i.name] = v
+	return nil
+}
+
+func (f *jsFuncExpr) eval(s *jsScope) (any, error) {
+	return &jsFunction{name: f.fn.name, params: f.fn.params, body: f.fn.body, scope: s}, nil
+}
+
+func (a *jsArrayLit) eval(s *jsScope) (any, error) {
+	arr := make([]any, len(a.elems))
+	for i, elem := range a.elems {
+		v, err := elem.eval(s)
+		if err != nil {
+			return nil, err
+		}
+		arr[i] = v
+	}
+	return &jsArray{elems: arr}, nil
+}
+
+// jsArray 数组，以指针传递使修改对所有引用可见
+type jsArray struct {
+	elems []any
+}
+
+func (u *jsUnary) eval(s *jsScope) (any, error) {
+	if u.op == "typeof" {
+		if ident, ok := u.operand.(*jsIdent); ok {
+			if _, found := s.lookup(ident.name); !found {
+				return "undefined", nil
+			}
+		}
+	}
+	v, err := u.operand.eval(s)
+	if err != nil {
+		return nil, err
+	}
+	switch u.op {
+	case "!":
+		return !jsTruthy(v), nil
+	case "-":
+		return -jsNumber(v), nil
+	case "+":
+		return jsNumber(v), nil
+	}
+	return jsTypeof(v), nil
+}
+
+func (b *jsBinary) eval(s *jsScope) (any, error) {
+	left, err := b.left.eval(s)
+	if err != nil {
+		return nil, err
+	}
+	switch b.op {
+	case "||":
+		if jsTruthy(left) {
+			return left, nil
+		}
+		return b.right.eval(s)
+	case "&&":
+		if !jsTruthy(left) {
+			return left, nil
+		}
+		return b.right.eval(s)
+	}
+	right, err := b.right.eval(s)
+	if err != nil {
+		return nil, err
+	}
+	return jsBinaryOp(b.op, left, right)
+}
+
+// jsBinaryOp 计算除逻辑运算外的二元运算
+func jsBinaryOp(op string, left, right any) (any, error) {
+	switch op {
+	case ",":
+		return right, nil
+	case "===":
+		return jsStrictEqual(left, right), nil
+	case "!==":
+		return !jsStrictEqual(left, right), nil
+	case "==":
+		return jsLooseEqual(left, right), nil
+	case "!=":
+		return !jsLooseEqual(left, right), nil
+	case "+":
+		ls, lok := left.(string)
+		rs, rok := right.(string)
+		if lok || rok || isJSObject(left) || isJSObject(right) {
+			if !lok {
+				ls = jsString(left)
+			}
+			if !rok {
+				rs = jsString(right)
+			}
+			return ls + rs, nil
+		}
+		return jsNumber(left) + jsNumber(right), nil
+	case "-":
+		return jsNumber(left) - jsNumber(right), nil
+	case "*":
+		return jsNumber(left) * jsNumber(right), nil
+	case "/":
+		return jsNumber(left) / jsNumber(right), nil
+	case "%":
+		return math.Mod(jsNumber(left), jsNumber(right)), nil
+	case "<", ">", "<=", ">=":
+		ls, lok := left.(string)
+		rs, rok := right.(string)
+		if lok && rok {
+			c := strings.Compare(ls, rs)
+			return (op == "<" && c < 0) || (op == ">" && c > 0) || (op == "<=" && c <= 0) || (op == ">=" && c >= 0), nil
+		}
+		l, r := jsNumber(left), jsNumber(right)
+		return (op == "<" && l < r) || (op == ">" && l > r) || (op == "<=" && l <= r) || (op == ">=" && l >= r), nil
+	}
+	return nil, fmt.Errorf("unsupported operator %s", op)
+}
+
+func (c *jsConditional) eval(s *jsScope) (any, error) {
+	cond, err := c.cond.eval(s)
+	if err != nil {
+		return nil, err
+	}
+	if jsTruthy(cond) {
+		return c.then.eval(s)
+	}
+	return c.els.eval(s)
+}
+
+func (a *jsAssign) eval(s *jsScope) (any, error) {
+	v, err := a.value.eval(s)
+	if err != nil {
+		return nil, err
+	}
+	if a.op != "" {
+		old, err := a.target.eval(s)
+		if err != nil {
+			return nil, err
+		}
+		if v, err = jsBinaryOp(a.op, old, v); err != nil {
+			return nil, err
+		}
+	}
+	return v, a.target.assign(s, v)
+}
+
+func (i *jsIncrement) eval(s *jsScope) (any, error) {
+	old, err := i.target.eval(s)
+	if err != nil {
+		return nil, err
+	}
+	n := jsNumber(old)
+	if err := i.target.assign(s, n+i.delta); err != nil {
+		return nil, err
+	}
+	if i.prefix {
+		return n + i.delta, nil
+	}
+	return n, nil
+}
+
+func (c *jsCall) eval(s *jsScope) (any, error) {
+	var (
+		fn   any
+		this any = undefined
+		err  error
+	)
+	if m, ok := c.callee.(*jsMember); ok {
+		if this, err = m.object.eval(s); err != nil {
+			return nil, err
+		}
+		prop, err := m.property.eval(s)
+		if err != nil {
+			return nil, err
+		}
+		if fn, err = jsMethod(this, jsString(prop)); err != nil {
+			return nil, err
+		}
+	} else if fn, err = c.callee.eval(s); err != nil {
+		return nil, err
+	}
+	args := make([]any, len(c.args))
+	for i, arg := range c.args {
+		if args[i], err = arg.eval(s); err != nil {
+			return nil, err
+		}
+	}
+	return jsCallValue(s, fn, args)
+}
+
+// jsCallValue 调用函数值
+func jsCallValue(s *jsScope, fn any, args []any) (any, error) {
+	if err := s.step(); err != nil {
+		return nil, err
+	}
+	switch f := fn.(type) {
+	case jsBuiltin:
+		return f(args)
+	case *jsFunction:
+		if s.run.depth >= jsMaxDepth {
+			return nil, errors.New("maximum call depth exceeded")
+		}
+		s.run.depth++
+		defer func() { s.run.depth-- }()
+		scope := &jsScope{vars: make(map[string]any, len(f.params)), parent: f.scope, run: s.run}
+		for i, name := range f.params {
+			if i < len(args) {
+				scope.vars[name] = args[i]
+			} else {
+				scope.vars[name] = undefined
+			}
+		}
+		flow, v, err := execBody(scope, f.body)
+		if err != nil {
+			return nil, err
+		}
+		if flow == flowReturn {
+			return v, nil
+		}
+		return undefined, nil
+	}
+	return nil, fmt.Errorf("%s is not a function", jsString(fn))
+}
+
+func (m *jsMember) eval(s *jsScope) (any, error) {
+	obj, err := m.object.eval(s)
+	if err != nil {
+		return nil, err
+	}
+	prop, err := m.property.eval(s)
+	if err != nil {
+		return nil, err
+	}
+	switch o := obj.(type) {
+	case string:
+		if jsString(prop) == "length" {
+			return float64(len(o)), nil
+		}
+		if i, ok := jsIndex(prop, len(o)); ok {
+			return o[i : i+1], nil
+		}
+	case *jsArray:
+		if jsString(prop) == "length" {
+			return float64(len(o.elems)), nil
+		}
+		if i, ok := jsIndex(prop, len(o.elems)); ok {
+			return o.elems[i], nil
+		}
+	case nil, jsUndefined:
+		return nil, fmt.Errorf("cannot read property %s of %s", jsString(prop), jsString(obj))
+	}
+	return undefined, nil
+}
+
+// assign 只支持给数组元素赋值
+func (m *jsMember) assign(s *jsScope, v any) error {
+	obj, err := m.object.eval(s)
+	if err != nil {
+		return err
+	}
+	prop, err := m.property.eval(s)
+	if err != nil {
+		return err
+	}
+	arr, ok := obj.(*jsArray)
+	if !ok {
+		return fmt.Errorf("cannot assign property %s", jsString(prop))
+	}
+	n := jsNumber(prop)
+	if n < 0 || n != math.Trunc(n) || n > 1<<16 {
+		return fmt.Errorf("invalid array index %s", jsString(prop))
+	}
+	for int(n) >= len(arr.elems) {
+		arr.elems = append(arr.elems, undefined)
+	}
+	arr.elems[int(n)] = v
+	return nil
+}
+
+// jsIndex 将属性转为[0,n)范围内的下标
+func jsIndex(prop any, n int) (int, bool) {
+	f, ok := prop.(float64)
+	if !ok || f != math.Trunc(f) || f < 0 || f >= float64(n) {
+		return 0, false
+	}
+	return int(f), true
+}
+
+// jsMethod 返回字符串和数组上的方法
+func jsMethod(this any, name string) (any, error) {
+	switch o := this.(type) {
+	case string:
+		if m, ok := jsStringMethods[name]; ok {
+			return jsBuiltin(func(args []any) (any, error) { return m(o, args), nil }), nil
+		}
+	case *jsArray:
+		switch name {
+		case "join":
+			return jsBuiltin(func(args []any) (any, error) {
+				sep := ","
+				if len(args) > 0 {
+					sep = jsString(args[0])
+				}
+				parts := make([]string, len(o.elems))
+				for i, e := range o.elems {
+					parts[i] = jsString(e)
+				}
+				return strings.Join(parts, sep), nil
+			}), nil
+		case "indexOf":
+			return jsBuiltin(func(args []any) (any, error) {
+				for i, e := range o.elems {
+					if len(args) > 0 && jsStrictEqual(e, args[0]) {
+						return float64(i), nil
+					}
+				}
+				return float64(-1), nil
+			}), nil
+		case "push":
+			return jsBuiltin(func(args []any) (any, error) {
+				o.elems = append(o.elems, args...)
+				return float64(len(o.elems)), nil
+			}), nil
+		}
+	case nil, jsUndefined:
+		return nil, fmt.Errorf("cannot read property %s of %s", name, jsString(this))
+	}
+	return nil, fmt.Errorf("%s.%s is not a function", jsTypeof(this), name)
+}
+
+// jsArg 返回第i个参数，缺少时为undefined
+func jsArg(args []any, i int) any {
+	if i < len(args) {
+		return args[i]
+	}
+	return undefined
+}
+
+// jsClamp 按JavaScript的规则将位置参数限制在[0,n]，负数从末尾计算由调用方处理
+func jsClamp(v any, n int, def int) int {
+	if _, ok := v.(jsUndefined); ok {
+		return def
+	}
+	f := jsNumber(v)
+	switch {
+	case math.IsNaN(f), f < 0:
+		return 0
+	case f > float64(n):
+		return n
+	}
+	return int(f)
+}
+
+// jsStringMethods 字符串上的方法，下标按字节计算，PAC处理的主机名和URL都是ASCII
+var jsStringMethods = map[string]func(s string, args []any) any{
+	"toLowerCase": func(s string, _ []any) any { return strings.ToLower(s) },
+	"toUpperCase": func(s string, _ []any) any { return strings.ToUpper(s) },
+	"trim":        func(s string, _ []any) any { return strings.TrimSpace(s) },
+	"indexOf": func(s string, args []any) any {
+		from := jsClamp(jsArg(args, 1), len(s), 0)
+		if i := strings.Index(s[from:], jsString(jsArg(args, 0))); i >= 0 {
+			return float64(from + i)
+		}
+		return float64(-1)
+	},
+	"lastIndexOf": func(s string, args []any) any {
+		return float64(strings.LastIndex(s, jsString(jsArg(args, 0))))
+	},
+	"charAt": func(s string, args []any) any {
+		if i, ok := jsIndex(jsNumber(jsArg(args, 0)), len(s)); ok {
+			return s[i : i+1]
+		}
+		return ""
+	},
+	"substring": func(s string, args []any) any {
+		start, end := jsClamp(jsArg(args, 0), len(s), 0), jsClamp(jsArg(args, 1), len(s), len(s))
+		if start > end {
+			start, end = end, start
+		}
+		return s[start:end]
+	},
+	"substr": func(s string, args []any) any {
+		start := jsRelative(jsArg(args, 0), len(s), 0)
+		length := jsClamp(jsArg(args, 1), len(s)-start, len(s)-start)
+		return s[start : start+length]
+	},
+	"slice": func(s string, args []any) any {
+		start, end := jsRelative(jsArg(args, 0), len(s), 0), jsRelative(jsArg(args, 1), len(s), len(s))
+		if start >= end {
+			return ""
+		}
+		return s[start:end]
+	},
+	"split": func(s string, args []any) any {
+		if _, ok := jsArg(args, 0).(jsUndefined); ok {
+			return &jsArray{elems: []any{s}}
+		}
+		parts := strings.Split(s, jsString(args[0]))
+		elems := make([]any, len(parts))
+		for i, part := range parts {
+			elems[i] = part
+		}
+		return &jsArray{elems: elems}
+	},
+	"startsWith": func(s string, args []any) any { return strings.HasPrefix(s, jsString(jsArg(args, 0))) },
+	"endsWith":   func(s string, args []any) any { return strings.HasSuffix(s, jsString(jsArg(args, 0))) },
+	"includes":   func(s string, args []any) any { return strings.Contains(s, jsString(jsArg(args, 0))) },
+}
+
+// jsRelative 按slice的规则处理位置参数，负数从末尾计算
+func jsRelative(v any, n int, def int) int {
+	if _, ok := v.(jsUndefined); ok {
+		return def
+	}
+	f := jsNumber(v)
+	if f < 0 {
+		f += float64(n)
+	}
+	return jsClamp(f, n, def)
+}
+
+// ---- 类型转换 ----
+
+func isJSObject(v any) bool {
+	_, ok := v.(*jsArray)
+	return ok
+}
+
+func jsTruthy(v any) bool {
+	switch x := v.(type) {
+	case bool:
+		return x
+	case float64:
+		return x != 0 && !math.IsNaN(x)
+	case string:
+		return x != ""
+	case nil, jsUndefined:
+		return false
+	}
+	return true
+}
+
+func jsNumber(v any) float64 {
+	switch x := v.(type) {
+	case float64:
+		return x
+	case bool:
+		if x {
+			return 1
+		}
+		return 0
+	case nil:
+		return 0
+	case string:
+		x = strings.TrimSpace(x)
+		if x == "" {
+			return 0
+		}
+		if f, err := strconv.ParseFloat(x, 64); err == nil {
+			return f
+		}
+	}
+	return math.NaN()
+}
+
+func jsString(v any) string {
+	switch x := v.(type) {
+	case string:
+		return x
+	case float64:
+		if x == math.Trunc(x) && math.Abs(x) < 1e21 {
+			return strconv.FormatFloat(x, 'f', -1, 64)
+		}
+		return strconv.FormatFloat(x, 'g', -1, 64)
+	case bool:
+		return strconv.FormatBool(x)
+	case nil:
+		return "null"
+	case jsUndefined:
+		return "undefined"
+	case *jsArray:
+		parts := make([]string, len(x.elems))
+		for i, e := range x.elems {
+			parts[i] = jsString(e)
+		}
+		return strings.Join(parts, ",")
+	case *jsFunction:
+		return "function " + x.name
+	}
+	return "function"
+}
+
+func jsTypeof(v any) string {
+	switch v.(type) {
+	case string:
+		return "string"
+	case float64:
+		return "number"
+	case bool:
+		return "boolean"
+	case jsUndefined:
+		return "undefined"
+	case *jsFunction, jsBuiltin:
+		return "function"
+	}
+	return "object"
+}
+
+func jsStrictEqual(a, b any) bool {
+	switch x := a.(type) {
+	case string, float64, bool, nil, jsUndefined:
+		return a == b
+	case *jsArray:
+		y, ok := b.(*jsArray)
+		return ok && x == y
+	}
+	return false
+}
+
+func jsLooseEqual(a, b any) bool {
+	isNullish := func(v any) bool { return v == nil || v == any(undefined) }
+	switch {
+	case isNullish(a) || isNullish(b):
+		return isNullish(a) && isNullish(b)
+	case jsTypeof(a) == jsTypeof(b):
+		return jsStrictEqual(a, b)
+	case isJSObject(a):
+		return jsString(a) == jsString(b)
+	case isJSObject(b):
+		return jsString(b) == jsString(a)
+	}
+	return jsNumber(a) == jsNumber(b)
+}
+
+// ---- 求值 ----
+
+// call 在新的全局作用域中执行脚本，再以args调用其中定义的函数name；globals为预先定义的全局函数
+func (p *jsProgram) call(globals map[string]jsBuiltin, name string, args ...any) (any, error) {
+	s := &jsScope{vars: make(map[string]any, len(globals)), run: &jsRun{}}
+	for k, fn := range globals {
+		s.vars[k] = fn
+	}
+	if _, _, err := execBody(s, p.body); err != nil {
+		return nil, err
+	}
+	fn, ok := s.vars[name]
+	if !ok {
+		return nil, fmt.Errorf("%s is not defined", name)
+	}
+	return jsCallValue(s, fn, args)
+}
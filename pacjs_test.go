@@ -0,0 +1,88 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// jsEval 解析src并调用其中的函数f，返回结果
+func jsEval(t *testing.T, src string) (any, error) {
+	t.Helper()
+	program, err := jsParse(src)
+	if err != nil {
+		return nil, err
+	}
+	return program.call(nil, "f")
+}
+
+func TestJSEval(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want any
+	}{
+		{"arithmetic", "function f() { return 1 + 2 * 3 - 8 / 4 % 3; }", float64(5)},
+		{"string concat", `function f() { return "PROXY " + "a:" + 3128; }`, "PROXY a:3128"},
+		{"comparison", "function f() { return 2 < 10 && '2' > '10' && 1 <= 1; }", true},
+		{"loose and strict equality", `function f() { return (1 == "1") + "," + (1 === "1") + "," + (null == undefined); }`, "true,false,true"},
+		{"logical value", `function f() { return "" || null || "x"; }`, "x"},
+		{"ternary", "function f() { var a = 3; return a > 2 ? 'big' : 'small'; }", "big"},
+		{"if else chain", `function f() { var h = "b"; if (h == "a") return 1; else if (h == "b") return 2; else return 3; }`, float64(2)},
+		{"for loop with continue and break", `function f() {
+			var s = 0;
+			for (var i = 0; i < 10; i++) {
+				if (i % 2) continue;
+				if (i > 6) break;
+				s += i;
+			}
+			return s;
+		}`, float64(12)},
+		{"while", "function f() { var n = 0; while (n < 5) n = n + 1; return n; }", float64(5)},
+		{"hoisted helper", "function f() { return g(2); }\nfunction g(x) { return x * x }", float64(4)},
+		{"function expression and closure", "var mk = function (a) { return function (b) { return a + b; }; };\nfunction f() { return mk(1)(2); }", float64(3)},
+		{"global assignment", "var n = 1;\nfunction f() { bump(); bump(); return n; }\nfunction bump() { n++; }", float64(3)},
+		{"string methods", `function f() {
+			var h = "WWW.Example.COM".toLowerCase();
+			return h.substring(4, 11) + "|" + h.indexOf(".") + "|" + h.length + "|" + h.split(".")[2] + "|" + h.slice(-3) + "|" + h.charAt(0);
+		}`, "example|3|15|com|com|w"},
+		{"arrays", `function f() { var a = ["x", "y"]; a.push("z"); a[3] = "w"; return a.join("-") + a.indexOf("z") + a.length; }`, "x-y-z-w24"},
+		{"typeof", "function f() { return typeof missing + typeof 1 + typeof f; }", "undefinednumberfunction"},
+		{"comments and no semicolons", "/* block */\nfunction f() {\n  // line\n  var a = 'x'\n  return a\n}", "x"},
+		{"return on its own line", "function f() {\n  return\n  1\n}", undefined},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := jsEval(t, tt.src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestJSErrors(t *testing.T) {
+	tests := []struct {
+		name, src, want string
+	}{
+		{"syntax", "function f() { return ( }", "line 1"},
+		{"unterminated string", "function f() {\n return 'x }", "line 2: unterminated string"},
+		{"unsupported statement", "function f() { switch (1) {} }", "unsupported statement"},
+		{"undefined variable", "function f() { return nope; }", "nope is not defined"},
+		{"not a function", "function f() { var a = 1; return a(); }", "is not a function"},
+		{"property of null", "function f() { return null.length; }", "cannot read property"},
+		{"infinite loop", "function f() { for (;;) {} }", "step limit"},
+		{"unbounded recursion", "function f() { return f(); }", "call depth"},
+		{"missing function", "var x = 1;", "f is not defined"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := jsEval(t, tt.src)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("error = %v, want it to mention %q", err, tt.want)
+			}
+		})
+	}
+}
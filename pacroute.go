@@ -0,0 +1,307 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	pacURL      string        // -pac-url，为空表示不按PAC脚本选择第二级代理
+	pacCacheTTL time.Duration // 每个主机的PAC求值结果缓存多久
+)
+
+const (
+	// wpadURL -proxy-url wpad 使用的PAC脚本地址
+	wpadURL = "http://wpad/wpad.dat"
+	// pacRefresh 重新获取PAC脚本的间隔，获取失败后按pacRetry重试
+	pacRefresh = 10 * time.Minute
+	pacRetry   = 30 * time.Second
+	// pacFetchTimeout 获取PAC脚本的超时
+	pacFetchTimeout = 10 * time.Second
+	// pacMaxSize PAC脚本的最大长度
+	pacMaxSize = 1 << 20
+	// pacMaxCache 缓存求值结果的主机数量上限，超出时清空重新缓存
+	pacMaxCache = 4096
+	// pacDNSTimeout PAC辅助函数解析域名的超时
+	pacDNSTimeout = 2 * time.Second
+)
+
+// errPACUnavailable PAC脚本尚未成功获取
+var errPACUnavailable = errors.New("PAC script is not available")
+
+// pacRouter 按PAC脚本为每个目标选择第二级代理或直接连接，求值结果按主机缓存
+type pacRouter struct {
+	source string
+	ttl    time.Duration
+
+	mu         sync.Mutex
+	program    *jsProgram // 最近一次成功获取并解析的脚本，从未成功时为nil
+	next       time.Time  // 下次重新获取脚本的时间
+	refreshing bool
+	cache      map[string]pacResult
+	upstreams  map[string]*upstreamProxy // PAC返回的代理地址解析后的结果，相同的地址共用同一个upstreamProxy
+}
+
+// pacResult 一个主机的求值结果
+type pacResult struct {
+	proxies []*upstreamProxy // 按顺序尝试的第二级代理，为空表示直接连接
+	result  string           // FindProxyForURL的返回值，出错时为错误信息
+	expires time.Time
+}
+
+// pacRouting 配置了-pac-url或-proxy-url wpad时的路由，为nil表示不使用PAC
+var pacRouting atomic.Pointer[pacRouter]
+
+// splitWPAD 从-proxy-url中去掉wpad，返回其余的代理地址和是否指定了wpad
+func splitWPAD(values []string) ([]string, bool) {
+	var rest []string
+	wpad := false
+	for _, value := range values {
+		var kept []string
+		for _, part := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), "wpad") {
+				wpad = true
+				continue
+			}
+			kept = append(kept, part)
+		}
+		if len(kept) > 0 {
+			rest = append(rest, strings.Join(kept, ","))
+		}
+	}
+	return rest, wpad
+}
+
+// setupPACRouting 配置了PAC脚本地址时获取脚本并启用按PAC选择第二级代理；获取或解析失败时只输出警告，
+// 在重新获取成功之前所有请求直接连接
+func setupPACRouting(source string, ttl time.Duration) error {
+	if source == "" {
+		pacRouting.Store(nil)
+		return nil
+	}
+	if ttl < 0 {
+		return fmt.Errorf("invalid -pac-cache-ttl %s, want 0 or more", ttl)
+	}
+	if i := strings.Index(source, "://"); i >= 0 {
+		switch scheme := strings.ToLower(source[:i]); scheme {
+		case "http", "https", "file":
+		default:
+			return fmt.Errorf("invalid -pac-url %q: unsupported scheme %q, want http, https, file or a local path", source, scheme)
+		}
+	}
+	p := &pacRouter{source: source, ttl: ttl, cache: make(map[string]pacResult), upstreams: make(map[string]*upstreamProxy)}
+	if err := p.load(); err != nil {
+		log.Printf("[PAC] 获取 %s 失败，在重新获取成功之前所有请求直接连接: %v", source, err)
+	} else {
+		log.Printf("[PAC] 按 %s 选择第二级代理，每个主机的结果缓存 %s", source, ttl)
+	}
+	pacRouting.Store(p)
+	return nil
+}
+
+// fetchPAC 读取PAC脚本，http(s)地址直接连接获取，不经过第二级代理，其他按本地文件读取
+func fetchPAC(source string) (string, error) {
+	lower := strings.ToLower(source)
+	if !strings.HasPrefix(lower, "http://") && !strings.HasPrefix(lower, "https://") {
+		path := source
+		if strings.HasPrefix(lower, "file://") {
+			path = source[len("file://"):]
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return "", err
+		}
+		defer f.Close()
+		data, err := io.ReadAll(io.LimitReader(f, pacMaxSize+1))
+		if err == nil && len(data) > pacMaxSize {
+			err = fmt.Errorf("%s is larger than %d bytes", path, pacMaxSize)
+		}
+		return string(data), err
+	}
+	client := &http.Client{Timeout: pacFetchTimeout, Transport: &http.Transport{DialContext: (&net.Dialer{}).DialContext}}
+	resp, err := client.Get(source)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("GET %s: %s", source, resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, pacMaxSize+1))
+	if err == nil && len(data) > pacMaxSize {
+		err = fmt.Errorf("%s is larger than %d bytes", source, pacMaxSize)
+	}
+	return string(data), err
+}
+
+// load 获取并解析PAC脚本，成功时替换当前脚本并清空缓存，失败时保留之前的脚本
+func (p *pacRouter) load() error {
+	src, err := fetchPAC(p.source)
+	var program *jsProgram
+	if err == nil {
+		program, err = jsParse(src)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err != nil {
+		p.next = time.Now().Add(pacRetry)
+		return err
+	}
+	p.program = program
+	p.next = time.Now().Add(pacRefresh)
+	p.cache = make(map[string]pacResult)
+	return nil
+}
+
+// refresh 脚本到了重新获取的时间时在后台重新获取，持有mu时调用
+func (p *pacRouter) refresh() {
+	if p.refreshing || time.Now().Before(p.next) {
+		return
+	}
+	p.refreshing = true
+	go func() {
+		err := p.load()
+		p.mu.Lock()
+		p.refreshing = false
+		p.mu.Unlock()
+		if err != nil {
+			log.Printf("[PAC] 重新获取 %s 失败: %v", p.source, err)
+		}
+	}()
+}
+
+// find 返回目标主机应使用的第二级代理，为空表示直接连接；求值出错时直接连接并返回错误，错误结果同样缓存
+func (p *pacRouter) find(r *http.Request) (proxies []*upstreamProxy, result string, err error) {
+	host := strings.ToLower(targetHost(r))
+	now := time.Now()
+	p.mu.Lock()
+	p.refresh()
+	if cached, ok := p.cache[host]; ok && now.Before(cached.expires) {
+		p.mu.Unlock()
+		return cached.proxies, cached.result, nil
+	}
+	program := p.program
+	p.mu.Unlock()
+
+	if program == nil {
+		err = errPACUnavailable
+	} else {
+		var v any
+		if v, err = program.call(pacFunctions, "FindProxyForURL", pacScriptURL(r), host); err == nil {
+			s, ok := v.(string)
+			if !ok {
+				err = fmt.Errorf("FindProxyForURL returned %s, want a string", jsTypeof(v))
+			} else {
+				result = s
+				proxies, err = p.parseResult(s)
+			}
+		}
+	}
+	if err != nil {
+		proxies, result = nil, err.Error()
+	}
+
+	p.mu.Lock()
+	if len(p.cache) >= pacMaxCache {
+		p.cache = make(map[string]pacResult)
+	}
+	p.cache[host] = pacResult{proxies: proxies, result: result, expires: now.Add(p.ttl)}
+	p.mu.Unlock()
+	return proxies, result, err
+}
+
+// pacScriptURL 传给FindProxyForURL的url，CONNECT请求与浏览器一样只给出https://host/
+func pacScriptURL(r *http.Request) string {
+	if r.Method == http.MethodConnect {
+		return "https://" + targetHost(r) + "/"
+	}
+	return r.URL.String()
+}
+
+// parseResult 解析FindProxyForURL的返回值，例如 "PROXY a:3128; SOCKS5 b:1080; DIRECT"，
+// 按顺序取DIRECT之前可用的代理，第一项为DIRECT或返回空字符串时直接连接
+func (p *pacRouter) parseResult(result string) ([]*upstreamProxy, error) {
+	var proxies []*upstreamProxy
+	for _, entry := range strings.Split(result, ";") {
+		fields := strings.Fields(entry)
+		if len(fields) == 0 {
+			continue
+		}
+		kind := strings.ToUpper(fields[0])
+		if kind == "DIRECT" {
+			return proxies, nil
+		}
+		if len(fields) != 2 {
+			continue
+		}
+		scheme := map[string]string{"PROXY": "http", "HTTP": "http", "HTTPS": "https", "SOCKS": "socks5", "SOCKS5": "socks5"}[kind]
+		if scheme == "" {
+			continue
+		}
+		u, err := p.upstream(scheme + "://" + fields[1])
+		if err != nil {
+			continue
+		}
+		proxies = append(proxies, u)
+	}
+	if len(proxies) == 0 && strings.TrimSpace(result) != "" {
+		return nil, fmt.Errorf("no usable entry in %q", result)
+	}
+	return proxies, nil
+}
+
+// upstream 解析PAC返回的代理地址，相同的地址返回同一个upstreamProxy
+func (p *pacRouter) upstream(rawURL string) (*upstreamProxy, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if u, ok := p.upstreams[rawURL]; ok {
+		return u, nil
+	}
+	u, err := parseProxyURL(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if len(p.upstreams) >= pacMaxCache {
+		p.upstreams = make(map[string]*upstreamProxy)
+	}
+	p.upstreams[rawURL] = u
+	return u, nil
+}
+
+// withProxyRoute 二次代理端口选择第二级代理：配置了PAC时按PAC的结果，否则按-proxy-url轮询
+func withProxyRoute(r *http.Request) *http.Request {
+	if pacRouting.Load() == nil {
+		return withUpstream(withDecision(r, routeProxy, ""))
+	}
+	return withPAC(r)
+}
+
+// withPAC 按PAC的结果为请求选定转发方式和第二级代理，出错时直接连接并输出警告
+func withPAC(r *http.Request) *http.Request {
+	proxies, result, err := pacRouting.Load().find(r)
+	if err != nil {
+		errorLog.PrintfCtx(r.Context(), "pac", targetHost(r), "[PAC] %s 求值失败，直接连接: %v", targetHost(r), err)
+	}
+	route := routeDirect
+	ctx := r.Context()
+	if len(proxies) > 0 {
+		route = routeProxy
+		ctx = context.WithValue(ctx, upstreamCtx{}, proxies)
+	}
+	logfCtx(ctx, levelDebug, "[PAC] %s 返回 %q，使用 %s", targetHost(r), result, route)
+	r = withDecision(r.WithContext(context.WithValue(ctx, routeCtx{}, route)), route, "pac")
+	if route == routeProxy {
+		r = withSession(r)
+	}
+	return r
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// withPACScript 在测试期间按内容为src的本地PAC文件选择第二级代理，返回文件路径
+func withPACScript(t *testing.T, src string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "proxy.pac")
+	if err := os.WriteFile(path, []byte(src), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	saved := pacRouting.Load()
+	t.Cleanup(func() { pacRouting.Store(saved) })
+	if err := setupPACRouting(path, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestPACFunctions(t *testing.T) {
+	savedNow := pacNow
+	t.Cleanup(func() { pacNow = savedNow })
+	// 2026-10-14是星期三
+	pacNow = func() time.Time { return time.Date(2026, 10, 14, 13, 30, 0, 0, time.UTC) }
+
+	tests := []struct {
+		expr string
+		want any
+	}{
+		{`isPlainHostName("intranet")`, true},
+		{`isPlainHostName("www.example.com")`, false},
+		{`dnsDomainIs("www.Example.com", ".example.com")`, true},
+		{`dnsDomainIs("example.com", ".example.com")`, false},
+		{`localHostOrDomainIs("www", "www.example.com")`, true},
+		{`localHostOrDomainIs("www.example.com", "www.example.com")`, true},
+		{`localHostOrDomainIs("www.other.com", "www.example.com")`, false},
+		{`isInNet("10.1.2.3", "10.0.0.0", "255.0.0.0")`, true},
+		{`isInNet("192.168.1.1", "10.0.0.0", "255.0.0.0")`, false},
+		{`isInNet("localhost", "127.0.0.0", "255.0.0.0")`, true},
+		{`dnsResolve("192.0.2.7")`, "192.0.2.7"},
+		{`isResolvable("127.0.0.1")`, true},
+		{`dnsDomainLevels("www.example.com")`, float64(2)},
+		{`shExpMatch("http://www.example.com/a/b", "*.example.com/*")`, true},
+		{`shExpMatch("www.example.com", "*.example.org")`, false},
+		{`shExpMatch("ab", "a?")`, true},
+		{`shExpMatch("a.b", "a*b*")`, true},
+		{`shExpMatch("abc", "a?")`, false},
+		{`weekdayRange("MON", "FRI", "GMT")`, true},
+		{`weekdayRange("SAT", "SUN", "GMT")`, false},
+		{`weekdayRange("WED", "GMT")`, true},
+		{`timeRange(13, "GMT")`, true},
+		{`timeRange(9, 17, "GMT")`, true},
+		{`timeRange(22, 6, "GMT")`, false},
+		{`timeRange(13, 0, 13, 29, "GMT")`, false},
+		{`typeof myIpAddress()`, "string"},
+	}
+	for _, tt := range tests {
+		program, err := jsParse("function f() { return " + tt.expr + "; }")
+		if err != nil {
+			t.Fatalf("%s: %v", tt.expr, err)
+		}
+		got, err := program.call(pacFunctions, "f")
+		if err != nil {
+			t.Errorf("%s: %v", tt.expr, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s = %#v, want %#v", tt.expr, got, tt.want)
+		}
+	}
+}
+
+func TestSplitWPAD(t *testing.T) {
+	rest, wpad := splitWPAD([]string{"WPAD", "http://a:1,wpad", "http://b:2"})
+	if !wpad || strings.Join(rest, " ") != "http://a:1 http://b:2" {
+		t.Errorf("splitWPAD = %q, %v", rest, wpad)
+	}
+	if _, wpad := splitWPAD([]string{"http://wpad.example:8080"}); wpad {
+		t.Error("a proxy host named wpad.example was taken as wpad")
+	}
+}
+
+// TestPACParseResult PAC返回值按顺序取DIRECT之前可用的代理，不认识的类型跳过
+func TestPACParseResult(t *testing.T) {
+	p := &pacRouter{upstreams: make(map[string]*upstreamProxy)}
+	tests := []struct {
+		result string
+		want   string // 代理的scheme://server，空格分隔，直接连接为空
+		ok     bool
+	}{
+		{"DIRECT", "", true},
+		{"", "", true},
+		{"PROXY a.example:3128", "http://a.example:3128", true},
+		{"PROXY a.example:3128; SOCKS5 b.example:1080; DIRECT", "http://a.example:3128 socks5://b.example:1080", true},
+		{"HTTPS c.example:443;PROXY d.example:80", "https://c.example:443 http://d.example:80", true},
+		{"SOCKS4 e.example:1080; DIRECT", "", true},
+		{"DIRECT; PROXY a.example:3128", "", true},
+		{"BOGUS", "", false},
+	}
+	for _, tt := range tests {
+		proxies, err := p.parseResult(tt.result)
+		if (err == nil) != tt.ok {
+			t.Errorf("parseResult(%q) error = %v, want ok %v", tt.result, err, tt.ok)
+			continue
+		}
+		var got []string
+		for _, u := range proxies {
+			got = append(got, u.scheme+"://"+u.server)
+		}
+		if strings.Join(got, " ") != tt.want {
+			t.Errorf("parseResult(%q) = %q, want %q", tt.result, got, tt.want)
+		}
+	}
+	a, _ := p.parseResult("PROXY a.example:3128")
+	b, _ := p.parseResult("PROXY a.example:3128; DIRECT")
+	if a[0] != b[0] {
+		t.Error("the same PAC proxy address was parsed into two upstreamProxy values")
+	}
+}
+
+// TestPACRouting 二次代理端口按本地PAC文件为每个目标选择：回环地址直接连接，匹配的域名经由PAC返回的代理
+func TestPACRouting(t *testing.T) {
+	echo := newEchoServer(t)
+	upstream := newConnectProxy(t, func(*http.Request) string { return "HTTP/1.1 200 Connection Established\r\n\r\n" })
+	withUpstreams(t, nil)
+	withPACScript(t, `
+function FindProxyForURL(url, host) {
+    if (isPlainHostName(host) || dnsDomainIs(host, ".corp.example"))
+        return "DIRECT";
+    if (isInNet(host, "127.0.0.0", "255.0.0.0"))
+        return "DIRECT";
+    if (shExpMatch(url, "https://*.proxied.example/*"))
+        return "PROXY `+upstream.addr+`; DIRECT";
+    return "DIRECT";
+}`)
+	srv := httptest.NewServer(proxyHandler("二次代理"))
+	t.Cleanup(srv.Close)
+
+	conn, br, resp := connectThrough(t, srv.Listener.Addr().String(), echo, "ping")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT %s status = %d, want 200", echo, resp.StatusCode)
+	}
+	got := make([]byte, 4)
+	if _, err := io.ReadFull(br, got); err != nil || string(got) != "ping" {
+		t.Fatalf("direct tunnel echoed %q, %v", got, err)
+	}
+	conn.Close()
+	select {
+	case r := <-upstream.requests:
+		t.Fatalf("the PAC proxy received %s %s for a DIRECT destination", r.Method, r.Host)
+	default:
+	}
+
+	conn, _, resp = connectThrough(t, srv.Listener.Addr().String(), "www.proxied.example:443", "")
+	defer conn.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT www.proxied.example status = %d, want 200", resp.StatusCode)
+	}
+	select {
+	case r := <-upstream.requests:
+		if r.Method != http.MethodConnect || r.Host != "www.proxied.example:443" {
+			t.Errorf("the PAC proxy received %s %s", r.Method, r.Host)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("www.proxied.example did not go through the proxy returned by the PAC script")
+	}
+}
+
+// TestPACFallbackDirect PAC脚本无法获取、无法解析或求值出错时直接连接并输出警告
+func TestPACFallbackDirect(t *testing.T) {
+	echo := newEchoServer(t)
+	withUpstreams(t, nil)
+	savedLog := errorLog
+	t.Cleanup(func() { errorLog = savedLog })
+	errorLog = newDedupLogger(0)
+	tests := []struct {
+		name, script, warning string
+	}{
+		{"syntax error", "function FindProxyForURL(url, host) { return ( }", "直接连接"},
+		{"runtime error", "function FindProxyForURL(url, host) { return nope(host); }", "nope is not defined"},
+		{"unsupported helper", "function FindProxyForURL(url, host) { return dateRange(1) ? 'DIRECT' : 'DIRECT'; }", "dateRange is not supported"},
+		{"not a string", "function FindProxyForURL(url, host) { return 1; }", "want a string"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs := captureLog(t)
+			withPACScript(t, tt.script)
+			srv := httptest.NewServer(proxyHandler("二次代理"))
+			defer srv.Close()
+			conn, _, resp := connectThrough(t, srv.Listener.Addr().String(), echo, "")
+			conn.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Errorf("CONNECT status = %d, want 200 over a direct connection", resp.StatusCode)
+			}
+			if !strings.Contains(logs.String(), tt.warning) {
+				t.Errorf("no warning mentioning %q:\n%s", tt.warning, logs)
+			}
+		})
+	}
+
+	if err := setupPACRouting("ftp://wpad/wpad.dat", time.Minute); err == nil {
+		t.Error("setupPACRouting accepted an ftp URL")
+	}
+	saved := pacRouting.Load()
+	t.Cleanup(func() { pacRouting.Store(saved) })
+	logs := captureLog(t)
+	if err := setupPACRouting(filepath.Join(t.TempDir(), "missing.pac"), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	r := connectRequest(net.JoinHostPort("example.com", "443"))
+	if proxies, _, err := pacRouting.Load().find(r); len(proxies) != 0 || err != errPACUnavailable {
+		t.Errorf("find with a missing script = %v, %v, want direct and errPACUnavailable", proxies, err)
+	}
+	if !strings.Contains(logs.String(), "所有请求直接连接") {
+		t.Errorf("no warning for a missing script:\n%s", logs)
+	}
+}
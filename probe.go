@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// upstreamProbeCount 判定连接或第二级代理失效前允许的连续探测失败次数
+const upstreamProbeCount = 3
+
+// upstreamProbeInterval 根据空闲时间计算探测间隔，最短1秒
+func upstreamProbeInterval(idle time.Duration) time.Duration {
+	interval := idle / 5
+	if interval < time.Second {
+		interval = time.Second
+	}
+	return interval
+}
+
+// tcpKeepAlive 隧道两端TCP连接的keepalive空闲时间，0表示不修改
+var tcpKeepAlive time.Duration
+
+// tcpConnOf 取出conn底层的TCP连接，TLS连接和带缓存的连接取其内层，其他连接返回nil
+func tcpConnOf(conn net.Conn) *net.TCPConn {
+	for {
+		switch c := conn.(type) {
+		case *net.TCPConn:
+			return c
+		case *tls.Conn:
+			conn = c.NetConn()
+		case *bufferedConn:
+			conn = c.Conn
+		default:
+			return nil
+		}
+	}
+}
+
+// enableTunnelKeepAlive 按-tcp-keepalive为隧道一端开启TCP keepalive，对端休眠或断网后
+// 在空闲时间加upstreamProbeCount次探测内判定失效，阻塞的读取返回错误，隧道随之关闭
+func enableTunnelKeepAlive(conn net.Conn) {
+	if tcpKeepAlive <= 0 {
+		return
+	}
+	if tcpConn := tcpConnOf(conn); tcpConn != nil {
+		if err := setKeepAliveProbe(tcpConn, tcpKeepAlive, upstreamProbeInterval(tcpKeepAlive), upstreamProbeCount); err != nil {
+			logf(levelDebug, "[隧道] 开启TCP keepalive失败: %v", err)
+		}
+	}
+}
+
+// upstreamProbe 一个第二级代理的空闲探测状态，经由它的空闲隧道共用探测结果，每个间隔最多探测一次
+type upstreamProbe struct {
+	mu       sync.Mutex
+	last     time.Time // 最近一次探测的时间
+	failures int       // 连续失败次数
+	err      error     // 最近一次失败的原因
+}
+
+// upstreamProbes 各第二级代理的空闲探测状态
+var upstreamProbes sync.Map // *upstreamProxy -> *upstreamProbe
+
+// check 探测第二级代理，距上次探测不足interval时直接使用上次的结果；
+// 返回是否已连续upstreamProbeCount次失败。启用健康检查时结果同时计入健康状态
+func (p *upstreamProbe) check(u *upstreamProxy, interval time.Duration) (bool, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if time.Since(p.last) >= interval {
+		start := time.Now()
+		err := probeUpstreamAlive(u)
+		countUpstreamProbe(u, probeIdle, err)
+		p.last = time.Now()
+		if err != nil {
+			p.failures++
+			p.err = err
+		} else {
+			p.failures, p.err = 0, nil
+		}
+		if set := healthStates.Load(); set != nil {
+			if h, ok := set.states[u]; ok {
+				h.record(u, time.Since(start), err)
+			}
+		}
+	}
+	return p.failures >= upstreamProbeCount, p.err
+}
+
+// probeUpstreamAlive 以应用层请求确认第二级代理仍在响应：配置了-health-target时经由它建立到该地址的隧道，
+// 否则HTTP(S)代理发送 OPTIONS * 并读取响应，任何状态码都视为存活，SOCKS5代理完成一次方法协商。
+// 探测使用新的连接，不会向隧道中注入任何数据
+func probeUpstreamAlive(u *upstreamProxy) error {
+	if healthTarget != "" {
+		return probeUpstream(u)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+	defer cancel()
+
+	var (
+		conn net.Conn
+		err  error
+	)
+	if u.scheme == "socks5" {
+		conn, err = dialUpstream(ctx, "tcp", u.server)
+	} else {
+		conn, err = dialProxyServer(ctx, u.scheme, u.server)
+	}
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if u.scheme == "socks5" {
+		if _, err := conn.Write([]byte{socksVersion, 1, socksAuthNone}); err != nil {
+			return err
+		}
+		var reply [2]byte
+		if _, err := io.ReadFull(conn, reply[:]); err != nil {
+			return err
+		}
+		if reply[0] != socksVersion {
+			return fmt.Errorf("unexpected SOCKS version %d", reply[0])
+		}
+		return nil
+	}
+	if _, err := fmt.Fprintf(conn, "OPTIONS * HTTP/1.1\r\nHost: %s\r\n\r\n", u.server); err != nil {
+		return err
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// watchUpstreamIdle 在二次代理隧道两个方向都空闲超过-upstream-probe-idle后，按间隔探测隧道使用的第二级代理，
+// 连续upstreamProbeCount次失败时关闭隧道两端，让客户端尽快重连而不是一直挂起，直到done被关闭。
+// 第二级代理仍在响应而隧道本身被中间设备静默丢弃的情况由-tcp-keepalive检测
+func watchUpstreamIdle(info *connInfo, u *upstreamProxy, done <-chan struct{}) {
+	interval := upstreamProbeInterval(upstreamProbeIdle)
+	state, _ := upstreamProbes.LoadOrStore(u, &upstreamProbe{})
+	probe := state.(*upstreamProbe)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var lastBytes int64
+	lastActive := time.Now()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		if n := info.up.Load() + info.down.Load(); n != lastBytes {
+			lastBytes, lastActive = n, time.Now()
+			continue
+		}
+		if time.Since(lastActive) < upstreamProbeIdle {
+			continue
+		}
+		if dead, err := probe.check(u, interval); dead {
+			logf(levelWarn, "[二次代理] 第二级代理 %s 连续 %d 次探测失败，关闭空闲隧道 %s -> %s: %v", u.server, upstreamProbeCount, info.client, info.target, err)
+			info.conn.Close()
+			info.backend.Close()
+			return
+		}
+	}
+}
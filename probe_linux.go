@@ -0,0 +1,35 @@
+package main
+
+import (
+	"net"
+	"syscall"
+	"time"
+)
+
+// setKeepAliveProbe 设置TCP keepalive的空闲时间、探测间隔和探测次数
+func setKeepAliveProbe(conn *net.TCPConn, idle, interval time.Duration, count int) error {
+	if err := conn.SetKeepAlive(true); err != nil {
+		return err
+	}
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		opts := [][2]int{
+			{syscall.TCP_KEEPIDLE, int(idle / time.Second)},
+			{syscall.TCP_KEEPINTVL, int(interval / time.Second)},
+			{syscall.TCP_KEEPCNT, count},
+		}
+		for _, opt := range opts {
+			if sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, opt[0], max(opt[1], 1)); sockErr != nil {
+				return
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+
+package main
+
+import (
+	"net"
+	"time"
+)
+
+// setKeepAliveProbe 非Linux平台只能设置keepalive周期，探测次数使用系统默认值
+func setKeepAliveProbe(conn *net.TCPConn, idle, _ time.Duration, _ int) error {
+	if err := conn.SetKeepAlive(true); err != nil {
+		return err
+	}
+	return conn.SetKeepAlivePeriod(idle)
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeUpstream 模拟第二级代理：存活时按协议应答探测，静默丢弃后接受连接但不再应答，模拟被中间设备丢弃的会话
+type fakeUpstream struct {
+	ln     net.Listener
+	socks  bool
+	silent atomic.Bool
+}
+
+func newFakeUpstream(t *testing.T, socks bool) *fakeUpstream {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := &fakeUpstream{ln: ln, socks: socks}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go u.serve(conn)
+		}
+	}()
+	return u
+}
+
+func (u *fakeUpstream) serve(conn net.Conn) {
+	defer conn.Close()
+	if u.silent.Load() {
+		io.Copy(io.Discard, conn)
+		return
+	}
+	if u.socks {
+		var greeting [3]byte
+		if _, err := io.ReadFull(conn, greeting[:]); err == nil {
+			conn.Write([]byte{socksVersion, socksAuthNone})
+		}
+		return
+	}
+	buf := make([]byte, 1024)
+	conn.Read(buf)
+	io.WriteString(conn, "HTTP/1.1 400 Bad Request\r\nContent-Length: 0\r\n\r\n")
+}
+
+func (u *fakeUpstream) proxy(scheme string) *upstreamProxy {
+	return &upstreamProxy{scheme: scheme, server: u.ln.Addr().String()}
+}
+
+// withProbeTimeouts 在测试期间缩短探测使用的超时，结束后恢复原值
+func withProbeTimeouts(t *testing.T, idle time.Duration) {
+	t.Helper()
+	savedIdle, savedDial, savedTarget := upstreamProbeIdle, dialTimeout, healthTarget
+	t.Cleanup(func() { upstreamProbeIdle, dialTimeout, healthTarget = savedIdle, savedDial, savedTarget })
+	upstreamProbeIdle, dialTimeout, healthTarget = idle, 200*time.Millisecond, ""
+}
+
+func TestProbeUpstreamAlive(t *testing.T) {
+	withProbeTimeouts(t, time.Second)
+	origin := httptest.NewServer(http.NotFoundHandler())
+	defer origin.Close()
+	silent := newFakeUpstream(t, false)
+	silent.silent.Store(true)
+	closed, _ := net.Listen("tcp", "127.0.0.1:0")
+	closedAddr := closed.Addr().String()
+	closed.Close()
+
+	tests := []struct {
+		name     string
+		upstream *upstreamProxy
+		alive    bool
+	}{
+		{"http proxy answering with an error status", newFakeUpstream(t, false).proxy("http"), true},
+		{"http server answering OPTIONS *", &upstreamProxy{scheme: "http", server: origin.Listener.Addr().String()}, true},
+		{"socks5 proxy", newFakeUpstream(t, true).proxy("socks5"), true},
+		{"silently dropped", silent.proxy("http"), false},
+		{"refused", &upstreamProxy{scheme: "http", server: closedAddr}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := probeUpstreamAlive(tt.upstream); (err == nil) != tt.alive {
+				t.Errorf("probeUpstreamAlive = %v, want alive %v", err, tt.alive)
+			}
+		})
+	}
+}
+
+// TestWatchUpstreamIdleClosesTunnel 第二级代理存活时空闲隧道保持打开且探测不向隧道写入数据，
+// 静默丢弃后在连续upstreamProbeCount次探测内关闭隧道两端
+func TestWatchUpstreamIdleClosesTunnel(t *testing.T) {
+	if testing.Short() {
+		t.Skip("probes run at a 1s minimum interval")
+	}
+	withProbeTimeouts(t, 50*time.Millisecond)
+	upstream := newFakeUpstream(t, false)
+
+	clientConn, clientPeer := net.Pipe()
+	backendConn, backendPeer := net.Pipe()
+	defer clientPeer.Close()
+	defer backendPeer.Close()
+	info := &connInfo{client: "test", target: "example.com:443", conn: clientConn, backend: backendConn}
+	done := make(chan struct{})
+	defer close(done)
+	go watchUpstreamIdle(info, upstream.proxy("http"), done)
+
+	read := func(conn net.Conn) chan error {
+		ch := make(chan error, 1)
+		go func() {
+			var b [1]byte
+			_, err := conn.Read(b[:])
+			ch <- err
+		}()
+		return ch
+	}
+	clientRead, backendRead := read(clientPeer), read(backendPeer)
+
+	interval := upstreamProbeInterval(upstreamProbeIdle)
+	select {
+	case err := <-backendRead:
+		t.Fatalf("tunnel to a live second proxy was written to or closed: %v", err)
+	case err := <-clientRead:
+		t.Fatalf("tunnel to a live second proxy was written to or closed: %v", err)
+	case <-time.After(2*interval + interval/2):
+	}
+
+	upstream.silent.Store(true)
+	window := time.Duration(upstreamProbeCount+1) * (interval + dialTimeout)
+	for _, ch := range []chan error{clientRead, backendRead} {
+		select {
+		case err := <-ch:
+			if err != io.EOF && err != io.ErrClosedPipe {
+				t.Errorf("leg closed with %v", err)
+			}
+		case <-time.After(window):
+			t.Fatalf("tunnel was not closed within %s after the second proxy went silent", window)
+		}
+	}
+}
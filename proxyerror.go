@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"syscall"
+)
+
+// errorKind 代理失败的种类，供错误响应、日志字段和指标标签区分
+type errorKind int
+
+const (
+	kindUnknown           errorKind = iota
+	kindDNS                         // 域名解析失败
+	kindDialRefused                 // 连接被拒绝或不可达
+	kindDialTimeout                 // 建立连接超时
+	kindUpstreamHandshake           // 与第二级代理的CONNECT握手失败
+	kindUpstreamAuth                // 第二级代理要求认证或认证失败
+	kindTLS                         // TLS握手或证书校验失败
+	kindPolicyDenied                // 被访问策略拒绝
+	kindCanceled                    // 请求被取消，通常是客户端已断开
+	kindConfig                      // 代理配置错误
+	kindBadTarget                   // 目标地址不合法
+)
+
+var errorKindNames = [...]string{
+	kindUnknown:           "unknown",
+	kindDNS:               "dns",
+	kindDialRefused:       "dial_refused",
+	kindDialTimeout:       "dial_timeout",
+	kindUpstreamHandshake: "upstream_handshake",
+	kindUpstreamAuth:      "upstream_auth",
+	kindTLS:               "tls",
+	kindPolicyDenied:      "policy_denied",
+	kindCanceled:          "canceled",
+	kindConfig:            "config",
+	kindBadTarget:         "bad_target",
+}
+
+func (k errorKind) String() string {
+	if int(k) < len(errorKindNames) {
+		return errorKindNames[k]
+	}
+	return "unknown"
+}
+
+// proxyError 代理在拨号、握手、转发过程中产生的错误，包装底层错误并记录失败种类
+type proxyError struct {
+	kind     errorKind
+	upstream bool   // 失败发生在与第二级代理之间还是与目标服务器之间
+	status   int    // 返回给客户端的状态码，0表示按kind决定
+	msg      string // 返回给客户端的错误信息
+	err      error  // 底层错误
+}
+
+func (e *proxyError) Error() string {
+	if e.err == nil {
+		return e.msg
+	}
+	return fmt.Sprintf("%s: %v", e.msg, e.err)
+}
+
+func (e *proxyError) Unwrap() error {
+	return e.err
+}
+
+// newProxyError 根据底层错误分类生成proxyError
+func newProxyError(upstream bool, msg string, err error) *proxyError {
+	return &proxyError{kind: classifyError(err), upstream: upstream, msg: msg, err: err}
+}
+
+// classifyError 从底层错误中判断失败种类，会逐层展开net.OpError、url.Error等包装
+func classifyError(err error) errorKind {
+	if err == nil {
+		return kindUnknown
+	}
+	var (
+		pe          *proxyError
+		dnsErr      *net.DNSError
+		unknownAuth x509.UnknownAuthorityError
+		hostErr     x509.HostnameError
+		certErr     x509.CertificateInvalidError
+		verifyErr   *tls.CertificateVerificationError
+		recordErr   tls.RecordHeaderError
+		alertErr    tls.AlertError
+	)
+	switch {
+	case errors.As(err, &pe):
+		return pe.kind
+	case errors.Is(err, context.Canceled):
+		return kindCanceled
+	case errors.Is(err, context.DeadlineExceeded):
+		return kindDialTimeout
+	case errors.As(err, &dnsErr):
+		return kindDNS
+	case errors.As(err, &verifyErr), errors.As(err, &unknownAuth), errors.As(err, &hostErr),
+		errors.As(err, &certErr), errors.As(err, &recordErr), errors.As(err, &alertErr):
+		return kindTLS
+	case isTimeout(err):
+		return kindDialTimeout
+	case errors.Is(err, syscall.ECONNREFUSED), errors.Is(err, syscall.ECONNRESET),
+		errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, syscall.ENETUNREACH):
+		return kindDialRefused
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return kindDialRefused
+	}
+	return kindUnknown
+}
+
+// reason 返回错误响应的X-WebProxy-Error原因
+func (e *proxyError) reason() errorReason {
+	switch e.kind {
+	case kindDNS:
+		return reasonDNSFailure
+	case kindDialTimeout:
+		return reasonDialTimeout
+	case kindPolicyDenied:
+		return reasonACLDenied
+	case kindConfig:
+		return reasonConfigError
+	case kindBadTarget:
+		return reasonBadRequest
+	case kindUpstreamHandshake, kindUpstreamAuth:
+		return reasonUpstreamRefused
+	}
+	if e.upstream {
+		return reasonUpstreamUnreachable
+	}
+	return reasonOriginUnreachable
+}
+
+// statusCode 返回错误响应的状态码
+func (e *proxyError) statusCode() int {
+	if e.status != 0 {
+		return e.status
+	}
+	switch e.kind {
+	case kindDialTimeout:
+		return http.StatusGatewayTimeout
+	case kindPolicyDenied:
+		return http.StatusForbidden
+	case kindConfig:
+		return http.StatusInternalServerError
+	case kindBadTarget:
+		return http.StatusBadRequest
+	case kindTLS, kindUpstreamAuth:
+		return http.StatusBadGateway
+	}
+	return http.StatusServiceUnavailable
+}
+
+// writeFailure 根据错误写入错误响应：预算耗尽时返回504并注明阶段，proxyError按种类决定状态码和原因
+func writeFailure(w http.ResponseWriter, r *http.Request, err error) {
+	if writeBudgetError(w, r) {
+		return
+	}
+	var pe *proxyError
+	if !errors.As(err, &pe) {
+		pe = newProxyError(false, "Proxy request failed", err)
+		pe.status = http.StatusBadGateway
+	}
+	writeProxyError(w, pe.statusCode(), pe.reason(), requestTarget(r), pe.msg)
+}
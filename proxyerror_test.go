@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"syscall"
+	"testing"
+)
+
+// timeoutError 模拟net.Error超时
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestClassifyError(t *testing.T) {
+	dial := func(err error) error { return &net.OpError{Op: "dial", Net: "tcp", Err: err} }
+	tests := []struct {
+		name string
+		err  error
+		want errorKind
+	}{
+		{"nil", nil, kindUnknown},
+		{"refused", dial(os.NewSyscallError("connect", syscall.ECONNREFUSED)), kindDialRefused},
+		{"unreachable", dial(os.NewSyscallError("connect", syscall.EHOSTUNREACH)), kindDialRefused},
+		{"other dial error", dial(errors.New("mystery")), kindDialRefused},
+		{"timeout", dial(timeoutError{}), kindDialTimeout},
+		{"deadline", fmt.Errorf("dial: %w", context.DeadlineExceeded), kindDialTimeout},
+		{"canceled", &url.Error{Op: "Get", URL: "http://example.com", Err: context.Canceled}, kindCanceled},
+		{"dns", dial(&net.DNSError{Err: "no such host", Name: "nx.example"}), kindDNS},
+		{"tls unknown authority", &url.Error{Op: "Get", Err: x509.UnknownAuthorityError{}}, kindTLS},
+		{"wrapped proxyError", fmt.Errorf("chain: %w", &proxyError{kind: kindUpstreamAuth}), kindUpstreamAuth},
+		{"unrelated", errors.New("boom"), kindUnknown},
+	}
+	for _, tt := range tests {
+		if got := classifyError(tt.err); got != tt.want {
+			t.Errorf("%s: classifyError(%v) = %s, want %s", tt.name, tt.err, got, tt.want)
+		}
+	}
+}
+
+// TestProxyErrorResponse 每种失败对应的状态码和X-WebProxy-Error原因，第二级代理和目标服务器的不可达分开
+func TestProxyErrorResponse(t *testing.T) {
+	tests := []struct {
+		err    *proxyError
+		status int
+		reason errorReason
+	}{
+		{&proxyError{kind: kindDialRefused}, http.StatusServiceUnavailable, reasonOriginUnreachable},
+		{&proxyError{kind: kindDialRefused, upstream: true}, http.StatusServiceUnavailable, reasonUpstreamUnreachable},
+		{&proxyError{kind: kindDialTimeout}, http.StatusGatewayTimeout, reasonDialTimeout},
+		{&proxyError{kind: kindDNS}, http.StatusServiceUnavailable, reasonDNSFailure},
+		{&proxyError{kind: kindPolicyDenied}, http.StatusForbidden, reasonACLDenied},
+		{&proxyError{kind: kindConfig}, http.StatusInternalServerError, reasonConfigError},
+		{&proxyError{kind: kindBadTarget}, http.StatusBadRequest, reasonBadRequest},
+		{&proxyError{kind: kindTLS, upstream: true}, http.StatusBadGateway, reasonUpstreamUnreachable},
+		{&proxyError{kind: kindUpstreamAuth, upstream: true}, http.StatusBadGateway, reasonUpstreamRefused},
+		{&proxyError{kind: kindUpstreamHandshake, upstream: true, status: http.StatusForbidden}, http.StatusForbidden, reasonUpstreamRefused},
+	}
+	for _, tt := range tests {
+		if got := tt.err.statusCode(); got != tt.status {
+			t.Errorf("%s upstream=%v: status %d, want %d", tt.err.kind, tt.err.upstream, got, tt.status)
+		}
+		if got := tt.err.reason(); got != tt.reason {
+			t.Errorf("%s upstream=%v: reason %s, want %s", tt.err.kind, tt.err.upstream, got, tt.reason)
+		}
+	}
+}
+
+func TestProxyErrorUnwrap(t *testing.T) {
+	cause := os.NewSyscallError("connect", syscall.ECONNREFUSED)
+	pe := newProxyError(true, "Failed to connect to the second proxy", &net.OpError{Op: "dial", Err: cause})
+	if !errors.Is(pe, syscall.ECONNREFUSED) {
+		t.Error("proxyError does not unwrap to the underlying errno")
+	}
+	if pe.kind != kindDialRefused || !pe.upstream {
+		t.Errorf("kind %s upstream %v", pe.kind, pe.upstream)
+	}
+	if got := (&proxyError{msg: "plain"}).Error(); got != "plain" {
+		t.Errorf("Error() without a cause = %q", got)
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	maxRatePerConn byteRate // 每个连接每个方向的速率上限，0表示不限速
+	maxRateTotal   byteRate // 所有连接合计的速率上限，0表示不限速
+)
+
+// byteRate 以字节/秒表示的速率参数，接受 5MB/s、512KB、1000 等写法，单位按1024进位；
+// 也接受按比特计的 50Mbit/s，按1000进位
+type byteRate int64
+
+// rateUnits 速率参数可用的单位
+var rateUnits = []struct {
+	suffix string
+	size   int64
+}{
+	{"GBIT", 1e9 / 8}, {"MBIT", 1e6 / 8}, {"KBIT", 1e3 / 8},
+	{"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"G", 1 << 30}, {"M", 1 << 20}, {"K", 1 << 10}, {"B", 1},
+}
+
+func (r *byteRate) String() string {
+	n := int64(*r)
+	if n == 0 {
+		return "0"
+	}
+	for _, u := range rateUnits[3:6] {
+		if n >= u.size && n%u.size == 0 {
+			return fmt.Sprintf("%d%s/s", n/u.size, u.suffix)
+		}
+	}
+	return fmt.Sprintf("%dB/s", n)
+}
+
+// Set 解析速率，/s可以省略
+func (r *byteRate) Set(value string) error {
+	s := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(value)), "/S")
+	size := int64(1)
+	for _, u := range rateUnits {
+		if strings.HasSuffix(s, u.suffix) {
+			s, size = strings.TrimSpace(strings.TrimSuffix(s, u.suffix)), u.size
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid rate %q, want e.g. 5MB/s, 512KB/s, 50Mbit/s or 0", value)
+	}
+	*r = byteRate(n * float64(size))
+	return nil
+}
+
+// rateChunk 限速时单次读取的上限，避免一个连接一次取走大量令牌
+const rateChunk = 16 << 10
+
+// totalLimiter 所有连接共用的-max-rate-total限速，为nil表示不限速
+var totalLimiter *rateLimiter
+
+// setupRateLimit 按-max-rate-total创建全局限速，桶的容量为0.1秒的流量，限制空闲后的突发
+func setupRateLimit() {
+	if maxRateTotal > 0 {
+		totalLimiter = newRateLimiter(float64(maxRateTotal), max(float64(maxRateTotal)/10, rateChunk))
+	}
+}
+
+// rateLimiter 令牌桶，空闲时最多积累burst个令牌，允许短时间突发
+type rateLimiter struct {
+	mu     sync.Mutex // 全局限速被所有连接并发使用
+	rate   float64    // 每秒补充的令牌数
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter 创建装满令牌的桶
+func newRateLimiter(rate, burst float64) *rateLimiter {
+	return &rateLimiter{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// wait 消耗n个令牌，令牌不足时休眠到补足为止；并发调用按先后预约令牌，活跃的连接依次分得带宽
+func (l *rateLimiter) wait(n int) {
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens = min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	l.tokens -= float64(n)
+	delay := time.Duration(-l.tokens / l.rate * float64(time.Second))
+	l.mu.Unlock()
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+// limitedReader 每次读取后按读到的字节数依次消耗各个桶的令牌，实际速率为其中最低的一个
+type limitedReader struct {
+	r        io.Reader
+	limiters []*rateLimiter
+	chunk    int // 单次读取的上限
+}
+
+// Read 单次读取不超过chunk，避免一次读取后长时间休眠
+func (r *limitedReader) Read(p []byte) (int, error) {
+	if len(p) > r.chunk {
+		p = p[:r.chunk]
+	}
+	n, err := r.r.Read(p)
+	if n > 0 {
+		for _, l := range r.limiters {
+			l.wait(n)
+		}
+	}
+	return n, err
+}
+
+// limitRate perConn大于0或配置了-max-rate-total时为r加上限速，每次调用得到独立的单连接限速，否则原样返回；
+// perConn通常为-max-rate-per-conn，命中的规则可以用rate=覆盖
+func limitRate(r io.Reader, perConn byteRate) io.Reader {
+	lr := &limitedReader{r: r, chunk: rateChunk}
+	if perConn > 0 {
+		rate := float64(perConn)
+		lr.limiters = append(lr.limiters, newRateLimiter(rate, rate))
+		lr.chunk = min(lr.chunk, max(int(rate), 1))
+	}
+	if totalLimiter != nil {
+		lr.limiters = append(lr.limiters, totalLimiter)
+	}
+	if len(lr.limiters) == 0 {
+		return r
+	}
+	return lr
+}
+
+// limitBody 与limitRate相同，用于响应体
+func limitBody(body io.ReadCloser, perConn byteRate) io.ReadCloser {
+	if perConn <= 0 && totalLimiter == nil {
+		return body
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{limitRate(body, perConn), body}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestByteRate(t *testing.T) {
+	tests := []struct {
+		value string
+		want  byteRate
+		str   string
+		ok    bool
+	}{
+		{"0", 0, "0", true},
+		{"1000", 1000, "1000B/s", true},
+		{"512KB/s", 512 << 10, "512KB/s", true},
+		{"5MB/s", 5 << 20, "5MB/s", true},
+		{"5mb", 5 << 20, "5MB/s", true},
+		{"1.5M", 3 << 19, "1536KB/s", true},
+		{"2 GB/s", 2 << 30, "2GB/s", true},
+		{"50Mbit/s", 50e6 / 8, "6250000B/s", true},
+		{"8kbit", 1000, "1000B/s", true},
+		{"fast", 0, "", false},
+		{"-1MB/s", 0, "", false},
+		{"MB/s", 0, "", false},
+	}
+	for _, tt := range tests {
+		var r byteRate
+		err := r.Set(tt.value)
+		if (err == nil) != tt.ok {
+			t.Errorf("Set(%q) error = %v, want ok %v", tt.value, err, tt.ok)
+			continue
+		}
+		if !tt.ok {
+			continue
+		}
+		if r != tt.want || r.String() != tt.str {
+			t.Errorf("Set(%q) = %d (%s), want %d (%s)", tt.value, r, r.String(), tt.want, tt.str)
+		}
+	}
+}
+
+// TestRateLimiter 装满的桶允许burst的突发，之后按rate补充
+func TestRateLimiter(t *testing.T) {
+	l := newRateLimiter(100<<10, 10<<10)
+	start := time.Now()
+	l.wait(10 << 10)
+	if elapsed := time.Since(start); elapsed > 20*time.Millisecond {
+		t.Errorf("burst within the bucket waited %v", elapsed)
+	}
+	start = time.Now()
+	l.wait(20 << 10) // 桶已空，需要0.2秒补充
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond || elapsed > time.Second {
+		t.Errorf("waiting for 20KB at 100KB/s took %v, want about 200ms", elapsed)
+	}
+}
+
+// withRates 在测试期间使用给定的-max-rate-per-conn和-max-rate-total
+func withRates(t testing.TB, perConn, total byteRate) {
+	t.Helper()
+	savedPer, savedTotal, savedLimiter := maxRatePerConn, maxRateTotal, totalLimiter
+	t.Cleanup(func() { maxRatePerConn, maxRateTotal, totalLimiter = savedPer, savedTotal, savedLimiter })
+	maxRatePerConn, maxRateTotal, totalLimiter = perConn, total, nil
+	setupRateLimit()
+}
+
+// TestLimitRatePerConn 每个连接单独限速，未配置时原样返回reader
+func TestLimitRatePerConn(t *testing.T) {
+	withRates(t, 0, 0)
+	src := strings.NewReader("data")
+	if limitRate(src, maxRatePerConn) != io.Reader(src) {
+		t.Error("limitRate wrapped the reader with no limit configured")
+	}
+
+	withRates(t, 64<<10, 0)
+	payload := bytes.Repeat([]byte("x"), 96<<10)
+	start := time.Now()
+	// 桶装满时先通过64KB，剩余32KB需要约0.5秒
+	got, err := io.ReadAll(limitRate(bytes.NewReader(payload), maxRatePerConn))
+	elapsed := time.Since(start)
+	if err != nil || len(got) != len(payload) {
+		t.Fatalf("read %d bytes, %v", len(got), err)
+	}
+	if elapsed < 400*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("96KB at 64KB/s took %v, want about 500ms", elapsed)
+	}
+
+	// 另一个连接有自己的令牌桶，不受前一个连接的影响
+	start = time.Now()
+	io.ReadAll(limitRate(bytes.NewReader(payload[:32<<10]), maxRatePerConn))
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("a new connection within its burst waited %v", elapsed)
+	}
+}
+
+// TestLimitRateTotal 所有连接共享-max-rate-total，同时进行的连接合计不超过上限且都能分得带宽
+func TestLimitRateTotal(t *testing.T) {
+	withRates(t, 0, 256<<10)
+	payload := bytes.Repeat([]byte("x"), 128<<10)
+	start := time.Now()
+	done := make(chan time.Duration, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			// 与隧道一样使用固定大小的缓冲读取，io.ReadAll逐步扩大的缓冲会使先开始的连接占优
+			io.Copy(io.Discard, limitRate(bytes.NewReader(payload), maxRatePerConn))
+			done <- time.Since(start)
+		}()
+	}
+	// 合计256KB，桶容量为0.1秒的流量，约需0.9秒
+	for i := 0; i < 2; i++ {
+		if elapsed := <-done; elapsed < 600*time.Millisecond || elapsed > 3*time.Second {
+			t.Errorf("connection %d finished after %v, want both to share about 900ms", i, elapsed)
+		}
+	}
+}
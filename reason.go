@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// errorReason 本地生成的错误响应的原因，作为X-WebProxy-Error头部的值，也用作指标标签
+type errorReason string
+
+const (
+	reasonUpstreamUnreachable errorReason = "upstream_unreachable" // 无法连接第二级代理
+	reasonUpstreamRefused     errorReason = "upstream_refused"     // 第二级代理拒绝了请求
+	reasonOriginUnreachable   errorReason = "origin_unreachable"   // 无法连接目标服务器
+	reasonDNSFailure          errorReason = "dns_failure"          // 域名解析失败
+	reasonACLDenied           errorReason = "acl_denied"           // 被访问策略拒绝
+	reasonDialTimeout         errorReason = "dial_timeout"         // 建立连接超时
+	reasonRequestTimeout      errorReason = "request_timeout"      // 请求超出整体时间预算
+	reasonQuotaExceeded       errorReason = "quota_exceeded"       // 超出连接数或流量配额
+	reasonOverloaded          errorReason = "overloaded"           // 代理资源耗尽
+	reasonConfigError         errorReason = "config_error"         // 代理配置错误
+	reasonInternalError       errorReason = "internal_error"       // 代理内部错误
+	reasonBadRequest          errorReason = "bad_request"          // 客户端请求不合法
+	reasonAuthRequired        errorReason = "auth_required"        // 客户端未通过代理认证
+)
+
+// writeProxyError 写入本地生成的错误响应，附带X-WebProxy-Error和X-WebProxy-Target头部
+func writeProxyError(w http.ResponseWriter, status int, reason errorReason, target, msg string) {
+	w.Header().Set("X-WebProxy-Error", string(reason))
+	if target != "" {
+		w.Header().Set("X-WebProxy-Target", target)
+	}
+	http.Error(w, msg, status)
+}
+
+// writeRawError 在已劫持或尚未交给net/http的连接上直接写入错误响应，原因同时作为状态行的reason phrase
+func writeRawError(conn io.Writer, status int, reason errorReason, target, msg string) {
+	header := fmt.Sprintf("HTTP/1.1 %d %s\r\nX-WebProxy-Error: %s\r\n", status, reason, reason)
+	if target != "" {
+		header += "X-WebProxy-Target: " + target + "\r\n"
+	}
+	body := msg + "\n"
+	fmt.Fprintf(conn, "%sContent-Type: text/plain; charset=utf-8\r\nConnection: close\r\nContent-Length: %d\r\n\r\n%s", header, len(body), body)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWriteProxyError(t *testing.T) {
+	w := httptest.NewRecorder()
+	writeProxyError(w, http.StatusServiceUnavailable, reasonOverloaded, "example.com:443", "Proxy is busy")
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("status %d, want 503", w.Code)
+	}
+	if got := w.Header().Get("X-WebProxy-Error"); got != "overloaded" {
+		t.Errorf("X-WebProxy-Error %q, want overloaded", got)
+	}
+	if got := w.Header().Get("X-WebProxy-Target"); got != "example.com:443" {
+		t.Errorf("X-WebProxy-Target %q", got)
+	}
+
+	w = httptest.NewRecorder()
+	writeProxyError(w, http.StatusBadRequest, reasonBadRequest, "", "Invalid target host")
+	if _, ok := w.Header()["X-Webproxy-Target"]; ok {
+		t.Error("X-WebProxy-Target sent without a target")
+	}
+}
+
+// TestWriteRawError 劫持后的连接上写入的错误响应是完整的HTTP响应，原因同时作为reason phrase
+func TestWriteRawError(t *testing.T) {
+	var buf strings.Builder
+	writeRawError(&buf, http.StatusBadGateway, reasonUpstreamRefused, "example.com:443", "The second proxy refused")
+	resp, err := http.ReadResponse(bufio.NewReader(strings.NewReader(buf.String())), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if resp.Status != "502 upstream_refused" {
+		t.Errorf("status line %q, want 502 upstream_refused", resp.Status)
+	}
+	if resp.Header.Get("X-WebProxy-Error") != "upstream_refused" || resp.Header.Get("X-WebProxy-Target") != "example.com:443" {
+		t.Errorf("headers %v", resp.Header)
+	}
+	if string(body) != "The second proxy refused\n" || !resp.Close {
+		t.Errorf("body %q close %v", body, resp.Close)
+	}
+}
+
+// TestFailureReasonHeaders 转发失败时客户端从头部得到机器可读的原因和目标
+func TestFailureReasonHeaders(t *testing.T) {
+	closed, _ := net.Listen("tcp", "127.0.0.1:0")
+	refused := closed.Addr().String()
+	closed.Close()
+	proxy := directProxy(t)
+
+	tests := []struct {
+		name   string
+		do     func() (*http.Response, error)
+		status int
+		reason errorReason
+	}{
+		{"CONNECT refused", func() (*http.Response, error) {
+			_, br := rawRequest(t, proxy.Listener.Addr().String(), "CONNECT "+refused+" HTTP/1.1\r\nHost: "+refused+"\r\n\r\n")
+			return http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+		}, http.StatusServiceUnavailable, reasonOriginUnreachable},
+		{"GET refused", func() (*http.Response, error) {
+			return proxyClient(proxy.URL).Get("http://" + refused + "/")
+		}, http.StatusBadGateway, reasonOriginUnreachable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := tt.do()
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.status {
+				t.Errorf("status %d, want %d", resp.StatusCode, tt.status)
+			}
+			if got := resp.Header.Get("X-WebProxy-Error"); got != string(tt.reason) {
+				t.Errorf("X-WebProxy-Error %q, want %q", got, tt.reason)
+			}
+			if got := resp.Header.Get("X-WebProxy-Target"); got != refused {
+				t.Errorf("X-WebProxy-Target %q, want %q", got, refused)
+			}
+		})
+	}
+}
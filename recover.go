@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"runtime/debug"
+)
+
+// countPanic 按发生panic的监听或隧道记录一次，返回累计次数
+func countPanic(title string) int64 {
+	where := listenerNames[title]
+	if where == "" {
+		where = title
+	}
+	metricPanics.with(where).Add(1)
+	return metricPanics.total()
+}
+
+// recoverWriter 记录响应是否已经开始，用于panic后判断还能否返回502
+type recoverWriter struct {
+	http.ResponseWriter
+	started bool
+}
+
+// WriteHeader 记录响应已开始
+func (w *recoverWriter) WriteHeader(code int) {
+	w.started = true
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// Write 记录响应已开始
+func (w *recoverWriter) Write(b []byte) (int, error) {
+	w.started = true
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush 透传Flush
+func (w *recoverWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		w.started = true
+		f.Flush()
+	}
+}
+
+// Hijack 透传Hijack，劫持后不能再写入错误响应
+func (w *recoverWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("hijacking not supported")
+	}
+	w.started = true
+	return hijacker.Hijack()
+}
+
+// withRecovery 为handler增加panic恢复：记录客户端、目标和堆栈，响应未开始时返回502
+func withRecovery(title string, h http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rw := &recoverWriter{ResponseWriter: w}
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			if v == http.ErrAbortHandler {
+				// net/http约定的中止信号，交给net/http处理
+				panic(v)
+			}
+			n := countPanic(title)
+			logfCtx(r.Context(), levelError, "[%s] 处理请求时发生panic(累计%d次): 客户端 %s 目标 %s: %v\n%s", title, n, clientKey(r), r.Host, v, debug.Stack())
+			if !rw.started {
+				writeProxyError(rw, http.StatusBadGateway, reasonInternalError, r.Host, "Proxy internal error")
+			}
+		}()
+		h(rw, r)
+	})
+}
+
+// recoverTunnel 用于隧道goroutine的defer，捕获panic并记录，避免整个进程退出
+// 调用方需要保证连接会在自身的defer中关闭
+func recoverTunnel(detail string) {
+	v := recover()
+	if v == nil {
+		return
+	}
+	n := countPanic("隧道")
+	logf(levelError, "[隧道] %s时发生panic(累计%d次): %v\n%s", detail, n, v, debug.Stack())
+}
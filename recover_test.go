@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWithRecoveryCountsPanics(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		status  int
+	}{
+		{"panic before the response", func(w http.ResponseWriter, r *http.Request) { panic("boom") }, http.StatusBadGateway},
+		{"panic after the response started", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusTeapot)
+			panic("boom")
+		}, http.StatusTeapot},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := metricPanics.with("proxy").Load()
+			w := httptest.NewRecorder()
+			withRecovery("二次代理", tt.handler).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+			if w.Code != tt.status {
+				t.Errorf("status %d, want %d", w.Code, tt.status)
+			}
+			if got := metricPanics.with("proxy").Load(); got != before+1 {
+				t.Errorf("webproxy_panics_total{where=\"proxy\"} = %d, want %d", got, before+1)
+			}
+		})
+	}
+}
+
+func TestRecoverTunnelCountsPanics(t *testing.T) {
+	before := metricPanics.with("tunnel").Load()
+	func() {
+		defer recoverTunnel("测试")
+		panic("boom")
+	}()
+	if got := metricPanics.with("tunnel").Load(); got != before+1 {
+		t.Errorf("webproxy_panics_total{where=\"tunnel\"} = %d, want %d", got, before+1)
+	}
+
+	var out strings.Builder
+	metricPanics.write(&out)
+	if !strings.Contains(out.String(), `webproxy_panics_total{where="tunnel"}`) {
+		t.Errorf("/metrics output does not include the panic counter:\n%s", out.String())
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// maxUpstreamRedirects 跟随第二级代理重定向的最大次数
+const maxUpstreamRedirects = 2
+
+// isRedirect 判断状态码是否为指向其他代理节点的重定向
+func isRedirect(status int) bool {
+	switch status {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther,
+		http.StatusUseProxy, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return true
+	}
+	return false
+}
+
+// redirectTarget 从Location中解析出下一个代理节点的host:port，支持 http://host:port 和 host:port 两种形式
+func redirectTarget(location string) (string, error) {
+	location = strings.TrimSpace(location)
+	if location == "" {
+		return "", errors.New("missing Location header")
+	}
+	if !strings.Contains(location, "://") {
+		location = "http://" + location
+	}
+	u, err := url.Parse(location)
+	if err != nil {
+		return "", err
+	}
+	if u.Hostname() == "" {
+		return "", errors.New("Location has no host: " + location)
+	}
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	return net.JoinHostPort(u.Hostname(), port), nil
+}
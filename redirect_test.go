@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// connectProxy 模拟第二级代理：以respond返回的状态行和头部应答每个CONNECT，
+// 200时把连接当作到目标的隧道原样回显，否则等待对方关闭连接后向closed发送一个值
+type connectProxy struct {
+	addr     string
+	requests chan *http.Request
+	closed   chan struct{}
+}
+
+func newConnectProxy(t *testing.T, respond func(r *http.Request) string) *connectProxy {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	p := &connectProxy{addr: ln.Addr().String(), requests: make(chan *http.Request, 16), closed: make(chan struct{}, 16)}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go p.serve(conn, respond)
+		}
+	}()
+	return p
+}
+
+func (p *connectProxy) serve(conn net.Conn, respond func(r *http.Request) string) {
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	req, err := http.ReadRequest(br)
+	if err != nil {
+		return
+	}
+	p.requests <- req
+	resp := respond(req)
+	io.WriteString(conn, resp)
+	if strings.HasPrefix(resp, "HTTP/1.1 200") {
+		io.Copy(conn, br)
+		return
+	}
+	io.Copy(io.Discard, br)
+	p.closed <- struct{}{}
+}
+
+// connectRequest 构造一个CONNECT target的客户端请求
+func connectRequest(target string) *http.Request {
+	r := httptest.NewRequest(http.MethodConnect, "http://"+target, nil)
+	r.Host = target
+	return withClientKey(r)
+}
+
+func TestRedirectTarget(t *testing.T) {
+	tests := []struct {
+		location string
+		want     string
+		ok       bool
+	}{
+		{"http://node2.example:3128", "node2.example:3128", true},
+		{"node2.example:3128", "node2.example:3128", true},
+		{"http://node2.example", "node2.example:80", true},
+		{"https://node2.example/", "node2.example:443", true},
+		{" http://[2001:db8::2]:3128 ", "[2001:db8::2]:3128", true},
+		{"", "", false},
+		{"http:///path", "", false},
+	}
+	for _, tt := range tests {
+		got, err := redirectTarget(tt.location)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("redirectTarget(%q) = %q, %v, want %q ok %v", tt.location, got, err, tt.want, tt.ok)
+		}
+	}
+	for status, want := range map[int]bool{301: true, 302: true, 303: true, 305: true, 307: true, 308: true, 300: false, 304: false, 200: false} {
+		if isRedirect(status) != want {
+			t.Errorf("isRedirect(%d) = %v, want %v", status, !want, want)
+		}
+	}
+}
+
+// TestConnectUpstreamRedirect 开启-follow-upstream-redirects时转而连接重定向到的节点，重定向循环和未开启时返回错误
+func TestConnectUpstreamRedirect(t *testing.T) {
+	saved := followUpstreamRedirects
+	t.Cleanup(func() { followUpstreamRedirects = saved })
+	final := newConnectProxy(t, func(*http.Request) string { return "HTTP/1.1 200 Connection Established\r\n\r\n" })
+	redirecting := newConnectProxy(t, func(*http.Request) string {
+		return "HTTP/1.1 307 Temporary Redirect\r\nLocation: http://" + final.addr + "\r\nContent-Length: 0\r\n\r\n"
+	})
+	var loopAddr string
+	loop := newConnectProxy(t, func(*http.Request) string {
+		return "HTTP/1.1 302 Found\r\nLocation: " + loopAddr + "\r\nContent-Length: 0\r\n\r\n"
+	})
+	loopAddr = loop.addr
+
+	tests := []struct {
+		name     string
+		follow   bool
+		upstream string
+		ok       bool
+	}{
+		{"followed", true, redirecting.addr, true},
+		{"disabled", false, redirecting.addr, false},
+		{"loop", true, loop.addr, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			followUpstreamRedirects = tt.follow
+			conn, err := connectUpstream(connectRequest("example.com:443"), &upstreamProxy{scheme: "http", server: tt.upstream})
+			if (err == nil) != tt.ok {
+				t.Fatalf("connectUpstream = %v, want ok %v", err, tt.ok)
+			}
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			io.WriteString(conn, "ping")
+			got := make([]byte, 4)
+			if _, err := io.ReadFull(conn, got); err != nil || string(got) != "ping" {
+				t.Errorf("tunnel through the redirected node echoed %q, %v", got, err)
+			}
+		})
+	}
+}
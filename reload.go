@@ -0,0 +1,156 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"web-proxy/config"
+)
+
+// reloadableOptions 收到SIGHUP时重新加载的参数，其他参数的修改需要重启才能生效
+var reloadableOptions = map[string]bool{
+	"proxy-url":     true,
+	"auth":          true,
+	"rules":         true,
+	"default-route": true,
+	"block-hosts":   true,
+}
+
+// reloadState 重新加载得到的新配置，全部校验通过后才替换
+type reloadState struct {
+	upstreams []*upstreamProxy
+	authUsers map[string]credential
+	rules     *ruleSet
+	fallback  string
+	blocked   *domainRules
+}
+
+// watchReload 收到SIGHUP时重新加载配置
+func watchReload() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	for range ch {
+		reloadConfig("收到SIGHUP")
+	}
+}
+
+// reloadConfig 重新读取配置文件、路由规则、黑名单和账户文件，新配置无效时保留原有配置。
+// 已经建立的隧道继续使用原来的第二级代理，只有之后的请求使用新配置；reason为触发原因，只用于日志
+func reloadConfig(reason string) {
+	log.Printf("[重新加载] %s，重新加载配置", reason)
+	values, err := reloadValues()
+	var next *reloadState
+	if err == nil {
+		next, err = buildReloadState(values)
+	}
+	if err == nil {
+		err = replaceAuthUsers(next.authUsers, authFile)
+	}
+	if err != nil {
+		log.Printf("[重新加载] 配置无效，继续使用原有配置: %v", err)
+		return
+	}
+
+	replaceUpstreams(next.upstreams, "重新加载")
+	if next.rules != nil {
+		setRoutes(next.rules, next.fallback)
+	}
+	blockedHosts.Store(next.blocked)
+
+	blocked := 0
+	if next.blocked != nil {
+		blocked = next.blocked.len()
+	}
+	log.Printf("[重新加载] 完成: 第二级代理 %d 个，-auth账户 %d 个，黑名单 %d 条", len(next.upstreams), len(next.authUsers), blocked)
+}
+
+// reloadValues 计算可重新加载参数的新值：命令行中显式指定的保持不变，其余取配置文件中的值或默认值
+func reloadValues() (map[string][]string, error) {
+	explicit := config.Explicit(flag.CommandLine)
+	values := make(map[string][]string, len(reloadableOptions))
+	for name := range reloadableOptions {
+		f := flag.Lookup(name)
+		l, isList := f.Value.(*stringList)
+		switch {
+		case explicit[name] && isList:
+			values[name] = append([]string(nil), (*l)...)
+		case explicit[name]:
+			values[name] = []string{f.Value.String()}
+		case !isList:
+			values[name] = []string{f.DefValue}
+		}
+	}
+	if configFile == "" {
+		return values, nil
+	}
+
+	options, err := config.Read(flag.CommandLine, configFile)
+	if err != nil {
+		return nil, err
+	}
+	for _, o := range options {
+		if explicit[o.Name] {
+			continue
+		}
+		f := flag.Lookup(o.Name)
+		if reloadableOptions[o.Name] {
+			values[o.Name] = o.FlagValues(f)
+			continue
+		}
+		if strings.Join(o.FlagValues(f), ",") != f.Value.String() {
+			log.Printf("[重新加载] 参数 -%s 的修改需要重启后生效", o.Name)
+		}
+	}
+	return values, nil
+}
+
+// buildReloadState 解析并校验新配置
+func buildReloadState(values map[string][]string) (*reloadState, error) {
+	next := &reloadState{}
+	var err error
+
+	if next.upstreams, err = parseUpstreams(values["proxy-url"]); err != nil {
+		return nil, err
+	}
+	if err := validateUpstreamChange(next.upstreams); err != nil {
+		return nil, err
+	}
+
+	if next.authUsers, err = parseAuthUsers(values["auth"]); err != nil {
+		return nil, err
+	}
+
+	rules, fallback := lastValue(values["rules"]), lastValue(values["default-route"])
+	if (rules == "") != (routes.Load() == nil) {
+		return nil, errors.New("enabling or disabling -rules requires a restart")
+	}
+	if rules != "" {
+		if err := validateRoute("-default-route", fallback); err != nil {
+			return nil, err
+		}
+		if next.rules, err = loadRules(rules); err != nil {
+			return nil, err
+		}
+		next.fallback = fallback
+	}
+
+	if path := lastValue(values["block-hosts"]); path != "" {
+		if next.blocked, err = loadBlocklist(path); err != nil {
+			return nil, err
+		}
+	}
+	return next, nil
+}
+
+// lastValue 返回最后一个值，没有时为空
+func lastValue(values []string) string {
+	if len(values) == 0 {
+		return ""
+	}
+	return values[len(values)-1]
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// TestReloadValues 可重新加载的参数取配置文件中的值，未出现的取默认值
+func TestReloadValues(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "web-proxy.yaml")
+	data := "proxy-url:\n  - http://10.0.0.1:8080\n  - socks5://10.0.0.2:1080\ndefault-route: direct\nproxy-port: 9000\n"
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	saved := configFile
+	t.Cleanup(func() { configFile = saved })
+	configFile = path
+
+	values, err := reloadValues()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][]string{
+		"proxy-url":     {"http://10.0.0.1:8080", "socks5://10.0.0.2:1080"},
+		"default-route": {"direct"},
+		"rules":         {""},
+		"block-hosts":   {""},
+	}
+	for name, v := range want {
+		if !reflect.DeepEqual(values[name], v) {
+			t.Errorf("%s = %q, want %q", name, values[name], v)
+		}
+	}
+	if _, ok := values["proxy-port"]; ok {
+		t.Error("proxy-port is not reloadable but was returned")
+	}
+
+	if err := os.WriteFile(path, []byte("bogus: 1\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reloadValues(); err == nil {
+		t.Error("reloadValues accepted a config file with an unknown option")
+	}
+}
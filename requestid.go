@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"time"
+)
+
+// requestIDHeader 普通HTTP请求中沿用并继续转发的请求ID头部
+const requestIDHeader = "X-Request-ID"
+
+// requestIDCtx 请求上下文中保存请求ID的key
+type requestIDCtx struct{}
+
+// receivedCtx 请求上下文中保存收到请求的时间的key
+type receivedCtx struct{}
+
+// newRequestID 生成12位十六进制的随机请求ID
+func newRequestID() string {
+	var b [6]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// withRequestID 为请求分配ID并存入请求上下文，该请求及其隧道的所有日志都带有这个ID；
+// 普通HTTP请求带有合法的X-Request-ID时沿用，该头部会随请求继续转发。同时记录收到请求的时间，隧道的各个时间点由此起算
+func withRequestID(r *http.Request) *http.Request {
+	id := ""
+	if r.Method != http.MethodConnect {
+		id = r.Header.Get(requestIDHeader)
+	}
+	if !validRequestID(id) {
+		id = newRequestID()
+	}
+	ctx := context.WithValue(r.Context(), receivedCtx{}, time.Now())
+	return r.WithContext(context.WithValue(ctx, requestIDCtx{}, id))
+}
+
+// validRequestID 只沿用长度有限且只包含可见ASCII字符的ID，避免日志注入
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// requestIDFrom 取出请求上下文中的请求ID，没有时为空
+func requestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDCtx{}).(string)
+	return id
+}
+
+// requestReceived 返回收到请求的时间，未经过withRequestID时为零值
+func requestReceived(ctx context.Context) time.Time {
+	t, _ := ctx.Value(receivedCtx{}).(time.Time)
+	return t
+}
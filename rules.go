@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// 规则路由的转发方式
+const (
+	routeDirect = "direct" // 直接连接目标
+	routeProxy  = "proxy"  // 经由第二级代理
+)
+
+// routeTable 规则路由的规则表和未命中时的转发方式
+type routeTable struct {
+	rules    *ruleSet
+	fallback string
+}
+
+// ruleSet 路由规则文件的内容：按域名匹配的转发方式和规则行上的属性
+type ruleSet struct {
+	routes *domainRules
+	attrs  map[string]ruleAttrs // 以normalizeRule后的规则为key，没有属性的规则不在其中
+}
+
+// len 返回规则数量
+func (s *ruleSet) len() int {
+	return s.routes.len()
+}
+
+// ruleAttrs 规则行上 key=value 形式的属性，覆盖对应的全局参数，为nil的属性使用全局参数
+type ruleAttrs struct {
+	idleTimeout *time.Duration // idle-timeout=，覆盖-tunnel-idle-timeout
+	rate        *byteRate      // rate=，覆盖-max-rate-per-conn，-max-rate-total仍然生效
+	shape       *ruleShape     // shape=，模拟网络条件，on使用-shape
+	tls         *ruleTLS       // tls-insecure、tls-ca=，代理访问https目标时的证书校验
+}
+
+// parseRuleAttrs 解析规则行上转发方式之后的属性，例如 idle-timeout=24h rate=5MB/s shape=latency=200ms,rate=1Mbps tls-insecure，
+// tls-insecure可以不写=
+func parseRuleAttrs(fields []string) (ruleAttrs, error) {
+	var attrs ruleAttrs
+	for _, field := range fields {
+		key, value, ok := strings.Cut(field, "=")
+		if !ok && strings.EqualFold(key, "tls-insecure") {
+			ok = true
+		}
+		if !ok {
+			return attrs, fmt.Errorf("invalid attribute %q, want key=value", field)
+		}
+		switch strings.ToLower(key) {
+		case "idle-timeout":
+			d, err := time.ParseDuration(value)
+			if err != nil || d < 0 {
+				return attrs, fmt.Errorf("invalid idle-timeout %q, want a duration such as 24h or 0", value)
+			}
+			attrs.idleTimeout = &d
+		case "rate":
+			rate := new(byteRate)
+			if err := rate.Set(value); err != nil {
+				return attrs, err
+			}
+			attrs.rate = rate
+		case "shape":
+			shape, err := parseRuleShape(value)
+			if err != nil {
+				return attrs, err
+			}
+			attrs.shape = shape
+		case "tls-insecure", "tls-ca":
+			tls, err := parseRuleTLS(attrs.tls, strings.ToLower(key), value)
+			if err != nil {
+				return attrs, err
+			}
+			attrs.tls = tls
+		default:
+			return attrs, fmt.Errorf("unknown attribute %q", key)
+		}
+	}
+	return attrs, nil
+}
+
+// String 按规则文件的写法输出设置了的属性
+func (a ruleAttrs) String() string {
+	var parts []string
+	if a.idleTimeout != nil {
+		parts = append(parts, "idle-timeout="+a.idleTimeout.String())
+	}
+	if a.rate != nil {
+		parts = append(parts, "rate="+a.rate.String())
+	}
+	if a.shape != nil {
+		parts = append(parts, "shape="+a.shape.String())
+	}
+	if a.tls != nil {
+		if s := a.tls.String(); s != "" {
+			parts = append(parts, s)
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// ruleAttrsCtx 请求上下文中保存命中规则的属性的key
+type ruleAttrsCtx struct{}
+
+// connSettings 一个连接实际使用的空闲超时和单连接限速
+type connSettings struct {
+	idleTimeout time.Duration
+	rate        byteRate
+}
+
+// settingsFrom 返回全局参数被ctx中命中规则的属性覆盖后的连接设置，生效的网络模拟速率更低时按其限速
+func settingsFrom(ctx context.Context) connSettings {
+	s := connSettings{idleTimeout: tunnelIdleTimeout, rate: maxRatePerConn}
+	attrs, _ := ctx.Value(ruleAttrsCtx{}).(ruleAttrs)
+	if attrs.idleTimeout != nil {
+		s.idleTimeout = *attrs.idleTimeout
+	}
+	if attrs.rate != nil {
+		s.rate = *attrs.rate
+	}
+	if p := attrs.shape.active(); p != nil && p.rate > 0 && (s.rate == 0 || p.rate < s.rate) {
+		s.rate = p.rate
+	}
+	return s
+}
+
+// routes 当前生效的路由规则，为nil表示未启用规则路由，重新加载配置时整体替换
+var routes atomic.Pointer[routeTable]
+
+// setRoutes 替换路由规则
+func setRoutes(rules *ruleSet, fallback string) {
+	routes.Store(&routeTable{rules: rules, fallback: fallback})
+	log.Printf("[规则代理] 已加载 %d 条路由规则，未命中时使用 %s", rules.len(), fallback)
+}
+
+// validateRoute 校验转发方式
+func validateRoute(name, route string) error {
+	if route != routeDirect && route != routeProxy {
+		return fmt.Errorf("invalid %s route %q, want direct or proxy", name, route)
+	}
+	return nil
+}
+
+// loadRules 读取路由规则文件，每行 域名 转发方式 [属性...]，例如 .example.com direct 或
+// *.backup.example direct idle-timeout=24h rate=0，忽略空行和#开头的注释
+func loadRules(path string) (*ruleSet, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	rules := &ruleSet{routes: newDomainRules(), attrs: make(map[string]ruleAttrs)}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("%s:%d: want \"domain route [key=value...]\"", path, line)
+		}
+		route := strings.ToLower(fields[1])
+		if err := validateRoute(fmt.Sprintf("%s:%d:", path, line), route); err != nil {
+			return nil, err
+		}
+		attrs, err := parseRuleAttrs(fields[2:])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+		if err := rules.routes.add(fields[0], route); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+		if len(fields) > 2 {
+			rules.attrs[normalizeRule(fields[0])] = attrs
+		} else {
+			delete(rules.attrs, normalizeRule(fields[0]))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// routeCtx 请求上下文中保存所选转发方式的key
+type routeCtx struct{}
+
+// withRoute 按目标主机(去掉端口)匹配路由规则，将选中的转发方式、命中规则的属性和routeDecision存入请求上下文
+func withRoute(r *http.Request) *http.Request {
+	table := routes.Load()
+	route := table.fallback
+	rule, value, ok := table.rules.routes.match(targetHost(r))
+	ctx := r.Context()
+	if ok {
+		route = value
+		if attrs, found := table.rules.attrs[rule]; found {
+			ctx = context.WithValue(ctx, ruleAttrsCtx{}, attrs)
+		}
+	}
+	if logEnabled(levelDebug) {
+		if !ok {
+			rule = "(未命中规则)"
+		}
+		line := fmt.Sprintf("[规则代理] %s 匹配 %s，使用 %s", targetHost(r), rule, route)
+		if attrs := table.rules.attrs[rule].String(); ok && attrs != "" {
+			line += " " + attrs
+		}
+		logfCtx(ctx, levelDebug, "%s", line)
+	}
+	if !ok {
+		rule = ""
+	}
+	return withDecision(r.WithContext(context.WithValue(ctx, routeCtx{}, route)), route, rule)
+}
+
+// routeFrom 取出请求选中的转发方式，未经过规则路由时为空
+func routeFrom(r *http.Request) string {
+	route, _ := r.Context().Value(routeCtx{}).(string)
+	return route
+}
+
+// handleRouted 按选中的转发方式交给直接转发或二次代理的处理函数，命中规则模拟网络条件时先等待其延迟
+func handleRouted(w http.ResponseWriter, r *http.Request) {
+	if !shapeDelay(r.Context()) {
+		return
+	}
+	switch {
+	case routeFrom(r) == routeDirect:
+		logOutIP(r)
+		if r.Method == http.MethodConnect {
+			handleDirectTunneling(w, r)
+		} else if !adviseDirect(w, r) {
+			withOriginLimit(w, r, handleDirectHTTP)
+		}
+	case len(upstreamList()) == 0 && pacRouting.Load() == nil:
+		handleWithoutUpstream(w, r)
+	case r.Method == http.MethodConnect:
+		handleProxyTunneling(w, r)
+	default:
+		withOriginLimit(w, r, handleProxyHTTP)
+	}
+}
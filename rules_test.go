@@ -0,0 +1,156 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeRules 将content写入临时的规则文件并返回路径
+func writeRules(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "rules.txt")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// withRules 在测试期间使用content中的路由规则，未命中时使用fallback
+func withRules(t *testing.T, content, fallback string) {
+	t.Helper()
+	rules, err := loadRules(writeRules(t, content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := routes.Load()
+	t.Cleanup(func() { routes.Store(saved) })
+	setRoutes(rules, fallback)
+}
+
+// TestLoadRulesErrors 格式错误、无效转发方式和无效或未知的属性都带行号报错
+func TestLoadRulesErrors(t *testing.T) {
+	tests := []struct {
+		name, content, want string
+	}{
+		{"missing route", "# comment\nexample.com\n", ":2: want"},
+		{"bad route", "example.com tunnel\n", ":1:"},
+		{"unknown attribute", "example.com direct\n\n*.backup.example direct speed=fast\n", `:3: unknown attribute "speed"`},
+		{"not key=value", "example.com direct idle-timeout\n", `:1: invalid attribute "idle-timeout"`},
+		{"bad duration", "example.com direct idle-timeout=soon\n", ":1: invalid idle-timeout"},
+		{"negative duration", "example.com direct idle-timeout=-1s\n", ":1: invalid idle-timeout"},
+		{"bad rate", "example.com proxy rate=fast\n", ":1: invalid rate"},
+		{"bad shape", "example.com direct shape=loss=5%\n", `:1: shape loss "5%" is not supported`},
+		{"missing tls-ca", "example.com direct tls-ca=/nonexistent/ca.pem\n", ":1: tls-ca:"},
+		{"bad tls-insecure", "example.com direct tls-insecure=maybe\n", ":1: invalid tls-insecure"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeRules(t, tt.content)
+			_, err := loadRules(path)
+			if err == nil {
+				t.Fatal("loadRules accepted an invalid rules file")
+			}
+			if !strings.Contains(err.Error(), path+tt.want) {
+				t.Errorf("error = %q, want it to contain %q", err, path+tt.want)
+			}
+		})
+	}
+}
+
+// TestRuleSettings 命中规则的属性覆盖全局参数，未设置的属性和未命中规则时使用全局参数
+func TestRuleSettings(t *testing.T) {
+	savedIdle := tunnelIdleTimeout
+	t.Cleanup(func() { tunnelIdleTimeout = savedIdle })
+	tunnelIdleTimeout = 5 * time.Minute
+	withRates(t, 5<<20, 0)
+	withRules(t, "*.backup.example direct idle-timeout=24h rate=0\n"+
+		"slow.example proxy rate=64KB/s\n"+
+		"plain.example direct\n"+
+		"* proxy rate=1MB/s\n", routeDirect)
+
+	tests := []struct {
+		host  string
+		route string
+		want  connSettings
+	}{
+		{"nas.backup.example", routeDirect, connSettings{24 * time.Hour, 0}},
+		{"slow.example", routeProxy, connSettings{5 * time.Minute, 64 << 10}},
+		{"plain.example", routeDirect, connSettings{5 * time.Minute, 5 << 20}},
+		{"www.example.org", routeProxy, connSettings{5 * time.Minute, 1 << 20}},
+	}
+	for _, tt := range tests {
+		r := withRoute(httptest.NewRequest("GET", "http://"+tt.host+"/", nil))
+		if got := routeFrom(r); got != tt.route {
+			t.Errorf("%s: route = %q, want %q", tt.host, got, tt.route)
+		}
+		if got := settingsFrom(r.Context()); got != tt.want {
+			t.Errorf("%s: settings = %+v, want %+v", tt.host, got, tt.want)
+		}
+	}
+}
+
+// TestDomainRulesWildcard *.example.com 等同于 .example.com，* 在其他规则都未命中时才命中
+func TestDomainRulesWildcard(t *testing.T) {
+	d := newDomainRules()
+	for rule, value := range map[string]string{"*.Example.com.": "a", "www.example.com": "b", "*": "c"} {
+		if err := d.add(rule, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct{ host, rule, value string }{
+		{"example.com", ".example.com", "a"},
+		{"api.example.com", ".example.com", "a"},
+		{"www.example.com", "www.example.com", "b"},
+		{"example.org", "*", "c"},
+	}
+	for _, tt := range tests {
+		rule, value, ok := d.match(tt.host)
+		if !ok || rule != tt.rule || value != tt.value {
+			t.Errorf("match(%q) = %q, %q, %v, want %q, %q", tt.host, rule, value, ok, tt.rule, tt.value)
+		}
+	}
+	if got := normalizeRule("*.Example.com."); got != ".example.com" {
+		t.Errorf("normalizeRule = %q, want .example.com", got)
+	}
+}
+
+// TestRuleIdleTimeoutTunnel 隧道按命中规则的idle-timeout关闭，关闭日志中输出实际使用的空闲超时和限速
+func TestRuleIdleTimeoutTunnel(t *testing.T) {
+	logs := captureLog(t)
+	savedIdle := tunnelIdleTimeout
+	t.Cleanup(func() { tunnelIdleTimeout = savedIdle })
+	tunnelIdleTimeout = time.Hour
+	withRates(t, 0, 0)
+	withRules(t, "127.0.0.1 direct idle-timeout=100ms\n", routeProxy)
+
+	echo := newEchoServer(t)
+	srv := httptest.NewServer(routedHandler("规则代理"))
+	t.Cleanup(srv.Close)
+	conn, _, resp := connectThrough(t, srv.Listener.Addr().String(), echo, "")
+	defer conn.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT status = %d, want 200", resp.StatusCode)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	start := time.Now()
+	if _, err := io.ReadAll(conn); err != nil {
+		t.Fatalf("tunnel was not closed by the rule's idle timeout: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("tunnel closed after %s, want about 100ms", elapsed)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for !strings.Contains(logs.String(), "[隧道] 关闭") && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !strings.Contains(logs.String(), "空闲超时 100ms 限速 0") {
+		t.Errorf("close log does not report the effective settings:\n%s", logs)
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// requestTarget 返回请求的目标地址host:port，CONNECT取r.Host，普通HTTP请求优先取绝对URI中的主机
+func requestTarget(r *http.Request) string {
+	host := r.Host
+	if r.Method != http.MethodConnect && r.URL.Host != "" {
+		host = r.URL.Host
+	}
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	port := "80"
+	if r.Method == http.MethodConnect || r.URL.Scheme == "https" {
+		port = "443"
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// isOwnPort 判断端口是否为本代理的某个监听端口，包括管理、指标、WPAD和调试这些不转发请求的监听，
+// 否则代理客户端可以经由本机回环地址访问只对本机开放的管理接口
+func isOwnPort(port int) bool {
+	switch {
+	case port == proxyPort, port == directPort:
+		return true
+	case routes.Load() != nil && port == rulesPort,
+		socksPort != 0 && port == socksPort,
+		h2cPort != 0 && port == h2cPort,
+		adminPort != 0 && port == adminPort,
+		metricsPort != 0 && port == metricsPort,
+		wpadEnabled && port == wpadPort,
+		debugAddr != "" && port == debugPort():
+		return true
+	}
+	return false
+}
+
+// debugPort 返回-debug-addr中的端口，无法解析时返回0
+func debugPort() int {
+	_, portStr, err := net.SplitHostPort(debugAddr)
+	if err != nil {
+		return 0
+	}
+	port, _ := strconv.Atoi(portStr)
+	return port
+}
+
+// isSelfTarget 判断目标地址是否明显指向本代理自身的某个监听端口：IP字面量和localhost在收到请求时即可判断；
+// 其他域名要解析后才知道，由拨号时的checkDialedAddr按实际连接的地址检查，避免两次解析结果不同被绕过
+func isSelfTarget(target string) bool {
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		return false
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || !isOwnPort(port) {
+		return false
+	}
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && isSelfIP(ip)
+}
+
+// isSelfIP 判断IP是否为回环地址、未指定地址或本机某个网络接口上的地址，NAT64合成的地址按其中的IPv4地址判断
+func isSelfIP(ip net.IP) bool {
+	ip = policyIP(ip)
+	if ip.IsLoopback() || ip.IsUnspecified() {
+		return true
+	}
+	for _, l := range localIPs() {
+		if l.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// errSelfTarget 拨号时发现实际连接的地址指向代理自身监听端口
+var errSelfTarget = &proxyError{kind: kindPolicyDenied, msg: "Request targets the proxy itself"}
+
+// checkDialedAddr 作为直接连接的net.Dialer.ControlContext，在建立连接前检查实际要连接的IP和端口，
+// 指向代理自身监听端口时拒绝连接；开启-allow-self时不检查
+func checkDialedAddr(ctx context.Context, network, address string, _ syscall.RawConn) error {
+	if allowSelf {
+		return nil
+	}
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || !isOwnPort(port) {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip != nil && isSelfIP(ip) {
+		logfCtx(ctx, levelInfo, "[直接连接] 拒绝连接 %s: 该地址指向代理自身的监听端口", address)
+		return errSelfTarget
+	}
+	return nil
+}
+
+// localIPs 返回本机所有网络接口上的IP地址
+func localIPs() []net.IP {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil
+	}
+	ips := make([]net.IP, 0, len(addrs))
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok {
+			ips = append(ips, ipNet.IP)
+		}
+	}
+	return ips
+}
+
+// rejectSelfTarget 拒绝指向代理自身监听端口的请求，避免回环和绕过另一个监听端口的限制，已拒绝时返回true
+func rejectSelfTarget(w http.ResponseWriter, r *http.Request, title string) bool {
+	if allowSelf {
+		return false
+	}
+	target := requestTarget(r)
+	if !isSelfTarget(target) {
+		return false
+	}
+	logfCtx(r.Context(), levelInfo, "[%s] 拒绝请求: 目标 %s 指向代理自身的监听端口", title, target)
+	writeFailure(w, r, errSelfTarget)
+	return true
+}
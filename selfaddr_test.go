@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+// withOwnPorts 在测试期间设置各监听端口，结束后恢复原值
+func withOwnPorts(t *testing.T) {
+	t.Helper()
+	saved := []int{proxyPort, directPort, adminPort, metricsPort, wpadPort, socksPort}
+	savedWPAD, savedDebug, savedAllow := wpadEnabled, debugAddr, allowSelf
+	t.Cleanup(func() {
+		proxyPort, directPort, adminPort, metricsPort, wpadPort, socksPort = saved[0], saved[1], saved[2], saved[3], saved[4], saved[5]
+		wpadEnabled, debugAddr, allowSelf = savedWPAD, savedDebug, savedAllow
+	})
+	proxyPort, directPort, adminPort, metricsPort, wpadPort, socksPort = 9522, 9521, 9600, 9601, 8080, 1080
+	wpadEnabled, debugAddr, allowSelf = true, "127.0.0.1:6060", false
+}
+
+func TestIsOwnPort(t *testing.T) {
+	withOwnPorts(t)
+	tests := []struct {
+		port int
+		want bool
+	}{
+		{9522, true},
+		{9521, true},
+		{9600, true},
+		{9601, true},
+		{8080, true},
+		{1080, true},
+		{6060, true},
+		{443, false},
+		{9602, false},
+	}
+	for _, tt := range tests {
+		if got := isOwnPort(tt.port); got != tt.want {
+			t.Errorf("isOwnPort(%d) = %v, want %v", tt.port, got, tt.want)
+		}
+	}
+
+	adminPort, metricsPort, wpadEnabled, debugAddr = 0, 0, false, ""
+	for _, port := range []int{0, 8080, 6060} {
+		if isOwnPort(port) {
+			t.Errorf("isOwnPort(%d) = true with the listener disabled", port)
+		}
+	}
+}
+
+func TestIsSelfTarget(t *testing.T) {
+	withOwnPorts(t)
+	tests := []struct {
+		target string
+		want   bool
+	}{
+		{"127.0.0.1:9600", true},
+		{"[::1]:9601", true},
+		{"0.0.0.0:6060", true},
+		{"localhost:9600", true},
+		{"api.localhost.:9600", true},
+		// 域名在拨号时按实际连接的地址检查
+		{"example.com:9600", false},
+		{"127.0.0.1:443", false},
+		{"192.0.2.1:9600", false},
+		{"missing-port", false},
+	}
+	for _, tt := range tests {
+		if got := isSelfTarget(tt.target); got != tt.want {
+			t.Errorf("isSelfTarget(%q) = %v, want %v", tt.target, got, tt.want)
+		}
+	}
+}
+
+// TestRejectSelfTargetAdminLoop 代理客户端不能通过CONNECT或绝对URI经由回环地址访问管理、指标和调试接口
+func TestRejectSelfTargetAdminLoop(t *testing.T) {
+	withOwnPorts(t)
+	tests := []struct {
+		method, target string
+	}{
+		{http.MethodConnect, "127.0.0.1:9600"},
+		{http.MethodPut, "http://127.0.0.1:9600/upstream"},
+		{http.MethodDelete, "http://localhost:9600/connections/1"},
+		{http.MethodGet, "http://127.0.0.1:9601/metrics"},
+		{http.MethodGet, "http://[::1]:6060/debug/pprof/"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, tt.target, nil)
+		if tt.method == http.MethodConnect {
+			r.Host = tt.target
+		}
+		w := httptest.NewRecorder()
+		if !rejectSelfTarget(w, r, "test") {
+			t.Errorf("%s %s was not rejected", tt.method, tt.target)
+			continue
+		}
+		if w.Code != http.StatusForbidden {
+			t.Errorf("%s %s: status %d, want %d", tt.method, tt.target, w.Code, http.StatusForbidden)
+		}
+	}
+
+	allowSelf = true
+	r := httptest.NewRequest(http.MethodConnect, "127.0.0.1:9600", nil)
+	r.Host = "127.0.0.1:9600"
+	if rejectSelfTarget(httptest.NewRecorder(), r, "test") {
+		t.Error("-allow-self did not disable the check")
+	}
+}
+
+// lanIP 返回本机某个非回环网络接口上的IPv4地址，没有时跳过测试
+func lanIP(t *testing.T) net.IP {
+	t.Helper()
+	for _, ip := range localIPs() {
+		if ip4 := ip.To4(); ip4 != nil && !ip4.IsLoopback() && !ip4.IsLinkLocalUnicast() {
+			return ip4
+		}
+	}
+	t.Skip("no non-loopback IPv4 interface address")
+	return nil
+}
+
+// TestSelfTargetCheckedAtDial 拨号时按实际连接的地址检查：本机网络接口地址和解析到回环地址的域名，
+// 在请求时的检查之外也会被拒绝，且不会建立连接
+func TestSelfTargetCheckedAtDial(t *testing.T) {
+	withOwnPorts(t)
+	ip := lanIP(t)
+	ln, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	accepted := make(chan struct{}, 8)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- struct{}{}
+			conn.Close()
+		}
+	}()
+	adminPort = ln.Addr().(*net.TCPAddr).Port
+	port := strconv.Itoa(adminPort)
+
+	for _, target := range []string{net.JoinHostPort(ip.String(), port), "localhost:" + port} {
+		conn, err := dialDirect(context.Background(), "tcp", target)
+		if err == nil {
+			conn.Close()
+			t.Errorf("dialDirect(%s) succeeded, want the self target rejected", target)
+			continue
+		}
+		if pe := directDialError(err); pe.statusCode() != http.StatusForbidden || pe.kind != kindPolicyDenied {
+			t.Errorf("dialDirect(%s): %v (%s), want policy_denied", target, err, pe.kind)
+		}
+	}
+	select {
+	case <-accepted:
+		t.Fatal("a connection reached the admin listener")
+	default:
+	}
+
+	srv := httptest.NewServer(directHandler("正向代理"))
+	t.Cleanup(srv.Close)
+	conn, _, resp := connectThrough(t, srv.Listener.Addr().String(), net.JoinHostPort(ip.String(), port), "")
+	conn.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("CONNECT to the LAN address status = %d, want 403", resp.StatusCode)
+	}
+
+	allowSelf = true
+	conn, err = dialDirect(context.Background(), "tcp", net.JoinHostPort(ip.String(), port))
+	if err != nil {
+		t.Fatalf("-allow-self: %v", err)
+	}
+	conn.Close()
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"syscall"
+)
+
+// proxyServer 一个代理监听服务，HTTP服务设置server，其他协议设置addr和serve
+type proxyServer struct {
+	title    string
+	server   *http.Server
+	addr     string                   // 非HTTP服务的监听地址
+	serve    func(net.Listener) error // 非HTTP服务的处理循环
+	listener net.Listener             // 绑定成功后的监听
+	tls      bool                     // HTTP服务是否以TLS提供服务
+}
+
+// address 返回监听地址
+func (s *proxyServer) address() string {
+	if s.server != nil {
+		return s.server.Addr
+	}
+	return s.addr
+}
+
+// run 在已绑定的监听上开始提供服务
+func (s *proxyServer) run() error {
+	if s.tls {
+		return s.server.ServeTLS(s.listener, "", "")
+	}
+	if s.server != nil {
+		return s.server.Serve(s.listener)
+	}
+	return s.serve(s.listener)
+}
+
+// shutdown 停止接受新连接，HTTP服务还会等待进行中的请求结束，劫持后的隧道由activeConns负责
+func (s *proxyServer) shutdown(ctx context.Context) error {
+	if s.server != nil {
+		return s.server.Shutdown(ctx)
+	}
+	return s.listener.Close()
+}
+
+// bindFailures -require-all-listeners=false时绑定失败的监听端口说明，不为空时/readyz不报告就绪
+var bindFailures []string
+
+// bindListeners 依次同步绑定所有监听端口，失败的端口集中报告；
+// requireAll为true时任一失败即退出，否则只返回绑定成功的服务
+func bindListeners(servers []*proxyServer, requireAll bool) []*proxyServer {
+	var (
+		bound    []*proxyServer
+		failures []string
+	)
+	for _, s := range servers {
+		ln, err := net.Listen("tcp", s.address())
+		if err != nil {
+			failures = append(failures, "["+s.title+"] 监听 "+s.address()+" 失败: "+err.Error()+"，"+bindAdvice(err))
+			continue
+		}
+		s.listener = newFDGuardListener(ln, s.title)
+		bound = append(bound, s)
+	}
+
+	bindFailures = failures
+	if len(failures) == 0 {
+		return bound
+	}
+	for _, f := range failures {
+		log.Println(f)
+	}
+	if requireAll || len(bound) == 0 {
+		for _, s := range bound {
+			s.listener.Close()
+		}
+		log.Println("监听端口绑定失败，程序退出(可使用 -require-all-listeners=false 仅启动绑定成功的监听)")
+		os.Exit(1)
+	}
+
+	titles := make([]string, 0, len(bound))
+	for _, s := range bound {
+		titles = append(titles, s.title+"("+s.address()+")")
+	}
+	log.Printf("警告: 部分监听端口绑定失败，仅启动: %s，/readyz 将一直返回503", strings.Join(titles, ", "))
+	return bound
+}
+
+// bindAdvice 根据绑定失败的原因给出处理建议
+func bindAdvice(err error) string {
+	switch {
+	case errors.Is(err, syscall.EADDRINUSE):
+		return "端口已被占用，请停止占用该端口的程序或更换端口"
+	case errors.Is(err, syscall.EACCES):
+		return "权限不足，请使用1024以上的端口或以管理员权限运行"
+	case errors.Is(err, syscall.EADDRNOTAVAIL):
+		return "该地址不属于本机，请检查监听地址"
+	default:
+		return "请检查端口配置"
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// busyAddr 返回一个已被占用的监听地址和一个空闲的监听地址
+func busyAddr(t *testing.T) (busy, free string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	probe, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	free = probe.Addr().String()
+	probe.Close()
+	return ln.Addr().String(), free
+}
+
+// TestBindListenersPartial -require-all-listeners=false时跳过绑定失败的监听，只返回绑定成功的服务并说明原因
+func TestBindListenersPartial(t *testing.T) {
+	logs := captureLog(t)
+	busy, free := busyAddr(t)
+	servers := []*proxyServer{
+		{title: "busy", addr: busy},
+		{title: "free", addr: free},
+	}
+	t.Cleanup(func() { bindFailures = nil })
+	bound := bindListeners(servers, false)
+	if len(bound) != 1 || bound[0].title != "free" {
+		t.Fatalf("bound %d listeners, want only the free one", len(bound))
+	}
+	defer bound[0].listener.Close()
+	if !strings.Contains(logs.String(), "[busy] 监听 "+busy+" 失败") || !strings.Contains(logs.String(), "端口已被占用") {
+		t.Errorf("failure not reported with advice:\n%s", logs.String())
+	}
+}
+
+// TestReadyzPartialBind 只启动了部分监听时/readyz返回503并列出绑定失败的地址，全部绑定成功后恢复就绪
+func TestReadyzPartialBind(t *testing.T) {
+	captureLog(t)
+	t.Cleanup(func() { bindFailures = nil })
+	busy, free := busyAddr(t)
+	readyz := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		serveReadyz(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		return w
+	}
+
+	bound := bindListeners([]*proxyServer{{title: "busy", addr: busy}, {title: "free", addr: free}}, false)
+	for _, s := range bound {
+		s.listener.Close()
+	}
+	if w := readyz(); w.Code != http.StatusServiceUnavailable || !strings.Contains(w.Body.String(), busy) {
+		t.Errorf("partial bind: /readyz = %d %q, want 503 naming %s", w.Code, w.Body, busy)
+	}
+
+	bound = bindListeners([]*proxyServer{{title: "free", addr: free}}, false)
+	for _, s := range bound {
+		s.listener.Close()
+	}
+	if w := readyz(); w.Code != http.StatusOK {
+		t.Errorf("all listeners bound: /readyz = %d %q, want 200", w.Code, w.Body)
+	}
+}
+
+// TestBindListenersRequireAll 默认任一监听绑定失败时退出，在子进程中验证退出码
+func TestBindListenersRequireAll(t *testing.T) {
+	if addr := os.Getenv("WEBPROXY_TEST_BIND"); addr != "" {
+		_, free := busyAddr(t)
+		bindListeners([]*proxyServer{{title: "free", addr: free}, {title: "busy", addr: addr}}, true)
+		return
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	cmd := exec.Command(os.Args[0], "-test.run=^TestBindListenersRequireAll$")
+	cmd.Env = append(os.Environ(), "WEBPROXY_TEST_BIND="+ln.Addr().String())
+	out, err := cmd.CombinedOutput()
+	var exit *exec.ExitError
+	if !errors.As(err, &exit) || exit.ExitCode() != 1 {
+		t.Fatalf("bindListeners with a busy port exited with %v, want status 1:\n%s", err, out)
+	}
+	if !strings.Contains(string(out), "-require-all-listeners=false") {
+		t.Errorf("exit message does not mention -require-all-listeners:\n%s", out)
+	}
+}
+
+func TestBindAdvice(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{&net.OpError{Op: "listen", Err: os.NewSyscallError("bind", syscall.EADDRINUSE)}, "端口已被占用"},
+		{&net.OpError{Op: "listen", Err: os.NewSyscallError("bind", syscall.EACCES)}, "权限不足"},
+		{&net.OpError{Op: "listen", Err: os.NewSyscallError("bind", syscall.EADDRNOTAVAIL)}, "不属于本机"},
+		{errors.New("other"), "请检查端口配置"},
+	}
+	for _, tt := range tests {
+		if got := bindAdvice(tt.err); !strings.Contains(got, tt.want) {
+			t.Errorf("bindAdvice(%v) = %q, want %q", tt.err, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// TLS监听可选的服务
+const (
+	tlsListenAll    = "all"    // 二次代理和直接转发
+	tlsListenProxy  = "proxy"  // 仅二次代理
+	tlsListenDirect = "direct" // 仅直接转发
+)
+
+// 客户端证书的校验方式
+const (
+	clientAuthRequire  = "require"  // 必须提供受信任的证书
+	clientAuthOptional = "optional" // 证书可选，未提供时回退到Proxy-Authorization
+)
+
+// serverTLSConfig 代理监听使用的TLS配置，为nil表示未启用
+var serverTLSConfig *tls.Config
+
+// setupServerTLS 加载-tls-cert和-tls-key指定的证书，两者需要同时配置；
+// 配置clientCA时按clientAuth要求客户端提供由该CA签发的证书
+func setupServerTLS(certFile, keyFile, listeners, clientCA, clientAuth string) error {
+	if certFile == "" && keyFile == "" {
+		if clientCA != "" {
+			return errors.New("-tls-client-ca requires -tls-cert and -tls-key")
+		}
+		return nil
+	}
+	if certFile == "" || keyFile == "" {
+		return errors.New("-tls-cert and -tls-key must be set together")
+	}
+	switch listeners {
+	case tlsListenAll, tlsListenProxy, tlsListenDirect:
+	default:
+		return fmt.Errorf("invalid -tls-listeners %q, want %s, %s or %s", listeners, tlsListenAll, tlsListenProxy, tlsListenDirect)
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return fmt.Errorf("load -tls-cert/-tls-key: %w", err)
+	}
+	serverTLSConfig = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+		NextProtos:   []string{"http/1.1"}, // CONNECT需要劫持连接，只提供HTTP/1.1
+	}
+	if clientCA == "" {
+		return nil
+	}
+
+	switch clientAuth {
+	case clientAuthRequire:
+		serverTLSConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	case clientAuthOptional:
+		serverTLSConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	default:
+		return fmt.Errorf("invalid -tls-client-auth %q, want %s or %s", clientAuth, clientAuthRequire, clientAuthOptional)
+	}
+	data, err := os.ReadFile(clientCA)
+	if err != nil {
+		return err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return fmt.Errorf("no certificates found in -tls-client-ca %s", clientCA)
+	}
+	serverTLSConfig.ClientCAs = pool
+	return nil
+}
+
+// clientCertName 返回客户端证书的CN和SAN，用于日志中区分设备，未提供已校验的证书时为空
+func clientCertName(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return ""
+	}
+	cert := r.TLS.VerifiedChains[0][0]
+	names := append([]string(nil), cert.DNSNames...)
+	names = append(names, cert.EmailAddresses...)
+	for _, ip := range cert.IPAddresses {
+		names = append(names, ip.String())
+	}
+	for _, u := range cert.URIs {
+		names = append(names, u.String())
+	}
+	name := "CN=" + cert.Subject.CommonName
+	if len(names) > 0 {
+		name += " SAN=" + strings.Join(names, ",")
+	}
+	return name
+}
+
+// enableServerTLS 为-tls-listeners选中的代理监听启用TLS，name为direct或proxy
+func enableServerTLS(s *proxyServer, name string) {
+	if serverTLSConfig == nil || (tlsListeners != tlsListenAll && tlsListeners != name) {
+		return
+	}
+	s.tls = true
+	s.server.TLSConfig = serverTLSConfig
+	// 非nil的空表禁止ServeTLS自动启用HTTP/2
+	s.server.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+}
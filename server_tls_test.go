@@ -0,0 +1,166 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCert 生成127.0.0.1的自签名证书，返回证书和私钥文件的路径以及解析后的证书
+func writeTestCert(t *testing.T) (certFile, keyFile string, cert *x509.Certificate) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "web-proxy test"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600)
+	cert, _ = x509.ParseCertificate(der)
+	return certFile, keyFile, cert
+}
+
+// withServerTLS 在测试期间保存并恢复serverTLSConfig
+func withServerTLS(t *testing.T) {
+	t.Helper()
+	saved := serverTLSConfig
+	t.Cleanup(func() { serverTLSConfig = saved })
+}
+
+func TestSetupServerTLS(t *testing.T) {
+	withServerTLS(t)
+	certFile, keyFile, _ := writeTestCert(t)
+	tests := []struct {
+		name            string
+		cert, key, list string
+		ok              bool
+	}{
+		{"disabled", "", "", tlsListenAll, true},
+		{"all", certFile, keyFile, tlsListenAll, true},
+		{"proxy only", certFile, keyFile, tlsListenProxy, true},
+		{"cert without key", certFile, "", tlsListenAll, false},
+		{"key without cert", "", keyFile, tlsListenAll, false},
+		{"bad listeners", certFile, keyFile, "socks", false},
+		{"key as cert", keyFile, keyFile, tlsListenAll, false},
+	}
+	for _, tt := range tests {
+		serverTLSConfig = nil
+		err := setupServerTLS(tt.cert, tt.key, tt.list, "", clientAuthRequire)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: setupServerTLS error = %v, want ok %v", tt.name, err, tt.ok)
+		}
+		if tt.ok && (serverTLSConfig != nil) != (tt.cert != "") {
+			t.Errorf("%s: serverTLSConfig set = %v", tt.name, serverTLSConfig != nil)
+		}
+	}
+}
+
+func TestEnableServerTLS(t *testing.T) {
+	withServerTLS(t)
+	saved := tlsListeners
+	t.Cleanup(func() { tlsListeners = saved })
+	certFile, keyFile, _ := writeTestCert(t)
+
+	for _, list := range []string{tlsListenAll, tlsListenProxy, tlsListenDirect} {
+		if err := setupServerTLS(certFile, keyFile, list, "", clientAuthRequire); err != nil {
+			t.Fatal(err)
+		}
+		tlsListeners = list
+		proxy, direct := &proxyServer{server: &http.Server{}}, &proxyServer{server: &http.Server{}}
+		enableServerTLS(proxy, tlsListenProxy)
+		enableServerTLS(direct, tlsListenDirect)
+		if want := list != tlsListenDirect; proxy.tls != want {
+			t.Errorf("-tls-listeners %s: proxy listener TLS = %v, want %v", list, proxy.tls, want)
+		}
+		if want := list != tlsListenProxy; direct.tls != want {
+			t.Errorf("-tls-listeners %s: direct listener TLS = %v, want %v", list, direct.tls, want)
+		}
+		if direct.tls && direct.server.TLSNextProto == nil {
+			t.Error("TLS listener would negotiate HTTP/2")
+		}
+	}
+}
+
+// TestTLSListener 客户端以HTTPS代理方式连接TLS监听，普通请求和CONNECT隧道都能工作，且只协商HTTP/1.1
+func TestTLSListener(t *testing.T) {
+	withServerTLS(t)
+	certFile, keyFile, cert := writeTestCert(t)
+	if err := setupServerTLS(certFile, keyFile, tlsListenAll, "", clientAuthRequire); err != nil {
+		t.Fatal(err)
+	}
+	s := &proxyServer{title: "test", server: &http.Server{Handler: directTestHandler}}
+	saved := tlsListeners
+	t.Cleanup(func() { tlsListeners = saved })
+	tlsListeners = tlsListenAll
+	enableServerTLS(s, tlsListenDirect)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.listener = ln
+	go s.run()
+	defer s.server.Close()
+
+	plain := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, "plain") }))
+	defer plain.Close()
+	secure := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, "secure") }))
+	defer secure.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	roots.AddCert(secure.Certificate())
+	proxyURL := &url.URL{Scheme: "https", Host: ln.Addr().String()}
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL), TLSClientConfig: &tls.Config{RootCAs: roots}}}
+	for target, want := range map[string]string{plain.URL: "plain", secure.URL: "secure"} {
+		resp, err := client.Get(target)
+		if err != nil {
+			t.Fatalf("GET %s through the TLS listener: %v", target, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != want {
+			t.Errorf("GET %s = %q, want %q", target, body, want)
+		}
+	}
+
+	conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{RootCAs: roots, NextProtos: []string{"h2", "http/1.1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if proto := conn.ConnectionState().NegotiatedProtocol; proto != "http/1.1" {
+		t.Errorf("negotiated %q, want http/1.1", proto)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// sessionEntry 一个客户端当前使用的上游会话ID
+type sessionEntry struct {
+	id      string
+	expires time.Time
+}
+
+// sessionIDs 按客户端分配上游会话ID，同一客户端在有效期内的隧道使用同一个ID，过期后轮换
+type sessionIDs struct {
+	mu        sync.Mutex
+	entries   map[string]sessionEntry
+	lastSweep time.Time
+	expired   func(id string) // 清理过期会话时调用，可为nil
+}
+
+var upstreamSessions = &sessionIDs{entries: make(map[string]sessionEntry), expired: func(id string) { proxySessions.drop(id) }}
+
+// proxySessions 经由第二级代理转发普通HTTP请求时按会话选择Transport
+var proxySessions = &sessionTransport{base: proxyTransport}
+
+// get 返回客户端key当前的会话ID，过期或不存在时生成新的ID
+func (s *sessionIDs) get(key string, ttl time.Duration) string {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if e, ok := s.entries[key]; ok && now.Before(e.expires) {
+		return e.id
+	}
+
+	// 定期清理过期的会话，避免map无限增长
+	if now.Sub(s.lastSweep) > ttl {
+		for k, e := range s.entries {
+			if !now.Before(e.expires) {
+				delete(s.entries, k)
+				if s.expired != nil {
+					s.expired(e.id)
+				}
+			}
+		}
+		s.lastSweep = now
+	}
+
+	id := newSessionID()
+	s.entries[key] = sessionEntry{id: id, expires: now.Add(ttl)}
+	logf(levelInfo, "[二次代理] 客户端 %s 分配上游会话: %s", key, id)
+	return id
+}
+
+// newSessionID 生成随机的会话ID
+func newSessionID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// sessionCtx 请求上下文中保存上游会话ID的key
+type sessionCtx struct{}
+
+// withSession 为经由第二级代理的请求分配上游会话ID：认证通过的账户按账户名、否则按客户端标识，
+// 同一会话的隧道和HTTP请求在有效期内使用同一个ID；未启用时不做处理
+func withSession(r *http.Request) *http.Request {
+	if upstreamSessionTTL <= 0 || upstreamSessionHeaderName == "" {
+		return r
+	}
+	key := authUser(r)
+	if key == "" {
+		key = clientKey(r)
+	}
+	if key == "" {
+		return r
+	}
+	return r.WithContext(context.WithValue(r.Context(), sessionCtx{}, upstreamSessions.get(key, upstreamSessionTTL)))
+}
+
+// sessionFrom 取出请求上下文中的上游会话ID，未分配时为空
+func sessionFrom(ctx context.Context) string {
+	id, _ := ctx.Value(sessionCtx{}).(string)
+	return id
+}
+
+// upstreamSessionHeader 返回发往第二级代理的会话头部，请求未分配会话时返回空
+func upstreamSessionHeader(ctx context.Context) (string, string) {
+	id := sessionFrom(ctx)
+	if id == "" {
+		return "", ""
+	}
+	return upstreamSessionHeaderName, id
+}
+
+// proxyConnectHeader 为proxyTransport发往第二级代理的CONNECT请求附加会话头部
+func proxyConnectHeader(ctx context.Context, _ *url.URL, _ string) (http.Header, error) {
+	name, id := upstreamSessionHeader(ctx)
+	if name == "" {
+		return nil, nil
+	}
+	return http.Header{name: []string{id}}, nil
+}
+
+// sessionTransport 经由第二级代理转发普通HTTP请求的RoundTripper，每个会话使用各自的http.Transport，
+// 避免到第二级代理的连接被其他会话复用；http://请求以绝对URI发给第二级代理，会话头部直接加在请求上，
+// https://请求的头部由proxyConnectHeader加在CONNECT上
+type sessionTransport struct {
+	base       *http.Transport
+	transports sync.Map // sessionTransportKey -> *http.Transport
+}
+
+// sessionTransportKey 会话ID和命中规则的TLS设置共同决定使用的Transport
+type sessionTransportKey struct {
+	id  string
+	tls string
+}
+
+// RoundTrip 使用请求所属会话的Transport发送请求，未分配会话时使用base；命中规则带TLS设置时从对应的副本复制
+func (t *sessionTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	tls := tlsFrom(req.Context())
+	base := transportForTLS(t.base, tls)
+	name, id := upstreamSessionHeader(req.Context())
+	if name == "" {
+		return base.RoundTrip(req)
+	}
+	key := sessionTransportKey{id, tls.transportKey()}
+	transport, ok := t.transports.Load(key)
+	if !ok {
+		transport, _ = t.transports.LoadOrStore(key, base.Clone())
+	}
+	if req.URL.Scheme == "http" {
+		req = req.Clone(req.Context())
+		req.Header.Set(name, id)
+	}
+	return transport.(*http.Transport).RoundTrip(req)
+}
+
+// drop 会话过期后关闭其空闲连接并删除对应的Transport，正在进行的请求不受影响
+func (t *sessionTransport) drop(id string) {
+	t.transports.Range(func(key, transport any) bool {
+		if key.(sessionTransportKey).id == id {
+			t.transports.Delete(key)
+			transport.(*http.Transport).CloseIdleConnections()
+		}
+		return true
+	})
+}
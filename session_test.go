@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// withSessions 在测试期间启用上游会话，结束后恢复原值并清空已分配的会话
+func withSessions(t *testing.T, ttl time.Duration) {
+	t.Helper()
+	savedTTL, savedName := upstreamSessionTTL, upstreamSessionHeaderName
+	t.Cleanup(func() {
+		upstreamSessionTTL, upstreamSessionHeaderName = savedTTL, savedName
+		upstreamSessions.mu.Lock()
+		upstreamSessions.entries = make(map[string]sessionEntry)
+		upstreamSessions.mu.Unlock()
+	})
+	upstreamSessionTTL, upstreamSessionHeaderName = ttl, "X-Session-Id"
+}
+
+// sessionRequest 构造一个已认证(user非空时)的请求并分配上游会话
+func sessionRequest(user, remote string) *http.Request {
+	r := httptest.NewRequest(http.MethodConnect, "example.com:443", nil)
+	r.RemoteAddr = remote
+	if user != "" {
+		r = r.WithContext(context.WithValue(r.Context(), authUserCtx{}, authResult{user: user, ok: true}))
+	}
+	return withSession(withClientKey(r))
+}
+
+// TestSessionSameWithinTTL 同一客户端在有效期内的隧道共用会话ID，不同客户端的会话ID不同
+func TestSessionSameWithinTTL(t *testing.T) {
+	withSessions(t, time.Minute)
+	first := sessionFrom(sessionRequest("", "192.0.2.1:1000").Context())
+	second := sessionFrom(sessionRequest("", "192.0.2.1:2000").Context())
+	if first == "" || first != second {
+		t.Errorf("two tunnels from one client got sessions %q and %q, want the same", first, second)
+	}
+	if other := sessionFrom(sessionRequest("", "192.0.2.2:1000").Context()); other == first {
+		t.Errorf("different clients share session %q", other)
+	}
+
+	// 认证通过的账户按账户名分配，与客户端地址无关
+	alice1 := sessionFrom(sessionRequest("alice", "192.0.2.1:1000").Context())
+	alice2 := sessionFrom(sessionRequest("alice", "192.0.2.99:1000").Context())
+	if alice1 != alice2 || alice1 == first {
+		t.Errorf("alice sessions = %q, %q (client session %q)", alice1, alice2, first)
+	}
+}
+
+// TestSessionRotates 会话过期后分配新的ID，并清理过期会话的Transport
+func TestSessionRotates(t *testing.T) {
+	withSessions(t, 20*time.Millisecond)
+	dropped := make(map[string]bool)
+	saved := upstreamSessions.expired
+	upstreamSessions.expired = func(id string) { dropped[id] = true }
+	t.Cleanup(func() { upstreamSessions.expired = saved })
+
+	first := sessionFrom(sessionRequest("", "192.0.2.1:1000").Context())
+	time.Sleep(40 * time.Millisecond)
+	rotated := sessionFrom(sessionRequest("", "192.0.2.1:1000").Context())
+	if rotated == "" || rotated == first {
+		t.Errorf("session after the TTL = %q, want a new ID (was %q)", rotated, first)
+	}
+	if !dropped[first] {
+		t.Errorf("expired session %q was not dropped", first)
+	}
+}
+
+func TestSessionDisabled(t *testing.T) {
+	withSessions(t, 0)
+	r := sessionRequest("", "192.0.2.1:1000")
+	if id := sessionFrom(r.Context()); id != "" {
+		t.Errorf("session %q assigned with -upstream-session-ttl 0", id)
+	}
+	if name, _ := upstreamSessionHeader(r.Context()); name != "" {
+		t.Errorf("session header %q sent with sessions disabled", name)
+	}
+}
+
+// TestSessionTransport http://请求携带各自的会话头部，不同会话不复用到第二级代理的连接
+func TestSessionTransport(t *testing.T) {
+	withSessions(t, time.Minute)
+	type seen struct{ session, remote string }
+	got := make(chan seen, 16)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got <- seen{r.Header.Get("X-Session-Id"), r.RemoteAddr}
+		io.WriteString(w, "ok")
+	}))
+	defer upstream.Close()
+	proxyURL, _ := url.Parse(upstream.URL)
+
+	transport := &sessionTransport{base: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	defer transport.base.CloseIdleConnections()
+	conns := make(map[string]string) // 会话ID -> 到第二级代理的连接
+	for i := 0; i < 3; i++ {
+		for _, remote := range []string{"192.0.2.1:1000", "192.0.2.2:1000"} {
+			client := sessionRequest("", remote)
+			req, _ := http.NewRequestWithContext(client.Context(), http.MethodGet, "http://example.com/", nil)
+			resp, err := transport.RoundTrip(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			io.ReadAll(resp.Body)
+			resp.Body.Close()
+
+			s := <-got
+			if want := sessionFrom(client.Context()); s.session != want {
+				t.Fatalf("upstream saw session %q, want %q", s.session, want)
+			}
+			if req.Header.Get("X-Session-Id") != "" {
+				t.Error("RoundTrip modified the caller's request headers")
+			}
+			if prev, ok := conns[s.session]; ok && prev != s.remote {
+				t.Errorf("session %s moved from connection %s to %s", s.session, prev, s.remote)
+			}
+			conns[s.session] = s.remote
+		}
+	}
+	if len(conns) != 2 {
+		t.Fatalf("saw %d sessions, want 2", len(conns))
+	}
+	remotes := make(map[string]bool)
+	for _, remote := range conns {
+		remotes[remote] = true
+	}
+	if len(remotes) != 2 {
+		t.Error("two sessions shared one connection to the second proxy")
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// defaultShape -shape 指定的模拟网络条件，规则行上的 shape=on 使用它
+var defaultShape shapeProfile
+
+// shapeProfile 模拟的网络条件：建立连接前增加latency±jitter的延迟，隧道和响应体按rate限速；
+// TCP会重传丢失的数据，丢包率只接受0
+type shapeProfile struct {
+	latency time.Duration
+	jitter  time.Duration
+	rate    byteRate
+}
+
+func (p *shapeProfile) String() string {
+	if *p == (shapeProfile{}) {
+		return ""
+	}
+	return fmt.Sprintf("latency=%s,jitter=%s,rate=%s", p.latency, p.jitter, p.rate.String())
+}
+
+// Set 解析 latency=200ms,jitter=50ms,rate=1Mbps,loss=0 形式的网络条件，省略的项为0
+func (p *shapeProfile) Set(value string) error {
+	var next shapeProfile
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		key, v, ok := strings.Cut(part, "=")
+		if !ok {
+			return fmt.Errorf("invalid shape %q, want key=value", part)
+		}
+		switch strings.ToLower(key) {
+		case "latency", "jitter":
+			d, err := time.ParseDuration(v)
+			if err != nil || d < 0 {
+				return fmt.Errorf("invalid shape %s %q, want a duration such as 200ms", key, v)
+			}
+			if strings.EqualFold(key, "latency") {
+				next.latency = d
+			} else {
+				next.jitter = d
+			}
+		case "rate":
+			// 网络条件习惯按比特写作1Mbps，换成byteRate接受的1Mbit
+			if upper := strings.ToUpper(v); strings.HasSuffix(upper, "BPS") {
+				v = v[:len(v)-3] + "bit"
+			}
+			if err := next.rate.Set(v); err != nil {
+				return err
+			}
+		case "loss":
+			loss, err := strconv.ParseFloat(strings.TrimSuffix(v, "%"), 64)
+			if err != nil {
+				return fmt.Errorf("invalid shape loss %q", v)
+			}
+			if loss != 0 {
+				return fmt.Errorf("shape loss %q is not supported, TCP retransmits lost segments; use loss=0", v)
+			}
+		default:
+			return fmt.Errorf("unknown shape key %q, want latency, jitter, rate or loss", key)
+		}
+	}
+	if next.jitter > next.latency {
+		return fmt.Errorf("shape jitter %s is larger than latency %s", next.jitter, next.latency)
+	}
+	*p = next
+	return nil
+}
+
+// delay 本次建立连接增加的延迟，在latency-jitter到latency+jitter之间均匀分布
+func (p *shapeProfile) delay() time.Duration {
+	if p.jitter <= 0 {
+		return p.latency
+	}
+	return p.latency - p.jitter + time.Duration(rand.Int63n(int64(2*p.jitter)+1))
+}
+
+// ruleShape 规则行上的 shape= 属性，可以通过管理接口 /routes 随时开关，重新加载规则后恢复为文件中的设置
+type ruleShape struct {
+	profile *shapeProfile // 为nil时使用-shape
+	enabled atomic.Bool
+}
+
+// parseRuleShape 解析 shape= 的值：on使用-shape，off先关闭(之后可通过管理接口打开)，其他按shapeProfile解析
+func parseRuleShape(value string) (*ruleShape, error) {
+	s := &ruleShape{}
+	switch strings.ToLower(value) {
+	case "on":
+		s.enabled.Store(true)
+	case "off":
+	default:
+		s.profile = new(shapeProfile)
+		if err := s.profile.Set(value); err != nil {
+			return nil, err
+		}
+		s.enabled.Store(true)
+	}
+	return s, nil
+}
+
+func (s *ruleShape) String() string {
+	switch {
+	case !s.enabled.Load():
+		return "off"
+	case s.profile == nil:
+		return "on"
+	}
+	return s.profile.String()
+}
+
+// active 返回实际生效的网络条件，规则未设置shape、已关闭或shape=on但没有配置-shape时返回nil
+func (s *ruleShape) active() *shapeProfile {
+	if s == nil || !s.enabled.Load() {
+		return nil
+	}
+	if s.profile != nil {
+		return s.profile
+	}
+	if defaultShape == (shapeProfile{}) {
+		return nil
+	}
+	return &defaultShape
+}
+
+// shapeFrom 返回ctx中命中规则生效的网络条件，没有时返回nil
+func shapeFrom(ctx context.Context) *shapeProfile {
+	attrs, _ := ctx.Value(ruleAttrsCtx{}).(ruleAttrs)
+	return attrs.shape.active()
+}
+
+// shapeDelay 按命中规则的网络条件在建立连接前等待，等待期间客户端断开时返回false
+func shapeDelay(ctx context.Context) bool {
+	p := shapeFrom(ctx)
+	if p == nil {
+		return true
+	}
+	d := p.delay()
+	if d <= 0 {
+		return true
+	}
+	logfCtx(ctx, levelDebug, "[网络模拟] 延迟 %s 后建立连接", d)
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// setupAdminRoutes 注册 /routes：GET返回当前的路由规则，PUT /routes?rule=...&shape=on|off 开关规则的网络模拟
+func setupAdminRoutes() {
+	adminMux.HandleFunc("/routes", serveAdminRoutes)
+}
+
+// routeEntry /routes返回的一条规则
+type routeEntry struct {
+	Rule  string `json:"rule"`
+	Route string `json:"route"`
+	Attrs string `json:"attrs,omitempty"`
+	Shape string `json:"shape,omitempty"` // 实际生效的网络条件，规则没有shape属性或已关闭时为空
+}
+
+// serveAdminRoutes 查看路由规则或开关一条规则的网络模拟，未启用规则路由时返回404
+func serveAdminRoutes(w http.ResponseWriter, r *http.Request) {
+	if rejectAdmin(w, r) {
+		return
+	}
+	table := routes.Load()
+	if table == nil {
+		http.Error(w, "Rule routing is not enabled", http.StatusNotFound)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+	case http.MethodPut:
+		rule := normalizeRule(r.URL.Query().Get("rule"))
+		shape := table.rules.attrs[rule].shape
+		if shape == nil {
+			auditAdmin(r, "rejected: no shape attribute")
+			http.Error(w, fmt.Sprintf("Rule %q has no shape attribute", rule), http.StatusNotFound)
+			return
+		}
+		switch value := strings.ToLower(r.URL.Query().Get("shape")); value {
+		case "on", "off":
+			shape.enabled.Store(value == "on")
+			auditAdmin(r, fmt.Sprintf("turned shaping of %s %s", rule, value))
+		default:
+			http.Error(w, "Want shape=on or shape=off", http.StatusBadRequest)
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, HEAD, PUT")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	entries := make([]routeEntry, 0, table.rules.len())
+	table.rules.routes.each(func(rule, route string) {
+		attrs := table.rules.attrs[rule]
+		e := routeEntry{Rule: rule, Route: route, Attrs: attrs.String()}
+		if p := attrs.shape.active(); p != nil {
+			e.Shape = p.String()
+		}
+		entries = append(entries, e)
+	})
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Rule < entries[j].Rule })
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Fallback string       `json:"fallback"`
+		Shape    string       `json:"shape,omitempty"`
+		Rules    []routeEntry `json:"rules"`
+	}{table.fallback, defaultShape.String(), entries})
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestShapeProfileSet(t *testing.T) {
+	tests := []struct {
+		value string
+		want  shapeProfile
+		err   string
+	}{
+		{"latency=200ms,jitter=50ms,rate=1Mbps,loss=0", shapeProfile{200 * time.Millisecond, 50 * time.Millisecond, 125000}, ""},
+		{"rate=512KB/s", shapeProfile{rate: 512 << 10}, ""},
+		{"latency=1s, loss=0%", shapeProfile{latency: time.Second}, ""},
+		{"", shapeProfile{}, ""},
+		{"loss=1%", shapeProfile{}, "not supported"},
+		{"latency=10ms,jitter=20ms", shapeProfile{}, "larger than latency"},
+		{"latency=soon", shapeProfile{}, "invalid shape latency"},
+		{"rate=fast", shapeProfile{}, "invalid rate"},
+		{"bandwidth=1Mbps", shapeProfile{}, "unknown shape key"},
+		{"latency", shapeProfile{}, "want key=value"},
+	}
+	for _, tt := range tests {
+		var p shapeProfile
+		err := p.Set(tt.value)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("Set(%q) error = %v, want %q", tt.value, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || p != tt.want {
+			t.Errorf("Set(%q) = %+v, %v, want %+v", tt.value, p, err, tt.want)
+		}
+	}
+}
+
+// withShape 在测试期间设置-shape
+func withShape(t *testing.T, value string) {
+	t.Helper()
+	saved := defaultShape
+	t.Cleanup(func() { defaultShape = saved })
+	if err := defaultShape.Set(value); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newSourceServer 接受连接后发送size个字节再关闭的本地服务，返回监听地址
+func newSourceServer(t *testing.T, size int) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				conn.Write(make([]byte, size))
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// TestShapeTunnel 命中shape规则的隧道在建立前增加延迟并按rate限速，通过/routes关闭后恢复全速；
+// 未设置shape的规则不受影响
+func TestShapeTunnel(t *testing.T) {
+	const size = 1 << 20
+	withRates(t, 0, 0)
+	withShape(t, "latency=200ms,rate=512KB/s")
+	withRules(t, "127.0.0.1 direct shape=on\nfast.example direct\n", routeProxy)
+	source := newSourceServer(t, size)
+	srv := httptest.NewServer(routedHandler("规则代理"))
+	t.Cleanup(srv.Close)
+
+	download := func() (connect, transfer time.Duration) {
+		t.Helper()
+		start := time.Now()
+		conn, br, resp := connectThrough(t, srv.Listener.Addr().String(), source, "")
+		defer conn.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("CONNECT status = %d, want 200", resp.StatusCode)
+		}
+		connect = time.Since(start)
+		conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+		n, err := io.Copy(io.Discard, br)
+		if err != nil || n != size {
+			t.Fatalf("read %d bytes, %v, want %d", n, err, size)
+		}
+		return connect, time.Since(start) - connect
+	}
+
+	// 令牌桶起始有1秒的令牌，1MB在512KB/s下约需1秒
+	connect, transfer := download()
+	if connect < 180*time.Millisecond || connect > 2*time.Second {
+		t.Errorf("shaped CONNECT took %s, want about 200ms", connect)
+	}
+	if transfer < 800*time.Millisecond || transfer > 4*time.Second {
+		t.Errorf("shaped download of %d bytes took %s (%.0f KB/s), want about 1s at 512KB/s", size, transfer, size/transfer.Seconds()/1024)
+	}
+
+	w := httptest.NewRecorder()
+	serveAdminRoutes(w, adminRequest(http.MethodPut, "/routes?rule=127.0.0.1&shape=off", ""))
+	if w.Code != http.StatusOK {
+		t.Fatalf("PUT /routes = %d %s", w.Code, w.Body)
+	}
+	connect, transfer = download()
+	if connect > 150*time.Millisecond || transfer > 500*time.Millisecond {
+		t.Errorf("unshaped tunnel took %s to connect and %s to download, want full speed", connect, transfer)
+	}
+
+	r := withRoute(httptest.NewRequest(http.MethodGet, "http://fast.example/", nil))
+	if p, s := shapeFrom(r.Context()), settingsFrom(r.Context()); p != nil || s.rate != 0 {
+		t.Errorf("fast.example: shape %v rate %s, want no shaping", p, s.rate.String())
+	}
+}
+
+// TestAdminRoutes /routes列出规则和生效的网络条件，开关不存在或没有shape属性的规则返回404
+func TestAdminRoutes(t *testing.T) {
+	logs := captureLog(t)
+	withShape(t, "latency=100ms,rate=1MB/s")
+	withRules(t, ".staging.example direct shape=off\nslow.example proxy shape=rate=64KB/s\nwww.example direct\n", routeProxy)
+
+	get := func() []routeEntry {
+		t.Helper()
+		w := httptest.NewRecorder()
+		serveAdminRoutes(w, adminRequest(http.MethodGet, "/routes", ""))
+		var body struct {
+			Fallback string       `json:"fallback"`
+			Shape    string       `json:"shape"`
+			Rules    []routeEntry `json:"rules"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Fatalf("GET /routes: %v\n%s", err, w.Body)
+		}
+		if body.Fallback != routeProxy || body.Shape != "latency=100ms,jitter=0s,rate=1MB/s" {
+			t.Errorf("GET /routes fallback %q shape %q", body.Fallback, body.Shape)
+		}
+		return body.Rules
+	}
+	want := []routeEntry{
+		{Rule: ".staging.example", Route: routeDirect, Attrs: "shape=off"},
+		{Rule: "slow.example", Route: routeProxy, Attrs: "shape=latency=0s,jitter=0s,rate=64KB/s", Shape: "latency=0s,jitter=0s,rate=64KB/s"},
+		{Rule: "www.example", Route: routeDirect},
+	}
+	if got := get(); len(got) != len(want) || got[0] != want[0] || got[1] != want[1] || got[2] != want[2] {
+		t.Errorf("GET /routes rules = %+v, want %+v", got, want)
+	}
+
+	tests := []struct {
+		target string
+		code   int
+	}{
+		{"/routes?rule=*.staging.example&shape=on", http.StatusOK},
+		{"/routes?rule=www.example&shape=on", http.StatusNotFound},
+		{"/routes?rule=missing.example&shape=on", http.StatusNotFound},
+		{"/routes?rule=.staging.example&shape=maybe", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		serveAdminRoutes(w, adminRequest(http.MethodPut, tt.target, ""))
+		if w.Code != tt.code {
+			t.Errorf("PUT %s = %d, want %d", tt.target, w.Code, tt.code)
+		}
+	}
+	if got := get()[0]; got.Attrs != "shape=on" || got.Shape != "latency=100ms,jitter=0s,rate=1MB/s" {
+		t.Errorf("after turning shaping on: %+v", got)
+	}
+	if !strings.Contains(logs.String(), "turned shaping of .staging.example on") {
+		t.Errorf("toggle was not audited:\n%s", logs)
+	}
+	r := withRoute(httptest.NewRequest(http.MethodGet, "http://api.staging.example/", nil))
+	if s := settingsFrom(r.Context()); s.rate != 1<<20 {
+		t.Errorf("api.staging.example rate = %s, want the -shape rate 1MB/s", s.rate.String())
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// shuttingDown 收到退出信号后置为true，监听关闭引起的Serve返回不再视为错误，新请求收到503
+var shuttingDown atomic.Bool
+
+// drainDeadline -drain-window结束、监听关闭的时间(UnixNano)，未开始退出时为0
+var drainDeadline atomic.Int64
+
+// waitShutdown 阻塞直到收到SIGINT或SIGTERM，先在-drain-window内继续接受连接并以503和Retry-After通知新请求重试，
+// 再停止接受新连接并在-shutdown-timeout内等待进行中的请求和隧道结束，
+// 全部结束时以0退出，超时或再次收到信号时强制关闭剩余连接并以1退出，退出前保存-state-file
+func waitShutdown(servers []*proxyServer, drain, timeout time.Duration) {
+	ch := make(chan os.Signal, 2)
+	signal.Notify(ch, os.Interrupt, syscall.SIGTERM)
+	sig := <-ch
+
+	forced, force := context.WithCancel(context.Background())
+	defer force()
+	go func() {
+		select {
+		case <-ch:
+			log.Println("再次收到退出信号，立即关闭剩余连接")
+			force()
+		case <-forced.Done():
+		}
+	}()
+
+	beginDrain(servers, drain)
+	if drain > 0 {
+		log.Printf("收到%v，%v 内继续接受连接并以503通知新请求重试", sig, drain)
+		select {
+		case <-time.After(drain):
+		case <-forced.Done():
+		}
+		log.Printf("停止接受新连接，最多等待 %v 让进行中的连接结束", timeout)
+	} else {
+		log.Printf("收到%v，停止接受新连接，最多等待 %v 让进行中的连接结束", sig, timeout)
+	}
+
+	ctx, cancel := context.WithTimeout(forced, timeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	clean := true
+	var mu sync.Mutex
+	for _, s := range servers {
+		wg.Add(1)
+		go func(s *proxyServer) {
+			defer wg.Done()
+			if err := s.shutdown(ctx); err != nil {
+				mu.Lock()
+				clean = false
+				mu.Unlock()
+			}
+		}(s)
+	}
+	wg.Wait()
+	if !activeConns.wait(ctx) {
+		clean = false
+	}
+
+	if !clean {
+		n := activeConns.closeAll()
+		for _, s := range servers {
+			if s.server != nil {
+				s.server.Close()
+			}
+		}
+		log.Printf("等待超时，强制关闭剩余的 %d 个隧道和进行中的请求", n)
+		persistState()
+		os.Exit(1)
+	}
+	persistState()
+	log.Println("所有连接已结束，程序退出")
+	os.Exit(0)
+}
+
+// beginDrain 进入退出流程：此后的新请求和CONNECT收到503，响应后关闭客户端连接而不再保持长连接，
+// 已建立的隧道不受影响
+func beginDrain(servers []*proxyServer, drain time.Duration) {
+	drainDeadline.Store(time.Now().Add(drain).UnixNano())
+	shuttingDown.Store(true)
+	for _, s := range servers {
+		if s.server != nil {
+			s.server.SetKeepAlivesEnabled(false)
+		}
+	}
+}
+
+// drainRetryAfter Retry-After的秒数：到监听关闭的剩余时间，向上取整且至少为1
+func drainRetryAfter() int {
+	remaining := time.Until(time.Unix(0, drainDeadline.Load()))
+	return max(int(math.Ceil(remaining.Seconds())), 1)
+}
+
+// rejectDraining 正在退出时以503和Retry-After拒绝新的请求和CONNECT并返回true，
+// 客户端据此稍后重试，由负载均衡转到新的实例
+func rejectDraining(w http.ResponseWriter, r *http.Request, title string) bool {
+	if !shuttingDown.Load() {
+		return false
+	}
+	logfCtx(r.Context(), levelInfo, "[%s] 正在退出，拒绝客户端 %s 的新请求 %s", title, clientKey(r), r.Host)
+	w.Header().Set("Retry-After", strconv.Itoa(drainRetryAfter()))
+	w.Header().Set("Connection", "close")
+	writeProxyError(w, http.StatusServiceUnavailable, reasonOverloaded, r.Host, "Proxy is shutting down, retry later")
+	return true
+}
+
+// setupReadyz 注册 /readyz：正常时返回200，退出流程中返回503和到监听关闭的Retry-After，
+// 供负载均衡在-drain-window内把流量转走，不需要管理接口认证
+func setupReadyz() {
+	adminMux.HandleFunc("/readyz", serveReadyz)
+}
+
+// serveReadyz 返回是否接受新请求，部分监听端口绑定失败时一直返回503，由负载均衡摘除只启动了一部分的实例
+func serveReadyz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	if shuttingDown.Load() {
+		w.Header().Set("Retry-After", strconv.Itoa(drainRetryAfter()))
+		http.Error(w, "draining", http.StatusServiceUnavailable)
+		return
+	}
+	if len(bindFailures) > 0 {
+		http.Error(w, "partially started, failed listeners:\n"+strings.Join(bindFailures, "\n"), http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	io.WriteString(w, "ready\n")
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// withDrain 在测试期间进入退出排空，结束后恢复为正常状态
+func withDrain(t *testing.T, window time.Duration) {
+	t.Helper()
+	t.Cleanup(func() {
+		shuttingDown.Store(false)
+		drainDeadline.Store(0)
+	})
+	beginDrain(nil, window)
+}
+
+// TestDrainAnnouncesRetryAfter 排空期间新的请求和CONNECT收到503和Retry-After，已建立的隧道继续转发
+func TestDrainAnnouncesRetryAfter(t *testing.T) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r = withClientKey(withRequestID(r))
+		if rejectRequest(w, r, "test") {
+			return
+		}
+		if r.Method == http.MethodConnect {
+			handleDirectTunneling(w, r)
+		} else {
+			handleDirectHTTP(w, r)
+		}
+	}))
+	defer proxy.Close()
+	addr := proxy.Listener.Addr().String()
+
+	tunnel, tunnelReader := rawRequest(t, addr, "CONNECT "+echo.Addr().String()+" HTTP/1.1\r\nHost: "+echo.Addr().String()+"\r\n\r\n")
+	if resp, err := http.ReadResponse(tunnelReader, &http.Request{Method: http.MethodConnect}); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT before the drain: %v %v", resp, err)
+	}
+	tunnel.SetDeadline(time.Time{})
+
+	w := httptest.NewRecorder()
+	serveReadyz(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("/readyz before the drain: %d, want 200", w.Code)
+	}
+
+	withDrain(t, 10*time.Second)
+	w = httptest.NewRecorder()
+	serveReadyz(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" {
+		t.Errorf("/readyz during the drain: %d Retry-After %q, want 503 with Retry-After", w.Code, w.Header().Get("Retry-After"))
+	}
+
+	tests := []struct {
+		name    string
+		request string
+		method  string
+	}{
+		{"GET", "GET http://" + echo.Addr().String() + "/ HTTP/1.1\r\nHost: x\r\n\r\n", http.MethodGet},
+		{"CONNECT", "CONNECT " + echo.Addr().String() + " HTTP/1.1\r\nHost: " + echo.Addr().String() + "\r\n\r\n", http.MethodConnect},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, br := rawRequest(t, addr, tt.request)
+			resp, err := http.ReadResponse(br, &http.Request{Method: tt.method})
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusServiceUnavailable {
+				t.Errorf("status %d, want 503", resp.StatusCode)
+			}
+			if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err != nil || secs < 1 || secs > 10 {
+				t.Errorf("Retry-After %q, want the remaining drain window", resp.Header.Get("Retry-After"))
+			}
+			if !resp.Close {
+				t.Error("503 during the drain kept the client connection open")
+			}
+		})
+	}
+
+	tunnel.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(tunnel, "still there")
+	got := make([]byte, len("still there"))
+	if _, err := io.ReadFull(tunnelReader, got); err != nil || string(got) != "still there" {
+		t.Errorf("tunnel established before the drain echoed %q, %v", got, err)
+	}
+}
+
+func TestDrainRetryAfter(t *testing.T) {
+	tests := []struct {
+		window time.Duration
+		want   int
+	}{
+		{10 * time.Second, 10},
+		{1500 * time.Millisecond, 2},
+		{0, 1},
+		{-time.Second, 1}, // 排空窗口已过，正在等待进行中的连接
+	}
+	for _, tt := range tests {
+		drainDeadline.Store(time.Now().Add(tt.window).UnixNano())
+		if got := drainRetryAfter(); got != tt.want {
+			t.Errorf("drainRetryAfter with %v left = %d, want %d", tt.window, got, tt.want)
+		}
+	}
+	drainDeadline.Store(0)
+}
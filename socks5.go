@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// SOCKS5协议常量(RFC 1928/1929)
+const (
+	socksVersion      = 0x05
+	socksAuthNone     = 0x00
+	socksAuthPassword = 0x02
+	socksAuthNoAccept = 0xff
+	socksCmdConnect   = 0x01
+	socksAtypIPv4     = 0x01
+	socksAtypDomain   = 0x03
+	socksAtypIPv6     = 0x04
+	socksReplySuccess = 0x00
+)
+
+// socksReplyText SOCKS5应答码的含义
+var socksReplyText = map[byte]string{
+	0x01: "general SOCKS server failure",
+	0x02: "connection not allowed by ruleset",
+	0x03: "network unreachable",
+	0x04: "host unreachable",
+	0x05: "connection refused",
+	0x06: "TTL expired",
+	0x07: "command not supported",
+	0x08: "address type not supported",
+}
+
+// socksReplyError SOCKS5服务器对CONNECT返回的失败应答
+type socksReplyError struct {
+	code byte
+}
+
+func (e *socksReplyError) Error() string {
+	text, ok := socksReplyText[e.code]
+	if !ok {
+		text = "unknown error"
+	}
+	return fmt.Sprintf("socks5 reply %d (%s)", e.code, text)
+}
+
+// errSOCKSAuth SOCKS5服务器拒绝了认证
+var errSOCKSAuth = errors.New("socks5 authentication failed")
+
+// dialSOCKS5 连接SOCKS5第二级代理并请求连接target，二次代理隧道和普通HTTP转发共用，失败时返回*proxyError
+func dialSOCKS5(ctx context.Context, upstream *upstreamProxy, target string) (net.Conn, error) {
+	setPhase(ctx, phaseUpstreamDial)
+	conn, err := dialUpstream(ctx, "tcp", upstream.server)
+	if err != nil {
+		errorLog.PrintfCtx(ctx, "upstream_dial", upstream.server, "[二次代理] 连接SOCKS5代理 %s 失败(%s): %v", upstream.server, classifyError(err), err)
+		pe := newProxyError(true, "Failed to connect to the second proxy", err)
+		if pe.kind == kindDialTimeout {
+			pe.msg = fmt.Sprintf("Timed out connecting to the second proxy after %s", dialTimeout)
+		}
+		return nil, pe
+	}
+
+	setPhase(ctx, phaseUpstreamHandshake)
+	stopWatch := watchConn(ctx, conn)
+	err = socks5Handshake(conn, target, upstream.user)
+	if !stopWatch() && err == nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		conn.Close()
+		errorLog.PrintfCtx(ctx, "upstream_socks", upstream.server, "[二次代理] SOCKS5代理 %s 连接 %s 失败: %v", upstream.server, target, err)
+		var replyErr *socksReplyError
+		switch {
+		case errors.Is(err, errSOCKSAuth):
+			return nil, &proxyError{kind: kindUpstreamAuth, upstream: true, msg: "The second proxy rejected our credentials", err: err}
+		case errors.As(err, &replyErr):
+			return nil, &proxyError{kind: kindUpstreamHandshake, upstream: true, status: http.StatusBadGateway, msg: "The second proxy failed to connect to the host: " + replyErr.Error(), err: err}
+		}
+		pe := newProxyError(true, "SOCKS5 handshake with the second proxy failed", err)
+		if pe.kind == kindUnknown {
+			pe.kind = kindUpstreamHandshake
+			pe.status = http.StatusBadGateway
+		}
+		return nil, pe
+	}
+	return conn, nil
+}
+
+// socks5Handshake 在conn上完成SOCKS5协商、认证和CONNECT请求，域名交由SOCKS5服务器解析
+func socks5Handshake(conn net.Conn, target string, user *url.Userinfo) error {
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return err
+	}
+
+	// 协商认证方式
+	methods := []byte{socksAuthNone}
+	if user != nil {
+		methods = []byte{socksAuthNone, socksAuthPassword}
+	}
+	if _, err := conn.Write(append([]byte{socksVersion, byte(len(methods))}, methods...)); err != nil {
+		return err
+	}
+	var reply [2]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		return err
+	}
+	if reply[0] != socksVersion {
+		return fmt.Errorf("unexpected socks version %d", reply[0])
+	}
+	switch reply[1] {
+	case socksAuthNone:
+	case socksAuthPassword:
+		if user == nil {
+			return errSOCKSAuth
+		}
+		if err := socks5PasswordAuth(conn, user); err != nil {
+			return err
+		}
+	case socksAuthNoAccept:
+		return errSOCKSAuth
+	default:
+		return fmt.Errorf("unsupported socks auth method %d", reply[1])
+	}
+
+	// 发送CONNECT请求
+	req := []byte{socksVersion, socksCmdConnect, 0}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			req = append(append(req, socksAtypIPv4), ip4...)
+		} else {
+			req = append(append(req, socksAtypIPv6), ip.To16()...)
+		}
+	} else {
+		if len(host) > 255 {
+			return errors.New("host name too long for socks5")
+		}
+		req = append(append(req, socksAtypDomain, byte(len(host))), host...)
+	}
+	req = append(req, byte(port>>8), byte(port))
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	// 读取应答，跳过其中的绑定地址
+	var head [4]byte
+	if _, err := io.ReadFull(conn, head[:]); err != nil {
+		return err
+	}
+	if head[1] != socksReplySuccess {
+		return &socksReplyError{code: head[1]}
+	}
+	var skip int
+	switch head[3] {
+	case socksAtypIPv4:
+		skip = net.IPv4len + 2
+	case socksAtypIPv6:
+		skip = net.IPv6len + 2
+	case socksAtypDomain:
+		var n [1]byte
+		if _, err := io.ReadFull(conn, n[:]); err != nil {
+			return err
+		}
+		skip = int(n[0]) + 2
+	default:
+		return fmt.Errorf("unexpected socks address type %d", head[3])
+	}
+	_, err = io.ReadFull(conn, make([]byte, skip))
+	return err
+}
+
+// socks5PasswordAuth 按RFC 1929发送账户和密码
+func socks5PasswordAuth(conn net.Conn, user *url.Userinfo) error {
+	name := user.Username()
+	pass, _ := user.Password()
+	if len(name) > 255 || len(pass) > 255 {
+		return errors.New("socks5 username or password too long")
+	}
+	req := append([]byte{0x01, byte(len(name))}, name...)
+	req = append(append(req, byte(len(pass))), pass...)
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+	var reply [2]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		return err
+	}
+	if reply[1] != 0 {
+		return errSOCKSAuth
+	}
+	return nil
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"testing"
+)
+
+// socksScript 模拟SOCKS5服务器的应答方式
+type socksScript struct {
+	method   byte // 选择的认证方式
+	authOK   bool // 账户密码认证是否通过
+	reply    byte // CONNECT的应答码
+	bindAtyp byte // 应答中绑定地址的类型
+}
+
+// socksSeen 模拟服务器收到的内容
+type socksSeen struct {
+	methods    []byte
+	user, pass string
+	target     string
+}
+
+// scriptedSOCKS 在conn上按script完成一次SOCKS5握手，把收到的内容发送到seen
+func scriptedSOCKS(conn net.Conn, script socksScript, seen chan<- socksSeen) {
+	defer conn.Close()
+	var s socksSeen
+	defer func() { seen <- s }()
+	head := make([]byte, 2)
+	if _, err := io.ReadFull(conn, head); err != nil {
+		return
+	}
+	s.methods = make([]byte, head[1])
+	io.ReadFull(conn, s.methods)
+	conn.Write([]byte{socksVersion, script.method})
+	switch script.method {
+	case socksAuthNoAccept:
+		return
+	case socksAuthPassword:
+		var n [2]byte
+		io.ReadFull(conn, n[:])
+		user := make([]byte, n[1])
+		io.ReadFull(conn, user)
+		io.ReadFull(conn, n[:1])
+		pass := make([]byte, n[0])
+		io.ReadFull(conn, pass)
+		s.user, s.pass = string(user), string(pass)
+		if !script.authOK {
+			conn.Write([]byte{0x01, 0x01})
+			return
+		}
+		conn.Write([]byte{0x01, 0x00})
+	}
+
+	req := make([]byte, 4)
+	if _, err := io.ReadFull(conn, req); err != nil {
+		return
+	}
+	var host string
+	switch req[3] {
+	case socksAtypIPv4, socksAtypIPv6:
+		ip := make([]byte, net.IPv4len)
+		if req[3] == socksAtypIPv6 {
+			ip = make([]byte, net.IPv6len)
+		}
+		io.ReadFull(conn, ip)
+		host = net.IP(ip).String()
+	case socksAtypDomain:
+		var n [1]byte
+		io.ReadFull(conn, n[:])
+		name := make([]byte, n[0])
+		io.ReadFull(conn, name)
+		host = string(name)
+	}
+	var port [2]byte
+	io.ReadFull(conn, port[:])
+	s.target = net.JoinHostPort(host, strconv.Itoa(int(port[0])<<8|int(port[1])))
+
+	resp := []byte{socksVersion, script.reply, 0, script.bindAtyp}
+	switch script.bindAtyp {
+	case socksAtypIPv4:
+		resp = append(resp, 0, 0, 0, 0)
+	case socksAtypIPv6:
+		resp = append(resp, make([]byte, net.IPv6len)...)
+	case socksAtypDomain:
+		resp = append(resp, 4, 'b', 'i', 'n', 'd')
+	}
+	resp = append(resp, 0x1f, 0x90)
+	conn.Write(resp)
+	if script.reply == socksReplySuccess {
+		io.Copy(conn, conn)
+	}
+}
+
+func TestSOCKS5Handshake(t *testing.T) {
+	ok := socksScript{method: socksAuthNone, reply: socksReplySuccess, bindAtyp: socksAtypIPv4}
+	withAuth := socksScript{method: socksAuthPassword, authOK: true, reply: socksReplySuccess, bindAtyp: socksAtypDomain}
+	user := url.UserPassword("alice", "p@ss")
+
+	tests := []struct {
+		name    string
+		script  socksScript
+		target  string
+		user    *url.Userinfo
+		seen    string // 服务器收到的目标
+		methods int
+		err     func(error) bool
+	}{
+		{"domain", ok, "example.com:443", nil, "example.com:443", 1, nil},
+		{"ipv4", ok, "192.0.2.1:80", nil, "192.0.2.1:80", 1, nil},
+		{"ipv6 bound address", socksScript{method: socksAuthNone, reply: socksReplySuccess, bindAtyp: socksAtypIPv6}, "[2001:db8::1]:8443", nil, "[2001:db8::1]:8443", 1, nil},
+		{"password", withAuth, "example.com:443", user, "example.com:443", 2, nil},
+		{"password rejected", socksScript{method: socksAuthPassword}, "example.com:443", user, "", 2,
+			func(err error) bool { return errors.Is(err, errSOCKSAuth) }},
+		{"password required without credentials", withAuth, "example.com:443", nil, "", 1,
+			func(err error) bool { return errors.Is(err, errSOCKSAuth) }},
+		{"no acceptable method", socksScript{method: socksAuthNoAccept}, "example.com:443", nil, "", 1,
+			func(err error) bool { return errors.Is(err, errSOCKSAuth) }},
+		{"connection refused", socksScript{method: socksAuthNone, reply: 0x05, bindAtyp: socksAtypIPv4}, "example.com:443", nil, "example.com:443", 1,
+			func(err error) bool {
+				var re *socksReplyError
+				return errors.As(err, &re) && re.code == 0x05
+			}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			seen := make(chan socksSeen, 1)
+			go scriptedSOCKS(server, tt.script, seen)
+
+			err := socks5Handshake(client, tt.target, tt.user)
+			if tt.err == nil && err != nil {
+				t.Fatalf("socks5Handshake: %v", err)
+			}
+			if tt.err != nil && !tt.err(err) {
+				t.Fatalf("socks5Handshake error %v", err)
+			}
+			if err == nil {
+				// 握手完成后连接即为到目标的隧道
+				go client.Write([]byte("ping"))
+				got := make([]byte, 4)
+				if _, err := io.ReadFull(client, got); err != nil || string(got) != "ping" {
+					t.Errorf("tunnel after the handshake echoed %q, %v", got, err)
+				}
+			}
+			client.Close()
+			s := <-seen
+			if len(s.methods) != tt.methods {
+				t.Errorf("offered methods %v, want %d", s.methods, tt.methods)
+			}
+			if s.target != tt.seen {
+				t.Errorf("server saw target %q, want %q", s.target, tt.seen)
+			}
+			if tt.user != nil && s.user != "" {
+				if pass, _ := tt.user.Password(); s.user != tt.user.Username() || s.pass != pass {
+					t.Errorf("server saw credentials %q:%q", s.user, s.pass)
+				}
+			}
+		})
+	}
+}
+
+// TestDialSOCKS5Errors SOCKS5的认证失败和失败应答转换为对应的proxyError
+func TestDialSOCKS5Errors(t *testing.T) {
+	tests := []struct {
+		name   string
+		script socksScript
+		kind   errorKind
+		status int
+	}{
+		{"auth rejected", socksScript{method: socksAuthPassword}, kindUpstreamAuth, 0},
+		{"not allowed", socksScript{method: socksAuthNone, reply: 0x02, bindAtyp: socksAtypIPv4}, kindUpstreamHandshake, 502},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ln.Close()
+			seen := make(chan socksSeen, 1)
+			go func() {
+				if conn, err := ln.Accept(); err == nil {
+					scriptedSOCKS(conn, tt.script, seen)
+				}
+			}()
+			upstream := &upstreamProxy{scheme: "socks5", server: ln.Addr().String(), user: url.UserPassword("alice", "pw")}
+			_, err = dialSOCKS5(connectRequest("example.com:443").Context(), upstream, "example.com:443")
+			var pe *proxyError
+			if !errors.As(err, &pe) || pe.kind != tt.kind {
+				t.Fatalf("dialSOCKS5 error %v, want kind %s", err, tt.kind)
+			}
+			if tt.status != 0 && pe.statusCode() != tt.status {
+				t.Errorf("status %d, want %d", pe.statusCode(), tt.status)
+			}
+		})
+	}
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// socksHandshakeTimeout SOCKS5客户端完成协商和发送请求的时间限制
+const socksHandshakeTimeout = 10 * time.Second
+
+// SOCKS5应答码
+const (
+	socksReplyGeneralFailure   = 0x01
+	socksReplyNotAllowed       = 0x02
+	socksReplyHostUnreachable  = 0x04
+	socksReplyRefused          = 0x05
+	socksReplyCmdNotSupported  = 0x07
+	socksReplyAtypNotSupported = 0x08
+)
+
+// newSOCKSServer 创建SOCKS5监听服务，未配置-socks-port时返回nil
+func newSOCKSServer() *proxyServer {
+	if socksPort == 0 {
+		return nil
+	}
+	return &proxyServer{title: "SOCKS5", addr: fmt.Sprintf(":%d", socksPort), serve: serveSOCKS}
+}
+
+// validateSOCKSMode 校验-socks-mode参数
+func validateSOCKSMode(mode string) error {
+	if err := validateRoute("-socks-mode", mode); err != nil {
+		return err
+	}
+	if mode == routeProxy && len(upstreamList()) == 0 && socksPort != 0 {
+		return errors.New("-socks-mode proxy requires -proxy-url")
+	}
+	return nil
+}
+
+// serveSOCKS 接受SOCKS5连接
+func serveSOCKS(ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go handleSOCKS(conn)
+	}
+}
+
+// handleSOCKS 处理一个SOCKS5客户端：完成协商和认证，读取CONNECT请求后构造等价的CONNECT请求，
+// 与HTTP监听共用访问控制、日志和拨号逻辑，最后交给transfer转发
+func handleSOCKS(conn net.Conn) {
+	defer recoverTunnel("SOCKS5")
+	conn.SetDeadline(time.Now().Add(socksHandshakeTimeout))
+
+	user, pass, ok := socksServerAuth(conn)
+	if !ok {
+		conn.Close()
+		return
+	}
+	target, code := socksReadRequest(conn)
+	if code != socksReplySuccess {
+		socksReply(conn, code, nil)
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	r := socksRequest(conn, target, user, pass)
+	r = withDecision(withEgress(withAuth(withClientKey(withRequestID(r)))), socksMode, "")
+	if socksMode == routeProxy {
+		r = withUpstream(r)
+	}
+	r, cancel := withBudget(r)
+	defer cancel()
+	r, releaseSlot := withConnSlot(r)
+	defer releaseSlot()
+	logRequest(r, "SOCKS5")
+
+	rec := &statusRecorder{header: make(http.Header)}
+	if rejectRequest(rec, r, "SOCKS5") {
+		socksReply(conn, socksStatusReply(rec.status), nil)
+		conn.Close()
+		return
+	}
+
+	var (
+		backend net.Conn
+		err     error
+	)
+	if socksMode == routeDirect {
+		logOutIP(r)
+		backend, err = dialDirect(r.Context(), "tcp", r.Host)
+	} else {
+		backend, err = connectWithFallback(r)
+	}
+	if err != nil {
+		errorLog.PrintfCtx(r.Context(), "socks_dial", r.Host, "[SOCKS5] 连接 %s 失败(%s): %v", r.Host, classifyError(err), err)
+		socksReply(conn, socksErrorReply(err), nil)
+		conn.Close()
+		return
+	}
+	if err := socksReply(conn, socksReplySuccess, backend.LocalAddr()); err != nil {
+		conn.Close()
+		backend.Close()
+		return
+	}
+
+	startTunnel(r, socksMode, conn, backend)
+}
+
+// socksServerAuth 协商认证方式，要求认证时按RFC 1929校验账户和密码
+func socksServerAuth(conn net.Conn) (user, pass string, ok bool) {
+	var head [2]byte
+	if _, err := io.ReadFull(conn, head[:]); err != nil || head[0] != socksVersion {
+		return "", "", false
+	}
+	methods := make([]byte, head[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return "", "", false
+	}
+	want := byte(socksAuthNone)
+	store := authStore.Load()
+	if store != nil {
+		want = socksAuthPassword
+	}
+	offered := false
+	for _, m := range methods {
+		if m == want {
+			offered = true
+		}
+	}
+	if !offered {
+		conn.Write([]byte{socksVersion, socksAuthNoAccept})
+		return "", "", false
+	}
+	if _, err := conn.Write([]byte{socksVersion, want}); err != nil {
+		return "", "", false
+	}
+	if store == nil {
+		return "", "", true
+	}
+
+	// 子协商: VER ULEN UNAME PLEN PASSWD
+	var ver [2]byte
+	if _, err := io.ReadFull(conn, ver[:]); err != nil {
+		return "", "", false
+	}
+	name := make([]byte, ver[1])
+	if _, err := io.ReadFull(conn, name); err != nil {
+		return "", "", false
+	}
+	var plen [1]byte
+	if _, err := io.ReadFull(conn, plen[:]); err != nil {
+		return "", "", false
+	}
+	secret := make([]byte, plen[0])
+	if _, err := io.ReadFull(conn, secret); err != nil {
+		return "", "", false
+	}
+	if !store.check(string(name), string(secret)) {
+		logf(levelWarn, "[SOCKS5] 客户端 %s 认证失败: 账户 %q", conn.RemoteAddr(), name)
+		conn.Write([]byte{0x01, 0x01})
+		return "", "", false
+	}
+	if _, err := conn.Write([]byte{0x01, 0x00}); err != nil {
+		return "", "", false
+	}
+	return string(name), string(secret), true
+}
+
+// socksReadRequest 读取SOCKS5请求，返回目标地址host:port，只支持CONNECT
+func socksReadRequest(conn net.Conn) (string, byte) {
+	var head [4]byte
+	if _, err := io.ReadFull(conn, head[:]); err != nil || head[0] != socksVersion {
+		return "", socksReplyGeneralFailure
+	}
+	var host string
+	switch head[3] {
+	case socksAtypIPv4, socksAtypIPv6:
+		size := net.IPv4len
+		if head[3] == socksAtypIPv6 {
+			size = net.IPv6len
+		}
+		ip := make(net.IP, size)
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return "", socksReplyGeneralFailure
+		}
+		host = ip.String()
+	case socksAtypDomain:
+		var n [1]byte
+		if _, err := io.ReadFull(conn, n[:]); err != nil {
+			return "", socksReplyGeneralFailure
+		}
+		name := make([]byte, n[0])
+		if _, err := io.ReadFull(conn, name); err != nil {
+			return "", socksReplyGeneralFailure
+		}
+		host = string(name)
+	default:
+		return "", socksReplyAtypNotSupported
+	}
+	var port [2]byte
+	if _, err := io.ReadFull(conn, port[:]); err != nil {
+		return "", socksReplyGeneralFailure
+	}
+	if head[1] != socksCmdConnect {
+		return "", socksReplyCmdNotSupported
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(port[0])<<8|int(port[1]))), socksReplySuccess
+}
+
+// socksRequest 构造与SOCKS5请求等价的CONNECT请求，认证信息以Proxy-Authorization传入，便于复用HTTP监听的处理逻辑
+func socksRequest(conn net.Conn, target, user, pass string) *http.Request {
+	r := &http.Request{
+		Method:     http.MethodConnect,
+		URL:        &url.URL{Host: target},
+		Host:       target,
+		RequestURI: target,
+		Proto:      "SOCKS5",
+		Header:     make(http.Header),
+		RemoteAddr: conn.RemoteAddr().String(),
+	}
+	if user != "" {
+		r.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(user+":"+pass)))
+	}
+	return r
+}
+
+// socksReply 发送SOCKS5应答，bound为代理侧用于连接目标的地址
+func socksReply(conn net.Conn, code byte, bound net.Addr) error {
+	reply := []byte{socksVersion, code, 0, socksAtypIPv4, 0, 0, 0, 0, 0, 0}
+	if addr, ok := bound.(*net.TCPAddr); ok {
+		if ip4 := addr.IP.To4(); ip4 != nil {
+			copy(reply[4:8], ip4)
+		} else {
+			reply = append([]byte{socksVersion, code, 0, socksAtypIPv6}, addr.IP.To16()...)
+			reply = append(reply, 0, 0)
+		}
+		reply[len(reply)-2], reply[len(reply)-1] = byte(addr.Port>>8), byte(addr.Port)
+	}
+	_, err := conn.Write(reply)
+	return err
+}
+
+// socksStatusReply 将HTTP监听的检查结果状态码转换为SOCKS5应答码
+func socksStatusReply(status int) byte {
+	switch status {
+	case http.StatusForbidden, http.StatusProxyAuthRequired:
+		return socksReplyNotAllowed
+	}
+	return socksReplyGeneralFailure
+}
+
+// socksErrorReply 将拨号失败转换为SOCKS5应答码
+func socksErrorReply(err error) byte {
+	switch classifyError(err) {
+	case kindDNS, kindDialTimeout:
+		return socksReplyHostUnreachable
+	case kindDialRefused:
+		return socksReplyRefused
+	case kindPolicyDenied:
+		return socksReplyNotAllowed
+	}
+	return socksReplyGeneralFailure
+}
+
+// statusRecorder 记录检查函数写出的状态码，SOCKS5监听据此给出应答码
+type statusRecorder struct {
+	header http.Header
+	status int
+}
+
+func (w *statusRecorder) Header() http.Header { return w.header }
+
+func (w *statusRecorder) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return len(p), nil
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"io"
+	"net"
+	"time"
+)
+
+// spliceChunk 每次交给内核splice的字节数上限，每段结束后更新计数和空闲时间
+const spliceChunk = 1 << 20
+
+// spliceTCP 两端都是未加TLS的TCP连接且未限速(rate为0且未配置-max-rate-total)时，由TCPConn.ReadFrom使用splice在内核中转发，
+// src中已缓存的数据先写出；不满足条件时返回spliced为false，由调用方改用缓冲区复制
+func spliceTCP(dst io.Writer, src io.Reader, rate byteRate, counters []byteCounter) (n int64, spliced bool, err error) {
+	if rate > 0 || totalLimiter != nil {
+		return 0, false, nil
+	}
+	var idle *tunnelIdle
+	if r, ok := src.(*idleReader); ok {
+		src, idle = r.Conn, r.idle
+	}
+	if c, ok := dst.(*bufferedConn); ok {
+		dst = c.Conn
+	}
+	dstTCP, ok := dst.(*net.TCPConn)
+	if !ok {
+		return 0, false, nil
+	}
+	var buffered *bufferedConn
+	if c, ok := src.(*bufferedConn); ok {
+		buffered, src = c, c.Conn
+	}
+	srcTCP, ok := src.(*net.TCPConn)
+	if !ok {
+		return 0, false, nil
+	}
+
+	count := func(m int64) {
+		n += m
+		for _, c := range counters {
+			c.Add(m)
+		}
+		if idle != nil {
+			idle.last.Store(time.Now().UnixNano())
+		}
+	}
+	if buffered != nil && buffered.r.Buffered() > 0 {
+		m, err := io.CopyN(dst, buffered.r, int64(buffered.r.Buffered()))
+		count(m)
+		if err != nil {
+			return n, true, err
+		}
+	}
+	// splice在一段结束前不会返回，配置了空闲超时时每段最多等待interval，以便及时更新最后活动时间
+	var interval time.Duration
+	if idle != nil {
+		interval = idle.timeout / 4
+	}
+	// 客户端的ClientHello等第一段数据在用户态读取一次，使firstRead立即得到其时间和大小，之后再交给splice
+	first := firstPending(counters)
+	for {
+		if idle != nil {
+			srcTCP.SetReadDeadline(time.Now().Add(interval))
+		}
+		wasFirst := first
+		var m int64
+		if first {
+			m, err = copyOnce(dstTCP, srcTCP)
+		} else {
+			m, err = dstTCP.ReadFrom(&io.LimitedReader{R: srcTCP, N: spliceChunk})
+		}
+		if m > 0 {
+			count(m)
+			first = false
+		}
+		switch {
+		case wasFirst && err == io.EOF:
+			return n, true, nil
+		case wasFirst && err == nil:
+		case err == nil && m < spliceChunk:
+			return n, true, nil // src已读到EOF
+		case err == nil:
+		case idle != nil && isTimeout(err):
+			// 另一个方向的活动最多滞后interval才会记录
+			if time.Now().After(idle.deadline().Add(interval)) {
+				return n, true, errTunnelIdle
+			}
+		default:
+			return n, true, err
+		}
+	}
+}
+
+// copyOnce 使用池中的缓冲区从src读取一次并写入dst
+func copyOnce(dst io.Writer, src io.Reader) (int64, error) {
+	buf := copyBuffers.Get().(*[]byte)
+	defer copyBuffers.Put(buf)
+	n, err := src.Read(*buf)
+	if n > 0 {
+		if _, werr := dst.Write((*buf)[:n]); werr != nil {
+			return int64(n), werr
+		}
+	}
+	return int64(n), err
+}
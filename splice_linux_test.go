@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+// tcpPair 返回本机上一条TCP连接的两端
+func tcpPair(b *testing.B) (*net.TCPConn, *net.TCPConn) {
+	b.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer ln.Close()
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	server, err := ln.Accept()
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client.(*net.TCPConn), server.(*net.TCPConn)
+}
+
+// BenchmarkSplice 比较spliceTCP与copyPooled在两条本机TCP连接之间转发的吞吐和分配：
+// 发送端写入b.N个64KB后关闭，转发一直进行到EOF，接收端读取并丢弃
+func BenchmarkSplice(b *testing.B) {
+	const chunk = 64 << 10
+	copies := []struct {
+		name string
+		copy func(dst, src *net.TCPConn) (int64, error)
+	}{
+		{"splice", func(dst, src *net.TCPConn) (int64, error) {
+			n, spliced, err := spliceTCP(dst, src, 0, nil)
+			if !spliced {
+				return n, errors.New("spliceTCP fell back to the userspace copy")
+			}
+			return n, err
+		}},
+		{"userspace", func(dst, src *net.TCPConn) (int64, error) {
+			return copyPooled(dst, src)
+		}},
+	}
+	for _, c := range copies {
+		b.Run(c.name, func(b *testing.B) {
+			withRates(b, 0, 0)
+			sender, in := tcpPair(b)
+			out, receiver := tcpPair(b)
+			go func() {
+				data := make([]byte, chunk)
+				for i := 0; i < b.N; i++ {
+					if _, err := sender.Write(data); err != nil {
+						return
+					}
+				}
+				sender.CloseWrite()
+			}()
+			received := make(chan int64, 1)
+			go func() {
+				n, _ := io.Copy(io.Discard, receiver)
+				received <- n
+			}()
+
+			b.ReportAllocs()
+			b.SetBytes(chunk)
+			b.ResetTimer()
+			n, err := c.copy(out, in)
+			if err != nil {
+				b.Fatal(err)
+			}
+			out.CloseWrite()
+			if got := <-received; n != int64(b.N)*chunk || got != n {
+				b.Fatalf("copied %d bytes, receiver got %d, want %d", n, got, int64(b.N)*chunk)
+			}
+		})
+	}
+}
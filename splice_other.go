@@ -0,0 +1,10 @@
+//go:build !linux
+
+package main
+
+import "io"
+
+// spliceTCP 非Linux平台的TCPConn.ReadFrom没有splice，总是由调用方使用缓冲区复制
+func spliceTCP(io.Writer, io.Reader, byteRate, []byteCounter) (int64, bool, error) {
+	return 0, false, nil
+}
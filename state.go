@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// stateFile -state-file指定的状态文件，为空表示不保存累计计数
+var stateFile string
+
+// stateInterval 定期保存状态文件的间隔
+const stateInterval = 5 * time.Minute
+
+// savedState 状态文件的内容：所有counter在保存时的值，按指标名和标签值记录
+type savedState struct {
+	Saved    time.Time                  `json:"saved"`
+	Counters map[string][]counterSeries `json:"counters"`
+}
+
+// counterSeries 一组标签值对应的counter值
+type counterSeries struct {
+	Labels []string `json:"labels,omitempty"`
+	Value  int64    `json:"value"`
+}
+
+// snapshotCounters 返回所有counter当前的值，gauge不保存
+func snapshotCounters() map[string][]counterSeries {
+	counters := make(map[string][]counterSeries)
+	for _, m := range metricRegistry {
+		if m.kind != "counter" {
+			continue
+		}
+		m.mu.Lock()
+		for _, v := range m.values {
+			counters[m.name] = append(counters[m.name], counterSeries{Labels: v.labels, Value: v.Load()})
+		}
+		m.mu.Unlock()
+	}
+	return counters
+}
+
+// saveState 将所有counter写入状态文件，先写临时文件再rename替换，中途退出不会留下不完整的文件
+func saveState(path string) error {
+	data, err := json.Marshal(savedState{Saved: time.Now(), Counters: snapshotCounters()})
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// loadState 读取状态文件并把其中的值加到对应的counter上，文件不存在时不做任何事；
+// 已不存在的指标和标签数量改变了的指标被忽略
+func loadState(path string) error {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var state savedState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return fmt.Errorf("parse %s: %v", path, err)
+	}
+	byName := make(map[string]*metricVec, len(metricRegistry))
+	for _, m := range metricRegistry {
+		if m.kind == "counter" {
+			byName[m.name] = m
+		}
+	}
+	for name, series := range state.Counters {
+		m := byName[name]
+		if m == nil {
+			continue
+		}
+		for _, s := range series {
+			if len(s.Labels) == len(m.labels) && s.Value > 0 {
+				m.with(s.Labels...).Add(s.Value)
+			}
+		}
+	}
+	log.Printf("[状态] 已从 %s 恢复累计计数，保存于 %s", path, state.Saved.Format(time.RFC3339))
+	return nil
+}
+
+// setupState 配置了-state-file时恢复上次保存的累计计数并定期保存，文件损坏时输出警告并从0开始
+func setupState(path string) {
+	if path == "" {
+		return
+	}
+	if err := loadState(path); err != nil {
+		log.Printf("[状态] 忽略无法读取的状态文件，计数从0开始: %v", err)
+	}
+	go func() {
+		for range time.Tick(stateInterval) {
+			persistState()
+		}
+	}()
+}
+
+// persistState 配置了-state-file时保存累计计数，失败时只输出日志
+func persistState() {
+	if stateFile == "" {
+		return
+	}
+	if err := saveState(stateFile); err != nil {
+		log.Printf("[状态] 保存 %s 失败: %v", stateFile, err)
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// resetCounters 将所有counter清零，模拟进程重新启动，测试结束后恢复原来的值
+func resetCounters(t *testing.T) {
+	t.Helper()
+	saved := snapshotCounters()
+	clear := func() {
+		for _, m := range metricRegistry {
+			if m.kind == "counter" {
+				m.mu.Lock()
+				m.values = make(map[string]*metricValue)
+				m.mu.Unlock()
+			}
+		}
+	}
+	t.Cleanup(func() {
+		clear()
+		for _, m := range metricRegistry {
+			for _, s := range saved[m.name] {
+				m.with(s.Labels...).Store(s.Value)
+			}
+		}
+	})
+	clear()
+}
+
+// TestStateContinuity 保存状态后"重启"代理，恢复的计数与重启前相同，之后的请求在此基础上继续累加
+func TestStateContinuity(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello")
+	}))
+	t.Cleanup(origin.Close)
+	path := filepath.Join(t.TempDir(), "state.json")
+	resetCounters(t)
+
+	requests := func() int64 { return metricRequests.with(listenerNames["正向代理"], "HTTP").Load() }
+	routed := func() int64 { return metricRouted.with(routeDirect, "").Load() }
+	downloaded := func() int64 { return metricRoutedBytes.with(routeDirect, "", directionDownload).Load() }
+	get := func(proxy *httptest.Server, n int) {
+		t.Helper()
+		client := proxyClient(proxy.URL)
+		for i := 0; i < n; i++ {
+			resp, err := client.Get(origin.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			io.ReadAll(resp.Body)
+			resp.Body.Close()
+		}
+	}
+
+	first := httptest.NewServer(directHandler("正向代理"))
+	get(first, 3)
+	first.Close()
+	if requests() != 3 || routed() != 3 || downloaded() != 15 {
+		t.Fatalf("before restart: requests %d routed %d downloaded %d, want 3, 3, 15", requests(), routed(), downloaded())
+	}
+	if err := saveState(path); err != nil {
+		t.Fatal(err)
+	}
+
+	resetCounters(t)
+	if err := loadState(path); err != nil {
+		t.Fatal(err)
+	}
+	if requests() != 3 || routed() != 3 || downloaded() != 15 {
+		t.Errorf("after restart: requests %d routed %d downloaded %d, want 3, 3, 15", requests(), routed(), downloaded())
+	}
+	second := httptest.NewServer(directHandler("正向代理"))
+	t.Cleanup(second.Close)
+	get(second, 1)
+	if requests() != 4 || routed() != 4 || downloaded() != 20 {
+		t.Errorf("after one more request: requests %d routed %d downloaded %d, want 4, 4, 20", requests(), routed(), downloaded())
+	}
+
+	w := httptest.NewRecorder()
+	serveMetrics(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if !strings.Contains(w.Body.String(), "webproxy_process_start_time_seconds ") {
+		t.Error("/metrics does not export webproxy_process_start_time_seconds")
+	}
+}
+
+// TestLoadStateInvalid 状态文件不存在时什么都不做，损坏时报错，setupState只输出警告
+func TestLoadStateInvalid(t *testing.T) {
+	dir := t.TempDir()
+	if err := loadState(filepath.Join(dir, "missing.json")); err != nil {
+		t.Errorf("missing state file: %v", err)
+	}
+
+	resetCounters(t)
+	path := filepath.Join(dir, "state.json")
+	data := `{"counters":{"webproxy_requests_total":[{"labels":["direct"],"value":7}],"webproxy_gone_total":[{"value":1}]}}`
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadState(path); err != nil {
+		t.Fatal(err)
+	}
+	if n := metricRequests.total(); n != 0 {
+		t.Errorf("series with the wrong number of labels was restored: total %d", n)
+	}
+
+	if err := os.WriteFile(path, []byte(`{"counters":`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadState(path); err == nil {
+		t.Error("loadState accepted a truncated state file")
+	}
+	logs := captureLog(t)
+	setupState(path)
+	if !strings.Contains(logs.String(), "忽略无法读取的状态文件") {
+		t.Errorf("no warning for a corrupt state file:\n%s", logs)
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"html/template"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// statusErrorCount 状态页保留的最近错误日志条数
+const statusErrorCount = 20
+
+// startTime 程序启动的时间，状态页据此计算运行时长
+var startTime = time.Now()
+
+// statusListeners 已绑定的监听，在main中开始提供服务前设置
+var statusListeners []*proxyServer
+
+// errorEntry 一条错误日志
+type errorEntry struct {
+	Time time.Time
+	Msg  string
+}
+
+// errorRing 保存最近输出的错误日志，满后覆盖最早的一条
+type errorRing struct {
+	mu      sync.Mutex
+	entries [statusErrorCount]errorEntry
+	next    int
+	size    int
+}
+
+// recentErrors errorLog输出的最近错误
+var recentErrors = &errorRing{}
+
+// add 记录一条错误
+func (e *errorRing) add(msg string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.entries[e.next] = errorEntry{Time: time.Now(), Msg: msg}
+	e.next = (e.next + 1) % len(e.entries)
+	e.size = min(e.size+1, len(e.entries))
+}
+
+// list 按时间从新到旧返回记录的错误
+func (e *errorRing) list() []errorEntry {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	list := make([]errorEntry, 0, e.size)
+	for i := 1; i <= e.size; i++ {
+		list = append(list, e.entries[(e.next-i+len(e.entries))%len(e.entries)])
+	}
+	return list
+}
+
+// statusListener 状态页中的一个监听
+type statusListener struct {
+	Title string
+	Addr  string
+	TLS   bool
+}
+
+// statusPage 状态页的数据，数量都取自 /tunnels 和 /metrics 使用的连接表和指标
+type statusPage struct {
+	Uptime    time.Duration
+	Listeners []statusListener
+	Upstreams []string
+	Requests  int64
+	BytesUp   int64
+	BytesDown int64
+	Tunnels   int
+	ByRoute   string
+	ConnsUsed int
+	MaxConns  int
+	Errors    []errorEntry
+
+	NoUpstream string // -no-upstream-mode，只读，没有第二级代理时才生效
+}
+
+var statusTemplate = template.Must(template.New("status").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="5">
+<title>web-proxy status</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 1.5em; }
+th, td { border: 1px solid #ccc; padding: 4px 10px; text-align: left; }
+td.msg { font-family: monospace; }
+</style>
+</head>
+<body>
+<h1>web-proxy</h1>
+<table>
+<tr><th>Uptime</th><td>{{.Uptime}}</td></tr>
+<tr><th>Requests</th><td>{{.Requests}}</td></tr>
+<tr><th>Tunnel bytes up / down</th><td>{{.BytesUp}} / {{.BytesDown}}</td></tr>
+<tr><th>Open tunnels</th><td>{{.Tunnels}} {{.ByRoute}}</td></tr>
+<tr><th>No-upstream mode</th><td>{{.NoUpstream}}{{if not .Upstreams}} (in effect){{end}}</td></tr>
+{{if .MaxConns}}<tr><th>Connection slots</th><td>{{.ConnsUsed}} / {{.MaxConns}}</td></tr>
+{{end}}</table>
+<h2>Listeners</h2>
+<table>
+<tr><th>Name</th><th>Address</th><th>TLS</th></tr>
+{{range .Listeners}}<tr><td>{{.Title}}</td><td>{{.Addr}}</td><td>{{if .TLS}}yes{{else}}no{{end}}</td></tr>
+{{end}}</table>
+<h2>Upstreams</h2>
+<table>
+{{range .Upstreams}}<tr><td>{{.}}</td></tr>
+{{else}}<tr><td>none</td></tr>
+{{end}}</table>
+<h2>Recent errors</h2>
+<table>
+{{range .Errors}}<tr><td>{{.Time.Format "2006-01-02 15:04:05"}}</td><td class="msg">{{.Msg}}</td></tr>
+{{else}}<tr><td>none</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// setupStatusPage 在管理接口的 / 提供状态页
+func setupStatusPage() {
+	adminMux.HandleFunc("/", serveStatusPage)
+}
+
+// serveStatusPage 输出状态页，其他未注册的路径返回404
+func serveStatusPage(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	if rejectAdmin(w, r) {
+		return
+	}
+	tunnels, byRoute := activeConns.counts()
+	page := statusPage{
+		Uptime:    time.Since(startTime).Round(time.Second),
+		Requests:  metricRequests.total(),
+		BytesUp:   metricTunnelBytes.with(directionUpload).Load(),
+		BytesDown: metricTunnelBytes.with(directionDownload).Load(),
+		Tunnels:   tunnels,
+		ByRoute:   formatRouteCounts(byRoute),
+		ConnsUsed: connsInUse(),
+		MaxConns:  maxConns,
+		Errors:    recentErrors.list(),
+
+		NoUpstream: noUpstreamMode,
+	}
+	for _, s := range statusListeners {
+		page.Listeners = append(page.Listeners, statusListener{
+			Title: s.title,
+			Addr:  s.address(),
+			TLS:   s.tls,
+		})
+	}
+	for _, u := range upstreamList() {
+		page.Upstreams = append(page.Upstreams, u.redacted())
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	statusTemplate.Execute(w, page)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"io"
+	"log"
+	"time"
+)
+
+// logSink 日志的另一个去向，send不能阻塞调用方
+type logSink interface {
+	send(level, msg string)
+}
+
+// syslogOut 配置了-syslog时的syslog去向，为nil表示不写syslog
+var syslogOut logSink
+
+// levelLoggers 启用syslog后文本格式下各级别使用的logger，使syslog能按级别设置严重程度
+var levelLoggers map[string]*log.Logger
+
+// syslogTee 将log包的输出同时写到原来的去向(加上时间)和syslog(由syslog自己记录时间)
+type syslogTee struct {
+	primary io.Writer
+	sink    logSink
+	level   string
+}
+
+// Write 写入一行日志
+func (t *syslogTee) Write(p []byte) (int, error) {
+	t.primary.Write(append([]byte(time.Now().Format("2006/01/02 15:04:05 ")), p...))
+	msg := string(p)
+	if n := len(msg); n > 0 && msg[n-1] == '\n' {
+		msg = msg[:n-1]
+	}
+	t.sink.send(t.level, msg)
+	return len(p), nil
+}
+
+// enableSyslog 在原有日志去向之外同时写入sink，需在setupLogging之后调用
+func enableSyslog(sink logSink) {
+	syslogOut = sink
+	if jsonLog != nil {
+		return
+	}
+	primary := log.Writer()
+	levelLoggers = make(map[string]*log.Logger, len(logLevels))
+	for _, level := range logLevels {
+		levelLoggers[level] = log.New(&syslogTee{primary: primary, sink: sink, level: level}, "", 0)
+	}
+	log.SetFlags(0)
+	log.SetOutput(&syslogTee{primary: primary, sink: sink, level: levelInfo})
+}
@@ -0,0 +1,123 @@
+//go:build !windows && !plan9
+
+package main
+
+import (
+	"fmt"
+	"log/syslog"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	syslogQueueSize      = 1024            // 等待写入syslog的日志上限，队列满时丢弃
+	syslogReconnectDelay = 5 * time.Second // 连接syslog失败后重试的间隔
+)
+
+// syslogFacilities -syslog-facility可用的取值
+var syslogFacilities = map[string]syslog.Priority{
+	"user":   syslog.LOG_USER,
+	"daemon": syslog.LOG_DAEMON,
+	"local0": syslog.LOG_LOCAL0,
+	"local1": syslog.LOG_LOCAL1,
+	"local2": syslog.LOG_LOCAL2,
+	"local3": syslog.LOG_LOCAL3,
+	"local4": syslog.LOG_LOCAL4,
+	"local5": syslog.LOG_LOCAL5,
+	"local6": syslog.LOG_LOCAL6,
+	"local7": syslog.LOG_LOCAL7,
+}
+
+// syslogLine 一条等待写入的日志
+type syslogLine struct {
+	level string
+	msg   string
+}
+
+// syslogSink 在后台goroutine中写入syslog，连接断开后定期重连，期间的日志被丢弃，不会阻塞调用方
+type syslogSink struct {
+	network, addr string
+	facility      syslog.Priority
+	tag           string
+	lines         chan syslogLine
+}
+
+// setupSyslog 按-syslog启用syslog输出：local为本机syslog，也可以是udp://、tcp://或unix://地址
+func setupSyslog(target, tag, facility string) error {
+	if target == "" {
+		return nil
+	}
+	f, ok := syslogFacilities[facility]
+	if !ok {
+		return fmt.Errorf("invalid -syslog-facility %q, want user, daemon or local0-local7", facility)
+	}
+	s := &syslogSink{facility: f, tag: tag, lines: make(chan syslogLine, syslogQueueSize)}
+	if target != "local" {
+		u, err := url.Parse(target)
+		if err != nil || (u.Scheme != "udp" && u.Scheme != "tcp" && u.Scheme != "unix") {
+			return fmt.Errorf("invalid -syslog %q, want local, udp://host:port, tcp://host:port or unix:///path", target)
+		}
+		s.network, s.addr = u.Scheme, u.Host
+		if u.Scheme == "unix" {
+			s.addr = u.Path
+		}
+	}
+	go s.run()
+	enableSyslog(s)
+	return nil
+}
+
+// send 放入写入队列，队列已满时丢弃
+func (s *syslogSink) send(level, msg string) {
+	select {
+	case s.lines <- syslogLine{level: level, msg: msg}:
+	default:
+	}
+}
+
+// run 依次写入队列中的日志，写入失败时关闭连接，下一条日志到来时按间隔重连
+func (s *syslogSink) run() {
+	var (
+		w         *syslog.Writer
+		nextDial  time.Time
+		reportErr = true
+	)
+	for line := range s.lines {
+		if w == nil {
+			if time.Now().Before(nextDial) {
+				continue
+			}
+			var err error
+			w, err = syslog.Dial(s.network, s.addr, s.facility|syslog.LOG_INFO, s.tag)
+			if err != nil {
+				nextDial = time.Now().Add(syslogReconnectDelay)
+				if reportErr {
+					fmt.Fprintf(os.Stderr, "%s 连接syslog失败，%s 后重试: %v\n", time.Now().Format("2006/01/02 15:04:05"), syslogReconnectDelay, err)
+					reportErr = false
+				}
+				continue
+			}
+			reportErr = true
+		}
+		if err := writeSyslog(w, line); err != nil {
+			w.Close()
+			w = nil
+		}
+	}
+}
+
+// writeSyslog 按日志级别选择syslog的严重程度
+func writeSyslog(w *syslog.Writer, line syslogLine) error {
+	msg := strings.TrimSpace(line.msg)
+	switch line.level {
+	case levelDebug:
+		return w.Debug(msg)
+	case levelWarn:
+		return w.Warning(msg)
+	case levelError:
+		return w.Err(msg)
+	}
+	return w.Info(msg)
+}
@@ -0,0 +1,11 @@
+package main
+
+import "errors"
+
+// setupSyslog Windows下没有syslog
+func setupSyslog(target, tag, facility string) error {
+	if target == "" {
+		return nil
+	}
+	return errors.New("-syslog is not supported on Windows")
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+// ruleTLS 规则行上的tls-insecure和tls-ca=属性，只作用于代理自己发起的到https目标的连接，
+// 隧道中的TLS由客户端与目标直接协商，不受影响
+type ruleTLS struct {
+	insecure bool           // tls-insecure，不校验目标的证书
+	caFile   string         // tls-ca=，用该文件中的证书代替系统根证书校验目标
+	roots    *x509.CertPool // 从caFile读取的证书
+	key      string         // 区分Transport的key，同一CA文件内容改变后重新加载规则得到新的key
+}
+
+// parseRuleTLS 按属性更新TLS设置，t为nil时新建；tls-ca=的文件在加载规则时读取，读取失败时报错
+func parseRuleTLS(t *ruleTLS, key, value string) (*ruleTLS, error) {
+	if t == nil {
+		t = &ruleTLS{}
+	}
+	switch key {
+	case "tls-insecure":
+		switch strings.ToLower(value) {
+		case "", "true", "on":
+			t.insecure = true
+		case "false", "off":
+			t.insecure = false
+		default:
+			return nil, fmt.Errorf("invalid tls-insecure %q, want tls-insecure or tls-insecure=false", value)
+		}
+	case "tls-ca":
+		data, err := os.ReadFile(value)
+		if err != nil {
+			return nil, fmt.Errorf("tls-ca: %v", err)
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("tls-ca %s: no PEM certificates found", value)
+		}
+		sum := sha256.Sum256(data)
+		t.caFile, t.roots = value, roots
+		t.key = hex.EncodeToString(sum[:8])
+	}
+	return t, nil
+}
+
+// String 按规则文件的写法输出
+func (t *ruleTLS) String() string {
+	var parts []string
+	if t.insecure {
+		parts = append(parts, "tls-insecure")
+	}
+	if t.caFile != "" {
+		parts = append(parts, "tls-ca="+t.caFile)
+	}
+	return strings.Join(parts, " ")
+}
+
+// transportKey 区分Transport的key，与默认设置相同时为空
+func (t *ruleTLS) transportKey() string {
+	if t == nil || (!t.insecure && t.caFile == "") {
+		return ""
+	}
+	return fmt.Sprintf("insecure=%v ca=%s", t.insecure, t.key)
+}
+
+// tlsFrom 返回ctx中命中规则的TLS设置，没有时返回nil
+func tlsFrom(ctx context.Context) *ruleTLS {
+	attrs, _ := ctx.Value(ruleAttrsCtx{}).(ruleAttrs)
+	return attrs.tls
+}
+
+// tlsTransportKey tlsTransports的key
+type tlsTransportKey struct {
+	base *http.Transport
+	tls  string
+}
+
+// tlsTransports 按TLS设置复制出的Transport，不修改共用的Transport，相同设置的规则共用连接池
+var tlsTransports sync.Map // tlsTransportKey -> *http.Transport
+
+// transportForTLS 返回按t的TLS设置从base复制出的Transport，没有特别的TLS设置时返回base
+func transportForTLS(base *http.Transport, t *ruleTLS) *http.Transport {
+	key := t.transportKey()
+	if key == "" {
+		return base
+	}
+	if transport, ok := tlsTransports.Load(tlsTransportKey{base, key}); ok {
+		return transport.(*http.Transport)
+	}
+	transport := base.Clone()
+	if transport.TLSClientConfig == nil {
+		transport.TLSClientConfig = &tls.Config{}
+	}
+	transport.TLSClientConfig.InsecureSkipVerify = t.insecure
+	if t.roots != nil {
+		transport.TLSClientConfig.RootCAs = t.roots
+	}
+	actual, _ := tlsTransports.LoadOrStore(tlsTransportKey{base, key}, transport)
+	return actual.(*http.Transport)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestRuleTLS 自签名证书的源站只在命中带tls-insecure或tls-ca=的规则时可以访问，其他目标仍然校验证书
+func TestRuleTLS(t *testing.T) {
+	withRates(t, 0, 0)
+	origin := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("internal"))
+	}))
+	t.Cleanup(origin.Close)
+	other := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("other"))
+	}))
+	t.Cleanup(other.Close)
+	ca := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(ca, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: origin.Certificate().Raw}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	upstream := httptest.NewServer(directHandler("正向代理"))
+	t.Cleanup(upstream.Close)
+	u, err := parseProxyURL(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	withUpstreams(t, []*upstreamProxy{u})
+
+	matched := "https://" + origin.Listener.Addr().String() + "/"
+	// 规则按主机匹配，localhost访问另一个源站不命中127.0.0.1的规则
+	unmatched := "https://" + strings.Replace(other.Listener.Addr().String(), "127.0.0.1", "localhost", 1) + "/"
+	tests := []struct {
+		name, rules, target string
+		want                int
+	}{
+		{"direct tls-insecure", "127.0.0.1 direct tls-insecure\n", matched, http.StatusOK},
+		{"direct tls-insecure unmatched", "127.0.0.1 direct tls-insecure\n", unmatched, http.StatusBadGateway},
+		{"direct tls-ca", "127.0.0.1 direct tls-ca=" + ca + "\n", matched, http.StatusOK},
+		{"direct tls-ca unmatched", "127.0.0.1 direct tls-ca=" + ca + "\n", unmatched, http.StatusBadGateway},
+		{"proxy tls-insecure", "127.0.0.1 proxy tls-insecure\n", matched, http.StatusOK},
+		{"proxy tls-insecure unmatched", "127.0.0.1 proxy tls-insecure\n", unmatched, http.StatusBadGateway},
+		{"direct without attributes", "127.0.0.1 direct\n", matched, http.StatusBadGateway},
+		{"proxy without attributes", "127.0.0.1 proxy\n", matched, http.StatusBadGateway},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withRules(t, tt.rules, routeProxy)
+			srv := httptest.NewServer(routedHandler("规则代理"))
+			defer srv.Close()
+			// 客户端以绝对URI发送https://请求，由代理与源站建立TLS连接
+			host := strings.TrimSuffix(strings.TrimPrefix(tt.target, "https://"), "/")
+			_, br := rawRequest(t, srv.Listener.Addr().String(), "GET "+tt.target+" HTTP/1.1\r\nHost: "+host+"\r\nConnection: close\r\n\r\n")
+			resp, err := http.ReadResponse(br, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.want {
+				t.Errorf("GET %s = %d, want %d", tt.target, resp.StatusCode, tt.want)
+			}
+		})
+	}
+}
+
+// TestTransportForTLS 相同TLS设置的规则共用同一个副本，共用的Transport不被修改
+func TestTransportForTLS(t *testing.T) {
+	a, _ := parseRuleTLS(nil, "tls-insecure", "")
+	b, _ := parseRuleTLS(nil, "tls-insecure", "true")
+	off, _ := parseRuleTLS(nil, "tls-insecure", "false")
+	if transportForTLS(proxyTransport, nil) != proxyTransport || transportForTLS(proxyTransport, off) != proxyTransport {
+		t.Error("rules without TLS settings do not use the shared transport")
+	}
+	insecure := transportForTLS(proxyTransport, a)
+	if insecure == proxyTransport || insecure != transportForTLS(proxyTransport, b) {
+		t.Error("rules with the same TLS settings do not share one transport")
+	}
+	if !insecure.TLSClientConfig.InsecureSkipVerify || proxyTransport.TLSClientConfig != nil {
+		t.Errorf("insecure copy %+v, shared %+v", insecure.TLSClientConfig, proxyTransport.TLSClientConfig)
+	}
+	if transportForTLS(directTransport.base, a) == insecure {
+		t.Error("direct and second-proxy transports share a copy")
+	}
+}
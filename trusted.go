@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// trustedNets 受信任的下游代理网段，只有来自这些地址的X-Forwarded-For/Forwarded才会被采信
+var trustedNets cidrMatcher
+
+// isTrustedProxy 判断地址是否属于受信任的下游代理
+func isTrustedProxy(ip net.IP) bool {
+	return trustedNets.contains(ip)
+}
+
+// forwardedClient 直连的对端是受信任代理时，从转发头部中取出实际的客户端地址：
+// 从右向左跳过受信任的代理，第一个不受信任的地址即为客户端；遇到无法解析的地址时停止，
+// 使用最后一个可信的地址，避免伪造的头部冒充其他客户端
+func forwardedClient(r *http.Request, peer net.IP) net.IP {
+	if len(trustedNets) == 0 || !isTrustedProxy(peer) {
+		return peer
+	}
+	hops := forwardedHops(r)
+	client := peer
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := parseForwardedNode(hops[i])
+		if ip == nil {
+			break
+		}
+		client = ip
+		if !isTrustedProxy(ip) {
+			break
+		}
+	}
+	return client
+}
+
+// forwardedHops 返回转发链中的各个地址(按从客户端到最近一跳的顺序)，优先使用X-Forwarded-For，其次为Forwarded的for参数
+func forwardedHops(r *http.Request) []string {
+	var hops []string
+	for _, value := range r.Header.Values("X-Forwarded-For") {
+		for _, item := range strings.Split(value, ",") {
+			hops = append(hops, strings.TrimSpace(item))
+		}
+	}
+	if len(hops) > 0 {
+		return hops
+	}
+	for _, value := range r.Header.Values("Forwarded") {
+		for _, element := range strings.Split(value, ",") {
+			node := ""
+			for _, pair := range strings.Split(element, ";") {
+				key, val, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if ok && strings.EqualFold(key, "for") {
+					node = strings.Trim(val, `"`)
+				}
+			}
+			// 每个转发元素都占一跳，缺少for参数的元素按无法识别处理
+			hops = append(hops, node)
+		}
+	}
+	return hops
+}
+
+// parseForwardedNode 解析转发头部中的单个节点，支持 1.2.3.4、1.2.3.4:80、2001:db8::1 和 [2001:db8::1]:80，
+// unknown、混淆标识等无法作为地址的节点返回nil
+func parseForwardedNode(node string) net.IP {
+	if host, _, err := net.SplitHostPort(node); err == nil {
+		node = host
+	}
+	node = strings.TrimSuffix(strings.TrimPrefix(node, "["), "]")
+	if i := strings.IndexByte(node, '%'); i >= 0 {
+		node = node[:i]
+	}
+	ip := net.ParseIP(node)
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip
+}
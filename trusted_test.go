@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// withTrustedProxies 在测试期间使用给定的-trusted-proxies
+func withTrustedProxies(t *testing.T, value string) {
+	t.Helper()
+	saved := trustedNets
+	t.Cleanup(func() { trustedNets = saved })
+	nets, err := parseCIDRs("-trusted-proxies", value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	trustedNets = nets
+}
+
+// TestForwardedClient 只采信受信任下游代理发来的转发头部，从右向左跳过受信任的代理，无法解析的节点处停止
+func TestForwardedClient(t *testing.T) {
+	withTrustedProxies(t, "10.0.0.0/8, 2001:db8:ffff::/48")
+	tests := []struct {
+		name   string
+		remote string
+		header http.Header
+		want   string
+	}{
+		{"no header", "10.0.0.1:1000", nil, "10.0.0.1"},
+		{"untrusted peer ignored", "198.51.100.1:1000", http.Header{"X-Forwarded-For": {"203.0.113.9"}}, "198.51.100.1"},
+		{"single hop", "10.0.0.1:1000", http.Header{"X-Forwarded-For": {"203.0.113.9"}}, "203.0.113.9"},
+		{"skip trusted hops", "10.0.0.1:1000", http.Header{"X-Forwarded-For": {"203.0.113.9, 10.1.1.1", "10.2.2.2"}}, "203.0.113.9"},
+		{"spoofed left part ignored", "10.0.0.1:1000", http.Header{"X-Forwarded-For": {"1.1.1.1, 203.0.113.9"}}, "203.0.113.9"},
+		{"unparsable stops", "10.0.0.1:1000", http.Header{"X-Forwarded-For": {"203.0.113.9, garbage, 10.1.1.1"}}, "10.1.1.1"},
+		{"with port", "10.0.0.1:1000", http.Header{"X-Forwarded-For": {"203.0.113.9:5555"}}, "203.0.113.9"},
+		{"Forwarded", "10.0.0.1:1000", http.Header{"Forwarded": {`for=192.0.2.60;proto=http, for="[2001:db8::7]:4711"`}}, "2001:db8::7"},
+		{"Forwarded unknown", "10.0.0.1:1000", http.Header{"Forwarded": {"for=unknown"}}, "10.0.0.1"},
+		{"XFF preferred over Forwarded", "10.0.0.1:1000", http.Header{"X-Forwarded-For": {"203.0.113.9"}, "Forwarded": {"for=192.0.2.60"}}, "203.0.113.9"},
+		{"IPv6 trusted peer", "[2001:db8:ffff::1]:1000", http.Header{"X-Forwarded-For": {"::ffff:203.0.113.9"}}, "203.0.113.9"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+			r.RemoteAddr = tt.remote
+			r.Header = tt.header
+			if r.Header == nil {
+				r.Header = http.Header{}
+			}
+			if got := clientKey(r); got != tt.want {
+				t.Errorf("clientKey = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestForwardedClientWithoutTrustedProxies(t *testing.T) {
+	withTrustedProxies(t, "")
+	r := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	r.RemoteAddr = "10.0.0.1:1000"
+	r.Header.Set("X-Forwarded-For", "203.0.113.9")
+	if got := clientKey(r); got != "10.0.0.1" {
+		t.Errorf("clientKey = %s without -trusted-proxies, want the peer", got)
+	}
+}
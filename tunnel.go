@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+// earlyDataLimit 乐观CONNECT模式下，后端就绪前最多缓存的客户端数据量
+const earlyDataLimit = 16 * 1024
+
+// connectEstablished 隧道建立后直接写给客户端的响应
+const connectEstablished = "HTTP/1.1 200 Connection Established\r\n\r\n"
+
+// dialResult 后端拨号结果
+type dialResult struct {
+	conn net.Conn
+	err  error
+}
+
+// optimisticTunnel 先响应客户端200，同时并行执行dial建立后端连接；
+// 后端就绪前客户端发来的数据(通常是TLS ClientHello)先缓存，最多earlyDataLimit字节
+// 拨号失败时直接重置客户端连接
+func optimisticTunnel(w http.ResponseWriter, r *http.Request, route string, dial func() (net.Conn, error)) {
+	target := r.Host
+	start := time.Now()
+	dialed := make(chan dialResult, 1)
+	go func() {
+		var res dialResult
+		defer func() {
+			if res.conn == nil && res.err == nil {
+				res.err = errors.New("dial panicked")
+			}
+			dialed <- res
+		}()
+		defer recoverTunnel("乐观CONNECT拨号")
+		res.conn, res.err = dial()
+	}()
+
+	clientConn, clientBuf, ok := hijackTunnel(w, target)
+	if !ok {
+		closeDialed(dialed)
+		return
+	}
+
+	// 后端就绪前先读取客户端的早期数据
+	var early []byte
+	readDone := make(chan error, 1)
+	go func() {
+		buf := make([]byte, earlyDataLimit)
+		// 劫持前已被缓存的客户端数据排在最前面
+		n, _ := clientBuf.Read(buf[:clientBuf.Buffered()])
+		var err error
+		for n < len(buf) {
+			var m int
+			m, err = clientConn.Read(buf[n:])
+			n += m
+			if err != nil {
+				break
+			}
+		}
+		early = buf[:n]
+		readDone <- err
+	}()
+
+	res := <-dialed
+	// 唤醒仍阻塞在Read上的读取goroutine
+	clientConn.SetReadDeadline(time.Now())
+	readErr := <-readDone
+	clientConn.SetReadDeadline(time.Time{})
+	logTunnelResult(r, route, start, res.err)
+
+	if res.err != nil {
+		errorLog.PrintfCtx(r.Context(), "optimistic_dial", target, "[乐观CONNECT] 连接 %s 失败: %v", target, res.err)
+		resetConn(clientConn)
+		return
+	}
+	backendConn := res.conn
+
+	if len(early) > 0 {
+		if _, err := backendConn.Write(early); err != nil {
+			resetConn(clientConn)
+			backendConn.Close()
+			return
+		}
+	}
+	if readErr != nil && !isTimeout(readErr) {
+		// 客户端在后端就绪前已经关闭或出错
+		clientConn.Close()
+		backendConn.Close()
+		return
+	}
+
+	// 开始转发数据
+	startTunnel(r, route, clientConn, backendConn)
+}
+
+// hijackTunnel 劫持客户端连接并直接写入200 Connection Established，返回连接和劫持前已缓存客户端数据的reader；
+// 劫持失败时还没有写出任何内容，可以正常返回错误响应
+func hijackTunnel(w http.ResponseWriter, target string) (net.Conn, *bufio.Reader, bool) {
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		writeProxyError(w, http.StatusInternalServerError, reasonInternalError, target, "Hijacking not supported")
+		return nil, nil, false
+	}
+	clientConn, bufrw, err := hijacker.Hijack()
+	if err != nil {
+		writeProxyError(w, http.StatusServiceUnavailable, reasonInternalError, target, err.Error())
+		return nil, nil, false
+	}
+
+	// 从此点开始，不要再使用w来写入响应
+	if _, err := io.WriteString(clientConn, connectEstablished); err != nil {
+		clientConn.Close()
+		return nil, nil, false
+	}
+	return clientConn, bufrw.Reader, true
+}
+
+// closeDialed 等待拨号结果并关闭已建立的后端连接
+func closeDialed(dialed <-chan dialResult) {
+	go func() {
+		if res := <-dialed; res.conn != nil {
+			res.conn.Close()
+		}
+	}()
+}
+
+// bufferedConn 读取时先返回bufio.Reader中已缓存的数据，再读取底层连接
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// Read 从带缓存的reader读取
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// closeWrite 关闭连接的写方向，对端读到EOF后仍可继续发送；连接不支持半关闭或失败时返回false
+func closeWrite(conn io.Writer) bool {
+	if c, ok := conn.(*bufferedConn); ok {
+		conn = c.Conn
+	}
+	cw, ok := conn.(interface{ CloseWrite() error })
+	return ok && cw.CloseWrite() == nil
+}
+
+// flushBuffered 将劫持连接时bufio.Reader中已缓存的客户端数据写入后端
+func flushBuffered(dst io.Writer, br *bufio.Reader) error {
+	n := br.Buffered()
+	if n == 0 {
+		return nil
+	}
+	data, err := br.Peek(n)
+	if err != nil {
+		return err
+	}
+	_, err = dst.Write(data)
+	return err
+}
+
+// resetConn 以RST方式关闭TCP连接，让客户端尽快感知失败
+func resetConn(conn net.Conn) {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn = tlsConn.NetConn()
+	}
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		tcpConn.SetLinger(0)
+	}
+	conn.Close()
+}
+
+// isTimeout 判断错误是否为超时错误
+func isTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
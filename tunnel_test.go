@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// newEchoServer 原样返回收到的数据的TCP服务，返回监听地址
+func newEchoServer(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// tunnelProxy 以handler处理CONNECT的代理，返回监听地址
+func tunnelProxy(t *testing.T, handler func(w http.ResponseWriter, r *http.Request)) string {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler(w, withClientKey(r))
+	}))
+	t.Cleanup(srv.Close)
+	return srv.Listener.Addr().String()
+}
+
+// connectThrough 经由proxy发送CONNECT target，payload与请求头在同一次写入中发出，返回连接和reader
+func connectThrough(t *testing.T, proxy, target, payload string) (net.Conn, *bufio.Reader, *http.Response) {
+	t.Helper()
+	conn, br := rawRequest(t, proxy, "CONNECT "+target+" HTTP/1.1\r\nHost: "+target+"\r\n\r\n"+payload)
+	resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn, br, resp
+}
+
+// TestOptimisticTunnel 乐观CONNECT在拨号完成前响应200，期间客户端发送的数据在后端就绪后按序转发；
+// 拨号失败时客户端连接被关闭
+func TestOptimisticTunnel(t *testing.T) {
+	echo := newEchoServer(t)
+	tests := []struct {
+		name string
+		dial func() (net.Conn, error)
+		ok   bool
+	}{
+		{"slow dial", func() (net.Conn, error) {
+			time.Sleep(100 * time.Millisecond)
+			return net.Dial("tcp", echo)
+		}, true},
+		{"failed dial", func() (net.Conn, error) {
+			time.Sleep(100 * time.Millisecond)
+			return nil, errors.New("connection refused")
+		}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxy := tunnelProxy(t, func(w http.ResponseWriter, r *http.Request) {
+				optimisticTunnel(w, r, routeDirect, tt.dial)
+			})
+			start := time.Now()
+			conn, br, resp := connectThrough(t, proxy, "example.com:443", "")
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("status %d, want 200 before the dial completes", resp.StatusCode)
+			}
+			if elapsed := time.Since(start); elapsed >= 50*time.Millisecond {
+				t.Errorf("200 took %v, want it before the dial finished", elapsed)
+			}
+			io.WriteString(conn, "early ")
+			io.WriteString(conn, "data")
+
+			got := make([]byte, len("early data"))
+			_, err := io.ReadFull(br, got)
+			if tt.ok && (err != nil || string(got) != "early data") {
+				t.Errorf("tunnel echoed %q, %v, want the early data in order", got, err)
+			}
+			if !tt.ok && err == nil {
+				t.Errorf("tunnel with a failed dial returned %q", got)
+			}
+		})
+	}
+}
+
+// TestConnectEarlyPayload 客户端紧跟在CONNECT请求头后发送的数据(劫持前已被读入缓冲)不会丢失
+func TestConnectEarlyPayload(t *testing.T) {
+	echo := newEchoServer(t)
+	saved := optimisticConnect
+	t.Cleanup(func() { optimisticConnect = saved })
+	for _, optimistic := range []bool{false, true} {
+		name := "dial first"
+		if optimistic {
+			name = "optimistic"
+		}
+		t.Run(name, func(t *testing.T) {
+			optimisticConnect = optimistic
+			proxy := tunnelProxy(t, handleDirectTunneling)
+			const payload = "\x16\x03\x01 client hello"
+			_, br, resp := connectThrough(t, proxy, echo, payload)
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("status %d, want 200", resp.StatusCode)
+			}
+			got := make([]byte, len(payload))
+			if _, err := io.ReadFull(br, got); err != nil || string(got) != payload {
+				t.Errorf("tunnel echoed %q, %v, want the payload sent with the request", got, err)
+			}
+		})
+	}
+}
+
+// TestConnectEstablishedRaw 劫持后写出的200响应不带任何头部(没有Content-Length、Date等)，紧接着就是隧道数据
+func TestConnectEstablishedRaw(t *testing.T) {
+	echo := newEchoServer(t)
+	saved := optimisticConnect
+	t.Cleanup(func() { optimisticConnect = saved })
+	for _, optimistic := range []bool{false, true} {
+		optimisticConnect = optimistic
+		proxy := tunnelProxy(t, handleDirectTunneling)
+		conn, br := rawRequest(t, proxy, "CONNECT "+echo+" HTTP/1.1\r\nHost: "+echo+"\r\n\r\n")
+		const want = "HTTP/1.1 200 Connection Established\r\n\r\n"
+		got := make([]byte, len(want))
+		if _, err := io.ReadFull(br, got); err != nil || string(got) != want {
+			t.Fatalf("optimistic=%v: response %q, %v, want exactly %q", optimistic, got, err, want)
+		}
+		io.WriteString(conn, "ping")
+		echoed := make([]byte, 4)
+		if _, err := io.ReadFull(br, echoed); err != nil || string(echoed) != "ping" {
+			t.Errorf("optimistic=%v: tunnel data after the response = %q, %v", optimistic, echoed, err)
+		}
+	}
+}
+
+// TestConnectFailureClosesUpstream 第二级代理拒绝CONNECT或返回无法解析的响应时，到它的连接被立即关闭
+func TestConnectFailureClosesUpstream(t *testing.T) {
+	tests := []struct {
+		name     string
+		response string
+	}{
+		{"forbidden", "HTTP/1.1 403 Forbidden\r\nContent-Length: 0\r\n\r\n"},
+		{"auth required", "HTTP/1.1 407 Proxy Authentication Required\r\nProxy-Authenticate: Basic\r\nContent-Length: 0\r\n\r\n"},
+		{"with a body", "HTTP/1.1 502 Bad Gateway\r\nContent-Length: 5\r\n\r\nerror"},
+		{"malformed", "SSH-2.0-OpenSSH\r\n\r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := newConnectProxy(t, func(*http.Request) string { return tt.response })
+			conn, err := connectUpstream(connectRequest("example.com:443"), &upstreamProxy{scheme: "http", server: upstream.addr})
+			if err == nil {
+				conn.Close()
+				t.Fatal("connectUpstream succeeded")
+			}
+			select {
+			case <-upstream.closed:
+			case <-time.After(2 * time.Second):
+				t.Fatal("connection to the second proxy left open after a failed CONNECT")
+			}
+		})
+	}
+}
+
+// TestTunnelHalfClose 客户端关闭写方向后目标读到EOF，目标之后发送的响应仍能完整返回给客户端
+func TestTunnelHalfClose(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		// 读到客户端的EOF之后才应答，类似 nc -N 或 HTTP/1.0 的请求方式
+		data, _ := io.ReadAll(conn)
+		io.WriteString(conn, "got:"+string(data))
+	}()
+
+	saved := optimisticConnect
+	t.Cleanup(func() { optimisticConnect = saved })
+	optimisticConnect = false
+	conn, br, resp := connectThrough(t, tunnelProxy(t, handleDirectTunneling), ln.Addr().String(), "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d, want 200", resp.StatusCode)
+	}
+	io.WriteString(conn, "hello")
+	if err := conn.(*net.TCPConn).CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(br)
+	if err != nil || string(got) != "got:hello" {
+		t.Errorf("response after the half-close = %q, %v, want %q", got, err, "got:hello")
+	}
+}
+
+func TestCloseWrite(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		if conn, err := ln.Accept(); err == nil {
+			defer conn.Close()
+			io.Copy(io.Discard, conn)
+		}
+	}()
+	tcp, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcp.Close()
+	pipe, peer := net.Pipe()
+	defer pipe.Close()
+	defer peer.Close()
+
+	tests := []struct {
+		name string
+		conn io.Writer
+		want bool
+	}{
+		{"tcp", tcp, true},
+		{"buffered tcp", &bufferedConn{Conn: tcp, r: bufio.NewReader(tcp)}, true},
+		{"pipe", pipe, false},
+	}
+	for _, tt := range tests {
+		if got := closeWrite(tt.conn); got != tt.want {
+			t.Errorf("closeWrite(%s) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
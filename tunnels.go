@@ -0,0 +1,548 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 登记的连接种类
+const (
+	connTunnel = "tunnel" // 劫持后的CONNECT或SOCKS5隧道
+	connHTTP   = "http"   // 正在转发的普通HTTP请求
+)
+
+// connInfo 一个正在转发的隧道或HTTP请求
+type connInfo struct {
+	id      uint64
+	kind    string    // connTunnel或connHTTP
+	client  string    // 客户端地址
+	target  string    // 目标host:port
+	route   string    // 转发方式：direct或proxy
+	session string    // 发给第二级代理的会话ID，未启用时为空
+	start   time.Time // 开始转发的时间
+	conn    net.Conn  // 隧道的客户端连接，HTTP请求为nil
+	backend net.Conn  // 隧道到第二级代理或目标服务器的连接，HTTP请求为nil
+	cancel  func()    // 中止HTTP请求，隧道为nil
+	slot    *connSlot // 隧道占用的连接名额，隧道结束时释放，未限制时为nil
+
+	settings connSettings   // 实际使用的空闲超时和限速，命中规则的属性覆盖全局参数
+	decision *routeDecision // 实际走的路径，HTTP请求转发过程中才确定经由的第二级代理
+
+	up   atomic.Int64 // 已从客户端转发到目标的字节数
+	down atomic.Int64 // 已从目标转发到客户端的字节数
+
+	upDone   atomic.Int64 // 隧道从客户端到目标的方向结束的时间(UnixNano)，仍在转发时为0
+	downDone atomic.Int64 // 隧道从目标到客户端的方向结束的时间(UnixNano)，仍在转发时为0
+
+	// 隧道的时间点，见milestones
+	received    time.Time    // 收到CONNECT的时间，没有记录时与start相同
+	firstUp     atomic.Int64 // 从received到客户端第一次发来数据的纳秒数，尚未收到时为0
+	firstDown   atomic.Int64 // 从received到目标第一次发来数据的纳秒数，尚未收到时为0
+	firstUpSize atomic.Int64 // 客户端第一次发来的数据的字节数
+}
+
+// connRegistry 记录正在转发的隧道和HTTP请求，劫持的连接不在net/http的统计范围内，
+// 当前数量、按路由的分布、连接列表和退出时的等待都以此为准
+type connRegistry struct {
+	mu      sync.Mutex
+	conns   map[uint64]*connInfo
+	clients map[string]int // 每个客户端占用的名额，由acquireClient和releaseClient维护
+	users   map[string]int // 每个账户占用的名额，由acquireUser和releaseUser维护
+	nextID  uint64
+	closed  bool           // 已开始退出，不再登记新的连接
+	wg      sync.WaitGroup // 只等待隧道，HTTP请求由http.Server.Shutdown等待，只在持有mu时Add
+}
+
+// newConnRegistry 创建空的连接表
+func newConnRegistry() *connRegistry {
+	return &connRegistry{conns: make(map[uint64]*connInfo), clients: make(map[string]int), users: make(map[string]int)}
+}
+
+// activeConns 所有监听共用的连接表
+var activeConns = newConnRegistry()
+
+// add 登记连接并分配ID，需在开始转发前调用；已开始退出时不登记并返回false，调用方需自行关闭连接
+func (t *connRegistry) add(info *connInfo) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return false
+	}
+	t.nextID++
+	info.id = t.nextID
+	t.conns[info.id] = info
+	if info.kind == connTunnel {
+		t.wg.Add(1)
+	}
+	return true
+}
+
+// remove 注销连接，隧道在两个方向都结束后调用
+func (t *connRegistry) remove(info *connInfo) {
+	t.mu.Lock()
+	delete(t.conns, info.id)
+	t.mu.Unlock()
+	if info.kind == connTunnel {
+		t.wg.Done()
+	}
+}
+
+// acquireClient 客户端占用的名额未达到limit时占用一个并返回true
+func (t *connRegistry) acquireClient(key string, limit int) bool {
+	return t.acquire(t.clients, key, limit)
+}
+
+// releaseClient 释放客户端的一个名额，归零时删除记录
+func (t *connRegistry) releaseClient(key string) {
+	t.release(t.clients, key)
+}
+
+// acquireUser 账户占用的名额未达到limit时占用一个并返回true
+func (t *connRegistry) acquireUser(key string, limit int) bool {
+	return t.acquire(t.users, key, limit)
+}
+
+// releaseUser 释放账户的一个名额，归零时删除记录
+func (t *connRegistry) releaseUser(key string) {
+	t.release(t.users, key)
+}
+
+// userCounts 返回每个账户当前占用的名额
+func (t *connRegistry) userCounts() map[string]int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	counts := make(map[string]int, len(t.users))
+	for key, n := range t.users {
+		counts[key] = n
+	}
+	return counts
+}
+
+// acquire 在counts中key占用的名额未达到limit时占用一个并返回true
+func (t *connRegistry) acquire(counts map[string]int, key string, limit int) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if counts[key] >= limit {
+		return false
+	}
+	counts[key]++
+	return true
+}
+
+// release 释放counts中key的一个名额，归零时删除记录
+func (t *connRegistry) release(counts map[string]int, key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if counts[key]--; counts[key] <= 0 {
+		delete(counts, key)
+	}
+}
+
+// counts 返回当前隧道总数和按路由的分布
+func (t *connRegistry) counts() (int, map[string]int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	total := 0
+	byRoute := make(map[string]int)
+	for _, info := range t.conns {
+		if info.kind == connTunnel {
+			total++
+			byRoute[info.route]++
+		}
+	}
+	return total, byRoute
+}
+
+// list 返回目标包含host(不区分大小写，为空表示全部)的连接
+func (t *connRegistry) list(host string) []*connInfo {
+	host = strings.ToLower(host)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	list := make([]*connInfo, 0, len(t.conns))
+	for _, info := range t.conns {
+		if host == "" || strings.Contains(strings.ToLower(info.target), host) {
+			list = append(list, info)
+		}
+	}
+	return list
+}
+
+// closeAll 停止登记并强制关闭所有仍在转发的隧道，返回关闭的数量
+func (t *connRegistry) closeAll() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.closed = true
+	n := 0
+	for _, info := range t.conns {
+		if info.kind == connTunnel {
+			info.kill()
+			n++
+		}
+	}
+	return n
+}
+
+// closeID 关闭指定ID的隧道或中止HTTP请求，ID不存在(包括已经正常结束)时返回false
+func (t *connRegistry) closeID(id uint64) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	info, ok := t.conns[id]
+	if ok {
+		info.kill()
+	}
+	return ok
+}
+
+// closeHost 关闭目标主机为host的所有隧道和HTTP请求，返回关闭的数量
+func (t *connRegistry) closeHost(host string) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n := 0
+	for _, info := range t.conns {
+		if strings.EqualFold(stripPort(info.target), host) {
+			info.kill()
+			n++
+		}
+	}
+	return n
+}
+
+// kill 关闭隧道的两端或中止HTTP请求，转发goroutine随之退出并注销，
+// 与正常结束同时发生时重复关闭连接没有影响
+func (info *connInfo) kill() {
+	if info.kind == connTunnel {
+		info.conn.Close()
+		info.backend.Close()
+	} else {
+		info.cancel()
+	}
+}
+
+// stripPort 去掉host:port中的端口
+func stripPort(target string) string {
+	if host, _, err := net.SplitHostPort(target); err == nil {
+		return host
+	}
+	return target
+}
+
+// wait 停止登记新的连接并等待所有隧道结束，ctx结束时返回false
+func (t *connRegistry) wait(ctx context.Context) bool {
+	// 置closed与add中的wg.Add在同一把锁下，之后不会再有Add与Wait并发
+	t.mu.Lock()
+	t.closed = true
+	t.mu.Unlock()
+	drained := make(chan struct{})
+	go func() {
+		t.wg.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// startTunnel 登记隧道并在client和backend之间双向转发数据：一个方向读到EOF时半关闭对端的写方向，另一个方向继续转发；
+// 任一方向出错或两个方向都空闲超过-tunnel-idle-timeout时两个连接都会关闭，两个方向都结束后关闭连接并注销
+func startTunnel(r *http.Request, route string, client, backend net.Conn) {
+	info := &connInfo{
+		kind:    connTunnel,
+		client:  clientKey(r),
+		target:  r.Host,
+		route:   route,
+		session: sessionFrom(r.Context()),
+		start:   time.Now(),
+		conn:    client,
+		backend: backend,
+		slot:    takeConnSlot(r.Context()),
+
+		settings: settingsFrom(r.Context()),
+		decision: decisionFor(r, route),
+	}
+	if info.received = requestReceived(r.Context()); info.received.IsZero() {
+		info.received = info.start
+	}
+	if !activeConns.add(info) {
+		logfCtx(r.Context(), levelInfo, "[隧道] 正在退出，关闭到 %s 的新隧道", r.Host)
+		client.Close()
+		backend.Close()
+		if info.slot != nil {
+			info.slot.release()
+		}
+		return
+	}
+	enableTunnelKeepAlive(client)
+	enableTunnelKeepAlive(backend)
+	metricTunnels.with(route).Add(1)
+	notifyTunnel(tunnelOpened, info)
+	done := make(chan struct{})
+	if upstream := connectedUpstream(r.Context()); upstream != nil && upstreamProbeIdle > 0 {
+		go watchUpstreamIdle(info, upstream, done)
+	}
+
+	var (
+		wg             sync.WaitGroup
+		upErr, downErr error
+		idle           = newTunnelIdle(info.settings.idleTimeout)
+	)
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		labelTunnel(info, directionUpload)
+		_, upErr = transfer(backend, idle.watch(client), info.settings.rate, &info.up, metricTunnelBytes.with(directionUpload),
+			firstRead{info.received, &info.firstUp, &info.firstUpSize})
+		info.upDone.Store(time.Now().UnixNano())
+	}()
+	go func() {
+		defer wg.Done()
+		labelTunnel(info, directionDownload)
+		_, downErr = transfer(client, idle.watch(backend), info.settings.rate, &info.down, metricTunnelBytes.with(directionDownload),
+			firstRead{info.received, &info.firstDown, nil})
+		info.downDone.Store(time.Now().UnixNano())
+	}()
+	go func() {
+		wg.Wait()
+		close(done)
+		// 半关闭后两个连接仍然打开，两个方向都结束后才完全关闭
+		client.Close()
+		backend.Close()
+		activeConns.remove(info)
+		if info.slot != nil {
+			info.slot.release()
+		}
+		metricTunnels.with(route).Add(-1)
+		countRouted(info.decision, info.up.Load(), info.down.Load())
+		observeMilestones(info)
+		notifyTunnel(tunnelClosed, info)
+		logTunnelAccess(r, info)
+		logTunnelClosed(r, info, tunnelError(upErr, downErr))
+	}()
+}
+
+// tunnelError 返回隧道两个方向中首个异常结束的原因，空闲超时为errTunnelIdle，对端关闭或己方关闭连接引起的错误不算异常
+func tunnelError(errs ...error) error {
+	for _, err := range errs {
+		if errors.Is(err, errTunnelIdle) {
+			return errTunnelIdle
+		}
+		if err != nil && !errors.Is(err, net.ErrClosed) {
+			return err
+		}
+	}
+	return nil
+}
+
+// logTunnelClosed 隧道两个方向都结束后输出一行汇总：客户端、目标、上下行字节数、持续时间和实际使用的空闲超时、限速
+func logTunnelClosed(r *http.Request, info *connInfo, err error) {
+	if !logEnabled(levelInfo) {
+		return
+	}
+	e := requestEntry(r, "tunnel_closed", "")
+	e.Level = levelInfo
+	e.Route, e.Upstream, e.Rule = info.decision.kind(), info.decision.upstreamID(), info.decision.rule
+	e.BytesUp, e.BytesDown, e.Error = info.up.Load(), info.down.Load(), errorString(err)
+	duration := time.Since(info.start)
+	e.DurationMS = duration.Milliseconds()
+	e.IdleTimeout, e.Rate = info.settings.idleTimeout.String(), info.settings.rate.String()
+	e.Milestones = info.milestones()
+	text := fmt.Sprintf("[隧道] 关闭: 客户端 %s 目标 %s 上行 %d 字节 下行 %d 字节 持续 %s 空闲超时 %s 限速 %s %s",
+		e.Client, e.Host, e.BytesUp, e.BytesDown, duration.Round(time.Millisecond), e.IdleTimeout, e.Rate, e.Milestones)
+	if err != nil {
+		text += " 原因: " + err.Error()
+	}
+	logEvent(e, text)
+}
+
+// formatRouteCounts 按路由名排序输出分布，例如 direct=3 proxy=5
+func formatRouteCounts(byRoute map[string]int) string {
+	routes := make([]string, 0, len(byRoute))
+	for route := range byRoute {
+		routes = append(routes, route)
+	}
+	sort.Strings(routes)
+	parts := make([]string, 0, len(routes))
+	for _, route := range routes {
+		parts = append(parts, route+"="+strconv.Itoa(byRoute[route]))
+	}
+	return strings.Join(parts, " ")
+}
+
+// setupTunnelStats 注册 /tunnels 和 /connections，配置了-tunnel-log-interval时定期输出隧道数量
+func setupTunnelStats(interval time.Duration) {
+	adminMux.HandleFunc("/tunnels", serveTunnelStats)
+	adminMux.HandleFunc("/connections", serveConnections)
+	adminMux.HandleFunc("/connections/", serveConnection)
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		for range time.Tick(interval) {
+			total, byRoute := activeConns.counts()
+			if total == 0 {
+				continue
+			}
+			log.Printf("[隧道] 当前 %d 个: %s", total, formatRouteCounts(byRoute))
+		}
+	}()
+}
+
+// serveTunnelStats 以JSON返回当前隧道数量、按路由的分布和-max-conns的占用，max_conns为0表示不限制
+func serveTunnelStats(w http.ResponseWriter, r *http.Request) {
+	if rejectAdmin(w, r) {
+		return
+	}
+	total, byRoute := activeConns.counts()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Active     int            `json:"active"`
+		ByRoute    map[string]int `json:"by_route"`
+		ConnsInUse int            `json:"conns_in_use"`
+		MaxConns   int            `json:"max_conns"`
+	}{total, byRoute, connsInUse(), maxConns})
+}
+
+// connStatus /connections 返回的单个连接
+type connStatus struct {
+	ID        uint64    `json:"id"`
+	Type      string    `json:"type"`
+	Client    string    `json:"client"`
+	Target    string    `json:"target"`
+	Route     string    `json:"route"` // 路由种类：direct、proxy，改为直接转发时为fallback
+	Upstream  string    `json:"upstream,omitempty"`
+	Rule      string    `json:"rule,omitempty"`
+	Retried   bool      `json:"retried,omitempty"`
+	Session   string    `json:"session,omitempty"`
+	BytesUp   int64     `json:"bytes_up"`
+	BytesDown int64     `json:"bytes_down"`
+	Start     time.Time `json:"start"`
+	Age       float64   `json:"age_seconds"`
+
+	Milestones *tunnelMilestones `json:"milestones,omitempty"` // 只有隧道有
+}
+
+// serveConnections GET以JSON返回正在转发的隧道和HTTP请求，?host= 按目标过滤，
+// ?sort= 可选 age(默认，最早的在前)、bytes(转发字节数多的在前)、host；
+// DELETE ?host= 关闭到该主机的所有连接
+func serveConnections(w http.ResponseWriter, r *http.Request) {
+	if rejectAdmin(w, r) {
+		return
+	}
+	query := r.URL.Query()
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+	case http.MethodDelete:
+		host := query.Get("host")
+		if host == "" {
+			http.Error(w, "host parameter is required", http.StatusBadRequest)
+			return
+		}
+		n := activeConns.closeHost(host)
+		auditAdmin(r, fmt.Sprintf("closed %d connections to %s", n, host))
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			Closed int `json:"closed"`
+		}{n})
+		return
+	default:
+		w.Header().Set("Allow", "GET, HEAD, DELETE")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	now := time.Now()
+	list := make([]connStatus, 0)
+	for _, info := range activeConns.list(query.Get("host")) {
+		list = append(list, connStatus{
+			ID:        info.id,
+			Type:      info.kind,
+			Client:    info.client,
+			Target:    info.target,
+			Route:     info.decision.kind(),
+			Upstream:  info.decision.upstreamID(),
+			Rule:      info.decision.rule,
+			Retried:   info.decision.retried.Load(),
+			Session:   info.session,
+			BytesUp:   info.up.Load(),
+			BytesDown: info.down.Load(),
+			Start:     info.start,
+			Age:       now.Sub(info.start).Seconds(),
+
+			Milestones: info.milestones(),
+		})
+	}
+
+	switch query.Get("sort") {
+	case "", "age":
+		sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	case "bytes":
+		sort.Slice(list, func(i, j int) bool {
+			return list[i].BytesUp+list[i].BytesDown > list[j].BytesUp+list[j].BytesDown
+		})
+	case "host":
+		sort.Slice(list, func(i, j int) bool { return list[i].Target < list[j].Target })
+	default:
+		http.Error(w, "sort must be age, bytes or host", http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// serveConnection DELETE /connections/{id} 关闭指定的隧道或中止HTTP请求，ID不存在时返回404
+func serveConnection(w http.ResponseWriter, r *http.Request) {
+	if rejectAdmin(w, r) {
+		return
+	}
+	if r.Method != http.MethodDelete {
+		w.Header().Set("Allow", "DELETE")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id, err := strconv.ParseUint(strings.TrimPrefix(r.URL.Path, "/connections/"), 10, 64)
+	if err != nil || !activeConns.closeID(id) {
+		auditAdmin(r, "connection not found")
+		http.Error(w, "Connection not found", http.StatusNotFound)
+		return
+	}
+	auditAdmin(r, fmt.Sprintf("closed connection %d", id))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// trackHTTP 登记一个正在转发的普通HTTP请求，返回可由管理接口中止的上下文和转发结束时调用的注销函数；
+// 已开始退出时不登记，ok为false
+func trackHTTP(r *http.Request, route string) (info *connInfo, ctx context.Context, done func(), ok bool) {
+	ctx, cancel := context.WithCancel(r.Context())
+	info = &connInfo{
+		kind:    connHTTP,
+		client:  clientKey(r),
+		target:  r.URL.Host,
+		route:   route,
+		session: sessionFrom(r.Context()),
+		start:   time.Now(),
+		cancel:  cancel,
+
+		decision: decisionFor(r, route),
+	}
+	if !activeConns.add(info) {
+		cancel()
+		return nil, nil, nil, false
+	}
+	return info, ctx, func() {
+		activeConns.remove(info)
+		countRouted(info.decision, info.up.Load(), info.down.Load())
+		cancel()
+	}, true
+}
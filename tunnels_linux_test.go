@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// newSilentServer 接受连接后在套接字上挂一个丢弃所有入站报文的过滤器，模拟不再响应的对端：
+// 内核收不到keepalive探测，也就不会回复ACK，连接保持不关闭
+func newSilentServer(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { conn.Close() })
+			raw, err := conn.(*net.TCPConn).SyscallConn()
+			if err != nil {
+				t.Error(err)
+				continue
+			}
+			raw.Control(func(fd uintptr) {
+				drop := []syscall.SockFilter{{Code: syscall.BPF_RET | syscall.BPF_K, K: 0}}
+				if err := syscall.AttachLsf(int(fd), drop); err != nil {
+					t.Errorf("attach filter: %v", err)
+				}
+			})
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// TestTunnelKeepAliveTearsDown 目标不再响应时，开启-tcp-keepalive的隧道在空闲时间加upstreamProbeCount次探测内关闭，
+// 客户端读到EOF；关闭keepalive时隧道在同样的时间内保持打开
+func TestTunnelKeepAliveTearsDown(t *testing.T) {
+	if testing.Short() {
+		t.Skip("keepalive probes run at a 1s minimum interval")
+	}
+	const idle = time.Second
+	window := idle + time.Duration(upstreamProbeCount+1)*upstreamProbeInterval(idle)
+	tests := []struct {
+		name      string
+		keepAlive time.Duration
+		closed    bool
+	}{
+		{"keepalive", idle, true},
+		{"no keepalive", 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			saved := tcpKeepAlive
+			tcpKeepAlive = tt.keepAlive
+			t.Cleanup(func() { tcpKeepAlive = saved })
+			withRates(t, 0, 0)
+			srv := httptest.NewServer(directHandler("正向代理"))
+			t.Cleanup(srv.Close)
+
+			conn, br, resp := connectThrough(t, srv.Listener.Addr().String(), newSilentServer(t), "")
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("CONNECT status = %d, want 200", resp.StatusCode)
+			}
+			defer conn.Close()
+			start := time.Now()
+			conn.SetReadDeadline(start.Add(window))
+			var b [1]byte
+			_, err := br.Read(b[:])
+			if !tt.closed {
+				if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+					t.Fatalf("tunnel without keepalive ended with %v after %s, want it open", err, time.Since(start))
+				}
+				return
+			}
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				t.Fatalf("tunnel was not closed within %s after the target went silent", window)
+			}
+			if elapsed := time.Since(start); elapsed < idle {
+				t.Errorf("tunnel closed after %s with %v, before the %s keepalive idle time", elapsed, err, idle)
+			}
+		})
+	}
+}
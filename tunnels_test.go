@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestConnRegistryCloseHost(t *testing.T) {
+	reg := newConnRegistry()
+	var cancelled []string
+	for _, target := range []string{"example.com:443", "EXAMPLE.com:80", "example.org:443"} {
+		target := target
+		reg.add(&connInfo{kind: connHTTP, target: target, cancel: func() { cancelled = append(cancelled, target) }})
+	}
+	if got := len(reg.list("example")); got != 3 {
+		t.Errorf("list(example) = %d entries, want 3", got)
+	}
+	if n := reg.closeHost("example.com"); n != 2 || len(cancelled) != 2 {
+		t.Errorf("closeHost(example.com) = %d, cancelled %v", n, cancelled)
+	}
+	if reg.closeID(999) {
+		t.Error("closeID of an unknown ID returned true")
+	}
+}
+
+// TestConnRegistryRefusesAfterShutdown 开始退出后不再登记新的连接，已登记的隧道结束后wait返回
+func TestConnRegistryRefusesAfterShutdown(t *testing.T) {
+	reg := newConnRegistry()
+	running := &connInfo{kind: connTunnel}
+	if !reg.add(running) {
+		t.Fatal("add refused before shutdown")
+	}
+
+	waited := make(chan bool, 1)
+	go func() { waited <- reg.wait(context.Background()) }()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		reg.mu.Lock()
+		closed := reg.closed
+		reg.mu.Unlock()
+		if closed || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	for _, kind := range []string{connTunnel, connHTTP} {
+		if reg.add(&connInfo{kind: kind}) {
+			t.Errorf("%s registered after shutdown started", kind)
+		}
+	}
+	reg.remove(running)
+	select {
+	case ok := <-waited:
+		if !ok {
+			t.Error("wait returned false")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("wait did not return after the last tunnel ended")
+	}
+}
+
+// TestConnRegistryConcurrentShutdown 退出时仍有隧道不断登记和注销，wait与add不能发生WaitGroup的并发误用
+func TestConnRegistryConcurrentShutdown(t *testing.T) {
+	reg := newConnRegistry()
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				info := &connInfo{kind: connTunnel}
+				if reg.add(info) {
+					reg.remove(info)
+				}
+			}
+		}()
+	}
+	time.Sleep(10 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if !reg.wait(ctx) {
+		t.Error("wait timed out")
+	}
+	close(stop)
+	wg.Wait()
+}
+
+func TestStartTunnelAfterShutdown(t *testing.T) {
+	saved := activeConns
+	activeConns = newConnRegistry()
+	t.Cleanup(func() { activeConns = saved })
+	activeConns.closeAll()
+
+	client, clientPeer := net.Pipe()
+	backend, backendPeer := net.Pipe()
+	defer clientPeer.Close()
+	defer backendPeer.Close()
+	r := httptest.NewRequest(http.MethodConnect, "example.com:443", nil)
+	startTunnel(r, routeDirect, client, backend)
+	for _, peer := range []net.Conn{clientPeer, backendPeer} {
+		peer.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if _, err := peer.Read(make([]byte, 1)); err == nil || isTimeout(err) {
+			t.Errorf("tunnel refused during shutdown was not closed: %v", err)
+		}
+	}
+	if list := activeConns.list(""); len(list) != 0 {
+		t.Errorf("%d connections registered during shutdown", len(list))
+	}
+
+	w := httptest.NewRecorder()
+	forwardHTTP(w, httptest.NewRequest(http.MethodGet, "http://example.com/", nil), directTransport, false)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("HTTP request during shutdown: status %d, want 503", w.Code)
+	}
+}
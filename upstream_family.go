@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+)
+
+// upstreamFamilies 缓存每个第二级代理地址实际可用的地址族(tcp4/tcp6)
+var upstreamFamilies sync.Map
+
+// validateUpstreamIPFamily 校验-upstream-ip-family的取值
+func validateUpstreamIPFamily(value string) error {
+	switch value {
+	case "auto", "v4", "v6":
+		return nil
+	}
+	return fmt.Errorf("invalid -upstream-ip-family %q: must be auto, v4 or v6", value)
+}
+
+// upstreamFamilyOrder 返回拨号第二级代理时依次尝试的地址族，已缓存可用地址族时优先使用
+func upstreamFamilyOrder(addr string) []string {
+	var order []string
+	switch upstreamIPFamily {
+	case "v4":
+		order = []string{"tcp4", "tcp6"}
+	case "v6":
+		order = []string{"tcp6", "tcp4"}
+	default:
+		order = []string{"tcp"}
+	}
+	if cached, ok := upstreamFamilies.Load(addr); ok && len(order) > 1 && order[0] != cached {
+		order[0], order[1] = order[1], order[0]
+	}
+	return order
+}
+
+// dialUpstream 按-upstream-ip-family的地址族偏好连接第二级代理，首选地址族失败时回退到另一个，
+// 并缓存可用的地址族，同一代理地址首次确定地址族时记录日志，每次拨号受-dial-timeout限制
+func dialUpstream(ctx context.Context, network, addr string) (net.Conn, error) {
+	dialer := net.Dialer{Timeout: dialTimeout}
+	if host, _, err := net.SplitHostPort(addr); err == nil && net.ParseIP(host) != nil {
+		// IP地址不需要选择地址族
+		return dialer.DialContext(ctx, network, addr)
+	}
+
+	var lastErr error
+	for _, family := range upstreamFamilyOrder(addr) {
+		conn, err := dialer.DialContext(ctx, family, addr)
+		if err != nil {
+			lastErr = err
+			if ctx.Err() != nil {
+				break
+			}
+			continue
+		}
+		used := "tcp4"
+		if tcpAddr, ok := conn.RemoteAddr().(*net.TCPAddr); ok && tcpAddr.IP.To4() == nil {
+			used = "tcp6"
+		}
+		if prev, loaded := upstreamFamilies.Swap(addr, used); !loaded || prev != used {
+			log.Printf("[二次代理] 第二级代理 %s 使用地址族: %s", addr, used)
+		}
+		return conn, nil
+	}
+	return nil, lastErr
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// withUpstreamIPFamily 在测试期间使用给定的-upstream-ip-family并清空地址族缓存
+func withUpstreamIPFamily(t *testing.T, family string) {
+	t.Helper()
+	saved := upstreamIPFamily
+	reset := func() {
+		upstreamFamilies.Range(func(key, _ any) bool {
+			upstreamFamilies.Delete(key)
+			return true
+		})
+	}
+	t.Cleanup(func() {
+		upstreamIPFamily = saved
+		reset()
+	})
+	upstreamIPFamily = family
+	reset()
+}
+
+func TestValidateUpstreamIPFamily(t *testing.T) {
+	for value, ok := range map[string]bool{"auto": true, "v4": true, "v6": true, "": false, "ipv4": false} {
+		if err := validateUpstreamIPFamily(value); (err == nil) != ok {
+			t.Errorf("validateUpstreamIPFamily(%q) = %v, want ok %v", value, err, ok)
+		}
+	}
+}
+
+func TestUpstreamFamilyOrder(t *testing.T) {
+	tests := []struct {
+		family string
+		cached string
+		want   []string
+	}{
+		{"auto", "", []string{"tcp"}},
+		{"auto", "tcp6", []string{"tcp"}},
+		{"v4", "", []string{"tcp4", "tcp6"}},
+		{"v6", "", []string{"tcp6", "tcp4"}},
+		{"v6", "tcp4", []string{"tcp4", "tcp6"}}, // 上次回退成功的地址族排在前面
+		{"v4", "tcp4", []string{"tcp4", "tcp6"}},
+	}
+	for _, tt := range tests {
+		withUpstreamIPFamily(t, tt.family)
+		if tt.cached != "" {
+			upstreamFamilies.Store("proxy.example:8080", tt.cached)
+		}
+		if got := upstreamFamilyOrder("proxy.example:8080"); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("-upstream-ip-family %s cached %q: order %v, want %v", tt.family, tt.cached, got, tt.want)
+		}
+	}
+}
+
+// TestDialUpstreamFallback 首选的IPv6不可用时回退到IPv4并记住，之后直接先试IPv4
+func TestDialUpstreamFallback(t *testing.T) {
+	withUpstreamIPFamily(t, "v6")
+	saved := dialTimeout
+	t.Cleanup(func() { dialTimeout = saved })
+	dialTimeout = time.Second
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	addr := net.JoinHostPort("localhost", port)
+
+	conn, err := dialUpstream(context.Background(), "tcp", addr)
+	if err != nil {
+		t.Fatalf("dialUpstream(%s) = %v, want a fallback to IPv4", addr, err)
+	}
+	conn.Close()
+	if cached, _ := upstreamFamilies.Load(addr); cached != "tcp4" {
+		t.Errorf("cached family %v, want tcp4", cached)
+	}
+	if order := upstreamFamilyOrder(addr); order[0] != "tcp4" {
+		t.Errorf("order after the fallback %v, want tcp4 first", order)
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// h2PingTimeout HTTP/2连接发出PING后等待响应的时间，超时即关闭连接
+const h2PingTimeout = 15 * time.Second
+
+// h2Transport 到第二级代理的HTTP/2连接池，为nil表示未启用-proxy-h2。
+// 连接收到GOAWAY后不再分配新的流，已有的隧道继续使用直到结束，新隧道会自动建立新连接
+var h2Transport *http2.Transport
+
+// setupProxyH2 按-proxy-h2初始化HTTP/2连接池，要求所有第二级代理都使用https
+func setupProxyH2() error {
+	if !proxyH2 {
+		return nil
+	}
+	if len(upstreamList()) == 0 {
+		return errors.New("-proxy-h2 requires -proxy-url")
+	}
+	if len(proxyChain) > 0 {
+		return errors.New("-proxy-h2 cannot be combined with -proxy-chain")
+	}
+	if err := validateH2Upstreams(upstreamList()); err != nil {
+		return err
+	}
+	h2Transport = &http2.Transport{
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			conn, err := dialProxyServer(ctx, "https", addr, http2.NextProtoTLS)
+			if err != nil {
+				return nil, err
+			}
+			if proto := conn.(*tls.Conn).ConnectionState().NegotiatedProtocol; proto != http2.NextProtoTLS {
+				conn.Close()
+				return nil, &proxyError{kind: kindUpstreamHandshake, upstream: true, status: http.StatusBadGateway,
+					msg: "The second proxy does not support HTTP/2", err: fmt.Errorf("negotiated protocol %q", proto)}
+			}
+			log.Printf("[二次代理] 已与第二级代理 %s 建立HTTP/2连接", addr)
+			return conn, nil
+		},
+		ReadIdleTimeout: upstreamProbeIdle, // 连接空闲时发送PING检测是否存活，0表示不检测
+		PingTimeout:     h2PingTimeout,
+	}
+	return nil
+}
+
+// validateH2Upstreams 校验启用-proxy-h2时所有第二级代理都使用https
+func validateH2Upstreams(list []*upstreamProxy) error {
+	for _, upstream := range list {
+		if upstream.scheme != "https" {
+			return fmt.Errorf("-proxy-h2 requires https:// proxy URLs, %s uses %s", upstream.server, upstream.scheme)
+		}
+	}
+	return nil
+}
+
+// connectViaH2 在到第二级代理的HTTP/2连接上以一个CONNECT流建立隧道，不跟随重定向
+func connectViaH2(r *http.Request, upstream *upstreamProxy) (net.Conn, error) {
+	target, err := validateTarget(r.Host)
+	if err != nil {
+		return nil, &proxyError{kind: kindBadTarget, upstream: true, msg: "Invalid target host", err: err}
+	}
+
+	// 流的生命周期与请求无关，握手期间请求被取消时才中断握手
+	ctx := r.Context()
+	streamCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	stopWatch := context.AfterFunc(ctx, cancel)
+
+	pr, pw := io.Pipe()
+	req := (&http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Scheme: "https", Host: upstream.server},
+		Host:   target,
+		Header: make(http.Header),
+		Body:   pr,
+	}).WithContext(streamCtx)
+	if upstream.authorization != "" {
+		req.Header.Set("Proxy-Authorization", upstream.authorization)
+	}
+	if name, id := upstreamSessionHeader(r.Context()); name != "" {
+		req.Header.Set(name, id)
+	}
+
+	setPhase(ctx, phaseUpstreamHandshake)
+	resp, err := h2Transport.RoundTrip(req)
+	if !stopWatch() && err == nil {
+		resp.Body.Close()
+		err = ctx.Err()
+	}
+	if err != nil {
+		cancel()
+		pw.Close()
+		pe := newProxyError(true, "Failed to connect to the second proxy", err)
+		if pe.kind == kindUnknown {
+			pe.kind = kindUpstreamHandshake
+			pe.status = http.StatusServiceUnavailable
+		}
+		errorLog.PrintfCtx(r.Context(), "upstream_dial", upstream.server, "[二次代理] 通过HTTP/2连接第二级代理 %s 失败(%s): %v", upstream.server, pe.kind, err)
+		return nil, pe
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		cancel()
+		pw.Close()
+		return nil, upstreamStatusError(r, resp)
+	}
+	return newH2StreamConn(resp.Body, pw, cancel, h2Addr(upstream.server)), nil
+}
+
+// h2Addr HTTP/2流的地址，即第二级代理的地址
+type h2Addr string
+
+func (a h2Addr) Network() string { return "h2" }
+func (a h2Addr) String() string  { return string(a) }
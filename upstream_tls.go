@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+)
+
+// upstreamRootCAs 校验https第二级代理证书使用的根证书，为nil时使用系统证书
+var upstreamRootCAs *x509.CertPool
+
+// setupUpstreamTLS 加载-proxy-ca指定的私有CA，与系统证书一起用于校验https第二级代理
+func setupUpstreamTLS(caFile string) error {
+	if caFile == "" {
+		return nil
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	data, err := os.ReadFile(caFile)
+	if err != nil {
+		return err
+	}
+	if !pool.AppendCertsFromPEM(data) {
+		return fmt.Errorf("no certificates found in -proxy-ca %s", caFile)
+	}
+	upstreamRootCAs = pool
+	return nil
+}
+
+// dialProxyServer 连接第二级代理本身，https代理时在TCP连接上完成TLS握手并校验代理的证书，
+// nextProtos为通过ALPN协商的协议
+func dialProxyServer(ctx context.Context, scheme, addr string, nextProtos ...string) (net.Conn, error) {
+	conn, err := dialUpstream(ctx, "tcp", addr)
+	if err != nil || scheme != "https" {
+		return conn, err
+	}
+	return proxyTLS(ctx, conn, addr, nextProtos...)
+}
+
+// proxyTLS 在conn上与地址为addr的https代理完成TLS握手并校验证书，失败时关闭conn
+func proxyTLS(ctx context.Context, conn net.Conn, addr string, nextProtos ...string) (net.Conn, error) {
+	host, _, _ := net.SplitHostPort(addr)
+	setPhase(ctx, phaseTLS)
+	tlsConn := tls.Client(conn, &tls.Config{
+		ServerName: host,
+		RootCAs:    upstreamRootCAs,
+		MinVersion: tls.VersionTLS12,
+		NextProtos: nextProtos,
+	})
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
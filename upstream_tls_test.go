@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/pem"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newTLSConnectProxy 以httptest的自签名证书监听的https第二级代理，CONNECT成功后原样回显隧道数据
+func newTLSConnectProxy(t *testing.T) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			http.Error(w, "CONNECT only", http.StatusMethodNotAllowed)
+			return
+		}
+		conn, bufrw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.WriteString(conn, connectEstablished)
+		io.Copy(conn, bufrw)
+	}))
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// withProxyCA 在测试期间使用srv的证书作为-proxy-ca
+func withProxyCA(t *testing.T, srv *httptest.Server) {
+	t.Helper()
+	saved := upstreamRootCAs
+	t.Cleanup(func() { upstreamRootCAs = saved })
+	path := filepath.Join(t.TempDir(), "ca.pem")
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := setupUpstreamTLS(path); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestHTTPSUpstreamVerified https第二级代理的证书必须由-proxy-ca或系统证书签发且与地址匹配
+func TestHTTPSUpstreamVerified(t *testing.T) {
+	srv := newTLSConnectProxy(t)
+	_, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+	connect := func(server string) (net.Conn, error) {
+		return connectUpstream(connectRequest("example.com:443"), &upstreamProxy{scheme: "https", server: server})
+	}
+
+	if conn, err := connect(srv.Listener.Addr().String()); err == nil {
+		conn.Close()
+		t.Fatal("untrusted certificate accepted without -proxy-ca")
+	}
+
+	withProxyCA(t, srv)
+	conn, err := connect(srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("trusted https proxy: %v", err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, "ping")
+	got := make([]byte, 4)
+	if _, err := io.ReadFull(conn, got); err != nil || string(got) != "ping" {
+		t.Errorf("tunnel through the https proxy echoed %q, %v", got, err)
+	}
+
+	// httptest的证书只包含example.com、127.0.0.1和::1
+	if conn, err := connect(net.JoinHostPort("localhost", port)); err == nil {
+		conn.Close()
+		t.Error("certificate accepted for a name it does not cover")
+	}
+}
+
+func TestSetupUpstreamTLS(t *testing.T) {
+	saved := upstreamRootCAs
+	t.Cleanup(func() { upstreamRootCAs = saved })
+	dir := t.TempDir()
+	empty := filepath.Join(dir, "empty.pem")
+	os.WriteFile(empty, []byte("not a certificate\n"), 0o600)
+
+	if err := setupUpstreamTLS(""); err != nil || upstreamRootCAs != saved {
+		t.Errorf("empty -proxy-ca: %v, pool changed %v", err, upstreamRootCAs != saved)
+	}
+	if err := setupUpstreamTLS(empty); err == nil || !strings.Contains(err.Error(), "no certificates") {
+		t.Errorf("file without certificates: %v", err)
+	}
+	if err := setupUpstreamTLS(filepath.Join(dir, "missing.pem")); err == nil {
+		t.Error("missing -proxy-ca file accepted")
+	}
+}
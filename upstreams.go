@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	upstreamSet  atomic.Pointer[[]*upstreamProxy] // 当前生效的第二级代理列表，重新加载配置时整体替换
+	upstreamNext atomic.Uint64                    // 轮询计数
+)
+
+// upstreamList 返回当前生效的第二级代理列表，已经开始的请求继续使用它选中的代理
+func upstreamList() []*upstreamProxy {
+	if list := upstreamSet.Load(); list != nil {
+		return *list
+	}
+	return nil
+}
+
+// setUpstreams 替换第二级代理列表，只影响之后的请求
+func setUpstreams(list []*upstreamProxy) {
+	upstreamSet.Store(&list)
+}
+
+// parseUpstreams 解析-proxy-url，可重复指定，每个值也可以是逗号分隔的多个地址，账户密码中的逗号需编码为%2C
+func parseUpstreams(values []string) ([]*upstreamProxy, error) {
+	var list []*upstreamProxy
+	for _, value := range values {
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item == "" {
+				continue
+			}
+			upstream, err := parseProxyURL(item)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, upstream)
+		}
+	}
+	if len(values) > 0 && len(list) == 0 {
+		return nil, errors.New("empty -proxy-url")
+	}
+	return list, nil
+}
+
+// validateUpstreamChange 校验运行中替换的第二级代理列表：监听是否启用在启动时已经决定，不能清空或从无到有
+func validateUpstreamChange(list []*upstreamProxy) error {
+	if (len(list) == 0) != (len(upstreamList()) == 0) {
+		return errors.New("adding or removing all -proxy-url entries requires a restart")
+	}
+	if h2Transport != nil {
+		return validateH2Upstreams(list)
+	}
+	return nil
+}
+
+// replaceUpstreams 替换第二级代理列表并重新开始健康检查，已经建立的隧道不受影响，source用于日志
+func replaceUpstreams(list []*upstreamProxy, source string) {
+	old := upstreamNames(upstreamList())
+	setUpstreams(list)
+	startHealthChecks(list)
+	if now := upstreamNames(list); now != old {
+		log.Printf("[%s] 第二级代理由 %s 改为 %s", source, old, now)
+	}
+}
+
+// upstreamNames 返回用于日志的第二级代理列表，不包含认证信息
+func upstreamNames(list []*upstreamProxy) string {
+	names := make([]string, 0, len(list))
+	for _, u := range list {
+		names = append(names, u.scheme+"://"+u.server)
+	}
+	return strings.Join(names, ",")
+}
+
+// upstreamOrder 返回一次请求尝试第二级代理的顺序：从轮询选中的代理开始，依次为其后的代理，
+// 未通过健康检查的代理不参与
+func upstreamOrder() []*upstreamProxy {
+	upstreams := upstreamList()
+	n := len(upstreams)
+	if n == 0 {
+		return nil
+	}
+	start := int((upstreamNext.Add(1) - 1) % uint64(n))
+	order := make([]*upstreamProxy, 0, n)
+	for i := 0; i < n; i++ {
+		if u := upstreams[(start+i)%n]; upstreamHealthy(u) {
+			order = append(order, u)
+		}
+	}
+	return order
+}
+
+// upstreamCtx context中保存本次请求尝试第二级代理顺序的键，第一个为当前使用的代理
+type upstreamCtx struct{}
+
+// withUpstream 按轮询为经由第二级代理的请求选择代理并分配上游会话，记录在context中供转发和日志使用；
+// 请求还没有routeDecision时创建一个，用于记录实际经由的代理
+func withUpstream(r *http.Request) *http.Request {
+	if len(upstreamList()) == 0 || routeFrom(r) == routeDirect {
+		return r
+	}
+	ctx := context.WithValue(r.Context(), upstreamCtx{}, upstreamOrder())
+	if decisionFrom(ctx) == nil {
+		ctx = context.WithValue(ctx, decisionCtx{}, &routeDecision{route: routeProxy})
+	}
+	return withSession(r.WithContext(ctx))
+}
+
+// connectedUpstream 返回隧道实际经由的第二级代理，换代理重试时为最后成功的一个，尚未建立或改为直接转发时为nil
+func connectedUpstream(ctx context.Context) *upstreamProxy {
+	if d := decisionFrom(ctx); d != nil {
+		return d.upstream.Load()
+	}
+	return nil
+}
+
+// upstreamsFor 返回请求尝试第二级代理的顺序，未经过withUpstream时重新轮询选择
+func upstreamsFor(ctx context.Context) []*upstreamProxy {
+	if order, ok := ctx.Value(upstreamCtx{}).([]*upstreamProxy); ok && len(order) > 0 {
+		return order
+	}
+	return upstreamOrder()
+}
+
+// currentUpstream 返回请求当前使用的第二级代理，未配置时为nil
+func currentUpstream(ctx context.Context) *upstreamProxy {
+	if order := upstreamsFor(ctx); len(order) > 0 {
+		return order[0]
+	}
+	return nil
+}
+
+// usedUpstream 返回请求选中的第二级代理地址，用于日志，未经由第二级代理时为空
+func usedUpstream(r *http.Request) string {
+	if order, ok := r.Context().Value(upstreamCtx{}).([]*upstreamProxy); ok && len(order) > 0 {
+		return order[0].server
+	}
+	return ""
+}
+
+// upstreamStatusCtx 请求上下文中记录第二级代理对CONNECT返回的状态码的key
+type upstreamStatusCtx struct{}
+
+// withUpstreamStatus 为CONNECT请求准备记录第二级代理状态码的位置
+func withUpstreamStatus(r *http.Request) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), upstreamStatusCtx{}, new(atomic.Int32)))
+}
+
+// recordUpstreamStatus 记录第二级代理返回的状态码，多次握手时保留最后一次
+func recordUpstreamStatus(ctx context.Context, code int) {
+	if status, ok := ctx.Value(upstreamStatusCtx{}).(*atomic.Int32); ok {
+		status.Store(int32(code))
+	}
+}
+
+// upstreamStatus 返回第二级代理对CONNECT返回的状态码，没有收到响应时为0
+func upstreamStatus(r *http.Request) int {
+	if status, ok := r.Context().Value(upstreamStatusCtx{}).(*atomic.Int32); ok {
+		return int(status.Load())
+	}
+	return 0
+}
+
+// canRetryUpstream 判断失败后能否换下一个第二级代理重试：只有连接第二级代理本身失败且请求仍未取消时才重试
+func canRetryUpstream(ctx context.Context, err error) bool {
+	var pe *proxyError
+	if ctx.Err() != nil || !errors.As(err, &pe) || !pe.upstream {
+		return false
+	}
+	switch pe.kind {
+	case kindDNS, kindDialRefused, kindDialTimeout:
+		return true
+	}
+	return false
+}
+
+// errNoUpstream 未配置第二级代理
+var errNoUpstream = &proxyError{kind: kindConfig, upstream: true, msg: "No upstream proxy configured"}
+
+// noUpstreamError 没有可用的第二级代理时返回的错误：已配置但都未通过健康检查时立即失败，可以触发直接转发
+func noUpstreamError() error {
+	if len(upstreamList()) > 0 {
+		return errUpstreamsDown
+	}
+	return errNoUpstream
+}
+
+// connectViaProxy 从轮询选中的第二级代理开始建立隧道，连接代理失败时立即换下一个代理重试，成功时返回已建立隧道的连接，失败时返回*proxyError
+func connectViaProxy(r *http.Request) (net.Conn, error) {
+	order := upstreamsFor(r.Context())
+	if len(order) == 0 {
+		return nil, noUpstreamError()
+	}
+	for i, upstream := range order {
+		start := time.Now()
+		conn, err := connectUpstream(r, upstream)
+		e := requestEntry(r, "upstream_dial", "")
+		e.Level = levelDebug
+		if err != nil {
+			e.Level = levelWarn
+		}
+		e.Upstream, e.DurationMS, e.Error = upstream.server, time.Since(start).Milliseconds(), errorString(err)
+		logEvent(e, "")
+		if err == nil {
+			recordUpstream(r.Context(), upstream)
+		}
+		if err == nil || i == len(order)-1 || !canRetryUpstream(r.Context(), err) {
+			return conn, err
+		}
+		recordRetry(r.Context())
+		logfCtx(r.Context(), levelWarn, "[二次代理] 连接第二级代理 %s 失败，改用 %s", upstream.server, order[i+1].server)
+	}
+	return nil, errNoUpstream
+}
+
+// upstreamRoundTripper 经由第二级代理转发普通HTTP请求，连接代理失败且请求没有请求体时换下一个代理重试
+type upstreamRoundTripper struct {
+	transport http.RoundTripper
+}
+
+func (t upstreamRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	order := upstreamsFor(req.Context())
+	if len(order) == 0 {
+		return nil, noUpstreamError()
+	}
+	for i := range order {
+		attempt := req.WithContext(context.WithValue(req.Context(), upstreamCtx{}, order[i:]))
+		resp, err := t.transport.RoundTrip(attempt)
+		if err == nil {
+			recordUpstream(req.Context(), order[i])
+		}
+		if err == nil || i == len(order)-1 || req.Body != nil || !canRetryUpstream(req.Context(), err) {
+			return resp, err
+		}
+		recordRetry(req.Context())
+		logfCtx(req.Context(), levelWarn, "[二次代理] 连接第二级代理 %s 失败，改用 %s", order[i].server, order[i+1].server)
+	}
+	return nil, errNoUpstream
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"testing"
+)
+
+// withUpstreams 在测试期间使用给定的第二级代理列表，不做健康检查
+func withUpstreams(t *testing.T, list []*upstreamProxy) {
+	t.Helper()
+	saved, savedHealth := upstreamList(), healthStates.Load()
+	t.Cleanup(func() {
+		setUpstreams(saved)
+		healthStates.Store(savedHealth)
+	})
+	setUpstreams(list)
+	healthStates.Store(nil)
+}
+
+func TestParseUpstreams(t *testing.T) {
+	tests := []struct {
+		values  []string
+		servers []string
+		ok      bool
+	}{
+		{nil, nil, true},
+		{[]string{"10.0.0.1:8080"}, []string{"10.0.0.1:8080"}, true},
+		{[]string{"10.0.0.1:8080, socks5://10.0.0.2:1080", "10.0.0.3:8080"}, []string{"10.0.0.1:8080", "10.0.0.2:1080", "10.0.0.3:8080"}, true},
+		{[]string{"u:a%2Cb@10.0.0.1:8080,"}, []string{"10.0.0.1:8080"}, true},
+		{[]string{" , "}, nil, false},
+		{[]string{"10.0.0.1:8080,bad host:1"}, nil, false},
+	}
+	for _, tt := range tests {
+		list, err := parseUpstreams(tt.values)
+		if (err == nil) != tt.ok {
+			t.Errorf("parseUpstreams(%q) error = %v, want ok %v", tt.values, err, tt.ok)
+			continue
+		}
+		if len(list) != len(tt.servers) {
+			t.Errorf("parseUpstreams(%q) = %d proxies, want %d", tt.values, len(list), len(tt.servers))
+			continue
+		}
+		for i, u := range list {
+			if u.server != tt.servers[i] {
+				t.Errorf("parseUpstreams(%q)[%d] = %s, want %s", tt.values, i, u.server, tt.servers[i])
+			}
+		}
+	}
+}
+
+// TestUpstreamOrderRoundRobin 每次请求从下一个代理开始，其余代理按顺序作为备选
+func TestUpstreamOrderRoundRobin(t *testing.T) {
+	list := []*upstreamProxy{{server: "a:1"}, {server: "b:1"}, {server: "c:1"}}
+	withUpstreams(t, list)
+
+	first := map[string]int{}
+	for i := 0; i < 30; i++ {
+		order := upstreamOrder()
+		if len(order) != len(list) {
+			t.Fatalf("order has %d proxies, want %d", len(order), len(list))
+		}
+		first[order[0].server]++
+		// 备选代理紧跟在选中的代理之后
+		for j := 1; j < len(order); j++ {
+			if order[j] != list[(indexOf(list, order[0])+j)%len(list)] {
+				t.Fatalf("order %s is not a rotation of the list", upstreamNames(order))
+			}
+		}
+	}
+	for _, u := range list {
+		if first[u.server] != 10 {
+			t.Errorf("%s was picked first %d times out of 30, want 10", u.server, first[u.server])
+		}
+	}
+}
+
+func indexOf(list []*upstreamProxy, u *upstreamProxy) int {
+	for i, v := range list {
+		if v == u {
+			return i
+		}
+	}
+	return -1
+}
+
+// TestConnectViaProxyFailover 连接选中的代理失败时换下一个代理，代理拒绝CONNECT时不换
+func TestConnectViaProxyFailover(t *testing.T) {
+	closed, _ := net.Listen("tcp", "127.0.0.1:0")
+	refused := &upstreamProxy{scheme: "http", server: closed.Addr().String()}
+	closed.Close()
+	good := newConnectProxy(t, func(*http.Request) string { return "HTTP/1.1 200 Connection Established\r\n\r\n" })
+	forbidding := newConnectProxy(t, func(*http.Request) string { return "HTTP/1.1 403 Forbidden\r\nContent-Length: 0\r\n\r\n" })
+	working := &upstreamProxy{scheme: "http", server: good.addr}
+	withUpstreams(t, []*upstreamProxy{refused, working})
+
+	for i := 0; i < 2; i++ {
+		r := withUpstream(connectRequest("example.com:443"))
+		conn, err := connectViaProxy(r)
+		if err != nil {
+			t.Fatalf("attempt %d: %v", i, err)
+		}
+		if got := connectedUpstream(r.Context()); got != working {
+			t.Errorf("attempt %d: connected through %v, want %s", i, got, working.server)
+		}
+		io.WriteString(conn, "ping")
+		got := make([]byte, 4)
+		if _, err := io.ReadFull(conn, got); err != nil || string(got) != "ping" {
+			t.Errorf("attempt %d: tunnel echoed %q, %v", i, got, err)
+		}
+		conn.Close()
+	}
+
+	withUpstreams(t, []*upstreamProxy{{scheme: "http", server: forbidding.addr}, working})
+	upstreamNext.Store(0)
+	if conn, err := connectViaProxy(withUpstream(connectRequest("example.com:443"))); err == nil {
+		conn.Close()
+		t.Error("403 from the selected proxy was retried on the next one")
+	}
+}
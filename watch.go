@@ -0,0 +1,106 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	fileWatchInterval = 2 * time.Second        // 检查被监视文件是否变化的间隔
+	fileWatchDebounce = 500 * time.Millisecond // 最后一次变化后等待多久再重新加载，合并编辑器的多次写入
+)
+
+// fileStamp 文件的修改时间和大小，任一变化即认为文件已修改
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+// statFile 返回文件当前的fileStamp，文件不存在时ok为false
+func statFile(path string) (stamp fileStamp, ok bool) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fileStamp{}, false
+	}
+	return fileStamp{info.ModTime(), info.Size()}, true
+}
+
+// watchFiles 轮询-rules、-block-hosts和-auth-file，变化后经与SIGHUP相同的reloadConfig重新加载，新文件无效时保留原有配置。
+// 每次按路径重新stat，编辑器先写临时文件再rename替换的保存方式同样能检测到；文件暂时不存在时等它重新出现。
+// stamps为开始监视时各文件的fileStamp，由fileStamps取得
+func watchFiles(stamps map[string]fileStamp, interval, debounce time.Duration) {
+	for {
+		time.Sleep(interval)
+		changed := changedFiles(stamps)
+		if len(changed) == 0 {
+			continue
+		}
+		// 等文件在debounce内不再变化后才重新加载
+		for {
+			time.Sleep(debounce)
+			more := changedFiles(stamps)
+			if len(more) == 0 {
+				break
+			}
+			changed = appendMissing(changed, more)
+		}
+		reloadConfig("文件 " + strings.Join(changed, ", ") + " 已修改")
+	}
+}
+
+// fileStamps 返回各文件当前的fileStamp，不存在的文件为零值
+func fileStamps(paths []string) map[string]fileStamp {
+	stamps := make(map[string]fileStamp, len(paths))
+	for _, path := range paths {
+		stamps[path], _ = statFile(path)
+	}
+	return stamps
+}
+
+// changedFiles 返回fileStamp与上次记录不同的文件并更新记录，不存在的文件留到重新出现时再比较
+func changedFiles(stamps map[string]fileStamp) []string {
+	var changed []string
+	for path, old := range stamps {
+		stamp, ok := statFile(path)
+		if !ok || stamp == old {
+			continue
+		}
+		stamps[path] = stamp
+		changed = append(changed, path)
+	}
+	return changed
+}
+
+// appendMissing 将more中list还没有的元素追加到list
+func appendMissing(list, more []string) []string {
+	for _, s := range more {
+		found := false
+		for _, have := range list {
+			if have == s {
+				found = true
+				break
+			}
+		}
+		if !found {
+			list = append(list, s)
+		}
+	}
+	return list
+}
+
+// startFileWatch 配置了-rules、-block-hosts或-auth-file时开始监视这些文件
+func startFileWatch() {
+	var paths []string
+	for _, path := range []string{rulesFile, blockHostsFile, authFile} {
+		if path != "" {
+			paths = append(paths, path)
+		}
+	}
+	if len(paths) == 0 {
+		return
+	}
+	log.Printf("[重新加载] 监视文件变化: %s", strings.Join(paths, ", "))
+	go watchFiles(fileStamps(paths), fileWatchInterval, fileWatchDebounce)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestWatchFilesReloadsRules 规则文件被rename替换后无需信号即按新规则路由，写入无效内容时保留原有规则
+func TestWatchFilesReloadsRules(t *testing.T) {
+	logs := captureLog(t)
+	dir := t.TempDir()
+	rules := filepath.Join(dir, "rules.txt")
+	if err := os.WriteFile(rules, []byte("example.com direct\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	config := filepath.Join(dir, "web-proxy.yaml")
+	if err := os.WriteFile(config, []byte("rules: "+rules+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	savedConfig, savedRoutes := configFile, routes.Load()
+	t.Cleanup(func() {
+		configFile = savedConfig
+		routes.Store(savedRoutes)
+	})
+	configFile = config
+	initial, err := loadRules(rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setRoutes(initial, routeProxy)
+
+	route := func() string {
+		return routeFrom(withRoute(httptest.NewRequest("GET", "http://example.com/", nil)))
+	}
+	waitFor := func(what string, cond func() bool) {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for !cond() {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for %s, log:\n%s", what, logs)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+	// 先写临时文件再rename替换，与vim等编辑器的保存方式相同
+	replace := func(content string) {
+		t.Helper()
+		tmp := rules + ".tmp"
+		if err := os.WriteFile(tmp, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Rename(tmp, rules); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if got := route(); got != routeDirect {
+		t.Fatalf("route before change = %q, want direct", got)
+	}
+	go watchFiles(fileStamps([]string{rules}), 10*time.Millisecond, 20*time.Millisecond)
+
+	replace("example.com proxy\nother.example direct\n")
+	waitFor("the rules change", func() bool { return route() == routeProxy })
+	if !strings.Contains(logs.String(), "rules.txt 已修改") {
+		t.Errorf("log does not name the changed file:\n%s", logs)
+	}
+
+	replace("example.com bogus\n")
+	waitFor("the invalid rules to be rejected", func() bool {
+		return strings.Contains(logs.String(), "配置无效")
+	})
+	if got := route(); got != routeProxy {
+		t.Errorf("route after invalid rules = %q, want the previous proxy", got)
+	}
+}
+
+// TestChangedFiles 修改时间或大小变化的文件只报告一次，暂时不存在的文件不报告
+func TestChangedFiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "blocklist.txt")
+	if err := os.WriteFile(path, []byte("a.example\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	stamps := fileStamps([]string{path})
+	if got := changedFiles(stamps); len(got) != 0 {
+		t.Errorf("unchanged file reported: %v", got)
+	}
+
+	if err := os.WriteFile(path, []byte("a.example\nb.example\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if got := changedFiles(stamps); len(got) != 1 || got[0] != path {
+		t.Errorf("changedFiles = %v, want [%s]", got, path)
+	}
+	if got := changedFiles(stamps); len(got) != 0 {
+		t.Errorf("change reported twice: %v", got)
+	}
+
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if got := changedFiles(stamps); len(got) != 0 {
+		t.Errorf("missing file reported: %v", got)
+	}
+}
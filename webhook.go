@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	webhookQueueSize = 1024             // 等待发送的通知上限，队列满时丢弃新的通知
+	webhookAttempts  = 3                // 每个通知最多尝试发送的次数
+	webhookTimeout   = 10 * time.Second // 单次发送的超时时间
+)
+
+// 隧道事件
+const (
+	tunnelOpened = "open"
+	tunnelClosed = "close"
+)
+
+// tunnelEvent 隧道建立或关闭时发送的通知
+type tunnelEvent struct {
+	Event     string    `json:"event"`
+	Timestamp time.Time `json:"timestamp"`
+	ClientIP  string    `json:"client_ip"`
+	Target    string    `json:"target"`
+	Route     string    `json:"route"`
+	BytesUp   int64     `json:"bytes_up"`
+	BytesDown int64     `json:"bytes_down"`
+	Duration  float64   `json:"duration_seconds"`
+}
+
+// webhookQueue 等待发送的通知，为nil表示未配置-webhook-url
+var webhookQueue chan tunnelEvent
+
+// setupWebhook 校验-webhook-url并启动发送通知的goroutine
+func setupWebhook(raw string) error {
+	if raw == "" {
+		return nil
+	}
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid -webhook-url %q, want http(s)://host/path", raw)
+	}
+	webhookQueue = make(chan tunnelEvent, webhookQueueSize)
+	go deliverWebhooks(raw, webhookSecret)
+	return nil
+}
+
+// notifyTunnel 将隧道事件放入通知队列，不会阻塞转发，队列已满时丢弃并告警
+func notifyTunnel(event string, info *connInfo) {
+	if webhookQueue == nil {
+		return
+	}
+	ev := tunnelEvent{
+		Event:     event,
+		Timestamp: time.Now(),
+		ClientIP:  info.client,
+		Target:    info.target,
+		Route:     info.route,
+		BytesUp:   info.up.Load(),
+		BytesDown: info.down.Load(),
+	}
+	if event == tunnelClosed {
+		ev.Duration = time.Since(info.start).Seconds()
+	}
+	select {
+	case webhookQueue <- ev:
+	default:
+		errorLog.Printf("webhook_drop", webhookURL, "[通知] 通知队列已满，丢弃 %s %s 的%s事件", info.client, info.target, event)
+	}
+}
+
+// deliverWebhooks 依次发送队列中的通知，失败时重试，仍失败则丢弃并告警
+func deliverWebhooks(target, secret string) {
+	client := &http.Client{Timeout: webhookTimeout}
+	for ev := range webhookQueue {
+		body, err := json.Marshal(ev)
+		if err != nil {
+			continue
+		}
+		for attempt := 1; ; attempt++ {
+			err = postWebhook(client, target, secret, body)
+			if err == nil || attempt == webhookAttempts {
+				break
+			}
+			time.Sleep(time.Duration(attempt) * time.Second)
+		}
+		if err != nil {
+			errorLog.Printf("webhook_post", target, "[通知] 发送 %s %s 的%s事件失败，已放弃: %v", ev.ClientIP, ev.Target, ev.Event, err)
+		}
+	}
+}
+
+// postWebhook 发送一次通知，配置了密钥时在 X-WebProxy-Signature 头部附带 sha256=<HMAC-SHA256十六进制>
+func postWebhook(client *http.Client, target, secret string, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if secret != "" {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(body)
+		req.Header.Set("X-WebProxy-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}